@@ -212,8 +212,9 @@ func (h *Handler) newframe(b []byte) (Frame, error) {
 	return f, nil
 }
 
-func trySetEthernetDst(ethFrame []byte, dst []byte) {
-	if len(ethFrame) >= 14 {
-		copy(ethFrame[:6], dst)
+// trySetEthernetDst sets the destination of the Ethernet header which occupies the last 14 bytes of carrierHeaders.
+func trySetEthernetDst(carrierHeaders []byte, dst []byte) {
+	if len(carrierHeaders) >= 14 {
+		copy(carrierHeaders[len(carrierHeaders)-14:], dst)
 	}
 }
@@ -69,3 +69,18 @@ func NeverZeroSum(sum16 uint16) uint16 {
 	}
 	return sum16
 }
+
+// IncrementalSum16 returns the updated checksum of a packet after one of its 16-bit words
+// changes from oldWord to newWord without recalculating the checksum over the whole packet.
+// sum is the checksum field value before the change. See [RFC1624] eqn. 3.
+//
+// [RFC1624]: https://datatracker.ietf.org/doc/html/rfc1624
+func IncrementalSum16(sum, oldWord, newWord uint16) uint16 {
+	return sum16(uint32(^sum) + uint32(^oldWord) + uint32(newWord))
+}
+
+// IncrementalSum32 is like [IncrementalSum16] but for a 32-bit field such as an IPv4 address.
+func IncrementalSum32(sum uint16, oldWord, newWord uint32) uint16 {
+	s := uint32(^sum) + uint32(^uint16(oldWord>>16)) + uint32(^uint16(oldWord)) + uint32(newWord>>16) + uint32(uint16(newWord))
+	return sum16(s)
+}
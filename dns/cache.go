@@ -0,0 +1,246 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/soypat/lneto"
+)
+
+// DefaultCacheMaxTTL is the default upper bound on the time an entry stays in a [Cache], one day.
+const DefaultCacheMaxTTL = 86400
+
+// CacheConfig configures a [Cache]. Used in [Cache.Reset].
+type CacheConfig struct {
+	// MaxEntries is the number of (name, type) entries the cache holds. Zero disables the cache.
+	MaxEntries int
+	// MaxAddrs is the maximum number of addresses stored per entry. Defaults to 4.
+	MaxAddrs int
+	// MaxTTL caps record TTLs, in seconds. Defaults to [DefaultCacheMaxTTL].
+	MaxTTL uint32
+}
+
+// Cache is a fixed capacity cache of A and AAAA lookup results keyed by name and type.
+// Entries expire according to the TTL of the answer records or, for negative answers (NXDOMAIN and NODATA),
+// according to the SOA record in the authority section as described in RFC 2308 §5. Negative answers
+// without SOA are not cached. When full the least recently used entry is evicted.
+//
+// All memory is allocated in [Cache.Reset] except for the entry names, whose buffers are reused.
+// Times are monotonic nanoseconds supplied by the caller. Cache is not safe for concurrent use.
+type Cache struct {
+	entries  []cacheEntry
+	addrs    []netip.Addr // MaxAddrs addresses per entry.
+	maxAddrs int
+	maxTTL   uint32
+	// clock is incremented on every use of an entry for LRU eviction.
+	clock uint64
+}
+
+type cacheEntry struct {
+	name    Name
+	typ     Type
+	rcode   RCode
+	naddrs  uint8
+	expires int64
+	lastUse uint64 // zero if entry is free.
+}
+
+// Reset discards all entries and configures the cache. It allocates only if the configuration requires more memory than the previous one.
+func (c *Cache) Reset(cfg CacheConfig) error {
+	if cfg.MaxEntries < 0 || cfg.MaxAddrs < 0 || cfg.MaxAddrs > 255 {
+		return lneto.ErrInvalidConfig
+	}
+	if cfg.MaxAddrs == 0 {
+		cfg.MaxAddrs = 4
+	}
+	if cfg.MaxTTL == 0 {
+		cfg.MaxTTL = DefaultCacheMaxTTL
+	}
+	entries := c.entries[:0]
+	if cap(entries) < cfg.MaxEntries {
+		entries = make([]cacheEntry, 0, cfg.MaxEntries)
+	}
+	entries = entries[:cfg.MaxEntries]
+	for i := range entries {
+		entries[i] = cacheEntry{name: Name{data: entries[i].name.data[:0]}}
+	}
+	naddrs := cfg.MaxEntries * cfg.MaxAddrs
+	addrs := c.addrs[:0]
+	if cap(addrs) < naddrs {
+		addrs = make([]netip.Addr, naddrs)
+	}
+	*c = Cache{
+		entries:  entries,
+		addrs:    addrs[:naddrs],
+		maxAddrs: cfg.MaxAddrs,
+		maxTTL:   cfg.MaxTTL,
+	}
+	return nil
+}
+
+// Cap returns the maximum number of entries in the cache.
+func (c *Cache) Cap() int { return len(c.entries) }
+
+// Len returns the number of unexpired entries in the cache at time now.
+func (c *Cache) Len(now int64) (n int) {
+	for i := range c.entries {
+		if c.entries[i].valid(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Flush removes all entries from the cache.
+func (c *Cache) Flush() {
+	for i := range c.entries {
+		c.entries[i].lastUse = 0
+	}
+}
+
+// Lookup copies the cached addresses of name and typ into dst. ok is true on a cache hit, in which case
+// rcode is [RCodeNameError] for a cached NXDOMAIN and n is zero for cached NXDOMAIN or NODATA answers.
+func (c *Cache) Lookup(dst []netip.Addr, name Name, typ Type, now int64) (n int, rcode RCode, ok bool) {
+	idx := c.find(name, typ, now)
+	if idx < 0 {
+		return 0, 0, false
+	}
+	e := &c.entries[idx]
+	c.clock++
+	e.lastUse = c.clock
+	n = copy(dst, c.entryAddrs(idx)[:e.naddrs])
+	return n, e.rcode, true
+}
+
+// Remove removes the entry of name and typ from the cache, if present.
+func (c *Cache) Remove(name Name, typ Type) {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.lastUse != 0 && e.typ == typ && NamesEqualFold(e.name, name) {
+			e.lastUse = 0
+		}
+	}
+}
+
+// Insert caches the response msg with response code rcode to the A or AAAA query in msg.Questions[0] received at time now.
+// Answer records must be owned by the queried name or by the end of the chain of CNAME answers starting at it,
+// in which case the TTLs of the CNAME records also bound the lifetime of the entry. Responses to other types, responses with an rcode other than success
+// or NXDOMAIN and negative answers without SOA are not cached. Returns true if the response was cached.
+func (c *Cache) Insert(msg *Message, rcode RCode, now int64) bool {
+	if len(c.entries) == 0 || len(msg.Questions) == 0 || (rcode != RCodeSuccess && rcode != RCodeNameError) {
+		return false
+	}
+	q := &msg.Questions[0]
+	addrLen := 4
+	if q.Type == TypeAAAA {
+		addrLen = 16
+	} else if q.Type != TypeA {
+		return false
+	}
+	target, ttl := msg.CanonicalName(q.Name)
+	if len(target.data) == 0 {
+		return false // CNAME loop.
+	}
+	ttl = min(ttl, c.maxTTL)
+	var n int
+	if rcode == RCodeSuccess {
+		for i := range msg.Answers {
+			r := &msg.Answers[i]
+			if isAddrAnswer(r, q.Type, target, addrLen) {
+				ttl = min(ttl, r.header.TTL)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		soaTTL, ok := negativeTTL(msg.Authorities)
+		if !ok {
+			return false // RFC 2308 §5: Negative responses without SOA SHOULD NOT be cached.
+		}
+		ttl = min(ttl, soaTTL)
+	}
+	if ttl == 0 {
+		return false
+	}
+	idx := c.slot(q.Name, q.Type, now)
+	e := &c.entries[idx]
+	e.name.CopyFrom(q.Name)
+	e.typ = q.Type
+	e.rcode = rcode
+	e.expires = now + int64(ttl)*1e9
+	c.clock++
+	e.lastUse = c.clock
+	addrs := c.entryAddrs(idx)
+	e.naddrs = 0
+	for i := 0; i < len(msg.Answers) && n > 0 && int(e.naddrs) < len(addrs); i++ {
+		r := &msg.Answers[i]
+		if isAddrAnswer(r, q.Type, target, addrLen) {
+			addrs[e.naddrs], _ = netip.AddrFromSlice(r.RawData())
+			e.naddrs++
+		}
+	}
+	return true
+}
+
+// isAddrAnswer reports whether r is an address record of type typ and length addrLen owned by name.
+func isAddrAnswer(r *Resource, typ Type, name Name, addrLen int) bool {
+	return r.header.Type == typ && r.header.Class == ClassINET && len(r.RawData()) == addrLen && NamesEqualFold(r.header.Name, name)
+}
+
+// negativeTTL returns the negative caching TTL of a response: the minimum of the SOA record's TTL and its MINIMUM field (RFC 2308 §5).
+func negativeTTL(authorities []Resource) (uint32, bool) {
+	for i := range authorities {
+		r := &authorities[i]
+		data := r.RawData()
+		if r.header.Type != TypeSOA || len(data) < 20 {
+			continue
+		}
+		minimum := binary.BigEndian.Uint32(data[len(data)-4:])
+		return min(r.header.TTL, minimum), true
+	}
+	return 0, false
+}
+
+// find returns the index of the unexpired entry of name and typ or -1 if not found.
+func (c *Cache) find(name Name, typ Type, now int64) int {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.lastUse == 0 || e.typ != typ || !NamesEqualFold(e.name, name) {
+			continue
+		}
+		if !e.valid(now) {
+			e.lastUse = 0 // Expired, free entry.
+			return -1
+		}
+		return i
+	}
+	return -1
+}
+
+// slot returns the index of the entry to store name and typ in: the existing entry for the key,
+// a free or expired entry or the least recently used entry, in that order of preference.
+func (c *Cache) slot(name Name, typ Type, now int64) int {
+	free, lru := -1, 0
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.lastUse != 0 && e.typ == typ && NamesEqualFold(e.name, name) {
+			return i
+		} else if free < 0 && !e.valid(now) {
+			free = i
+		} else if e.lastUse < c.entries[lru].lastUse {
+			lru = i
+		}
+	}
+	if free >= 0 {
+		return free
+	}
+	return lru
+}
+
+func (c *Cache) entryAddrs(idx int) []netip.Addr {
+	return c.addrs[idx*c.maxAddrs : (idx+1)*c.maxAddrs]
+}
+
+func (e *cacheEntry) valid(now int64) bool {
+	return e.lastUse != 0 && now < e.expires
+}
@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+const second = int64(1e9)
+
+func cacheResponse(name string, qtype Type, answers []Resource, authorities ...Resource) *Message {
+	return &Message{
+		Questions:   []Question{{Name: MustNewName(name), Type: qtype, Class: ClassINET}},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+}
+
+func newTestCache(t *testing.T, cfg CacheConfig) *Cache {
+	t.Helper()
+	var c Cache
+	if err := c.Reset(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newTestCache(t, CacheConfig{MaxEntries: 2})
+	name := MustNewName("device.lan")
+	msg := cacheResponse("device.lan", TypeA, []Resource{
+		NewResource(name, TypeA, ClassINET, 300, []byte{192, 168, 4, 1}),
+		NewResource(name, TypeA, ClassINET, 60, []byte{192, 168, 4, 2}),
+		NewResource(MustNewName("other.lan"), TypeA, ClassINET, 10, []byte{10, 0, 0, 1}), // Not owned by queried name.
+	})
+	if !c.Insert(msg, RCodeSuccess, 0) {
+		t.Fatal("response not cached")
+	}
+	var dst [4]netip.Addr
+	n, rcode, ok := c.Lookup(dst[:], MustNewName("DEVICE.lan"), TypeA, 59*second)
+	if !ok || rcode != RCodeSuccess || n != 2 {
+		t.Fatalf("want hit with 2 addrs, got ok=%v rcode=%v n=%d", ok, rcode, n)
+	}
+	if dst[0] != netip.AddrFrom4([4]byte{192, 168, 4, 1}) || dst[1] != netip.AddrFrom4([4]byte{192, 168, 4, 2}) {
+		t.Errorf("unexpected addresses %v", dst[:n])
+	}
+	if _, _, ok = c.Lookup(dst[:], name, TypeAAAA, 0); ok {
+		t.Error("hit on different type")
+	}
+	// Minimum TTL of the answers is 60s.
+	if _, _, ok = c.Lookup(dst[:], name, TypeA, 60*second); ok {
+		t.Error("hit after TTL expired")
+	}
+	if c.Len(60*second) != 0 {
+		t.Error("expired entry counted")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newTestCache(t, CacheConfig{MaxEntries: 2})
+	var soa Resource
+	soa.SetSOA(MustNewName("lan"), ClassINET, 120, MustNewName("ns.lan"), MustNewName("admin.lan"), 1, 3600, 600, 86400, 30)
+	if c.Insert(cacheResponse("missing.lan", TypeA, nil), RCodeNameError, 0) {
+		t.Error("negative response without SOA cached")
+	}
+	if !c.Insert(cacheResponse("missing.lan", TypeA, nil, soa), RCodeNameError, 0) {
+		t.Fatal("NXDOMAIN not cached")
+	}
+	if !c.Insert(cacheResponse("device.lan", TypeAAAA, nil, soa), RCodeSuccess, 0) {
+		t.Fatal("NODATA not cached")
+	}
+	if c.Insert(cacheResponse("fail.lan", TypeA, nil, soa), RCodeServerFailure, 0) {
+		t.Error("SERVFAIL cached")
+	}
+	var dst [4]netip.Addr
+	n, rcode, ok := c.Lookup(dst[:], MustNewName("missing.lan"), TypeA, 29*second)
+	if !ok || rcode != RCodeNameError || n != 0 {
+		t.Errorf("want NXDOMAIN hit, got ok=%v rcode=%v n=%d", ok, rcode, n)
+	}
+	n, rcode, ok = c.Lookup(dst[:], MustNewName("device.lan"), TypeAAAA, 29*second)
+	if !ok || rcode != RCodeSuccess || n != 0 {
+		t.Errorf("want NODATA hit, got ok=%v rcode=%v n=%d", ok, rcode, n)
+	}
+	// Negative TTL is min(SOA TTL, SOA MINIMUM) = 30s.
+	if _, _, ok = c.Lookup(dst[:], MustNewName("missing.lan"), TypeA, 30*second); ok {
+		t.Error("hit after negative TTL expired")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newTestCache(t, CacheConfig{MaxEntries: 2, MaxAddrs: 1})
+	insert := func(name string, addr byte) {
+		t.Helper()
+		msg := cacheResponse(name, TypeA, []Resource{NewResource(MustNewName(name), TypeA, ClassINET, 300, []byte{10, 0, 0, addr})})
+		if !c.Insert(msg, RCodeSuccess, 0) {
+			t.Fatal("response not cached")
+		}
+	}
+	var dst [1]netip.Addr
+	insert("a.lan", 1)
+	insert("b.lan", 2)
+	c.Lookup(dst[:], MustNewName("a.lan"), TypeA, 0) // b.lan is now least recently used.
+	insert("c.lan", 3)
+	if _, _, ok := c.Lookup(dst[:], MustNewName("b.lan"), TypeA, 0); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, name := range []string{"a.lan", "c.lan"} {
+		if _, _, ok := c.Lookup(dst[:], MustNewName(name), TypeA, 0); !ok {
+			t.Errorf("%s evicted", name)
+		}
+	}
+	insert("a.lan", 4) // Overwrite existing entry.
+	if n, _, _ := c.Lookup(dst[:], MustNewName("a.lan"), TypeA, 0); n != 1 || dst[0] != netip.AddrFrom4([4]byte{10, 0, 0, 4}) {
+		t.Errorf("entry not updated, got %v", dst[:n])
+	}
+	if c.Len(0) != 2 {
+		t.Errorf("want 2 entries, got %d", c.Len(0))
+	}
+	c.Flush()
+	if c.Len(0) != 0 {
+		t.Error("entries after flush")
+	}
+}
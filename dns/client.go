@@ -27,6 +27,12 @@ type ResolveConfig struct {
 	// MaxResponseAnswers limits how many answer records are decoded from the
 	// DNS response. If zero it defaults to the number of Questions.
 	MaxResponseAnswers uint16
+	// MaxResponseAuthorities limits how many authority records are decoded from the DNS response.
+	// The SOA record in the authority section of negative responses sets their caching TTL, see [Cache].
+	MaxResponseAuthorities uint16
+	// MaxResponseAdditionals limits how many additional records are decoded from the DNS response.
+	// The OPT record of EDNS0 responses, see [Message.OPT], is in the additional section.
+	MaxResponseAdditionals uint16
 }
 
 func (sudp *Client) Protocol() uint64 { return uint64(lneto.IPProtoUDP) }
@@ -45,7 +51,7 @@ func (c *Client) StartResolve(localPort, txid uint16, cfg ResolveConfig) error {
 		maxAns = uint16(nd)
 	}
 	c.reset(localPort, txid, CQueryPending, cfg.EnableRecursion)
-	c.msg.LimitResourceDecoding(uint16(nd), maxAns, 0, 0)
+	c.msg.LimitResourceDecoding(uint16(nd), maxAns, cfg.MaxResponseAuthorities, cfg.MaxResponseAdditionals)
 	c.msg.AddQuestions(cfg.Questions)
 	c.msg.AddAdditionals(cfg.Additional)
 	return nil
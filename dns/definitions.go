@@ -25,6 +25,7 @@ var (
 	errSegTooLong     = errors.New("segment length too long")
 	errZeroSegLen     = errors.New("zero length segment")
 	errResTooLong     = errors.New("resource length too long")
+	errCNAMEChain     = errors.New("CNAME chain too long or looping")
 
 	errTooManyQuestions   = lneto.ErrExhausted
 	errTooManyAnswers     = lneto.ErrExhausted
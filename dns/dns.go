@@ -99,6 +99,30 @@ func NamesEqual(a, b Name) bool {
 	return internal.BytesEqual(a.data, b.data)
 }
 
+// NamesEqualFold reports whether two DNS names are equal under ASCII
+// case-folding as required by RFC 4343 for name comparison.
+func NamesEqualFold(a, b Name) bool {
+	if len(a.data) != len(b.data) {
+		return false
+	}
+	for i, ca := range a.data {
+		cb := b.data[i]
+		if ca != cb && lowerASCII(ca) != lowerASCII(cb) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII lowercases c if it is an ASCII uppercase letter. Label length
+// octets are never in the uppercase range since labels are at most 63 bytes long.
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
 type ZFlags uint16
 
 func NewResource(name Name, typ Type, class Class, ttl uint32, data []byte) Resource {
@@ -299,15 +323,26 @@ func (m *Message) AppendTo(buf []byte, txid uint16, flags HeaderFlags) (_ []byte
 	return buf, nil
 }
 
+// MaxCNAMEChain is the maximum number of CNAME records followed in a response to find the
+// canonical name of a queried name, protecting against CNAME loops.
+const MaxCNAMEChain = 8
+
+// WriteAnswers writes to dst the addresses in the A and AAAA answers for host. If the answers contain
+// a chain of CNAME records starting at host, addresses of the name at the end of the chain are written instead.
 func (m *Message) WriteAnswers(dst []netip.Addr, host string) (n uint16, err error) {
+	last, _, ok := m.cnameChainEnd(host, Name{})
+	if !ok {
+		return 0, errCNAMEChain
+	}
 	for i := range m.Answers {
-		if int(n) >= len(dst) {
-			return n, lneto.ErrExhausted
-		}
 		ans := &m.Answers[i]
-		hdr := ans.Header()
-		if !hdr.Name.EqualString(host) {
+		hdr := &ans.header
+		if hdr.Type != TypeA && hdr.Type != TypeAAAA {
+			continue
+		} else if !m.ownedByChainEnd(ans, last, host, Name{}) {
 			continue
+		} else if int(n) >= len(dst) {
+			return n, lneto.ErrExhausted
 		}
 		var ok bool
 		dst[n], ok = netip.AddrFromSlice(ans.RawData())
@@ -320,6 +355,55 @@ func (m *Message) WriteAnswers(dst []netip.Addr, host string) (n uint16, err err
 	return n, err
 }
 
+// CanonicalName follows the chain of CNAME answers starting at name and returns the name at its end.
+// If there are no CNAME answers for name it is returned as is. minTTL is the smallest TTL of the CNAME records in
+// the chain or [math.MaxUint32] if there are none. The returned name shares memory with m.
+// If the chain is longer than [MaxCNAMEChain] or loops an empty name is returned.
+func (m *Message) CanonicalName(name Name) (cname Name, minTTL uint32) {
+	last, minTTL, ok := m.cnameChainEnd("", name)
+	if !ok {
+		return Name{}, minTTL
+	} else if last < 0 {
+		return name, minTTL
+	}
+	return Name{data: m.Answers[last].RawData()}, minTTL
+}
+
+// cnameChainEnd returns the index of the CNAME answer at the end of the chain starting at host,
+// or at name if host is empty, or -1 if there is no CNAME answer for it. ok is false if the chain
+// does not end within [MaxCNAMEChain] records, which includes CNAME loops.
+func (m *Message) cnameChainEnd(host string, name Name) (last int, minTTL uint32, ok bool) {
+	last = -1
+	minTTL = math.MaxUint32
+	for range MaxCNAMEChain + 1 {
+		next := -1
+		for i := range m.Answers {
+			ans := &m.Answers[i]
+			if ans.header.Type == TypeCNAME && m.ownedByChainEnd(ans, last, host, name) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return last, minTTL, true
+		}
+		last = next
+		minTTL = min(minTTL, m.Answers[last].header.TTL)
+	}
+	return last, minTTL, false
+}
+
+// ownedByChainEnd reports whether the owner of r is the target of the CNAME answer at index last
+// or, if last is negative, host or name if host is empty.
+func (m *Message) ownedByChainEnd(r *Resource, last int, host string, name Name) bool {
+	if last >= 0 {
+		return NamesEqualFold(r.header.Name, Name{data: m.Answers[last].RawData()})
+	} else if host != "" {
+		return r.header.Name.EqualString(host)
+	}
+	return NamesEqualFold(r.header.Name, name)
+}
+
 func (m *Message) Len() uint16 {
 	return SizeHeader + m.lenResources()
 }
@@ -460,8 +544,58 @@ func (r *Resource) Decode(b []byte, off uint16) (uint16, error) {
 	if r.header.Length > uint16(len(b[off:])) {
 		return off, errResourceLen
 	}
-	r.data = append(r.data[:0], b[off:off+r.header.Length]...)
-	return off + r.header.Length, nil
+	end := off + r.header.Length
+	// Expand compressed names so that RDATA is self-contained. See RFC 3597 §4.
+	switch r.header.Type {
+	case TypeCNAME, TypeNS, TypePTR:
+		err = r.expandRDATA(b, off, end, 0, 1)
+	case TypeMX:
+		err = r.expandRDATA(b, off, end, 2, 1)
+	case TypeSRV:
+		err = r.expandRDATA(b, off, end, 6, 1) // RFC 2782 forbids compression, be lenient.
+	case TypeSOA:
+		err = r.expandRDATA(b, off, end, 0, 2)
+	default:
+		r.data = append(r.data[:0], b[off:end]...)
+	}
+	if err != nil {
+		return off, err
+	}
+	return end, nil
+}
+
+// expandRDATA copies the RDATA in msg[off:end] to r.data with names expanded. The RDATA is made
+// up of prefixLen bytes of fixed fields followed by nnames names and the remaining fixed fields.
+func (r *Resource) expandRDATA(msg []byte, off, end uint16, prefixLen, nnames int) (err error) {
+	if int(off)+prefixLen > int(end) {
+		return errResourceLen
+	}
+	r.data = append(r.data[:0], msg[off:off+uint16(prefixLen)]...)
+	off += uint16(prefixLen)
+	for range nnames {
+		if off >= end {
+			return errResourceLen
+		}
+		start := len(r.data)
+		off, err = visitAllLabels(msg, off, r.appendLabel, allowCompression)
+		if err != nil {
+			return err
+		} else if len(r.data)-start > 254 {
+			return errNameTooLong
+		}
+		r.data = append(r.data, 0)
+	}
+	if off > end {
+		return errResourceLen
+	}
+	r.data = append(r.data, msg[off:end]...)
+	r.header.Length = uint16(len(r.data))
+	return nil
+}
+
+func (r *Resource) appendLabel(label []byte) {
+	r.data = append(r.data, byte(len(label)))
+	r.data = append(r.data, label...)
 }
 
 func (r *Resource) appendTo(buf []byte) (_ []byte, err error) {
@@ -555,6 +689,34 @@ func (n Name) TrimLabels(skip int) Name {
 	return Name{data: n.data[off:]}
 }
 
+// SetReverseAddr sets the name to the reverse lookup domain of addr used in PTR queries, reusing the buffer of n.
+// IPv4 (and IPv4-mapped IPv6) addresses map to "in-addr.arpa" (RFC 1035 §3.5) and IPv6 addresses to "ip6.arpa" (RFC 3596 §2.5).
+// i.e: 192.0.2.7 becomes "7.2.0.192.in-addr.arpa".
+func (n *Name) SetReverseAddr(addr netip.Addr) error {
+	if !addr.IsValid() {
+		return lneto.ErrInvalidAddr
+	}
+	addr = addr.Unmap()
+	n.Reset()
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			start := len(n.data)
+			n.data = strconv.AppendUint(append(n.data, 0), uint64(ip[i]), 10)
+			n.data[start] = byte(len(n.data) - start - 1)
+		}
+		n.data = append(n.data, "\x07in-addr\x04arpa\x00"...)
+		return nil
+	}
+	const hexDigits = "0123456789abcdef"
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		n.data = append(n.data, 1, hexDigits[ip[i]&0xf], 1, hexDigits[ip[i]>>4])
+	}
+	n.data = append(n.data, "\x03ip6\x04arpa\x00"...)
+	return nil
+}
+
 // Len returns the length over-the-wire of the encoded Name.
 func (n *Name) Len() uint16 {
 	if len(n.data) > math.MaxUint16 {
@@ -812,6 +974,20 @@ func (r *Resource) SetTXT(name Name, class Class, ttl uint32, txt []byte) {
 	r.header.Length = uint16(len(r.data))
 }
 
+// SetSOA sets a SOA (start of authority) resource record, reusing internal buffers.
+// The minimum field is the TTL resolvers use to cache negative answers (RFC 2308 §4).
+func (r *Resource) SetSOA(name Name, class Class, ttl uint32, mname, rname Name, serial, refresh, retry, expire, minimum uint32) {
+	r.setHeader(name, TypeSOA, class, ttl)
+	r.data, _ = mname.AppendTo(r.data[:0])
+	r.data, _ = rname.AppendTo(r.data)
+	r.data = binary.BigEndian.AppendUint32(r.data, serial)
+	r.data = binary.BigEndian.AppendUint32(r.data, refresh)
+	r.data = binary.BigEndian.AppendUint32(r.data, retry)
+	r.data = binary.BigEndian.AppendUint32(r.data, expire)
+	r.data = binary.BigEndian.AppendUint32(r.data, minimum)
+	r.header.Length = uint16(len(r.data))
+}
+
 func (r *Resource) setHeader(name Name, typ Type, class Class, ttl uint32) {
 	r.header.Name.CopyFrom(name)
 	r.header.Type = typ
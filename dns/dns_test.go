@@ -22,6 +22,33 @@ func TestNameString(t *testing.T) {
 	}
 }
 
+func TestNameSetReverseAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.0.2.7", want: "7.2.0.192.in-addr.arpa."},
+		{addr: "::ffff:10.0.0.1", want: "1.0.0.10.in-addr.arpa."},
+		{addr: "2001:db8::567:89ab", want: "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	var name Name
+	for _, test := range tests {
+		err := name.SetReverseAddr(netip.MustParseAddr(test.addr))
+		if err != nil {
+			t.Fatal(err)
+		} else if got := name.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.addr, got, test.want)
+		}
+		want := MustNewName(strings.TrimSuffix(test.want, "."))
+		if !NamesEqual(name, want) {
+			t.Errorf("%s: wire format mismatch %q", test.addr, name.data)
+		}
+	}
+	if err := name.SetReverseAddr(netip.Addr{}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
 func TestNameAppendDecode(t *testing.T) {
 	const domain = "foo.bar.org"
 	name, err := NewName(domain)
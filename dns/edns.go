@@ -0,0 +1,317 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+)
+
+// EDNSOption is the code of an option carried in the RDATA of an OPT record. See RFC 6891 §6.1.2.
+type EDNSOption uint16
+
+const (
+	EDNSOptionClientSubnet  EDNSOption = 8  // Client Subnet, RFC 7871.
+	EDNSOptionCookie        EDNSOption = 10 // DNS Cookie, RFC 7873.
+	EDNSOptionPadding       EDNSOption = 12 // Padding, RFC 7830.
+	EDNSOptionExtendedError EDNSOption = 15 // Extended DNS Error, RFC 8914.
+)
+
+const (
+	// RCodeBadCookie is the extended RCODE BADCOOKIE (RFC 7873 §8). Extended RCODEs
+	// are split between the message header and the OPT record, see [Message.ResponseCode].
+	RCodeBadCookie RCode = 23
+	// SizeClientCookie is the length of the client part of a DNS Cookie.
+	SizeClientCookie = 8
+	// MaxSizeServerCookie is the maximum length of the server part of a DNS Cookie.
+	MaxSizeServerCookie = 32
+)
+
+var (
+	errNoOPT        = errors.New("resource is not an OPT record")
+	errOptionLen    = errors.New("EDNS0 option length exceeds OPT data")
+	errCookieLen    = errors.New("invalid DNS cookie length")
+	errSubnetFamily = errors.New("unsupported client subnet address family")
+	errSubnetLen    = errors.New("client subnet address length does not match prefix")
+)
+
+// AppendEDNSOption appends an option with code and data to dst in the format of OPT RDATA.
+// The result is passed as data to [Resource.SetEDNS0].
+func AppendEDNSOption(dst []byte, code EDNSOption, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(code))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+// AppendEDNSCookie appends a DNS Cookie option with the client cookie and the server cookie last
+// received from the server, which is empty on first contact. The server cookie must be 8 to 32 bytes long.
+func AppendEDNSCookie(dst []byte, client [SizeClientCookie]byte, server []byte) ([]byte, error) {
+	if len(server) != 0 && (len(server) < 8 || len(server) > MaxSizeServerCookie) {
+		return dst, errCookieLen
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(EDNSOptionCookie))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(SizeClientCookie+len(server)))
+	dst = append(dst, client[:]...)
+	return append(dst, server...), nil
+}
+
+// DecodeEDNSCookie decodes the data of a DNS Cookie option. server is empty if the option only
+// carries the client cookie and shares memory with data.
+func DecodeEDNSCookie(data []byte) (client [SizeClientCookie]byte, server []byte, err error) {
+	if len(data) != SizeClientCookie && (len(data) < SizeClientCookie+8 || len(data) > SizeClientCookie+MaxSizeServerCookie) {
+		return client, nil, errCookieLen
+	}
+	return [SizeClientCookie]byte(data), data[SizeClientCookie:], nil
+}
+
+// AppendEDNSClientSubnet appends a Client Subnet option for prefix, which is masked so that
+// only the leading prefix.Bits() of the address are sent. scope is zero in queries.
+func AppendEDNSClientSubnet(dst []byte, prefix netip.Prefix, scope uint8) ([]byte, error) {
+	if !prefix.IsValid() {
+		return dst, errSubnetFamily
+	}
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+	addrLen := (prefix.Bits() + 7) / 8
+	dst = binary.BigEndian.AppendUint16(dst, uint16(EDNSOptionClientSubnet))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(4+addrLen))
+	dst = binary.BigEndian.AppendUint16(dst, family)
+	dst = append(dst, uint8(prefix.Bits()), scope)
+	return append(dst, prefix.Addr().AsSlice()[:addrLen]...), nil
+}
+
+// DecodeEDNSClientSubnet decodes the data of a Client Subnet option.
+func DecodeEDNSClientSubnet(data []byte) (prefix netip.Prefix, scope uint8, err error) {
+	if len(data) < 4 {
+		return prefix, 0, errOptionLen
+	}
+	var addr [16]byte
+	maxBits := 128
+	switch binary.BigEndian.Uint16(data) {
+	case 1:
+		maxBits = 32
+	case 2:
+	default:
+		return prefix, 0, errSubnetFamily
+	}
+	bits := int(data[2])
+	scope = data[3]
+	data = data[4:]
+	if bits > maxBits || len(data) != (bits+7)/8 {
+		return prefix, 0, errSubnetLen
+	}
+	copy(addr[:], data)
+	ip := netip.AddrFrom16(addr)
+	if maxBits == 32 {
+		ip = netip.AddrFrom4([4]byte(addr[:4]))
+	}
+	return netip.PrefixFrom(ip, bits), scope, nil
+}
+
+// AppendEDNSPadding appends a Padding option of n zero bytes.
+func AppendEDNSPadding(dst []byte, n int) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(EDNSOptionPadding))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	for range n {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// EDNSPaddingLen returns the length of the padding option data that makes a message of msgLen bytes,
+// which already contains an OPT record, a multiple of blockSize once the padding option is added.
+// RFC 8467 recommends a block size of 128 for queries and 468 for responses.
+func EDNSPaddingLen(msgLen, blockSize int) int {
+	if blockSize <= 0 {
+		return 0
+	}
+	return (blockSize - (msgLen+4)%blockSize) % blockSize
+}
+
+// ExtendedErrorCode is the INFO-CODE of an Extended DNS Error. See RFC 8914 §4.
+type ExtendedErrorCode uint16
+
+const (
+	ExtendedErrorOther               ExtendedErrorCode = 0
+	ExtendedErrorUnsupportedDNSKEY   ExtendedErrorCode = 1
+	ExtendedErrorUnsupportedDS       ExtendedErrorCode = 2
+	ExtendedErrorStaleAnswer         ExtendedErrorCode = 3
+	ExtendedErrorForgedAnswer        ExtendedErrorCode = 4
+	ExtendedErrorDNSSECIndeterminate ExtendedErrorCode = 5
+	ExtendedErrorDNSSECBogus         ExtendedErrorCode = 6
+	ExtendedErrorSignatureExpired    ExtendedErrorCode = 7
+	ExtendedErrorSignatureNotYet     ExtendedErrorCode = 8
+	ExtendedErrorDNSKEYMissing       ExtendedErrorCode = 9
+	ExtendedErrorRRSIGsMissing       ExtendedErrorCode = 10
+	ExtendedErrorNoZoneKeyBit        ExtendedErrorCode = 11
+	ExtendedErrorNSECMissing         ExtendedErrorCode = 12
+	ExtendedErrorCachedError         ExtendedErrorCode = 13
+	ExtendedErrorNotReady            ExtendedErrorCode = 14
+	ExtendedErrorBlocked             ExtendedErrorCode = 15
+	ExtendedErrorCensored            ExtendedErrorCode = 16
+	ExtendedErrorFiltered            ExtendedErrorCode = 17
+	ExtendedErrorProhibited          ExtendedErrorCode = 18
+	ExtendedErrorStaleNXDOMAIN       ExtendedErrorCode = 19
+	ExtendedErrorNotAuthoritative    ExtendedErrorCode = 20
+	ExtendedErrorNotSupported        ExtendedErrorCode = 21
+	ExtendedErrorNoReachableAuth     ExtendedErrorCode = 22
+	ExtendedErrorNetworkError        ExtendedErrorCode = 23
+	ExtendedErrorInvalidData         ExtendedErrorCode = 24
+)
+
+var extendedErrorNames = [...]string{
+	"other error",
+	"unsupported DNSKEY algorithm",
+	"unsupported DS digest type",
+	"stale answer",
+	"forged answer",
+	"DNSSEC indeterminate",
+	"DNSSEC bogus",
+	"signature expired",
+	"signature not yet valid",
+	"DNSKEY missing",
+	"RRSIGs missing",
+	"no zone key bit set",
+	"NSEC missing",
+	"cached error",
+	"not ready",
+	"blocked",
+	"censored",
+	"filtered",
+	"prohibited",
+	"stale NXDOMAIN answer",
+	"not authoritative",
+	"not supported",
+	"no reachable authority",
+	"network error",
+	"invalid data",
+}
+
+func (code ExtendedErrorCode) String() string {
+	if int(code) < len(extendedErrorNames) {
+		return extendedErrorNames[code]
+	}
+	return "ExtendedErrorCode(" + strconv.Itoa(int(code)) + ")"
+}
+
+// ExtendedError is an Extended DNS Error (RFC 8914) explaining why a response failed.
+// It unwraps to the response code of the message it was received in, if not successful,
+// or else to Err.
+type ExtendedError struct {
+	RCode RCode
+	Code  ExtendedErrorCode
+	// Text is the optional EXTRA-TEXT field, meant for humans.
+	Text string
+	// Err is the error of a successful response that failed the lookup, i.e: no answers.
+	Err error
+}
+
+func (ede *ExtendedError) Error() string {
+	s := ede.Code.String()
+	if ede.RCode != RCodeSuccess {
+		s = ede.RCode.String() + ": " + s
+	}
+	if ede.Text != "" {
+		s += " (" + ede.Text + ")"
+	}
+	return s
+}
+
+func (ede *ExtendedError) Unwrap() error {
+	if ede.RCode == RCodeSuccess {
+		return ede.Err
+	}
+	return ede.RCode
+}
+
+// AppendEDNSExtendedError appends an Extended DNS Error option with info code and optional text.
+func AppendEDNSExtendedError(dst []byte, code ExtendedErrorCode, text string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(EDNSOptionExtendedError))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(2+len(text)))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(code))
+	return append(dst, text...)
+}
+
+// DecodeEDNSExtendedError decodes the data of an Extended DNS Error option. Trailing NUL bytes in the text are removed.
+func DecodeEDNSExtendedError(data []byte) (code ExtendedErrorCode, text []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, errOptionLen
+	}
+	text = data[2:]
+	for len(text) > 0 && text[len(text)-1] == 0 {
+		text = text[:len(text)-1]
+	}
+	return ExtendedErrorCode(binary.BigEndian.Uint16(data)), text, nil
+}
+
+// VisitEDNSOptions calls fn with the code and data of each option of an OPT record.
+// The data passed to fn shares memory with r.
+func (r *Resource) VisitEDNSOptions(fn func(code EDNSOption, data []byte)) error {
+	if r.header.Type != TypeOPT {
+		return errNoOPT
+	}
+	data := r.RawData()
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errOptionLen
+		}
+		n := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		if n > len(data) {
+			return errOptionLen
+		}
+		fn(EDNSOption(binary.BigEndian.Uint16(data)), data[4:n])
+		data = data[n:]
+	}
+	return nil
+}
+
+// EDNSOption returns the data of the first option with code in the OPT record r.
+func (r *Resource) EDNSOption(code EDNSOption) (data []byte, ok bool) {
+	r.VisitEDNSOptions(func(c EDNSOption, d []byte) {
+		if c == code && !ok {
+			data, ok = d, true
+		}
+	})
+	return data, ok
+}
+
+// OPT returns the OPT pseudo-record in the additional section of m, or nil if m has none.
+func (m *Message) OPT() *Resource {
+	for i := range m.Additionals {
+		if m.Additionals[i].header.Type == TypeOPT {
+			return &m.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// ResponseCode returns the 12-bit response code of a response with header flags, combining
+// the upper 8 bits stored in the OPT record of m with the lower 4 bits of flags (RFC 6891 §6.1.3).
+func (m *Message) ResponseCode(flags HeaderFlags) RCode {
+	rcode := flags.ResponseCode()
+	if opt := m.OPT(); opt != nil {
+		rcode |= RCode(opt.header.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// ExtendedError returns the first Extended DNS Error in the OPT record of m, if any.
+// The RCode field is left to the caller to set. See [Message.ResponseCode].
+func (m *Message) ExtendedError() (ede ExtendedError, ok bool) {
+	opt := m.OPT()
+	if opt == nil {
+		return ede, false
+	}
+	data, ok := opt.EDNSOption(EDNSOptionExtendedError)
+	if !ok {
+		return ede, false
+	}
+	code, text, err := DecodeEDNSExtendedError(data)
+	if err != nil {
+		return ede, false
+	}
+	return ExtendedError{Code: code, Text: string(text)}, true
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestEDNSOptions(t *testing.T) {
+	client := [SizeClientCookie]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	server := []byte("server-cookie-16")
+	subnet := netip.MustParsePrefix("192.0.2.77/24")
+	opts, err := AppendEDNSCookie(nil, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err = AppendEDNSClientSubnet(opts, subnet, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = AppendEDNSExtendedError(opts, ExtendedErrorBlocked, "ads\x00")
+	var opt Resource
+	opt.SetEDNS0(1232, 0, 0, opts)
+	msg := Message{
+		Questions:   []Question{{Name: MustNewName("example.com"), Type: TypeA, Class: ClassINET}},
+		Additionals: []Resource{opt},
+	}
+	// Pad message to a block of 128 bytes as RFC 8467 recommends for queries.
+	pad := EDNSPaddingLen(int(msg.Len()), 128)
+	msg.Additionals[0].SetEDNS0(1232, 0, 0, AppendEDNSPadding(opts, pad))
+	wire, err := msg.AppendTo(nil, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(wire)%128 != 0 {
+		t.Errorf("padded message length %d not a multiple of 128", len(wire))
+	}
+
+	var got Message
+	got.LimitResourceDecoding(1, 0, 0, 1)
+	if _, _, err = got.Decode(wire); err != nil {
+		t.Fatal(err)
+	}
+	gotOpt := got.OPT()
+	if gotOpt == nil {
+		t.Fatal("OPT record not decoded")
+	}
+	var codes []EDNSOption
+	err = gotOpt.VisitEDNSOptions(func(code EDNSOption, data []byte) {
+		codes = append(codes, code)
+		switch code {
+		case EDNSOptionCookie:
+			c, s, err := DecodeEDNSCookie(data)
+			if err != nil || c != client || string(s) != string(server) {
+				t.Errorf("cookie %x %q err=%v", c, s, err)
+			}
+		case EDNSOptionClientSubnet:
+			prefix, scope, err := DecodeEDNSClientSubnet(data)
+			if err != nil || prefix != subnet.Masked() || scope != 0 {
+				t.Errorf("client subnet %s scope=%d err=%v", prefix, scope, err)
+			}
+		}
+	})
+	if err != nil || len(codes) != 4 || codes[3] != EDNSOptionPadding {
+		t.Errorf("options %v err=%v", codes, err)
+	}
+	ede, ok := got.ExtendedError()
+	if !ok || ede.Code != ExtendedErrorBlocked || ede.Text != "ads" {
+		t.Errorf("extended error %+v ok=%v", ede, ok)
+	}
+	ede.RCode = RCodeNameError
+	var err2 error = &ede
+	if !errors.Is(err2, RCodeNameError) || err2.Error() != "name error: blocked (ads)" {
+		t.Errorf("extended error %q does not wrap rcode", err2.Error())
+	}
+	noData := errors.New("no answers")
+	ede.RCode, ede.Err = RCodeSuccess, noData
+	if !errors.Is(err2, noData) {
+		t.Errorf("extended error %q of successful response does not wrap Err", err2.Error())
+	}
+}
+
+func TestEDNSExtendedRCode(t *testing.T) {
+	var msg Message
+	var opt Resource
+	opt.SetEDNS0(1232, RCodeBadCookie>>4, 0, nil)
+	msg.Additionals = []Resource{opt}
+	flags := HeaderFlags(1<<15) | HeaderFlags(RCodeBadCookie&0xf)
+	if rcode := msg.ResponseCode(flags); rcode != RCodeBadCookie {
+		t.Errorf("got rcode %d, want BADCOOKIE", rcode)
+	}
+	msg.Additionals = nil
+	if rcode := msg.ResponseCode(flags); rcode != RCodeBadCookie&0xf {
+		t.Errorf("got rcode %d without OPT", rcode)
+	}
+	if _, _, err := DecodeEDNSCookie(make([]byte, 12)); err == nil {
+		t.Error("expected error on short server cookie")
+	}
+	if _, err := AppendEDNSCookie(nil, [SizeClientCookie]byte{}, make([]byte, 33)); err == nil {
+		t.Error("expected error on long server cookie")
+	}
+	v6 := netip.MustParsePrefix("2001:db8:abcd::/48")
+	data, _ := AppendEDNSClientSubnet(nil, v6, 0)
+	if prefix, _, err := DecodeEDNSClientSubnet(data[4:]); err != nil || prefix != v6 || len(data) != 4+4+6 {
+		t.Errorf("IPv6 client subnet %s len=%d err=%v", prefix, len(data), err)
+	}
+}
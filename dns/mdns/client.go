@@ -3,6 +3,7 @@ package mdns
 import (
 	"math"
 	"net"
+	"time"
 
 	"github.com/soypat/lneto"
 	"github.com/soypat/lneto/dns"
@@ -18,8 +19,11 @@ const (
 	// classCacheFlush is bit 15 of the Class field, indicating the record
 	// is from a unique source and should replace cached entries (RFC 6762 §10.2).
 	classCacheFlush uint16 = 1 << 15
-	mdnsTxID               = 0
-	mdnsFlags              = 0
+	// classUnicastResponse is bit 15 of the Class field of a question, requesting
+	// a unicast response (RFC 6762 §5.4).
+	classUnicastResponse uint16 = 1 << 15
+	mdnsTxID                    = 0
+	mdnsFlags                   = 0
 )
 
 type querierState uint8
@@ -37,6 +41,10 @@ const (
 //
 // Clients are attached to MDNS ports and function until manual detachment
 // due to their dual design: they double as a querier and service discovery.
+//
+// If configured with a clock, the client claims the names of its services before
+// answering for them: it probes for their uniqueness, announces them, renames them
+// on conflicts and defends them. See [State] and RFC 6762 §8 and §9.
 type Client struct {
 	connID uint64
 	closed bool
@@ -54,12 +62,32 @@ type Client struct {
 	services []Service // Stores services we'd broadcast.
 	rans     []dns.Resource
 	rqst     []dns.Question
+	// Responder name claiming state, see [State].
+	now             func() time.Time
+	nextActionAt    time.Time      // Time of next probe or announcement.
+	conflictsAt     time.Time      // Start of conflict rate limiting window.
+	recs            []dns.Resource // Unique records of services in canonical order.
+	pqst            []dns.Question // Probe questions.
+	cmsg            dns.Message    // Received records inspected for conflicts.
+	prng            uint32
+	conflicts       uint16
+	windowConflicts uint8
+	rstate          State
+	probesSent      uint8
+	announceSent    uint8
 }
 
 type ClientConfig struct {
 	LocalPort     uint16
 	Services      []Service
 	MulticastAddr []byte
+	// Now is the clock timing the probing and announcing of Services (RFC 6762 §8).
+	// If nil, names of Services are assumed unique: they are answered for
+	// immediately, never announced and not defended against conflicts.
+	Now func() time.Time
+	// Seed seeds the random delay before the first probe. It should differ
+	// between hosts, i.e: be derived from the MAC address.
+	Seed uint32
 }
 
 func (c *Client) Configure(cfg ClientConfig) error {
@@ -67,15 +95,29 @@ func (c *Client) Configure(cfg ClientConfig) error {
 		return lneto.ErrZeroSource
 	}
 	c.reset(cfg.LocalPort)
+	nsvc := len(cfg.Services)
 	c.services = append(c.services[:0], cfg.Services...)
 	c.ip = append(c.ip[:0], cfg.MulticastAddr...)
-	internal.SliceReuse(&c.rqst, len(cfg.Services))
+	internal.SliceReuse(&c.rqst, nsvc)
 	// Each service can produce up to 4 answer records (PTR+SRV+TXT+A).
-	nrans := 2 * len(cfg.Services)
-	if nrans > 0 {
-		nrans = max(4, nrans)
+	internal.SliceReuse(&c.rans, 4*nsvc)
+	if nsvc == 0 {
+		return nil
+	} else if cfg.Now == nil {
+		c.rstate = StateAnnounced
+		return nil
+	}
+	c.now = cfg.Now
+	c.prng = cfg.Seed
+	if c.prng == 0 {
+		c.prng = 1 // xorshift cannot escape the zero state.
 	}
-	internal.SliceReuse(&c.rans, nrans)
+	// Each service owns up to 3 unique records (SRV+TXT+A) under 2 names.
+	internal.SliceReuse(&c.recs, 3*nsvc)
+	internal.SliceReuse(&c.pqst, 2*nsvc)
+	c.cmsg.LimitResourceDecoding(0, maxConflictRecords, maxConflictRecords, maxConflictRecords)
+	c.buildRecords()
+	c.beginProbing(cfg.Now(), randDelay(c.prand(), probeWait))
 	return nil
 }
 
@@ -115,6 +157,9 @@ func (c *Client) reset(localport uint16) {
 		services: c.services[:0],
 		rans:     c.rans[:0],
 		ip:       c.ip[:0],
+		recs:     c.recs[:0],
+		pqst:     c.pqst[:0],
+		cmsg:     c.cmsg,
 	}
 }
 
@@ -124,16 +169,22 @@ func (c *Client) qreset(state querierState) {
 }
 
 // Encapsulate writes a pending mDNS packet into carrierData[offsetToFrame:].
-// Pending responses take priority over outgoing queries.
+// Goodbyes take priority over pending responses, which take priority over
+// due probes and announcements, which take priority over outgoing queries.
 func (c *Client) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (n int, err error) {
 	if c.isClosed() {
 		return 0, net.ErrClosed
 	}
-	if len(c.rans) > 0 {
+	frame := carrierData[offsetToFrame:]
+	if c.rstate == StateClosing {
+		n, err = c.encapsGoodbye(frame)
+	} else if len(c.rans) > 0 {
 		// Pending response to an incoming query.
-		n, err = c.encapsResponse(carrierData[offsetToFrame:])
+		n, err = c.encapsResponse(frame)
+	} else if now, due := c.claimDue(); due {
+		n, err = c.encapsClaim(frame, now)
 	} else if c.qstate == querierSendQuery {
-		n, err = c.encapsQuery(carrierData[offsetToFrame:])
+		n, err = c.encapsQuery(frame)
 	}
 	if n > 0 && offsetToIP >= 0 {
 		// Set Multicast IP destination and Ethernet MAC.
@@ -145,9 +196,12 @@ func (c *Client) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int)
 // Demux processes an incoming mDNS response packet. Answers are accumulated
 // into the internal message. Once sufficient answers are collected or a
 // timeout occurs the querier transitions to querierDone.
+// Responses and probes of other hosts are inspected for conflicts with the names of services.
 func (c *Client) Demux(carrierData []byte, frameOffset int) error {
 	if c.isClosed() {
 		return net.ErrClosed
+	} else if c.rstate == StateClosing {
+		return nil
 	}
 	frame := carrierData[frameOffset:]
 	f, err := dns.NewFrame(frame)
@@ -158,6 +212,12 @@ func (c *Client) Demux(carrierData []byte, frameOffset int) error {
 	}
 	flags := f.Flags()
 	isresponse := flags.IsResponse()
+	if c.now != nil && c.rstate != StateIdle && (isresponse || f.NSCount() > 0) {
+		err = c.checkConflicts(frame, isresponse)
+		if err != nil {
+			return err
+		}
+	}
 	if isresponse && c.qstate == querierAwaitResponse {
 		c.qcode = flags.ResponseCode()
 		// Decode response into our message, collecting answers.
@@ -170,7 +230,7 @@ func (c *Client) Demux(carrierData []byte, frameOffset int) error {
 		return nil // success.
 	}
 	freeAns := cap(c.rans) - len(c.rans)
-	if !isresponse && len(c.services) > 0 && freeAns > 0 {
+	if !isresponse && c.answering() && freeAns > 0 {
 		// Incoming query — match against our services.
 		var query dns.Message
 		query.LimitResourceDecoding(f.QDCount(), 0, 0, 0)
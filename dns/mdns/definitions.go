@@ -1,9 +1,69 @@
 package mdns
 
 import (
+	"time"
+
 	"github.com/soypat/lneto/dns"
 )
 
+// Responder timing constants as defined in RFC 6762 §8.
+const (
+	// probeWait bounds the random delay before the first probe (RFC 6762 §8.1).
+	probeWait = 250 * time.Millisecond
+	// probeInterval is the spacing between probes and the wait after the last probe before announcing.
+	probeInterval = 250 * time.Millisecond
+	// probeNum is the number of probes sent before claiming names.
+	probeNum = 3
+	// announceNum is the number of unsolicited announcements sent after claiming names (RFC 6762 §8.3).
+	announceNum = 2
+	// announceInterval is the spacing between announcements.
+	announceInterval = 1 * time.Second
+	// tiebreakDelay is the wait before probing again after losing a simultaneous probe tiebreak (RFC 6762 §8.2).
+	tiebreakDelay = 1 * time.Second
+	// maxConflicts conflicts within conflictWindow rate limit probing to once every rateLimitDelay (RFC 6762 §8.1).
+	maxConflicts   = 15
+	conflictWindow = 10 * time.Second
+	rateLimitDelay = 5 * time.Second
+	// maxConflictRecords is the number of records per section of a received packet inspected for conflicts.
+	maxConflictRecords = 16
+)
+
+// State is the stage of the responder of a [Client], which claims the names of its
+// services before answering for them (RFC 6762 §8). The transition order of a successful claim is:
+//
+//	StateProbing -> StateAnnouncing -> StateAnnounced
+type State uint8
+
+const (
+	// StateIdle is the state of a client without services.
+	StateIdle State = iota
+	// StateProbing queries for the names of services to verify they are unique. Queries for them are not answered.
+	StateProbing
+	// StateAnnouncing has claimed the names and sends unsolicited announcements of the service records.
+	StateAnnouncing
+	// StateAnnounced owns the names, answering queries for them and defending them against conflicts.
+	StateAnnounced
+	// StateClosing sends goodbye announcements before closing the client, see [Client.Close].
+	StateClosing
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateProbing:
+		return "probing"
+	case StateAnnouncing:
+		return "announcing"
+	case StateAnnounced:
+		return "announced"
+	case StateClosing:
+		return "closing"
+	default:
+		return "mdns.State(?)"
+	}
+}
+
 // IPv4MulticastAddr is the IPv4 multicast address used by mDNS (224.0.0.251).
 // Defined by RFC 6762. Packets sent to this address use UDP port 5353 and are
 // link-local (not routed beyond the local network segment).
@@ -111,7 +171,7 @@ func addServiceAnswers(dst *[]dns.Resource, q *dns.Question, svc *Service) {
 		if avail < 1 {
 			return
 		}
-		setPTR(growSlice(dst), svc)
+		setPTR(growSlice(dst), svc, ttl)
 	case dns.TypeSRV:
 		if avail < 2 {
 			return
@@ -132,7 +192,12 @@ func addServiceAnswers(dst *[]dns.Resource, q *dns.Question, svc *Service) {
 		if avail < 4 {
 			return
 		}
-		setPTR(growSlice(dst), svc)
+		if dns.NamesEqual(q.Name, svc.Host) {
+			// Query for the host name, i.e: a probe (RFC 6762 §8.1).
+			growSlice(dst).SetA(svc.Host, cacheFlush, ttl, svc.Addr)
+			return
+		}
+		setPTR(growSlice(dst), svc, ttl)
 		growSlice(dst).SetSRV(svc.Name, cacheFlush, ttl, 0, 0, svc.Port, svc.Host)
 		growSlice(dst).SetTXT(svc.Name, cacheFlush, ttl, txtData)
 		growSlice(dst).SetA(svc.Host, cacheFlush, ttl, svc.Addr)
@@ -146,7 +211,7 @@ func growSlice[T any](s *[]T) *T {
 	return &(*s)[len(*s)-1]
 }
 
-func setPTR(ans *dns.Resource, svc *Service) {
+func setPTR(ans *dns.Resource, svc *Service, ttl uint32) {
 	svcType := svc.serviceType()
-	ans.SetPTR(svcType, dns.ClassINET, svc.ttl(), svc.Name)
+	ans.SetPTR(svcType, dns.ClassINET, ttl, svc.Name)
 }
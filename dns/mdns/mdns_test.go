@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/soypat/lneto/dns"
 )
@@ -236,11 +237,230 @@ func TestClientQueryARecord(t *testing.T) {
 	}
 }
 
-// TODO: TestClientAnnounce — test unsolicited announcement of all registered services.
-// func TestClientAnnounce(t *testing.T) { ... }
+type fakeClock struct{ t time.Time }
 
-// TODO: TestClientProbeFinish — test probing sequence for name uniqueness (RFC 6762 §8.1).
-// func TestClientProbeFinish(t *testing.T) { ... }
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newClaimingResponder(t *testing.T, clk *fakeClock, seed uint32, services ...Service) *Client {
+	t.Helper()
+	var c Client
+	err := c.Configure(ClientConfig{
+		LocalPort: Port,
+		Services:  services,
+		Now:       clk.now,
+		Seed:      seed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if c.State() != StateProbing {
+		t.Fatalf("expected probing after Configure, got %s", c.State())
+	}
+	return &c
+}
+
+// encaps runs one Encapsulate on c and returns the packet written, if any.
+func encaps(t *testing.T, c *Client, buf []byte) []byte {
+	t.Helper()
+	n, err := c.Encapsulate(buf, -1, 0)
+	if err != nil {
+		t.Fatal("encapsulate:", err)
+	}
+	return buf[:n]
+}
+
+// claim advances the clock through probing and announcing of c until it owns its names.
+func claim(t *testing.T, c *Client, clk *fakeClock) {
+	t.Helper()
+	var buf [1024]byte
+	for range probeNum + announceNum {
+		clk.advance(announceInterval)
+		if len(encaps(t, c, buf[:])) == 0 {
+			t.Fatalf("no packet sent while claiming in state %s", c.State())
+		}
+	}
+	if c.State() != StateAnnounced {
+		t.Fatalf("expected announced, got %s", c.State())
+	}
+}
+
+func TestClientProbeFinish(t *testing.T) {
+	var clk fakeClock
+	svc := testService()
+	c := newClaimingResponder(t, &clk, 1, svc)
+	var buf [1024]byte
+	clk.advance(probeWait)
+	for i := range probeNum {
+		pkt := encaps(t, c, buf[:])
+		if len(pkt) == 0 {
+			t.Fatalf("probe %d not sent", i+1)
+		} else if len(encaps(t, c, buf[:])) != 0 {
+			t.Fatal("probe sent before probe interval elapsed")
+		}
+		var msg dns.Message
+		msg.LimitResourceDecoding(4, 0, 4, 0)
+		_, _, err := msg.Decode(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := dns.NewFrame(pkt)
+		if f.Flags().IsResponse() || len(msg.Questions) != 2 || len(msg.Authorities) != 3 {
+			t.Fatalf("bad probe: flags=%v questions=%d authorities=%d", f.Flags(), len(msg.Questions), len(msg.Authorities))
+		}
+		for _, q := range msg.Questions {
+			unicast := uint16(q.Class)&classUnicastResponse != 0
+			if q.Type != dns.TypeALL || unicast != (i == 0) {
+				t.Errorf("probe %d question %s type=%s unicast=%v", i+1, q.Name.String(), q.Type, unicast)
+			}
+		}
+		// Queries for names being probed are not answered.
+		n := buildMDNSQuery(t, buf[:], "mydevice.local", dns.TypeA, false)
+		if err = c.Demux(buf[:n], 0); err != nil {
+			t.Fatal(err)
+		} else if len(encaps(t, c, buf[:])) != 0 {
+			t.Fatal("answered query for name being probed")
+		}
+		clk.advance(probeInterval)
+	}
+	if c.State() != StateProbing {
+		t.Fatalf("expected probing until first announcement, got %s", c.State())
+	}
+	if len(encaps(t, c, buf[:])) == 0 || c.State() != StateAnnouncing {
+		t.Fatalf("expected first announcement, state %s", c.State())
+	}
+	n := buildMDNSQuery(t, buf[:], "mydevice.local", dns.TypeA, false)
+	c.Demux(buf[:n], 0)
+	if pkt := encaps(t, c, buf[:]); len(pkt) == 0 {
+		t.Fatal("claimed name not answered")
+	}
+}
+
+func TestClientAnnounce(t *testing.T) {
+	var clk fakeClock
+	svc := testService()
+	c := newClaimingResponder(t, &clk, 1, svc)
+	var buf [1024]byte
+	for range probeNum {
+		clk.advance(probeInterval)
+		encaps(t, c, buf[:])
+	}
+	for i := range announceNum {
+		clk.advance(announceInterval)
+		checkAnnouncement(t, encaps(t, c, buf[:]), svc.ttl())
+		if len(encaps(t, c, buf[:])) != 0 {
+			t.Fatalf("announcement %d repeated before interval elapsed", i+1)
+		}
+	}
+	clk.advance(time.Hour)
+	if c.State() != StateAnnounced || len(encaps(t, c, buf[:])) != 0 {
+		t.Fatalf("expected silent announced client, got %s", c.State())
+	}
+
+	// Goodbye announces all records with zero TTL before closing.
+	c.Close()
+	checkAnnouncement(t, encaps(t, c, buf[:]), 0)
+	if _, err := c.Encapsulate(buf[:], -1, 0); err != net.ErrClosed {
+		t.Errorf("expected closed client after goodbye, got %v", err)
+	}
+}
+
+// checkAnnouncement checks pkt is an unsolicited response with the 4 records of testService.
+func checkAnnouncement(t *testing.T, pkt []byte, ttl uint32) {
+	t.Helper()
+	var msg dns.Message
+	msg.LimitResourceDecoding(0, 8, 0, 0)
+	_, _, err := msg.Decode(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := dns.NewFrame(pkt)
+	if !f.Flags().IsResponse() || len(msg.Answers) != 4 {
+		t.Fatalf("bad announcement: flags=%v answers=%d", f.Flags(), len(msg.Answers))
+	}
+	for _, ans := range msg.Answers {
+		hdr := ans.Header()
+		cacheFlush := uint16(hdr.Class)&classCacheFlush != 0
+		if hdr.TTL != ttl || cacheFlush == (hdr.Type == dns.TypePTR) {
+			t.Errorf("record %s ttl=%d cache-flush=%v", hdr.String(), hdr.TTL, cacheFlush)
+		}
+	}
+}
+
+func TestClientConflictRename(t *testing.T) {
+	var clk fakeClock
+	owner := newResponder(t, []Service{{Host: mustNewName("device.local"), Addr: []byte{192, 168, 1, 10}}})
+	c := newClaimingResponder(t, &clk, 1, Service{Host: mustNewName("device.local"), Addr: []byte{192, 168, 1, 11}})
+	var buf [1024]byte
+	clk.advance(probeWait)
+	probe := encaps(t, c, buf[:])
+	if err := owner.Demux(probe, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Owner of the name defends it by answering the probe.
+	answer := encaps(t, owner, buf[:])
+	if len(answer) == 0 {
+		t.Fatal("owner did not answer probe")
+	}
+	if err := c.Demux(answer, 0); err != nil {
+		t.Fatal(err)
+	}
+	host := c.Services()[0].Host
+	if c.Conflicts() != 1 || !host.EqualString("device (2).local") {
+		t.Fatalf("conflicts=%d host=%s, want rename to device (2).local", c.Conflicts(), host.String())
+	}
+	claim(t, c, &clk)
+
+	// An announced name is probed again on conflict, another answer results in another rename.
+	conflicting := dns.Message{Answers: []dns.Resource{
+		dns.NewResource(mustNewName("device (2).local"), dns.TypeA, dns.ClassINET, 120, []byte{192, 168, 1, 12}),
+	}}
+	answer, _ = conflicting.AppendTo(buf[:0], 0, dns.HeaderFlags(1<<15|1<<10))
+	c.Demux(answer, 0)
+	if c.State() != StateProbing {
+		t.Fatalf("expected probing after conflict on announced name, got %s", c.State())
+	}
+	c.Demux(answer, 0)
+	host = c.Services()[0].Host
+	if c.Conflicts() != 2 || !host.EqualString("device (3).local") {
+		t.Fatalf("conflicts=%d host=%s, want rename to device (3).local", c.Conflicts(), host.String())
+	}
+}
+
+func TestClientSimultaneousProbe(t *testing.T) {
+	var clk fakeClock
+	svc := Service{Host: mustNewName("device.local"), Addr: []byte{192, 168, 1, 10}}
+	loser := newClaimingResponder(t, &clk, 1, svc)
+	svc.Addr = []byte{192, 168, 1, 11} // Lexicographically later address wins.
+	winner := newClaimingResponder(t, &clk, 2, svc)
+	var buf1, buf2 [1024]byte
+	clk.advance(probeWait)
+	probe1 := encaps(t, loser, buf1[:])
+	probe2 := encaps(t, winner, buf2[:])
+	loser.Demux(probe2, 0)
+	winner.Demux(probe1, 0)
+	// Own looped back probe is no conflict.
+	winner.Demux(probe2, 0)
+	clk.advance(probeInterval)
+	if len(encaps(t, loser, buf1[:])) != 0 {
+		t.Error("tiebreak loser did not defer probing")
+	}
+	for range probeNum + announceNum - 1 {
+		if len(encaps(t, winner, buf2[:])) == 0 {
+			t.Fatalf("winner stalled in state %s", winner.State())
+		}
+		clk.advance(announceInterval)
+	}
+	if winner.State() != StateAnnounced || winner.Conflicts() != 0 {
+		t.Fatalf("winner state=%s conflicts=%d", winner.State(), winner.Conflicts())
+	}
+	// Loser probes again and is answered by the winner.
+	probe1 = encaps(t, loser, buf1[:])
+	winner.Demux(probe1, 0)
+	loser.Demux(encaps(t, winner, buf2[:]), 0)
+	if host := loser.Services()[0].Host; !host.EqualString("device (2).local") {
+		t.Errorf("loser host=%s, want device (2).local", host.String())
+	}
+}
 
 func TestClientIgnoresQueriesWithoutServices(t *testing.T) {
 	// A querier-only client should ignore incoming queries.
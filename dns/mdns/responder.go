@@ -0,0 +1,374 @@
+package mdns
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/dns"
+	"github.com/soypat/lneto/internal"
+)
+
+// This file implements the claiming of service names by the responder of a
+// Client: probing for uniqueness (RFC 6762 §8.1), simultaneous probe
+// tiebreaking (§8.2), announcing (§8.3), conflict resolution (§9) and goodbyes (§10.1).
+
+// State returns the state of the responder claiming the names of the client's services.
+func (c *Client) State() State { return c.rstate }
+
+// Services returns the services of the client. Names taken by other hosts are
+// renamed on conflicts (RFC 6762 §9), i.e: "device.local" becomes "device (2).local",
+// which is reflected in the returned services. The returned slice must not be modified.
+func (c *Client) Services() []Service { return c.services }
+
+// Conflicts returns the number of name conflicts encountered while probing.
+func (c *Client) Conflicts() int { return int(c.conflicts) }
+
+// Close sends goodbye announcements, service records with zero TTL (RFC 6762 §10.1), on
+// the next call to Encapsulate and closes the client after, as [Client.Abort] does.
+// A client that has not announced its services is closed immediately.
+func (c *Client) Close() {
+	if c.rstate == StateAnnouncing || c.rstate == StateAnnounced {
+		c.rstate = StateClosing
+		return
+	}
+	c.Abort()
+}
+
+// answering reports whether the responder answers queries for its services.
+func (c *Client) answering() bool {
+	return c.rstate == StateAnnouncing || c.rstate == StateAnnounced
+}
+
+// claimDue reports whether a probe or announcement is due.
+func (c *Client) claimDue() (now time.Time, due bool) {
+	if c.rstate != StateProbing && c.rstate != StateAnnouncing {
+		return now, false
+	}
+	now = c.now()
+	return now, !now.Before(c.nextActionAt)
+}
+
+// encapsClaim writes the next probe or announcement into frame.
+func (c *Client) encapsClaim(frame []byte, now time.Time) (int, error) {
+	if c.rstate == StateProbing && c.probesSent < probeNum {
+		c.probesSent++
+		c.nextActionAt = now.Add(probeInterval)
+		return c.encapsProbe(frame, c.probesSent == 1)
+	}
+	// Probing finished without conflicts, names are ours.
+	c.rstate = StateAnnouncing
+	c.announceSent++
+	if c.announceSent >= announceNum {
+		c.rstate = StateAnnounced
+	} else {
+		c.nextActionAt = now.Add(announceInterval)
+	}
+	c.rans = c.rans[:0]
+	c.addServiceRecords(false)
+	return c.encapsResponse(frame)
+}
+
+// encapsProbe writes a query for all names being claimed with the proposed records
+// in the authority section (RFC 6762 §8.2). The first probe requests unicast responses.
+func (c *Client) encapsProbe(frame []byte, unicast bool) (int, error) {
+	class := dns.ClassINET
+	if unicast {
+		class |= dns.Class(classUnicastResponse)
+	}
+	c.pqst = c.pqst[:0]
+	for i := range c.recs {
+		name := c.recs[i].Header().Name
+		if nextOwned(c.recs[:i], 0, name) < i {
+			continue // Name already in question.
+		}
+		q := growSlice(&c.pqst)
+		q.Name.CopyFrom(name)
+		q.Type = dns.TypeALL
+		q.Class = class
+	}
+	msg := dns.Message{
+		Questions:   c.pqst,
+		Authorities: c.recs,
+	}
+	if int(msg.Len()) > len(frame) {
+		return 0, lneto.ErrShortBuffer
+	}
+	data, err := msg.AppendTo(frame[:0], mdnsTxID, mdnsFlags)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// encapsGoodbye writes the goodbye announcement of the client's services and closes the client.
+func (c *Client) encapsGoodbye(frame []byte) (int, error) {
+	c.rans = c.rans[:0]
+	c.addServiceRecords(true)
+	n, err := c.encapsResponse(frame)
+	if err == nil {
+		c.closed = true
+	}
+	return n, err
+}
+
+// addServiceRecords adds all records of the client's services to the pending answers, for
+// announcements (RFC 6762 §8.3) or goodbyes with zero TTL (RFC 6762 §10.1).
+func (c *Client) addServiceRecords(goodbye bool) {
+	cacheFlush := dns.Class(uint16(dns.ClassINET) | classCacheFlush)
+	for i := range c.services {
+		svc := &c.services[i]
+		ttl := svc.ttl()
+		if goodbye {
+			ttl = 0
+		}
+		if svc.Name.Len() > 0 {
+			setPTR(growSlice(&c.rans), svc, ttl)
+		}
+		addUniqueRecords(&c.rans, svc, cacheFlush, ttl)
+	}
+}
+
+// buildRecords sets the unique records of the client's services, sorted in the
+// canonical order of RFC 6762 §8.2.1 for comparison with records of other hosts.
+func (c *Client) buildRecords() {
+	c.recs = c.recs[:0]
+	for i := range c.services {
+		addUniqueRecords(&c.recs, &c.services[i], dns.ClassINET, c.services[i].ttl())
+	}
+	slices.SortFunc(c.recs, compareRecords)
+}
+
+// beginProbing restarts probing for the client's names after delay.
+func (c *Client) beginProbing(now time.Time, delay time.Duration) {
+	c.rstate = StateProbing
+	c.probesSent = 0
+	c.announceSent = 0
+	c.rans = c.rans[:0] // Drop answers with records no longer ours.
+	c.nextActionAt = now.Add(delay)
+}
+
+// checkConflicts inspects the records of a received response, or the authority section
+// of a received probe, for records conflicting with those of the client's services.
+func (c *Client) checkConflicts(frame []byte, isresponse bool) error {
+	m := &c.cmsg
+	_, incomplete, err := dns.DecodeMessage(nil, &m.Answers, &m.Authorities, &m.Additionals, frame)
+	if err != nil && !incomplete {
+		return err
+	}
+	now := c.now()
+	if !isresponse {
+		if c.rstate == StateProbing {
+			c.tiebreak(now)
+		}
+		return nil
+	}
+	for _, section := range [2][]dns.Resource{m.Answers, m.Additionals} {
+		for i := range section {
+			if c.isConflict(&section[i]) {
+				c.onConflict(now, section[i].Header().Name)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// isConflict reports whether r, received in a response, conflicts with the client's records.
+// While probing any record for a name being claimed is a conflict (RFC 6762 §8.1). Once
+// claimed, only a record of the same name and type with different data is (RFC 6762 §9).
+func (c *Client) isConflict(r *dns.Resource) bool {
+	hdr := r.Header()
+	if uint16(hdr.Class)&^classCacheFlush != uint16(dns.ClassINET) {
+		return false
+	}
+	conflict := false
+	for i := range c.recs {
+		our := c.recs[i].Header()
+		if !dns.NamesEqualFold(our.Name, hdr.Name) {
+			continue
+		} else if our.Type == hdr.Type && bytes.Equal(c.recs[i].RawData(), r.RawData()) {
+			return false // Our own record.
+		}
+		conflict = conflict || c.rstate == StateProbing || our.Type == hdr.Type
+	}
+	return conflict
+}
+
+// onConflict handles a conflict on name. While probing, services are renamed and probed
+// again, rate limited to once every rateLimitDelay after maxConflicts conflicts within
+// conflictWindow (RFC 6762 §8.1). Claimed names are probed again (RFC 6762 §9): if the other
+// host owns the name its answer to the probes results in a rename.
+func (c *Client) onConflict(now time.Time, name dns.Name) {
+	if c.rstate != StateProbing {
+		c.beginProbing(now, 0)
+		return
+	}
+	if c.conflicts < 0xffff {
+		c.conflicts++
+	}
+	if now.Sub(c.conflictsAt) >= conflictWindow {
+		c.conflictsAt = now
+		c.windowConflicts = 0
+	}
+	c.windowConflicts++
+	c.rename(name)
+	delay := time.Duration(0)
+	if c.windowConflicts >= maxConflicts {
+		delay = rateLimitDelay
+	}
+	c.beginProbing(now, delay)
+}
+
+// tiebreak compares the records the client probes for with those of another host probing
+// for the same names, found in the authority section of the decoded probe. If the other host's
+// records are lexicographically later it wins and the client probes again after tiebreakDelay (RFC 6762 §8.2).
+func (c *Client) tiebreak(now time.Time) {
+	auth := c.cmsg.Authorities
+	slices.SortFunc(auth, compareRecords)
+	for i := range c.recs {
+		name := c.recs[i].Header().Name
+		if nextOwned(c.recs[:i], 0, name) < i {
+			continue // Name already compared.
+		}
+		if compareRecordSets(name, c.recs, auth) < 0 {
+			c.beginProbing(now, tiebreakDelay)
+			return
+		}
+	}
+}
+
+// rename picks new names for the services owning name. Renaming allocates.
+func (c *Client) rename(name dns.Name) {
+	for i := range c.services {
+		svc := &c.services[i]
+		if dns.NamesEqualFold(svc.Host, name) {
+			if next, ok := nextName(svc.Host); ok {
+				svc.Host = next
+			}
+		}
+		if dns.NamesEqualFold(svc.Name, name) {
+			if next, ok := nextName(svc.Name); ok {
+				svc.Name = next
+			}
+		}
+	}
+	c.buildRecords()
+}
+
+// nextName returns name with a conflict number added to or incremented in its first label
+// as suggested by RFC 6762 §9, i.e: "device.local" becomes "device (2).local" and
+// "device (2).local" becomes "device (3).local".
+func nextName(name dns.Name) (next dns.Name, ok bool) {
+	ok = true
+	first := true
+	name.VisitLabels(func(label []byte) {
+		if first {
+			first = false
+			base, n := splitConflictNumber(label)
+			suffix := " (" + strconv.Itoa(n+1) + ")"
+			base = base[:min(len(base), 63-len(suffix))]
+			label = append(append([]byte{}, base...), suffix...)
+		}
+		ok = ok && next.CanAddLabel(string(label))
+		if ok {
+			next.AddLabel(string(label))
+		}
+	})
+	return next, ok && !first
+}
+
+// splitConflictNumber splits a label as "device (2)" into its base "device" and conflict number 2.
+// Labels without conflict number return the label and 1.
+func splitConflictNumber(label []byte) (base []byte, n int) {
+	open := bytes.LastIndex(label, []byte(" ("))
+	if open < 0 || label[len(label)-1] != ')' {
+		return label, 1
+	}
+	n, err := strconv.Atoi(string(label[open+2 : len(label)-1]))
+	if err != nil || n < 2 {
+		return label, 1
+	}
+	return label[:open], n
+}
+
+// addUniqueRecords adds the records of svc owned by a single host, the A, SRV and TXT
+// records, to dst. Records whose name and type are already in dst are skipped.
+func addUniqueRecords(dst *[]dns.Resource, svc *Service, class dns.Class, ttl uint32) {
+	if svc.Host.Len() > 0 && len(svc.Addr) > 0 && !hasRecord(*dst, svc.Host, dns.TypeA) {
+		growSlice(dst).SetA(svc.Host, class, ttl, svc.Addr)
+	}
+	if svc.Name.Len() == 0 {
+		return
+	}
+	if svc.Host.Len() > 0 && !hasRecord(*dst, svc.Name, dns.TypeSRV) {
+		growSlice(dst).SetSRV(svc.Name, class, ttl, 0, 0, svc.Port, svc.Host)
+	}
+	if !hasRecord(*dst, svc.Name, dns.TypeTXT) {
+		growSlice(dst).SetTXT(svc.Name, class, ttl, svc.TXTData)
+	}
+}
+
+func hasRecord(recs []dns.Resource, name dns.Name, typ dns.Type) bool {
+	for i := range recs {
+		hdr := recs[i].Header()
+		if hdr.Type == typ && dns.NamesEqualFold(hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOwned returns the index of the first record in recs[start:] owned by name, or len(recs) if none.
+func nextOwned(recs []dns.Resource, start int, name dns.Name) int {
+	for i := start; i < len(recs); i++ {
+		if dns.NamesEqualFold(recs[i].Header().Name, name) {
+			return i
+		}
+	}
+	return len(recs)
+}
+
+// compareRecords compares records by class, excluding the cache-flush bit, type and
+// raw data, the lexicographical order of RFC 6762 §8.2.
+func compareRecords(a, b dns.Resource) int {
+	ha, hb := a.Header(), b.Header()
+	if c := cmp.Compare(uint16(ha.Class)&^classCacheFlush, uint16(hb.Class)&^classCacheFlush); c != 0 {
+		return c
+	} else if c = cmp.Compare(ha.Type, hb.Type); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.RawData(), b.RawData())
+}
+
+// compareRecordSets compares the records owned by name in the sorted record lists a and b
+// pairwise. A list that runs out of records first is the earlier one (RFC 6762 §8.2).
+func compareRecordSets(name dns.Name, a, b []dns.Resource) int {
+	i, j := nextOwned(a, 0, name), nextOwned(b, 0, name)
+	for i < len(a) && j < len(b) {
+		if c := compareRecords(a[i], b[j]); c != 0 {
+			return c
+		}
+		i, j = nextOwned(a, i+1, name), nextOwned(b, j+1, name)
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	}
+	return 0
+}
+
+func (c *Client) prand() uint32 {
+	c.prng = internal.Prand32(c.prng)
+	return c.prng
+}
+
+// randDelay returns a duration uniformly in [0, max] derived from r.
+func randDelay(r uint32, max time.Duration) time.Duration {
+	return time.Duration(uint64(r) % uint64(max+1))
+}
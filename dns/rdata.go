@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+var errRDATAType = errors.New("resource type does not match RDATA decoder")
+
+// MXData is the RDATA of a MX (mail exchange) record. See RFC 1035 §3.3.9.
+type MXData struct {
+	Preference uint16
+	Exchange   Name
+}
+
+// SRVData is the RDATA of a SRV (service locator) record. See RFC 2782.
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   Name
+}
+
+// SOAData is the RDATA of a SOA (start of authority) record. See RFC 1035 §3.3.13.
+type SOAData struct {
+	MName   Name // Primary name server of the zone.
+	RName   Name // Mailbox of the person responsible for the zone.
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// Minimum is the TTL used to cache negative answers (RFC 2308 §4).
+	Minimum uint32
+}
+
+// Names in RDATA decoded by [Resource.Decode] are stored uncompressed so the decoders below
+// need no access to the message the resource was decoded from. Decoders reuse the buffers of dst.
+
+// DecodeCNAME decodes the canonical name of a CNAME record into dst.
+func (r *Resource) DecodeCNAME(dst *Name) error {
+	return r.decodeName(TypeCNAME, dst)
+}
+
+// DecodeNS decodes the name server of a NS record into dst.
+func (r *Resource) DecodeNS(dst *Name) error {
+	return r.decodeName(TypeNS, dst)
+}
+
+// DecodePTR decodes the target name of a PTR record into dst.
+func (r *Resource) DecodePTR(dst *Name) error {
+	return r.decodeName(TypePTR, dst)
+}
+
+// DecodeMX decodes the RDATA of a MX record into dst.
+func (r *Resource) DecodeMX(dst *MXData) error {
+	data, err := r.rdata(TypeMX, 3)
+	if err != nil {
+		return err
+	}
+	dst.Preference = binary.BigEndian.Uint16(data)
+	return decodeFullName(&dst.Exchange, data, 2)
+}
+
+// DecodeSRV decodes the RDATA of a SRV record into dst.
+func (r *Resource) DecodeSRV(dst *SRVData) error {
+	data, err := r.rdata(TypeSRV, 7)
+	if err != nil {
+		return err
+	}
+	dst.Priority = binary.BigEndian.Uint16(data)
+	dst.Weight = binary.BigEndian.Uint16(data[2:])
+	dst.Port = binary.BigEndian.Uint16(data[4:])
+	return decodeFullName(&dst.Target, data, 6)
+}
+
+// DecodeSOA decodes the RDATA of a SOA record into dst.
+func (r *Resource) DecodeSOA(dst *SOAData) error {
+	data, err := r.rdata(TypeSOA, 22)
+	if err != nil {
+		return err
+	}
+	off, err := dst.MName.Decode(data, 0)
+	if err != nil {
+		return err
+	}
+	off, err = dst.RName.Decode(data, off)
+	if err != nil {
+		return err
+	} else if int(off)+20 != len(data) {
+		return errResourceLen
+	}
+	fields := data[off:]
+	dst.Serial = binary.BigEndian.Uint32(fields)
+	dst.Refresh = binary.BigEndian.Uint32(fields[4:])
+	dst.Retry = binary.BigEndian.Uint32(fields[8:])
+	dst.Expire = binary.BigEndian.Uint32(fields[12:])
+	dst.Minimum = binary.BigEndian.Uint32(fields[16:])
+	return nil
+}
+
+// VisitTXT calls fn with each character-string of a TXT record, without the length prefix.
+// The slice passed to fn is only valid for the duration of the call.
+func (r *Resource) VisitTXT(fn func(txt []byte)) error {
+	data, err := r.rdata(TypeTXT, 1)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			return errResourceLen
+		}
+		fn(data[1 : 1+n])
+		data = data[1+n:]
+	}
+	return nil
+}
+
+// Addr returns the address of an A or AAAA record.
+func (r *Resource) Addr() (netip.Addr, error) {
+	if r.header.Type != TypeA && r.header.Type != TypeAAAA {
+		return netip.Addr{}, errRDATAType
+	}
+	addr, ok := netip.AddrFromSlice(r.RawData())
+	if !ok || (r.header.Type == TypeA) != addr.Is4() {
+		return netip.Addr{}, errResourceLen
+	}
+	return addr, nil
+}
+
+func (r *Resource) decodeName(typ Type, dst *Name) error {
+	data, err := r.rdata(typ, 1)
+	if err != nil {
+		return err
+	}
+	return decodeFullName(dst, data, 0)
+}
+
+// rdata returns the RDATA of r after checking its type and minimum length.
+func (r *Resource) rdata(typ Type, minLen int) ([]byte, error) {
+	if r.header.Type != typ {
+		return nil, errRDATAType
+	}
+	data := r.RawData()
+	if len(data) < minLen {
+		return nil, errResourceLen
+	}
+	return data, nil
+}
+
+// decodeFullName decodes the name at data[off:] into dst and checks it spans the rest of data.
+func decodeFullName(dst *Name, data []byte, off uint16) error {
+	end, err := dst.Decode(data, off)
+	if err != nil {
+		return err
+	} else if int(end) != len(data) {
+		return errResourceLen
+	}
+	return nil
+}
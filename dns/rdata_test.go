@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// compressedCNAMEResponse returns a response to "www.example.com" A with a CNAME to "cdn.example.com",
+// an A record for it and a MX record, using name compression as DNS servers do.
+func compressedCNAMEResponse() []byte {
+	msg := []byte{
+		0x12, 0x34, 0x81, 0x80, // txid, flags.
+		0, 1, 0, 3, 0, 0, 0, 0, // 1 question, 3 answers.
+		// Question at offset 12.
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+	}
+	const exampleOff = 12 + 4 // "example.com" label.
+	answer := func(ownerPtr uint16, typ Type, ttl uint32, rdata []byte) {
+		msg = binary.BigEndian.AppendUint16(msg, 0xc000|ownerPtr)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(typ))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(ClassINET))
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	cnameRdataOff := len(msg) + 12
+	answer(12, TypeCNAME, 30, []byte{3, 'c', 'd', 'n', 0xc0, exampleOff})
+	answer(uint16(cnameRdataOff), TypeA, 300, []byte{192, 0, 2, 7})
+	answer(exampleOff, TypeMX, 300, []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, exampleOff})
+	return msg
+}
+
+func TestCNAMEChainAndCompressedRDATA(t *testing.T) {
+	var msg Message
+	msg.LimitResourceDecoding(1, 4, 0, 0)
+	_, _, err := msg.Decode(compressedCNAMEResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs [2]netip.Addr
+	n, err := msg.WriteAnswers(addrs[:], "www.example.com")
+	if err != nil || n != 1 || addrs[0] != netip.AddrFrom4([4]byte{192, 0, 2, 7}) {
+		t.Fatalf("CNAME not followed: n=%d err=%v addrs=%v", n, err, addrs[:n])
+	}
+	cname, ttl := msg.CanonicalName(MustNewName("www.example.com"))
+	if !cname.EqualString("cdn.example.com") || ttl != 30 {
+		t.Errorf("canonical name %q ttl=%d", cname.String(), ttl)
+	}
+	var name Name
+	if err = msg.Answers[0].DecodeCNAME(&name); err != nil || !name.EqualString("cdn.example.com") {
+		t.Errorf("DecodeCNAME=%q err=%v", name.String(), err)
+	}
+	if err = msg.Answers[0].DecodePTR(&name); err == nil {
+		t.Error("expected type mismatch error")
+	}
+	var mx MXData
+	if err = msg.Answers[2].DecodeMX(&mx); err != nil || mx.Preference != 10 || !mx.Exchange.EqualString("mail.example.com") {
+		t.Errorf("DecodeMX=%d %q err=%v", mx.Preference, mx.Exchange.String(), err)
+	}
+	if addr, err := msg.Answers[1].Addr(); err != nil || addr != addrs[0] {
+		t.Errorf("Addr=%v err=%v", addr, err)
+	}
+	// Expanded RDATA must re-encode without reference to the original message.
+	buf, err := msg.AppendTo(nil, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg2 Message
+	msg2.LimitResourceDecoding(1, 4, 0, 0)
+	if _, _, err = msg2.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = msg2.Answers[2].DecodeMX(&mx); err != nil || !mx.Exchange.EqualString("mail.example.com") {
+		t.Errorf("re-encoded MX=%q err=%v", mx.Exchange.String(), err)
+	}
+}
+
+func TestCNAMELoop(t *testing.T) {
+	a, b := MustNewName("a.example"), MustNewName("b.example")
+	msg := Message{Answers: []Resource{
+		NewResource(a, TypeCNAME, ClassINET, 60, b.data),
+		NewResource(b, TypeCNAME, ClassINET, 60, a.data),
+		NewResource(a, TypeA, ClassINET, 60, []byte{10, 0, 0, 1}),
+	}}
+	var addrs [2]netip.Addr
+	n, err := msg.WriteAnswers(addrs[:], "a.example")
+	if n != 0 || err == nil {
+		t.Errorf("CNAME loop resolved to %v err=%v", addrs[:n], err)
+	}
+	if cname, _ := msg.CanonicalName(a); len(cname.data) != 0 {
+		t.Errorf("CNAME loop canonical name %q", cname.String())
+	}
+}
+
+func TestRDATADecoders(t *testing.T) {
+	name := MustNewName("_http._tcp.example")
+	target := MustNewName("host.example")
+	var r Resource
+	r.SetSRV(name, ClassINET, 60, 1, 2, 8080, target)
+	var srv SRVData
+	if err := r.DecodeSRV(&srv); err != nil || srv.Priority != 1 || srv.Weight != 2 || srv.Port != 8080 || !NamesEqual(srv.Target, target) {
+		t.Errorf("DecodeSRV=%+v err=%v", srv, err)
+	}
+	r.SetSOA(name, ClassINET, 60, MustNewName("ns.example"), MustNewName("admin.example"), 7, 3600, 600, 86400, 30)
+	var soa SOAData
+	if err := r.DecodeSOA(&soa); err != nil || soa.Serial != 7 || soa.Expire != 86400 || soa.Minimum != 30 || !soa.RName.EqualString("admin.example") {
+		t.Errorf("DecodeSOA=%+v err=%v", soa, err)
+	}
+	r.SetTXT(name, ClassINET, 60, []byte("\x05hello\x00\x03abc"))
+	var txts []string
+	if err := r.VisitTXT(func(txt []byte) { txts = append(txts, string(txt)) }); err != nil || len(txts) != 3 || txts[0] != "hello" || txts[1] != "" || txts[2] != "abc" {
+		t.Errorf("VisitTXT=%q err=%v", txts, err)
+	}
+	r.SetTXT(name, ClassINET, 60, []byte("\x09short"))
+	if err := r.VisitTXT(func([]byte) {}); err == nil {
+		t.Error("expected error on malformed TXT")
+	}
+	r.SetPTR(name, ClassINET, 60, target)
+	var ptr Name
+	if err := r.DecodePTR(&ptr); err != nil || !NamesEqual(ptr, target) {
+		t.Errorf("DecodePTR=%q err=%v", ptr.String(), err)
+	}
+}
@@ -0,0 +1,405 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/udp"
+)
+
+const (
+	// DefaultServerUDPSize is the default maximum UDP payload a [Server] sends to EDNS0 clients.
+	// It is the value recommended by DNS Flag Day 2020 to avoid IP fragmentation.
+	DefaultServerUDPSize = 1232
+	// maxCNAMEChase limits how many CNAME records are followed inside the zone when answering.
+	maxCNAMEChase = 8
+	// sizeOPT is the length of an OPT pseudo-record with no options.
+	sizeOPT = 11
+	// rcodeBadVersion is the extended RCODE BADVERS (RFC 6891 §6.1.3).
+	rcodeBadVersion = 16
+)
+
+// ServerConfig configures a [Server]. Used in [Server.Reset].
+type ServerConfig struct {
+	// Records is the zone served. Records are matched on name (case-insensitive), type and class.
+	// The slice is referenced, not copied, and must not be modified while the Server is in use.
+	// Records of type CNAME are followed inside the zone when the queried type is not found.
+	Records []Resource
+	// SOA, if set (see [Resource.SetSOA]), is added to the authority section of
+	// NXDOMAIN and NODATA responses so resolvers can cache the negative answer (RFC 2308).
+	SOA Resource
+	// WildcardAddr, if set, is a 4 byte IPv4 address returned in answer to A queries
+	// for any name not in Records. Used in captive portals to resolve every name to the device itself.
+	// AAAA queries for such names get a NODATA response.
+	WildcardAddr []byte
+	// WildcardTTL is the TTL of wildcard answers. Defaults to 60 seconds.
+	WildcardTTL uint32
+	// MaxPending is the maximum number of queries received and not yet answered. Defaults to 4.
+	MaxPending int
+	// MaxUDPSize is the largest response sent to clients that advertise a larger EDNS0 UDP payload size.
+	// Responses to clients without EDNS0 are limited to [MaxSizeUDP]. Defaults to [DefaultServerUDPSize].
+	MaxUDPSize uint16
+	// Port is the local port. Defaults to [ServerPort].
+	Port uint16
+}
+
+// Server is an authoritative DNS server over UDP implementing [lneto.StackNode].
+// It answers queries from a fixed zone of records without allocating. Queries are
+// received via [Server.Demux] and answered in order of arrival via [Server.Encapsulate].
+//
+// Since Server answers many clients it handles the UDP header itself and is registered directly
+// on the UDP port stack (i.e. internet.StackPorts) instead of being wrapped in a single remote UDP port.
+// Responses that do not fit the client's UDP payload size have the TC bit set and no records.
+//
+// Server is not safe for concurrent use.
+type Server struct {
+	connID   uint64
+	lport    uint16
+	maxUDP   uint16
+	zone     []Resource
+	soa      Resource
+	wildAddr []byte
+	wildTTL  uint32
+	// wild is scratch space for the wildcard answer to the query being answered.
+	wild Resource
+	// pending is a ring buffer of received queries.
+	pending []serverQuery
+	head    int
+	npend   int
+}
+
+type serverQuery struct {
+	q     Question
+	raddr [16]byte
+	// raddrLen is 4 or 16 for IPv4 and IPv6 clients and 0 if the query was received without IP header.
+	raddrLen uint8
+	rport    uint16
+	txid     uint16
+	flags    HeaderFlags
+	// rcode is set on malformed or unsupported queries, which are answered without a question.
+	rcode RCode
+	// udpSize is the EDNS0 UDP payload size of the query or 0 if it had no OPT record.
+	udpSize     uint16
+	ednsVersion uint8
+}
+
+// Reset re-initialises the server with cfg and discards pending queries. Increments connID.
+func (s *Server) Reset(cfg ServerConfig) error {
+	if cfg.MaxPending < 0 || (len(cfg.WildcardAddr) != 0 && len(cfg.WildcardAddr) != 4) {
+		return lneto.ErrInvalidConfig
+	} else if cfg.MaxUDPSize != 0 && cfg.MaxUDPSize < MaxSizeUDP {
+		return lneto.ErrInvalidConfig
+	}
+	if cfg.MaxPending == 0 {
+		cfg.MaxPending = 4
+	}
+	if cfg.MaxUDPSize == 0 {
+		cfg.MaxUDPSize = DefaultServerUDPSize
+	}
+	if cfg.WildcardTTL == 0 {
+		cfg.WildcardTTL = 60
+	}
+	if cfg.Port == 0 {
+		cfg.Port = ServerPort
+	}
+	pending := s.pending
+	internal.SliceReuse(&pending, cfg.MaxPending)
+	pending = pending[:cfg.MaxPending]
+	for i := range pending {
+		if cap(pending[i].q.Name.data) < 255 {
+			// Preallocate maximum length names so decoding queries does not allocate.
+			pending[i].q.Name.data = make([]byte, 0, 255)
+		}
+	}
+	*s = Server{
+		connID:   s.connID + 1,
+		lport:    cfg.Port,
+		maxUDP:   cfg.MaxUDPSize,
+		zone:     cfg.Records,
+		soa:      cfg.SOA,
+		wildAddr: cfg.WildcardAddr,
+		wildTTL:  cfg.WildcardTTL,
+		wild:     s.wild,
+		pending:  pending,
+	}
+	return nil
+}
+
+// ConnectionID implements [lneto.StackNode].
+func (s *Server) ConnectionID() *uint64 { return &s.connID }
+
+// Protocol implements [lneto.StackNode].
+func (s *Server) Protocol() uint64 { return uint64(lneto.IPProtoUDP) }
+
+// LocalPort implements [lneto.StackNode].
+func (s *Server) LocalPort() uint16 { return s.lport }
+
+// Pending returns the number of queries received and not yet answered.
+func (s *Server) Pending() int { return s.npend }
+
+// Demux implements [lneto.StackNode]. carrierData[frameOffset:] is the UDP datagram carrying the query.
+// The client address is read from the IP header preceding it, if present. Returns [lneto.ErrExhausted]
+// if [ServerConfig.MaxPending] queries are pending.
+func (s *Server) Demux(carrierData []byte, frameOffset int) error {
+	if s.pending == nil {
+		return net.ErrClosed
+	}
+	ufrm, err := udp.NewFrame(carrierData[frameOffset:])
+	if err != nil {
+		return err
+	} else if ufrm.DestinationPort() != s.lport {
+		return lneto.ErrPacketDrop
+	} else if ul := ufrm.Length(); ul < 8 || int(ul) > len(ufrm.RawData()) {
+		return lneto.ErrInvalidLengthField
+	}
+	msg := ufrm.Payload()
+	frm, err := NewFrame(msg)
+	if err != nil {
+		return err
+	}
+	flags := frm.Flags()
+	if flags.IsResponse() {
+		return lneto.ErrPacketDrop // Never answer responses, avoids loops.
+	} else if s.npend == len(s.pending) {
+		return lneto.ErrExhausted
+	}
+	sq := &s.pending[(s.head+s.npend)%len(s.pending)]
+	*sq = serverQuery{
+		q:     Question{Name: Name{data: sq.q.Name.data[:0]}},
+		rport: ufrm.SourcePort(),
+		txid:  frm.TxID(),
+		flags: flags,
+	}
+	if frameOffset >= 20 {
+		src, _, _, _, err := internal.GetIPAddr(carrierData)
+		if err != nil {
+			return err
+		}
+		sq.raddrLen = uint8(copy(sq.raddr[:], src))
+	}
+	s.npend++
+	if flags.OpCode() != OpCodeQuery {
+		sq.rcode = RCodeNotImplemented
+		return nil
+	} else if frm.QDCount() != 1 {
+		sq.rcode = RCodeFormatError
+		return nil
+	}
+	off, err := sq.q.Decode(msg, SizeHeader)
+	if err != nil {
+		sq.rcode = RCodeFormatError
+		return nil
+	}
+	// Skip answer and authority sections, which queries should not have, and look for OPT.
+	for range int(frm.ANCount()) + int(frm.NSCount()) {
+		if off, err = skipResourceBounded(msg, off); err != nil {
+			sq.rcode = RCodeFormatError
+			return nil
+		}
+	}
+	for range frm.ARCount() {
+		start := off
+		if off, err = skipResourceBounded(msg, off); err != nil {
+			sq.rcode = RCodeFormatError
+			return nil
+		}
+		hdr := start + 1 // OPT is owned by the root name.
+		if msg[start] != 0 || Type(binary.BigEndian.Uint16(msg[hdr:])) != TypeOPT {
+			continue
+		} else if sq.udpSize != 0 {
+			sq.rcode = RCodeFormatError // RFC 6891 §6.1.1: more than one OPT record.
+			return nil
+		}
+		sq.udpSize = max(binary.BigEndian.Uint16(msg[hdr+2:]), MaxSizeUDP)
+		sq.ednsVersion = msg[hdr+5]
+	}
+	return nil
+}
+
+// Encapsulate implements [lneto.StackNode]. It writes the UDP datagram answering the oldest
+// pending query to carrierData[offsetToFrame:] and sets the destination IP address.
+func (s *Server) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if s.pending == nil {
+		return 0, net.ErrClosed
+	} else if s.npend == 0 {
+		return 0, nil
+	}
+	ufrm, err := udp.NewFrame(carrierData[offsetToFrame:])
+	if err != nil {
+		return 0, err
+	}
+	sq := &s.pending[s.head]
+	limit := MaxSizeUDP
+	if sq.udpSize != 0 {
+		limit = int(min(sq.udpSize, s.maxUDP))
+	}
+	buf := carrierData[offsetToFrame+8:]
+	if len(buf) < limit {
+		if len(buf) < MaxSizeUDP {
+			return 0, lneto.ErrShortBuffer
+		}
+		limit = len(buf)
+	}
+	n, err := s.appendResponse(buf[:0:limit], sq)
+	if err != nil {
+		return 0, err
+	}
+	s.head = (s.head + 1) % len(s.pending)
+	s.npend--
+	ufrm.SetSourcePort(s.lport)
+	ufrm.SetDestinationPort(sq.rport)
+	ufrm.SetLength(uint16(8 + n))
+	if offsetToIP >= 0 && sq.raddrLen > 0 {
+		err = internal.SetIPAddrs(carrierData[offsetToIP:], 0, nil, sq.raddr[:sq.raddrLen])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 8 + n, nil
+}
+
+// appendResponse writes the response to sq into buf, whose capacity is the maximum response size.
+func (s *Server) appendResponse(buf []byte, sq *serverQuery) (int, error) {
+	limit := cap(buf)
+	rcode := sq.rcode
+	var optRcode uint8
+	if sq.udpSize != 0 && sq.ednsVersion != 0 && rcode == RCodeSuccess {
+		optRcode = rcodeBadVersion >> 4 // RFC 6891 §6.1.3: answer unsupported versions with BADVERS only.
+		rcode = rcodeBadVersion & 0xf
+	}
+	size := SizeHeader
+	var nans uint16
+	var nauth uint16
+	var found bool
+	hasQuestion := sq.rcode == RCodeSuccess
+	if hasQuestion {
+		size += int(sq.q.Len())
+	}
+	if hasQuestion && optRcode == 0 {
+		var ansSize int
+		_, nans, ansSize, found = s.appendAnswers(nil, &sq.q, false)
+		size += ansSize
+		if !found {
+			rcode = RCodeNameError
+		}
+		if nans == 0 && s.soa.header.Type == TypeSOA {
+			nauth = 1
+			size += int(s.soa.Len())
+		}
+	}
+	if sq.udpSize != 0 {
+		size += sizeOPT
+	}
+	flags := HeaderFlags(1<<15|1<<10) | sq.flags&(0b1111<<11|1<<8) | HeaderFlags(rcode)
+	if size > limit {
+		// RFC 2181 §9: Drop all records and let client retry over TCP.
+		flags |= 1 << 9
+		nans, nauth = 0, 0
+	}
+	buf = buf[:SizeHeader]
+	frm, _ := NewFrame(buf)
+	frm.SetTxID(sq.txid)
+	frm.SetFlags(flags)
+	frm.SetQDCount(uint16(b2u8(hasQuestion)))
+	frm.SetANCount(nans)
+	frm.SetNSCount(nauth)
+	frm.SetARCount(uint16(b2u8(sq.udpSize != 0)))
+	var err error
+	if hasQuestion {
+		buf, err = sq.q.appendTo(buf)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if nans > 0 {
+		buf, _, _, _ = s.appendAnswers(buf, &sq.q, true)
+	}
+	if nauth > 0 {
+		buf, err = s.soa.appendTo(buf)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if sq.udpSize != 0 {
+		// OPT pseudo-record: root name, type, advertised UDP size, extended rcode and version 0, no options.
+		buf = append(buf, 0)
+		buf = append16(buf, uint16(TypeOPT))
+		buf = append16(buf, s.maxUDP)
+		buf = append32(buf, uint32(optRcode)<<24)
+		buf = append16(buf, 0)
+	}
+	if len(buf) > limit {
+		return 0, lneto.ErrBug
+	}
+	return len(buf), nil
+}
+
+// appendAnswers appends the zone records answering q to buf if write is set, following CNAMEs in the zone.
+// It returns the number and size of records answering q and whether the name exists in the zone.
+func (s *Server) appendAnswers(buf []byte, q *Question, write bool) (_ []byte, nans uint16, size int, found bool) {
+	name := q.Name
+	for range maxCNAMEChase {
+		var cname *Resource
+		var n uint16
+		for i := range s.zone {
+			r := &s.zone[i]
+			if !classMatches(r.header.Class, q.Class) || !NamesEqualFold(r.header.Name, name) {
+				continue
+			}
+			found = true
+			if q.Type == TypeALL || r.header.Type == q.Type {
+				n++
+				size += int(r.Len())
+				if write {
+					buf, _ = r.appendTo(buf)
+				}
+			} else if r.header.Type == TypeCNAME {
+				cname = r
+			}
+		}
+		nans += n
+		if n > 0 || cname == nil {
+			break
+		}
+		nans++
+		size += int(cname.Len())
+		if write {
+			buf, _ = cname.appendTo(buf)
+		}
+		name = Name{data: cname.RawData()}
+	}
+	if found || len(s.wildAddr) == 0 || !classMatches(ClassINET, q.Class) {
+		return buf, nans, size, found
+	}
+	// Wildcard: the name exists and has only an A record.
+	if q.Type == TypeA || q.Type == TypeALL {
+		s.wild.SetA(q.Name, ClassINET, s.wildTTL, s.wildAddr)
+		nans++
+		size += int(s.wild.Len())
+		if write {
+			buf, _ = s.wild.appendTo(buf)
+		}
+	}
+	return buf, nans, size, true
+}
+
+func classMatches(recordClass, queryClass Class) bool {
+	return queryClass == ClassANY || recordClass == queryClass
+}
+
+// skipResourceBounded skips the resource at off checking that its header is within msg.
+func skipResourceBounded(msg []byte, off uint16) (uint16, error) {
+	off, err := skipName(msg, off)
+	if err != nil {
+		return off, err
+	} else if int(off)+10 > len(msg) {
+		return off, lneto.ErrTruncatedFrame
+	}
+	end := int(off) + 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	if end > len(msg) {
+		return off, lneto.ErrTruncatedFrame
+	}
+	return uint16(end), nil
+}
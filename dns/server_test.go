@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+)
+
+const testClientPort = 40000
+
+func newTestServer(t *testing.T, cfg ServerConfig) *Server {
+	t.Helper()
+	var sv Server
+	if err := sv.Reset(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &sv
+}
+
+// serverQueryDatagram writes a query as a UDP datagram with no IP header.
+func serverQueryDatagram(t *testing.T, txid uint16, q Question, additional ...Resource) []byte {
+	t.Helper()
+	msg := Message{Questions: []Question{q}, Additionals: additional}
+	buf := make([]byte, 8, 8+msg.Len())
+	buf, err := msg.AppendTo(buf, txid, NewClientHeaderFlags(OpCodeQuery, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufrm, _ := udp.NewFrame(buf)
+	ufrm.SetSourcePort(testClientPort)
+	ufrm.SetDestinationPort(ServerPort)
+	ufrm.SetLength(uint16(len(buf)))
+	return buf
+}
+
+// exchange sends the query to the server and decodes the response.
+func exchange(t *testing.T, sv *Server, query []byte) (Frame, Message) {
+	t.Helper()
+	if err := sv.Demux(query, 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := sv.Encapsulate(buf, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("no response")
+	}
+	ufrm, _ := udp.NewFrame(buf[:n])
+	if ufrm.DestinationPort() != testClientPort || ufrm.SourcePort() != ServerPort || int(ufrm.Length()) != n {
+		t.Fatalf("bad UDP header %d->%d len=%d", ufrm.SourcePort(), ufrm.DestinationPort(), ufrm.Length())
+	}
+	payload := ufrm.Payload()
+	frm, _ := NewFrame(payload)
+	var msg Message
+	msg.LimitResourceDecoding(1, 8, 1, 1)
+	if _, _, err = msg.Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+	return frm, msg
+}
+
+func testZone() (records []Resource, soa Resource) {
+	records = []Resource{
+		NewResource(MustNewName("device.lan"), TypeA, ClassINET, 300, []byte{192, 168, 4, 1}),
+		NewResource(MustNewName("www.device.lan"), TypeCNAME, ClassINET, 300, MustNewName("device.lan").data),
+	}
+	records = append(records, Resource{})
+	records[2].SetTXT(MustNewName("device.lan"), ClassINET, 300, []byte("\x0bhello world"))
+	soa.SetSOA(MustNewName("lan"), ClassINET, 60, MustNewName("device.lan"), MustNewName("admin.device.lan"), 1, 3600, 600, 86400, 30)
+	return records, soa
+}
+
+func TestServerAnswers(t *testing.T) {
+	records, soa := testZone()
+	sv := newTestServer(t, ServerConfig{Records: records, SOA: soa})
+	frm, msg := exchange(t, sv, serverQueryDatagram(t, 1, Question{Name: MustNewName("DEVICE.lan"), Type: TypeA, Class: ClassINET}))
+	flags := frm.Flags()
+	if frm.TxID() != 1 || !flags.IsResponse() || !flags.IsAuthorativeAnswer() || !flags.IsRecursionDesired() || flags.ResponseCode() != RCodeSuccess {
+		t.Fatalf("bad header txid=%d flags=%s", frm.TxID(), flags)
+	}
+	if len(msg.Questions) != 1 || len(msg.Answers) != 1 || len(msg.Authorities) != 0 {
+		t.Fatalf("bad response %s", msg.String())
+	} else if !bytes.Equal(msg.Answers[0].RawData(), []byte{192, 168, 4, 1}) {
+		t.Fatalf("bad address %v", msg.Answers[0].RawData())
+	}
+
+	// CNAME is followed inside the zone.
+	_, msg = exchange(t, sv, serverQueryDatagram(t, 2, Question{Name: MustNewName("www.device.lan"), Type: TypeA, Class: ClassINET}))
+	if len(msg.Answers) != 2 || msg.Answers[0].header.Type != TypeCNAME || msg.Answers[1].header.Type != TypeA {
+		t.Fatalf("CNAME not followed: %s", msg.String())
+	}
+
+	// TypeALL matches every record of the name.
+	_, msg = exchange(t, sv, serverQueryDatagram(t, 3, Question{Name: MustNewName("device.lan"), Type: TypeALL, Class: ClassANY}))
+	if len(msg.Answers) != 2 {
+		t.Fatalf("want 2 answers to ALL query: %s", msg.String())
+	}
+}
+
+func TestServerNegative(t *testing.T) {
+	records, soa := testZone()
+	sv := newTestServer(t, ServerConfig{Records: records, SOA: soa})
+	// NXDOMAIN.
+	frm, msg := exchange(t, sv, serverQueryDatagram(t, 1, Question{Name: MustNewName("other.lan"), Type: TypeA, Class: ClassINET}))
+	if rcode := frm.Flags().ResponseCode(); rcode != RCodeNameError {
+		t.Fatalf("want NXDOMAIN, got %s", rcode)
+	} else if len(msg.Answers) != 0 || len(msg.Authorities) != 1 || msg.Authorities[0].header.Type != TypeSOA {
+		t.Fatalf("want SOA in authority section: %s", msg.String())
+	}
+	// NODATA.
+	frm, msg = exchange(t, sv, serverQueryDatagram(t, 2, Question{Name: MustNewName("device.lan"), Type: TypeAAAA, Class: ClassINET}))
+	if rcode := frm.Flags().ResponseCode(); rcode != RCodeSuccess {
+		t.Fatalf("want NODATA, got %s", rcode)
+	} else if len(msg.Answers) != 0 || len(msg.Authorities) != 1 {
+		t.Fatalf("want SOA in authority section: %s", msg.String())
+	}
+}
+
+func TestServerWildcard(t *testing.T) {
+	records, _ := testZone()
+	portal := []byte{192, 168, 4, 1}
+	sv := newTestServer(t, ServerConfig{Records: records, WildcardAddr: portal, WildcardTTL: 5})
+	frm, msg := exchange(t, sv, serverQueryDatagram(t, 1, Question{Name: MustNewName("connectivitycheck.example.com"), Type: TypeA, Class: ClassINET}))
+	if frm.Flags().ResponseCode() != RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("want wildcard answer: %s", msg.String())
+	}
+	hdr := msg.Answers[0].Header()
+	if !hdr.Name.EqualString("connectivitycheck.example.com") || hdr.TTL != 5 || !bytes.Equal(msg.Answers[0].RawData(), portal) {
+		t.Fatalf("bad wildcard answer %s", hdr.String())
+	}
+	frm, msg = exchange(t, sv, serverQueryDatagram(t, 2, Question{Name: MustNewName("example.com"), Type: TypeAAAA, Class: ClassINET}))
+	if frm.Flags().ResponseCode() != RCodeSuccess || len(msg.Answers) != 0 {
+		t.Fatalf("want NODATA for wildcard AAAA: %s", msg.String())
+	}
+
+	query := serverQueryDatagram(t, 3, Question{Name: MustNewName("a.very.long.name.example.com"), Type: TypeA, Class: ClassINET})
+	buf := make([]byte, 1500)
+	allocs := testing.AllocsPerRun(10, func() {
+		sv.Demux(query, 0)
+		sv.Encapsulate(buf, -1, 0)
+	})
+	if allocs > 0 {
+		t.Errorf("got %v allocations per query", allocs)
+	}
+}
+
+func TestServerEDNS0Truncation(t *testing.T) {
+	big := bytes.Repeat([]byte{'x'}, 255)
+	txt := make([]byte, 0, 3*256)
+	for range 3 {
+		txt = append(txt, byte(len(big)))
+		txt = append(txt, big...)
+	}
+	var rec Resource
+	rec.SetTXT(MustNewName("big.lan"), ClassINET, 60, txt)
+	sv := newTestServer(t, ServerConfig{Records: []Resource{rec}})
+	q := Question{Name: MustNewName("big.lan"), Type: TypeTXT, Class: ClassINET}
+
+	// Without EDNS0 the answer does not fit 512 bytes.
+	frm, msg := exchange(t, sv, serverQueryDatagram(t, 1, q))
+	if !frm.Flags().IsTruncated() || len(msg.Answers) != 0 || len(msg.Questions) != 1 {
+		t.Fatalf("want truncated response: flags=%s %s", frm.Flags(), msg.String())
+	}
+
+	// EDNS0 client advertising 4096 bytes is limited to the server's maximum which fits the answer.
+	var opt Resource
+	opt.SetEDNS0(4096, 0, 0, nil)
+	frm, msg = exchange(t, sv, serverQueryDatagram(t, 2, q, opt))
+	if frm.Flags().IsTruncated() || len(msg.Answers) != 1 || len(msg.Additionals) != 1 {
+		t.Fatalf("want complete response: flags=%s %s", frm.Flags(), msg.String())
+	}
+	if hdr := msg.Additionals[0].Header(); hdr.Type != TypeOPT || uint16(hdr.Class) != DefaultServerUDPSize {
+		t.Fatalf("bad OPT record %s", hdr.String())
+	}
+
+	// EDNS0 client advertising less than the answer gets a truncated response with OPT.
+	opt.SetEDNS0(600, 0, 0, nil)
+	frm, msg = exchange(t, sv, serverQueryDatagram(t, 3, q, opt))
+	if !frm.Flags().IsTruncated() || len(msg.Answers) != 0 || len(msg.Additionals) != 1 {
+		t.Fatalf("want truncated response with OPT: flags=%s %s", frm.Flags(), msg.String())
+	}
+
+	// Unsupported EDNS version gets BADVERS.
+	opt.SetEDNS0(4096, 0, 0, nil)
+	opt.header.TTL |= 1 << 16
+	_, msg = exchange(t, sv, serverQueryDatagram(t, 4, q, opt))
+	if len(msg.Answers) != 0 || len(msg.Additionals) != 1 || msg.Additionals[0].header.TTL>>24 != 1 {
+		t.Fatalf("want BADVERS: %s", msg.String())
+	}
+}
+
+func TestServerPendingQueries(t *testing.T) {
+	records, _ := testZone()
+	sv := newTestServer(t, ServerConfig{Records: records, MaxPending: 2})
+	q := Question{Name: MustNewName("device.lan"), Type: TypeA, Class: ClassINET}
+
+	// Two clients with IPv4 headers.
+	clients := [][4]byte{{192, 168, 4, 10}, {192, 168, 4, 11}}
+	for i, addr := range clients {
+		query := serverQueryDatagram(t, uint16(i+1), q)
+		carrier := make([]byte, 20+len(query))
+		ifrm, _ := ipv4.NewFrame(carrier)
+		ifrm.SetVersionAndIHL(4, 5)
+		ifrm.SetTotalLength(uint16(len(carrier)))
+		*ifrm.SourceAddr() = addr
+		copy(carrier[20:], query)
+		if err := sv.Demux(carrier, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sv.Demux(serverQueryDatagram(t, 3, q), 0); err != lneto.ErrExhausted {
+		t.Fatalf("want ErrExhausted, got %v", err)
+	}
+	for i, addr := range clients {
+		carrier := make([]byte, 1500)
+		ifrm, _ := ipv4.NewFrame(carrier)
+		ifrm.SetVersionAndIHL(4, 5)
+		n, err := sv.Encapsulate(carrier, 0, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frm, _ := NewFrame(carrier[28 : 20+n])
+		if frm.TxID() != uint16(i+1) || *ifrm.DestinationAddr() != addr {
+			t.Fatalf("response %d: txid=%d dst=%v", i, frm.TxID(), *ifrm.DestinationAddr())
+		}
+	}
+	if n, err := sv.Encapsulate(make([]byte, 1500), -1, 0); n != 0 || err != nil || sv.Pending() != 0 {
+		t.Fatalf("want no pending responses, got n=%d err=%v", n, err)
+	}
+}
+
+func TestServerMalformed(t *testing.T) {
+	sv := newTestServer(t, ServerConfig{})
+	query := serverQueryDatagram(t, 7, Question{Name: MustNewName("device.lan"), Type: TypeA, Class: ClassINET})
+	frm, _ := NewFrame(query[8:])
+	frm.SetQDCount(2)
+	frm, msg := exchange(t, sv, query)
+	if frm.TxID() != 7 || frm.Flags().ResponseCode() != RCodeFormatError || len(msg.Questions) != 0 {
+		t.Fatalf("want FORMERR: flags=%s %s", frm.Flags(), msg.String())
+	}
+	// Responses are never answered.
+	frm, _ = NewFrame(query[8:])
+	frm.SetFlags(1 << 15)
+	if err := sv.Demux(query, 0); err != lneto.ErrPacketDrop {
+		t.Fatalf("want ErrPacketDrop, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/netip"
+
+	"github.com/soypat/lneto"
+)
+
+var errTCPResponseTooLong = errors.New("DNS TCP response exceeds client buffer")
+
+// StreamConn is the byte stream a [TCPClient] exchanges messages over, such as a tcp.Conn.
+// Implementations must not block on Write when len(b) <= FreeOutput() nor on Read when BufferedInput() > 0.
+type StreamConn interface {
+	io.ReadWriter
+	BufferedInput() int
+	FreeOutput() int
+}
+
+// TCPClientConfig configures a [TCPClient]. Used in [TCPClient.Configure].
+type TCPClientConfig struct {
+	// Buffer holds the outgoing query and the incoming response, each preceded by its
+	// 2-byte length. Responses that do not fit fail with an error. Must be at least 512 bytes long.
+	Buffer []byte
+}
+
+// TCPClient performs a DNS query over a stream connection using the 2-byte length
+// framing of RFC 7766 §8. It is typically used to retry a query whose response over UDP
+// came back truncated. Unlike [Client] it is not a StackNode: the caller establishes the
+// connection and calls [TCPClient.Poll] to exchange the query and response without blocking.
+type TCPClient struct {
+	msg             Message
+	buf             []byte
+	nbuf            int // bytes of response accumulated in buf.
+	txid            uint16
+	respFlags       HeaderFlags
+	state           StateClientQuery
+	enableRecursion bool
+}
+
+// Configure sets the client buffer and aborts any query in progress.
+func (c *TCPClient) Configure(cfg TCPClientConfig) error {
+	if len(cfg.Buffer) < 512 {
+		return lneto.ErrShortBuffer
+	}
+	c.reset(0, CQueryIdle, false)
+	c.buf = cfg.Buffer
+	return nil
+}
+
+// StartResolve prepares the query to be written over the connection on the next call to [TCPClient.Poll].
+func (c *TCPClient) StartResolve(txid uint16, cfg ResolveConfig) error {
+	nd := len(cfg.Questions)
+	if nd > math.MaxUint16 {
+		return lneto.ErrInvalidConfig
+	} else if len(c.buf) == 0 {
+		return lneto.ErrInvalidConfig // Not configured.
+	}
+	maxAns := cfg.MaxResponseAnswers
+	if maxAns == 0 {
+		maxAns = uint16(nd)
+	}
+	c.reset(txid, CQueryPending, cfg.EnableRecursion)
+	c.msg.LimitResourceDecoding(uint16(nd), maxAns, cfg.MaxResponseAuthorities, cfg.MaxResponseAdditionals)
+	c.msg.AddQuestions(cfg.Questions)
+	c.msg.AddAdditionals(cfg.Additional)
+	if int(c.msg.Len())+2 > len(c.buf) {
+		c.state = CQueryAborted
+		return lneto.ErrShortBuffer
+	}
+	return nil
+}
+
+// Poll writes the pending query to conn once there is room for it and reads the response as it arrives.
+// conn must be established. done is true once the response is decoded or the query failed with err.
+// Messages with a transaction ID other than the query's are discarded.
+func (c *TCPClient) Poll(conn StreamConn) (done bool, err error) {
+	switch c.state {
+	case CQueryPending:
+		data, err := c.msg.AppendTo(c.buf[2:2], c.txid, NewClientHeaderFlags(OpCodeQuery, c.enableRecursion))
+		if err != nil {
+			c.state = CQueryAborted
+			return true, err
+		}
+		binary.BigEndian.PutUint16(c.buf, uint16(len(data)))
+		query := c.buf[:2+len(data)]
+		if conn.FreeOutput() < len(query) {
+			return false, nil // Wait for room in connection buffer.
+		}
+		_, err = conn.Write(query)
+		if err != nil {
+			c.state = CQueryAborted
+			return true, err
+		}
+		c.state = CQueryOutstanding
+		c.nbuf = 0
+		fallthrough
+	case CQueryOutstanding:
+		return c.readResponse(conn)
+	case CQueryDone:
+		return true, nil
+	}
+	return true, errNoResponse
+}
+
+func (c *TCPClient) readResponse(conn StreamConn) (done bool, err error) {
+	for {
+		need := 2
+		if c.nbuf >= 2 {
+			need += int(binary.BigEndian.Uint16(c.buf))
+			if need > len(c.buf) {
+				c.state = CQueryAborted
+				return true, errTCPResponseTooLong
+			}
+		}
+		if c.nbuf < need {
+			if conn.BufferedInput() == 0 {
+				return false, nil
+			}
+			n, err := conn.Read(c.buf[c.nbuf:need])
+			c.nbuf += n
+			if err != nil {
+				c.state = CQueryAborted
+				return true, err
+			}
+			continue
+		}
+		c.nbuf = 0
+		frame := c.buf[2:need]
+		f, err := NewFrame(frame)
+		if err != nil {
+			c.state = CQueryAborted
+			return true, err
+		}
+		flags := f.Flags()
+		if f.TxID() != c.txid || !flags.IsResponse() {
+			continue // Not the response to our query.
+		}
+		_, incompleteButOK, err := c.msg.Decode(frame)
+		if err != nil && !incompleteButOK {
+			c.state = CQueryAborted
+			return true, err
+		}
+		c.respFlags = flags
+		c.state = CQueryDone
+		return true, nil
+	}
+}
+
+// State returns the state of the query.
+func (c *TCPClient) State() StateClientQuery { return c.state }
+
+// ResponseCopyTo copies the response message to dst. See [Client.ResponseCopyTo].
+func (c *TCPClient) ResponseCopyTo(dst *Message) (done bool, err error) {
+	if !c.respFlags.IsResponse() {
+		return false, nil
+	}
+	dst.CopyFrom(c.msg)
+	rcode := c.respFlags.ResponseCode()
+	if rcode != 0 {
+		return true, rcode
+	}
+	return true, nil
+}
+
+// ResponseAnswerLookup writes the addresses in the answers for host to dst. See [Client.ResponseAnswerLookup].
+func (c *TCPClient) ResponseAnswerLookup(dst []netip.Addr, host string) (uint16, error) {
+	if !c.respFlags.IsResponse() {
+		return 0, nil
+	}
+	rcode := c.respFlags.ResponseCode()
+	if rcode != 0 {
+		return 0, rcode
+	}
+	return c.msg.WriteAnswers(dst, host)
+}
+
+func (c *TCPClient) ResponseFlags() (HeaderFlags, bool) {
+	return c.respFlags, c.respFlags.IsResponse()
+}
+
+// Abort abandons the query in progress.
+func (c *TCPClient) Abort() {
+	c.reset(0, CQueryAborted, false)
+}
+
+func (c *TCPClient) reset(txid uint16, state StateClientQuery, enableRecursion bool) {
+	*c = TCPClient{
+		msg:             c.msg,
+		buf:             c.buf,
+		txid:            txid,
+		state:           state,
+		enableRecursion: enableRecursion,
+	}
+	c.msg.Reset()
+}
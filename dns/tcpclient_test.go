@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// testStream is a StreamConn whose input is fed by the test.
+type testStream struct {
+	in, out bytes.Buffer
+	maxRead int // Limits bytes returned per Read to exercise reassembly.
+}
+
+func (ts *testStream) Read(b []byte) (int, error) {
+	if ts.maxRead > 0 && len(b) > ts.maxRead {
+		b = b[:ts.maxRead]
+	}
+	return ts.in.Read(b)
+}
+func (ts *testStream) Write(b []byte) (int, error) { return ts.out.Write(b) }
+func (ts *testStream) BufferedInput() int          { return ts.in.Len() }
+func (ts *testStream) FreeOutput() int             { return 1024 }
+
+func appendTCPMessage(t *testing.T, dst []byte, msg *Message, txid uint16, flags HeaderFlags) []byte {
+	t.Helper()
+	data, err := msg.AppendTo(nil, txid, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+func TestTCPClient(t *testing.T) {
+	const txid = 0x1234
+	name := MustNewName("example.com")
+	var c TCPClient
+	err := c.Configure(TCPClientConfig{Buffer: make([]byte, 1024)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := Question{Name: name, Type: TypeA, Class: ClassINET}
+	err = c.StartResolve(txid, ResolveConfig{Questions: []Question{q}, EnableRecursion: true, MaxResponseAnswers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &testStream{maxRead: 3}
+	done, err := c.Poll(stream)
+	if done || err != nil {
+		t.Fatalf("unexpected done=%v err=%v before response", done, err)
+	}
+	// Check query framing.
+	out := stream.out.Bytes()
+	if len(out) < 2 || int(binary.BigEndian.Uint16(out)) != len(out)-2 {
+		t.Fatalf("bad query length prefix in %x", out)
+	}
+	var query Message
+	query.LimitResourceDecoding(1, 0, 0, 0)
+	if _, _, err = query.Decode(out[2:]); err != nil || len(query.Questions) != 1 || !NamesEqual(query.Questions[0].Name, name) {
+		t.Fatalf("bad query: err=%v questions=%v", err, query.Questions)
+	}
+
+	resp := Message{
+		Questions: []Question{q},
+		Answers: []Resource{
+			NewResource(name, TypeA, ClassINET, 300, []byte{93, 184, 216, 34}),
+			NewResource(name, TypeA, ClassINET, 300, []byte{93, 184, 216, 35}),
+		},
+	}
+	flags := HeaderFlags(1<<15 | 1<<8 | 1<<7)
+	wire := appendTCPMessage(t, nil, &resp, txid+1, flags) // Not our transaction, discarded.
+	wire = appendTCPMessage(t, wire, &resp, txid, flags)
+	// Feed response in two halves.
+	stream.in.Write(wire[:len(wire)/2])
+	done, err = c.Poll(stream)
+	if done || err != nil {
+		t.Fatalf("unexpected done=%v err=%v on partial response", done, err)
+	}
+	stream.in.Write(wire[len(wire)/2:])
+	done, err = c.Poll(stream)
+	if !done || err != nil {
+		t.Fatalf("want done, got done=%v err=%v", done, err)
+	}
+	var addrs [4]netip.Addr
+	n, err := c.ResponseAnswerLookup(addrs[:], "example.com")
+	if err != nil || n != 2 {
+		t.Fatalf("want 2 answers, got %d err=%v", n, err)
+	}
+	if addrs[1] != netip.AddrFrom4([4]byte{93, 184, 216, 35}) {
+		t.Errorf("unexpected addresses %v", addrs[:n])
+	}
+}
+
+func TestTCPClientResponseTooLong(t *testing.T) {
+	var c TCPClient
+	err := c.Configure(TCPClientConfig{Buffer: make([]byte, 512)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.StartResolve(1, ResolveConfig{Questions: []Question{{Name: MustNewName("example.com"), Type: TypeTXT, Class: ClassINET}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &testStream{}
+	c.Poll(stream)
+	stream.in.Write([]byte{0x10, 0x00}) // 4096 byte message.
+	done, err := c.Poll(stream)
+	if !done || err == nil {
+		t.Errorf("want error on response larger than buffer, got done=%v err=%v", done, err)
+	}
+}
@@ -132,14 +132,28 @@ const (
 )
 
 // VLANTag holds priority (PCP) Drop indicator (DEI) and VLAN ID bits of the VLAN tag field.
+// As per IEEE 802.1Q PCP occupies the 3 most significant bits, followed by DEI and the 12 bit VLAN ID.
 type VLANTag uint16
 
+// NewVLANTag returns a VLAN tag with the given priority code point, drop eligible indicator and VLAN identifier.
+// Excess bits of priority and vid are discarded.
+func NewVLANTag(priority uint8, dropEligible bool, vid uint16) VLANTag {
+	return VLANTag(uint16(priority&0b111)<<13 | uint16(b2u8(dropEligible))<<12 | vid&0xfff)
+}
+
 // DropEligibleIndicator returns true if the DEI bit is set.
 // DEI may be used separately or in conjunction with PCP to indicate frames eligible to be dropped in the presence of congestion.
-func (vt VLANTag) DropEligibleIndicator() bool { return vt&(1<<3) != 0 }
+func (vt VLANTag) DropEligibleIndicator() bool { return vt&(1<<12) != 0 }
 
 // PriorityCodePoint is 3-bit field which refers to the IEEE 802.1p class of service (CoS) and maps to the frame priority level. Different PCP values can be used to prioritize different classes of traffic
-func (vt VLANTag) PriorityCodePoint() uint8 { return uint8(vt & 0b111) }
+func (vt VLANTag) PriorityCodePoint() uint8 { return uint8(vt >> 13) }
 
 // VLANIdentifier 12 bit field which specifies which VLAN the frame belongs to. Values of 0 and 4095 are reserved.
-func (vt VLANTag) VLANIdentifier() uint16 { return uint16(vt) >> 4 }
+func (vt VLANTag) VLANIdentifier() uint16 { return uint16(vt) & 0xfff }
+
+func b2u8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
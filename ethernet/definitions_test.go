@@ -40,3 +40,14 @@ func TestString_singleAlloc(t *testing.T) {
 		t.Errorf("expected 1 alloc, got %v", allocs)
 	}
 }
+
+func TestVLANTag(t *testing.T) {
+	// PCP=5, DEI=1, VID=100 encodes as 0xb064 on the wire.
+	tag := NewVLANTag(5, true, 100)
+	if tag != 0xb064 {
+		t.Fatalf("want tag 0xb064, got %#x", uint16(tag))
+	}
+	if tag.PriorityCodePoint() != 5 || !tag.DropEligibleIndicator() || tag.VLANIdentifier() != 100 {
+		t.Errorf("bad tag fields pcp=%d dei=%v vid=%d", tag.PriorityCodePoint(), tag.DropEligibleIndicator(), tag.VLANIdentifier())
+	}
+}
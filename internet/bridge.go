@@ -0,0 +1,309 @@
+package internet
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/internal"
+)
+
+// BridgeDevice is the transmit side of an Ethernet device bridged by a [Bridge].
+// It is satisfied by netdev.DevEthernet.
+type BridgeDevice interface {
+	// SendOffsetEthFrame transmits the Ethernet frame starting at the offset returned by MaxFrameSizeAndOffset.
+	SendOffsetEthFrame(offsetTxEthFrame []byte) error
+	// MaxFrameSizeAndOffset returns the maximum device frame size and the offset of the Ethernet frame within it.
+	MaxFrameSizeAndOffset() (maxFrameSize int, sendEthFrameOff int)
+}
+
+// BridgeConfig configures a [Bridge].
+type BridgeConfig struct {
+	// MaxPorts is the maximum number of devices that can be added to the bridge.
+	MaxPorts int
+	// FDBSize is the capacity of the forwarding database of learned MAC addresses.
+	FDBSize int
+	// AgingTime is the time after which a learned MAC address not seen as source is forgotten.
+	// Defaults to 300 seconds as recommended by IEEE 802.1D.
+	AgingTime time.Duration
+	// Nanotime is a monotonic time source in nanoseconds used to age learned addresses. Required.
+	Nanotime func() int64
+	// Local is the optional Ethernet stack of the bridge itself. It receives frames addressed to its
+	// hardware address as well as broadcast and multicast frames, and its output is sent through the bridge.
+	Local *StackEthernet
+	// TxBuffer is used to build frames sent to devices. It must fit the largest device frame plus the largest device frame offset.
+	TxBuffer []byte
+}
+
+// BridgePortStats holds the counters of a [Bridge] port.
+type BridgePortStats struct {
+	// RxFrames counts frames received on the port.
+	RxFrames uint64
+	// TxFrames counts frames sent out of the port.
+	TxFrames uint64
+	// TxErrors counts frames the port's device failed to send.
+	TxErrors uint64
+	// Filtered counts received frames not forwarded since their destination is on the same port or is reserved.
+	Filtered uint64
+}
+
+// Bridge is a transparent learning bridge as described in IEEE 802.1D that forwards Ethernet frames
+// between devices. Source hardware addresses are learned per port and aged out; frames to
+// unknown unicast, broadcast and multicast destinations are flooded to all ports except the
+// one they were received on. The bridge implements no spanning tree so the bridged network must be loop free.
+//
+// Received frames are passed to [Bridge.Ingress] and the local stack's output is sent with
+// [Bridge.Egress]. Bridge is not safe for concurrent use so all calls must be serialized, i.e:
+//
+//	for {
+//		for i, dev := range devs {
+//			off, n, _ := dev.EthPoll(rxbuf)
+//			if n > 0 {
+//				bridge.Ingress(i, rxbuf[off:off+n])
+//			}
+//		}
+//		bridge.Egress()
+//	}
+type Bridge struct {
+	ports    []bridgePort
+	fdb      []fdbEntry
+	local    *StackEthernet
+	txbuf    []byte
+	txoff    int // Largest device frame offset.
+	nanotime func() int64
+	aging    int64
+	logger
+}
+
+type bridgePort struct {
+	dev   BridgeDevice
+	off   int
+	maxsz int
+	stats BridgePortStats
+}
+
+type fdbEntry struct {
+	mac      [6]byte
+	port     uint8
+	lastSeen int64
+}
+
+const bridgeLocalPort = 0xff
+
+// Reset removes all ports and clears the forwarding database.
+func (b *Bridge) Reset(cfg BridgeConfig) error {
+	if cfg.MaxPorts <= 0 || cfg.MaxPorts >= bridgeLocalPort || cfg.FDBSize <= 0 || cfg.Nanotime == nil || cfg.AgingTime < 0 {
+		return lneto.ErrInvalidConfig
+	} else if len(cfg.TxBuffer) < 60 {
+		return lneto.ErrShortBuffer
+	}
+	aging := cfg.AgingTime
+	if aging == 0 {
+		aging = 300 * time.Second
+	}
+	internal.SliceReuse(&b.ports, cfg.MaxPorts)
+	internal.SliceReuse(&b.fdb, cfg.FDBSize)
+	b.local = cfg.Local
+	b.txbuf = cfg.TxBuffer
+	b.txoff = 0
+	b.nanotime = cfg.Nanotime
+	b.aging = int64(aging)
+	return nil
+}
+
+// SetLogger sets the bridge's logger.
+func (b *Bridge) SetLogger(log *slog.Logger) { b.log = log }
+
+// AddPort adds a device to the bridge and returns its port index used in [Bridge.Ingress].
+func (b *Bridge) AddPort(dev BridgeDevice) (port int, err error) {
+	if dev == nil {
+		return -1, lneto.ErrInvalidConfig
+	} else if len(b.ports) == cap(b.ports) {
+		return -1, lneto.ErrExhausted
+	}
+	maxsz, off := dev.MaxFrameSizeAndOffset()
+	if off < 0 || maxsz-off < 60 {
+		return -1, lneto.ErrInvalidConfig
+	}
+	txoff := max(b.txoff, off)
+	for i := range b.ports {
+		if txoff+b.ports[i].maxsz-b.ports[i].off > len(b.txbuf) {
+			return -1, lneto.ErrShortBuffer
+		}
+	}
+	if txoff+maxsz-off > len(b.txbuf) {
+		return -1, lneto.ErrShortBuffer
+	}
+	port = len(b.ports)
+	b.txoff = txoff
+	b.ports = append(b.ports, bridgePort{dev: dev, off: off, maxsz: maxsz})
+	return port, nil
+}
+
+// PortStats returns the counters of the port.
+func (b *Bridge) PortStats(port int) BridgePortStats { return b.ports[port].stats }
+
+// Lookup returns the port on which mac was last seen. It returns ok=false for
+// unknown addresses and addresses belonging to the local stack.
+func (b *Bridge) Lookup(mac [6]byte) (port int, ok bool) {
+	entry := b.lookup(mac, b.nanotime())
+	if entry == nil || entry.port == bridgeLocalPort {
+		return -1, false
+	}
+	return int(entry.port), true
+}
+
+// Flush forgets all learned addresses.
+func (b *Bridge) Flush() { b.fdb = b.fdb[:0] }
+
+// Ingress processes an Ethernet frame received on port. The frame is forwarded to the
+// port its destination was learned on or flooded, and delivered to the local stack if addressed to it.
+// The returned error is that of the local stack, if the frame was delivered to it.
+func (b *Bridge) Ingress(port int, frame []byte) error {
+	if port < 0 || port >= len(b.ports) {
+		return lneto.ErrInvalidConfig
+	}
+	efrm, err := ethernet.NewFrame(frame)
+	if err != nil {
+		return err
+	}
+	in := &b.ports[port]
+	in.stats.RxFrames++
+	now := b.nanotime()
+	src := *efrm.SourceHardwareAddr()
+	dst := *efrm.DestinationHardwareAddr()
+	if src[0]&1 == 0 {
+		b.learn(src, uint8(port), now)
+	}
+	if isReservedMAC(dst) {
+		in.stats.Filtered++ // IEEE 802.1D §7.12.6: Frames to reserved addresses such as STP and LLDP are never relayed.
+		return b.deliverLocal(frame)
+	}
+	group := dst[0]&1 != 0
+	if !group && b.local != nil && dst == b.local.HardwareAddr6() {
+		return b.local.Demux(frame, 0)
+	}
+	var entry *fdbEntry
+	if !group {
+		entry = b.lookup(dst, now)
+	}
+	if entry == nil {
+		b.forward(frame, -1, port) // Flood.
+	} else if int(entry.port) == port {
+		in.stats.Filtered++
+	} else if entry.port != bridgeLocalPort {
+		b.forward(frame, int(entry.port), port)
+	}
+	if group {
+		return b.deliverLocal(frame)
+	}
+	return nil
+}
+
+// Egress sends a frame generated by the local stack through the bridge, if any. It returns the Ethernet frame length sent.
+func (b *Bridge) Egress() (int, error) {
+	if b.local == nil {
+		return 0, nil
+	}
+	n, err := b.local.Encapsulate(b.txbuf, -1, b.txoff)
+	if n == 0 {
+		return 0, err
+	}
+	efrm, _ := ethernet.NewFrame(b.txbuf[b.txoff : b.txoff+n])
+	now := b.nanotime()
+	b.learn(*efrm.SourceHardwareAddr(), bridgeLocalPort, now)
+	dst := *efrm.DestinationHardwareAddr()
+	var entry *fdbEntry
+	if dst[0]&1 == 0 {
+		entry = b.lookup(dst, now)
+	}
+	if entry != nil && entry.port != bridgeLocalPort {
+		b.transmit(int(entry.port), n)
+	} else {
+		for i := range b.ports {
+			b.transmit(i, n)
+		}
+	}
+	return n, err
+}
+
+func (b *Bridge) deliverLocal(frame []byte) error {
+	if b.local == nil {
+		return nil
+	}
+	return b.local.Demux(frame, 0)
+}
+
+// forward sends the received frame out of port, or out of all ports except the
+// ingress port if port is negative.
+func (b *Bridge) forward(frame []byte, port, ingress int) {
+	if len(frame) > len(b.txbuf)-b.txoff {
+		b.ports[ingress].stats.Filtered++
+		return
+	}
+	n := copy(b.txbuf[b.txoff:], frame)
+	if port >= 0 {
+		b.transmit(port, n)
+		return
+	}
+	for i := range b.ports {
+		if i != ingress {
+			b.transmit(i, n)
+		}
+	}
+}
+
+// transmit sends the frame of length n stored at txbuf[txoff:] out of port. The frame is
+// stored after the largest device offset so each device gets its frame offset without copying.
+func (b *Bridge) transmit(port, n int) {
+	p := &b.ports[port]
+	if n > p.maxsz-p.off {
+		p.stats.TxErrors++
+		return
+	}
+	err := p.dev.SendOffsetEthFrame(b.txbuf[b.txoff-p.off : b.txoff+n])
+	if err != nil {
+		p.stats.TxErrors++
+		b.debug("bridge:tx", slog.Int("port", port), slog.String("err", err.Error()))
+		return
+	}
+	p.stats.TxFrames++
+}
+
+func (b *Bridge) lookup(mac [6]byte, now int64) *fdbEntry {
+	for i := range b.fdb {
+		if b.fdb[i].mac == mac && now-b.fdb[i].lastSeen < b.aging {
+			return &b.fdb[i]
+		}
+	}
+	return nil
+}
+
+// learn records that mac was seen as source on port. When the database is full the oldest entry is replaced.
+func (b *Bridge) learn(mac [6]byte, port uint8, now int64) {
+	oldest := -1
+	for i := range b.fdb {
+		entry := &b.fdb[i]
+		if entry.mac == mac {
+			if entry.port != port && b.log != nil {
+				b.debug("bridge:station-moved", internal.SlogAddr6("mac", &mac), slog.Int("port", int(port)))
+			}
+			entry.port = port
+			entry.lastSeen = now
+			return
+		} else if oldest < 0 || entry.lastSeen < b.fdb[oldest].lastSeen {
+			oldest = i
+		}
+	}
+	if len(b.fdb) < cap(b.fdb) {
+		b.fdb = append(b.fdb, fdbEntry{mac: mac, port: port, lastSeen: now})
+	} else {
+		b.fdb[oldest] = fdbEntry{mac: mac, port: port, lastSeen: now}
+	}
+}
+
+// isReservedMAC reports whether mac is in the IEEE 802.1D reserved range 01-80-C2-00-00-00 to 01-80-C2-00-00-0F.
+func isReservedMAC(mac [6]byte) bool {
+	return mac[0] == 0x01 && mac[1] == 0x80 && mac[2] == 0xc2 && mac[3] == 0 && mac[4] == 0 && mac[5] <= 0x0f
+}
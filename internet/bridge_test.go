@@ -0,0 +1,165 @@
+package internet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto/arp"
+	"github.com/soypat/lneto/ethernet"
+)
+
+// testBridgeDev is a BridgeDevice that records sent Ethernet frames.
+type testBridgeDev struct {
+	off  int
+	sent [][]byte
+}
+
+func (d *testBridgeDev) SendOffsetEthFrame(buf []byte) error {
+	d.sent = append(d.sent, append([]byte(nil), buf[d.off:]...))
+	return nil
+}
+
+func (d *testBridgeDev) MaxFrameSizeAndOffset() (int, int) { return d.off + 1514, d.off }
+
+func (d *testBridgeDev) pop() (frame []byte) {
+	if len(d.sent) == 0 {
+		return nil
+	}
+	frame = d.sent[0]
+	d.sent = d.sent[1:]
+	return frame
+}
+
+func newTestBridge(t *testing.T, now *int64, local *StackEthernet, devs ...*testBridgeDev) *Bridge {
+	t.Helper()
+	var b Bridge
+	err := b.Reset(BridgeConfig{
+		MaxPorts:  len(devs),
+		FDBSize:   4,
+		AgingTime: time.Minute,
+		Nanotime:  func() int64 { return *now },
+		Local:     local,
+		TxBuffer:  make([]byte, 1600),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dev := range devs {
+		port, err := b.AddPort(dev)
+		if err != nil {
+			t.Fatal(err)
+		} else if port != i {
+			t.Fatalf("want port %d, got %d", i, port)
+		}
+	}
+	return &b
+}
+
+func TestBridge_LearnFlood(t *testing.T) {
+	var now int64 = 1
+	devs := []*testBridgeDev{{}, {off: 4}, {off: 2}}
+	b := newTestBridge(t, &now, nil, devs...)
+	macA, macB := [6]byte{0x2, 0, 0, 0, 0, 0xa}, [6]byte{0x2, 0, 0, 0, 0, 0xb}
+	frameAB := appendEthernet(nil, macB, macA, ethernet.TypeIPv4, []byte("hello"))
+	frameBA := appendEthernet(nil, macA, macB, ethernet.TypeIPv4, []byte("reply"))
+
+	// Unknown unicast is flooded to all other ports.
+	b.Ingress(0, frameAB)
+	if len(devs[0].sent) != 0 || string(devs[1].pop()) != string(frameAB) || string(devs[2].pop()) != string(frameAB) {
+		t.Fatal("unknown unicast not flooded correctly")
+	}
+	if port, ok := b.Lookup(macA); !ok || port != 0 {
+		t.Fatal("source address not learned")
+	}
+	// Learned destination is forwarded to its port only.
+	b.Ingress(1, frameBA)
+	if string(devs[0].pop()) != string(frameBA) || len(devs[2].sent) != 0 {
+		t.Fatal("learned unicast not forwarded to single port")
+	}
+	b.Ingress(0, frameAB)
+	if string(devs[1].pop()) != string(frameAB) || len(devs[2].sent) != 0 {
+		t.Fatal("learned unicast not forwarded to single port")
+	}
+	// Frames to a destination on the ingress port are filtered.
+	frameAA := appendEthernet(nil, macA, [6]byte{0x2, 0, 0, 0, 0, 0xc}, ethernet.TypeIPv4, nil)
+	b.Ingress(0, frameAA)
+	if len(devs[1].sent)+len(devs[2].sent) != 0 || b.PortStats(0).Filtered != 1 {
+		t.Fatal("frame to same port segment not filtered")
+	}
+	// Aging.
+	now += int64(time.Minute)
+	if _, ok := b.Lookup(macA); ok {
+		t.Fatal("address not aged out")
+	}
+	b.Ingress(1, frameBA)
+	if len(devs[0].pop()) == 0 || len(devs[2].pop()) == 0 {
+		t.Fatal("aged out destination not flooded")
+	}
+	// Reserved addresses are not relayed.
+	stp := appendEthernet(nil, [6]byte{0x01, 0x80, 0xc2, 0, 0, 0}, macA, 0x26, nil)
+	b.Ingress(0, stp)
+	if len(devs[1].sent)+len(devs[2].sent) != 0 {
+		t.Fatal("reserved group address frame relayed")
+	}
+}
+
+func TestBridge_Local(t *testing.T) {
+	var now int64 = 1
+	localMAC, localIP := [6]byte{0x2, 0, 0, 0, 0, 1}, [4]byte{192, 168, 1, 1}
+	macA, ipA := [6]byte{0x2, 0, 0, 0, 0, 0xa}, [4]byte{192, 168, 1, 2}
+	var local StackEthernet
+	var arpHandler arp.Handler
+	if err := local.Configure(StackEthernetConfig{MTU: 1500, MaxNodes: 1, MAC: localMAC}); err != nil {
+		t.Fatal(err)
+	}
+	err := arpHandler.Reset(arp.HandlerConfig{
+		HardwareAddr: localMAC[:],
+		ProtocolAddr: localIP[:],
+		MaxQueries:   2,
+		MaxPending:   2,
+		HardwareType: 1,
+		ProtocolType: ethernet.TypeIPv4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.RegisterEthernet(&arpHandler)
+	devs := []*testBridgeDev{{}, {off: 3}}
+	b := newTestBridge(t, &now, &local, devs...)
+
+	// Broadcast ARP request is flooded and delivered locally.
+	var req [28]byte
+	afrm, _ := arp.NewFrame(req[:])
+	afrm.SetHardware(1, 6)
+	afrm.SetProtocol(ethernet.TypeIPv4, 4)
+	afrm.SetOperation(arp.OpRequest)
+	shw, sproto := afrm.Sender4()
+	*shw, *sproto = macA, ipA
+	_, tproto := afrm.Target4()
+	*tproto = localIP
+	frame := appendEthernet(nil, ethernet.BroadcastAddr(), macA, ethernet.TypeARP, req[:])
+	if err := b.Ingress(1, frame); err != nil {
+		t.Fatal(err)
+	}
+	if string(devs[0].pop()) != string(frame) {
+		t.Fatal("broadcast not flooded")
+	}
+	// Local reply is sent only to the port the requester was learned on.
+	n, err := b.Egress()
+	if err != nil || n == 0 {
+		t.Fatal("expected local ARP reply", n, err)
+	}
+	if len(devs[0].sent) != 0 {
+		t.Fatal("reply to learned address flooded")
+	}
+	reply := devs[1].pop()
+	efrm, _ := ethernet.NewFrame(reply)
+	if *efrm.DestinationHardwareAddr() != macA || *efrm.SourceHardwareAddr() != localMAC || efrm.EtherTypeOrSize() != ethernet.TypeARP {
+		t.Fatalf("bad local reply %x", reply[:14])
+	}
+	// Frames addressed to the local stack are not forwarded.
+	b.Ingress(1, appendEthernet(nil, localMAC, macA, ethernet.TypeARP, req[:]))
+	if len(devs[0].sent) != 0 {
+		t.Fatal("frame to local stack forwarded")
+	}
+}
@@ -24,6 +24,16 @@ type node struct {
 	remoteAddr []byte
 	proto      uint16 // StackNode.Protocol()
 	lport      uint16 // StackNode.LocalPort()
+	// emittedProto is set when the StackNode implements [protoEmitter].
+	emittedProto func() lneto.IPProto
+}
+
+// protoEmitter is implemented by StackNodes whose Encapsulate may write frames of an IP
+// protocol other than their own, i.e: [StackPorts] emitting ICMP errors for unbound UDP ports.
+// Nodes wrapping a StackNode, such as [StackFilter], forward the wrapped node's method.
+type protoEmitter interface {
+	// EncapsulatedProto returns the IP protocol of the frame last written by Encapsulate.
+	EncapsulatedProto() lneto.IPProto
 }
 
 type handlers struct {
@@ -138,6 +148,19 @@ func (h *handlers) demuxByProto(buf []byte, offset int, proto uint16) (*node, er
 	return node, err
 }
 
+func (h *handlers) demuxByPortProto(buf []byte, offset int, port, proto uint16) (*node, error) {
+	node := h.nodeByPortProto(port, proto)
+	if node == nil {
+		return nil, lneto.ErrPacketDrop
+	}
+	err := node.callbacks.Demux(buf, offset)
+	if h.tryHandleError(node, err) {
+		err = nil
+		node = nil // Node is destroyed in tryHandleError and invalidated.
+	}
+	return node, err
+}
+
 func (h *handlers) demuxByPort(buf []byte, offset int, port uint16) (*node, error) {
 	node := h.nodeByPort(port)
 	if node == nil {
@@ -193,6 +216,14 @@ var (
 	_ = net.ErrClosed
 )
 
+// encapsulatedProto returns the IP protocol of the frame last written by the node's Encapsulate.
+func (node *node) encapsulatedProto() lneto.IPProto {
+	if node.emittedProto != nil {
+		return node.emittedProto()
+	}
+	return lneto.IPProto(node.proto)
+}
+
 func (node *node) IsInvalid() bool {
 	return node.callbacks.IsZeroed() || (node.connID != nil && node.currConnID != *node.connID)
 }
@@ -210,7 +241,7 @@ func nodeFromStackNode(s lneto.StackNode, port uint16, protocol uint64, remoteAd
 	if connIDPtr != nil {
 		currConnID = *connIDPtr
 	}
-	return node{
+	n := node{
 		currConnID: currConnID,
 		connID:     connIDPtr,
 		callbacks:  makecbnode(s),
@@ -218,6 +249,10 @@ func nodeFromStackNode(s lneto.StackNode, port uint16, protocol uint64, remoteAd
 		lport:      port,
 		remoteAddr: remoteAddr, // SHARED MEMORY- used to signal.
 	}
+	if pe, ok := s.(protoEmitter); ok {
+		n.emittedProto = pe.EncapsulatedProto
+	}
+	return n
 }
 
 // destroy removes all references to underlying StackNode. Allows garbage collection of node if possible.
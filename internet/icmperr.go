@@ -0,0 +1,163 @@
+package internet
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+	"github.com/soypat/lneto/ipv6/icmpv6"
+)
+
+const (
+	// sizeICMPQuote is the maximum amount of the offending datagram quoted in an ICMP error.
+	// Fits the largest IPv4 header (60 bytes) plus the first 64 bits of the datagram as required by RFC 792.
+	sizeICMPQuote = 60 + 8
+	// sizeICMPErrHeader is the ICMP(v4/v6) error header: type, code, checksum and 4 unused bytes.
+	sizeICMPErrHeader = 8
+
+	defaultICMPErrInterval = 20 * time.Millisecond
+	defaultICMPErrBurst    = 4
+)
+
+// icmpErrQueue is a small fixed-size queue of ICMP Destination Unreachable (Port Unreachable)
+// messages pending transmission. Emission is rate limited with a token bucket as
+// recommended by RFC 1812 §4.3.2.8 and RFC 4443 §2.4(f).
+type icmpErrQueue struct {
+	buf  [2]icmpErrEntry
+	head uint8 // Index of the oldest entry in buf.
+	len  uint8
+
+	tokens   uint8
+	burst    uint8
+	lastFill int64
+	interval int64
+	nanotime func() int64
+}
+
+type icmpErrEntry struct {
+	quote [sizeICMPQuote]byte
+	qlen  uint8
+}
+
+func (q *icmpErrQueue) configure(nanotime func() int64, interval time.Duration, burst uint8) {
+	if interval <= 0 {
+		interval = defaultICMPErrInterval
+	}
+	if burst == 0 {
+		burst = defaultICMPErrBurst
+	}
+	*q = icmpErrQueue{
+		tokens:   burst,
+		burst:    burst,
+		interval: int64(interval),
+		nanotime: nanotime,
+	}
+}
+
+// reset discards all pending entries while keeping rate limit configuration.
+func (q *icmpErrQueue) reset() {
+	q.head = 0
+	q.len = 0
+	q.tokens = q.burst
+	q.lastFill = 0
+}
+
+func (q *icmpErrQueue) pending() int { return int(q.len) }
+
+// queuePortUnreachable stores the quote of the IP datagram in carrierData whose transport frame
+// starts at frameOffset. It silently drops the request when the datagram must not
+// elicit an ICMP error (RFC 1122 §3.2.2), the queue is full or the rate limit is exceeded.
+func (q *icmpErrQueue) queuePortUnreachable(carrierData []byte, frameOffset int) {
+	if q.len >= uint8(len(q.buf)) || frameOffset <= 0 || frameOffset > len(carrierData) {
+		return
+	}
+	src, dst, _, _, err := internal.GetIPAddr(carrierData)
+	if err != nil || internal.IsZeroed(src...) || internal.IsMulticastIPAddr(src) || internal.IsMulticastIPAddr(dst) {
+		return
+	} else if len(dst) == 4 && (ipv4.IsBroadcast([4]byte(dst)) || ipv4.IsBroadcast([4]byte(src))) {
+		return
+	} else if len(dst) == 4 && binary.BigEndian.Uint16(carrierData[6:8])&0x1fff != 0 {
+		return // Not the first fragment of the datagram.
+	}
+	if !q.takeToken() {
+		return
+	}
+	entry := &q.buf[(q.head+q.len)%uint8(len(q.buf))]
+	qlen := min(len(carrierData), frameOffset+8, sizeICMPQuote)
+	entry.qlen = uint8(copy(entry.quote[:], carrierData[:qlen]))
+	q.len++
+}
+
+func (q *icmpErrQueue) takeToken() bool {
+	if q.nanotime == nil {
+		return true // No time source, queue size limits bursts.
+	}
+	now := q.nanotime()
+	if q.lastFill == 0 {
+		q.lastFill = now
+	}
+	if elapsed := now - q.lastFill; elapsed >= q.interval {
+		refill := elapsed / q.interval
+		q.tokens = uint8(min(int64(q.burst), int64(q.tokens)+refill))
+		q.lastFill += refill * q.interval
+	}
+	if q.tokens == 0 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+// drain writes the oldest pending ICMP error into carrierData[offsetToFrame:] and sets the IP destination
+// field of the IP header at offsetToIP. It returns the ICMP protocol the error was written with.
+// Returns 0 if queue empty, the IP header is absent or carrierData is too short, in which case the entry stays queued.
+func (q *icmpErrQueue) drain(carrierData []byte, offsetToIP, offsetToFrame int) (int, lneto.IPProto) {
+	if q.len == 0 || offsetToIP < 0 {
+		return 0, 0
+	}
+	entry := &q.buf[q.head]
+	quote := entry.quote[:entry.qlen]
+	n := sizeICMPErrHeader + len(quote)
+	if offsetToFrame+n > len(carrierData) {
+		return 0, 0
+	}
+	remoteAddr, _, _, _, err := internal.GetIPAddr(quote)
+	if err != nil {
+		q.pop() // Unusable quote, would block the queue forever.
+		return 0, 0
+	}
+	ipHdr := carrierData[offsetToIP:offsetToFrame]
+	err = internal.SetIPAddrs(ipHdr, 0, nil, remoteAddr)
+	if err != nil {
+		return 0, 0
+	}
+	q.pop()
+	frame := carrierData[offsetToFrame : offsetToFrame+n]
+	clear(frame[:sizeICMPErrHeader])
+	copy(frame[sizeICMPErrHeader:], quote)
+	var crc lneto.CRC791
+	proto := lneto.IPProtoICMP
+	if len(remoteAddr) == 4 {
+		frame[0] = byte(icmpv4.TypeDestinationUnreachable)
+		frame[1] = byte(icmpv4.CodePortUnreachable)
+	} else {
+		proto = lneto.IPProtoIPv6ICMP
+		frame[0] = byte(icmpv6.TypeDestinationUnreachable)
+		frame[1] = byte(icmpv6.CodePortUnreachable)
+		// ICMPv6 checksum covers IPv6 pseudo-header (RFC 4443 §2.3).
+		crc.WriteEven(ipHdr[8:40])
+		crc.AddUint32(uint32(n))
+		crc.AddUint32(uint32(proto))
+	}
+	binary.BigEndian.PutUint16(frame[2:4], crc.PayloadSum16(frame))
+	return n, proto
+}
+
+// pop discards the oldest pending entry.
+func (q *icmpErrQueue) pop() {
+	q.head = (q.head + 1) % uint8(len(q.buf))
+	q.len--
+}
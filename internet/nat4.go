@@ -0,0 +1,515 @@
+package internet
+
+import (
+	"cmp"
+	"encoding/binary"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+)
+
+// NATConfig configures a [NAT44].
+type NATConfig struct {
+	// MaxMappings is the capacity of the translation table.
+	MaxMappings int
+	// Nanotime is a monotonic time source in nanoseconds used to expire idle mappings. Required.
+	Nanotime func() int64
+	// PortMin and PortMax are the inclusive range of external ports and ICMP identifiers
+	// allocated for mappings. Defaults to the dynamic port range 49152-65535.
+	PortMin, PortMax uint16
+	// TCPTimeout is the idle timeout of established TCP mappings. Defaults to 2 hours 4 minutes as per RFC 5382 REQ-5.
+	// TCP mappings which have seen a FIN or RST expire after 4 minutes of inactivity instead.
+	TCPTimeout time.Duration
+	// UDPTimeout is the idle timeout of UDP mappings. Defaults to 2 minutes as per RFC 4787 REQ-5.
+	UDPTimeout time.Duration
+	// ICMPTimeout is the idle timeout of ICMP query mappings. Defaults to 60 seconds as per RFC 5508 REQ-1.
+	ICMPTimeout time.Duration
+	// ALGs are the application level gateway hooks called on translated packets. They are copied on configuration.
+	ALGs []NATALG
+}
+
+// NATMapping is a translation of an internal endpoint to an external port for a session with a remote endpoint.
+// For ICMP queries ports are the query identifier and RemotePort is zero.
+type NATMapping struct {
+	Protocol     lneto.IPProto
+	InternalAddr [4]byte
+	InternalPort uint16
+	ExternalAddr [4]byte
+	ExternalPort uint16
+	RemoteAddr   [4]byte
+	RemotePort   uint16
+}
+
+// NATALG is an application level gateway hook for protocols that embed addresses or ports
+// in their payload, such as FTP or SIP.
+type NATALG struct {
+	// Protocol and Port select the sessions handled by the hook: Port is matched against the remote port.
+	Protocol lneto.IPProto
+	Port     uint16
+	// Translate is called after the packet's addresses and ports have been translated.
+	// pkt is the IPv4 packet and outbound is true for packets leaving through the NAT.
+	// The hook may rewrite the payload in place, in which case it must return modified=true so
+	// that the transport checksum is recalculated. The packet length may not be changed.
+	// A non-nil error drops the packet.
+	Translate func(pkt []byte, mapping *NATMapping, outbound bool) (modified bool, err error)
+}
+
+// NATStats holds the counters of a [NAT44].
+type NATStats struct {
+	// Outbound and Inbound count translated packets.
+	Outbound, Inbound uint64
+	// Exhausted counts outbound packets dropped due to a full translation table or no free external port.
+	Exhausted uint64
+	// Unsupported counts packets dropped for not being translatable, i.e: non-first fragments or unsupported protocols.
+	Unsupported uint64
+}
+
+// NAT44 is a network address and port translator (NAPT) as described in RFC 3022.
+// Outbound packets have their source address and TCP/UDP port or ICMP query identifier rewritten
+// to an external address and port, inbound packets of established sessions are translated back.
+// Mappings are endpoint independent (RFC 4787 REQ-1) while filtering is address and port dependent.
+// Checksums are updated incrementally as per RFC 1624.
+//
+// A NAT44 is typically used by setting it in the [RouterInterfaceConfig] of the interface facing the
+// upstream network, though it may be used standalone via TranslateOutbound and TranslateInbound.
+type NAT44 struct {
+	maps     []natEntry
+	algs     []NATALG
+	nanotime func() int64
+	portMin  uint16
+	portMax  uint16
+	nextPort uint16
+	timeouts [3]int64 // TCP, UDP and ICMP.
+	stats    NATStats
+}
+
+type natEntry struct {
+	NATMapping
+	lastSeen int64
+	closing  bool // TCP FIN or RST seen.
+}
+
+const natTransitoryTimeout = 4 * time.Minute
+
+// Reset clears the translation table and configures the NAT.
+func (nat *NAT44) Reset(cfg NATConfig) error {
+	if cfg.PortMin == 0 && cfg.PortMax == 0 {
+		cfg.PortMin, cfg.PortMax = 49152, 65535
+	}
+	if cfg.MaxMappings <= 0 || cfg.Nanotime == nil || cfg.PortMin == 0 || cfg.PortMin > cfg.PortMax {
+		return lneto.ErrInvalidConfig
+	} else if cfg.TCPTimeout < 0 || cfg.UDPTimeout < 0 || cfg.ICMPTimeout < 0 {
+		return lneto.ErrInvalidConfig
+	}
+	for i := range cfg.ALGs {
+		if cfg.ALGs[i].Translate == nil {
+			return lneto.ErrInvalidConfig
+		}
+	}
+	internal.SliceReuse(&nat.maps, cfg.MaxMappings)
+	nat.algs = append(nat.algs[:0], cfg.ALGs...)
+	nat.nanotime = cfg.Nanotime
+	nat.portMin = cfg.PortMin
+	nat.portMax = cfg.PortMax
+	nat.nextPort = cfg.PortMin
+	nat.timeouts = [3]int64{
+		int64(cmp.Or(cfg.TCPTimeout, 2*time.Hour+4*time.Minute)),
+		int64(cmp.Or(cfg.UDPTimeout, 2*time.Minute)),
+		int64(cmp.Or(cfg.ICMPTimeout, time.Minute)),
+	}
+	nat.stats = NATStats{}
+	return nil
+}
+
+// Stats returns the NAT's counters.
+func (nat *NAT44) Stats() NATStats { return nat.stats }
+
+// Len returns the number of mappings in the translation table, including expired mappings not yet evicted.
+func (nat *NAT44) Len() int { return len(nat.maps) }
+
+// Mapping returns the mapping at index i of the translation table, i must be less than [NAT44.Len].
+func (nat *NAT44) Mapping(i int) NATMapping { return nat.maps[i].NATMapping }
+
+// TranslateOutbound rewrites the source address of the IPv4 packet in pkt to externalAddr and its
+// source port or ICMP query identifier to the mapped external port, creating a mapping if needed.
+// The packet header must be valid. Non-first fragments are not translatable and return [lneto.ErrUnsupported].
+func (nat *NAT44) TranslateOutbound(pkt []byte, externalAddr [4]byte) error {
+	ifrm, err := ipv4.NewFrame(pkt)
+	if err != nil {
+		return err
+	}
+	fi, err := nat.parse(ifrm)
+	if err != nil {
+		nat.stats.Unsupported++
+		return err
+	}
+	if fi.icmpErr {
+		return nat.unsupported() // Errors generated by internal hosts are not translated.
+	}
+	key := NATMapping{
+		Protocol:     ifrm.Protocol(),
+		InternalAddr: *ifrm.SourceAddr(),
+		InternalPort: fi.srcPort,
+		ExternalAddr: externalAddr,
+		RemoteAddr:   *ifrm.DestinationAddr(),
+		RemotePort:   fi.dstPort,
+	}
+	now := nat.nanotime()
+	entry := nat.lookupOutbound(&key, now)
+	if entry == nil {
+		entry, err = nat.newMapping(&key, now)
+		if err != nil {
+			nat.stats.Exhausted++
+			return err
+		}
+	}
+	entry.lastSeen = now
+	nat.trackTCP(entry, fi)
+	ifrm.SetCRC(lneto.IncrementalSum32(ifrm.CRC(), addr4u32(ifrm.SourceAddr()), addr4u32(&entry.ExternalAddr)))
+	fi.rewrite(ifrm, ifrm.SourceAddr(), entry.ExternalAddr, fi.srcPortOff, entry.ExternalPort)
+	if err = nat.callALG(ifrm, fi, entry, true); err != nil {
+		return err
+	}
+	nat.stats.Outbound++
+	return nil
+}
+
+// TranslateInbound rewrites the destination address and port of the IPv4 packet in pkt back
+// to the internal endpoint of its mapping. It returns translated=false if the packet belongs to
+// no mapping, in which case the packet is left untouched and should be processed locally or dropped.
+// ICMP errors quoting a translated packet are translated as per RFC 5508.
+func (nat *NAT44) TranslateInbound(pkt []byte) (translated bool, err error) {
+	ifrm, err := ipv4.NewFrame(pkt)
+	if err != nil {
+		return false, err
+	}
+	fi, err := nat.parse(ifrm)
+	if err != nil {
+		return false, nil
+	}
+	now := nat.nanotime()
+	if fi.icmpErr {
+		return nat.translateInboundICMPErr(ifrm, now)
+	}
+	key := NATMapping{
+		Protocol:     ifrm.Protocol(),
+		ExternalAddr: *ifrm.DestinationAddr(),
+		ExternalPort: fi.dstPort,
+		RemoteAddr:   *ifrm.SourceAddr(),
+		RemotePort:   fi.srcPort,
+	}
+	entry := nat.lookupInbound(&key, now)
+	if entry == nil {
+		return false, nil
+	}
+	entry.lastSeen = now
+	nat.trackTCP(entry, fi)
+	ifrm.SetCRC(lneto.IncrementalSum32(ifrm.CRC(), addr4u32(ifrm.DestinationAddr()), addr4u32(&entry.InternalAddr)))
+	fi.rewrite(ifrm, ifrm.DestinationAddr(), entry.InternalAddr, fi.dstPortOff, entry.InternalPort)
+	if err = nat.callALG(ifrm, fi, entry, false); err != nil {
+		return false, err
+	}
+	nat.stats.Inbound++
+	return true, nil
+}
+
+// translateInboundICMPErr translates an ICMP error received for a packet previously translated outbound.
+// Both the outer destination and the quoted packet's source are rewritten to the internal endpoint.
+func (nat *NAT44) translateInboundICMPErr(ifrm ipv4.Frame, now int64) (bool, error) {
+	icmp := ifrm.Payload()
+	qfrm, err := ipv4.NewFrame(icmp[sizeICMPErrHeader:])
+	if err != nil || qfrm.HeaderLength() < 20 || len(qfrm.RawData()) < qfrm.HeaderLength()+8 {
+		return false, nil
+	}
+	qpayload := qfrm.RawData()[qfrm.HeaderLength():]
+	key := NATMapping{
+		Protocol:     qfrm.Protocol(),
+		ExternalAddr: *qfrm.SourceAddr(),
+		RemoteAddr:   *qfrm.DestinationAddr(),
+	}
+	var portOff int // Offset of the quoted source port or identifier within the quoted payload.
+	switch key.Protocol {
+	case lneto.IPProtoTCP, lneto.IPProtoUDP:
+		key.ExternalPort = binary.BigEndian.Uint16(qpayload[0:2])
+		key.RemotePort = binary.BigEndian.Uint16(qpayload[2:4])
+	case lneto.IPProtoICMP:
+		if icmpv4.Type(qpayload[0]) != icmpv4.TypeEcho {
+			return false, nil
+		}
+		portOff = 4
+		key.ExternalPort = binary.BigEndian.Uint16(qpayload[4:6])
+	default:
+		return false, nil
+	}
+	if *ifrm.DestinationAddr() != key.ExternalAddr {
+		return false, nil
+	}
+	entry := nat.lookupInbound(&key, now)
+	if entry == nil {
+		return false, nil
+	}
+	// Every rewritten word within the ICMP message must also be accounted for in the ICMP checksum.
+	icmpSum := binary.BigEndian.Uint16(icmp[2:4])
+	oldAddr, newAddr := addr4u32(&entry.ExternalAddr), addr4u32(&entry.InternalAddr)
+	// Quoted IP header: source address and checksum.
+	oldQCRC := qfrm.CRC()
+	newQCRC := lneto.IncrementalSum32(oldQCRC, oldAddr, newAddr)
+	*qfrm.SourceAddr() = entry.InternalAddr
+	qfrm.SetCRC(newQCRC)
+	icmpSum = lneto.IncrementalSum32(icmpSum, oldAddr, newAddr)
+	icmpSum = lneto.IncrementalSum16(icmpSum, oldQCRC, newQCRC)
+	// Quoted transport header: source port. The quoted transport checksum is left untouched
+	// since the quote is usually truncated and may not include it; hosts do not validate it.
+	binary.BigEndian.PutUint16(qpayload[portOff:], entry.InternalPort)
+	icmpSum = lneto.IncrementalSum16(icmpSum, entry.ExternalPort, entry.InternalPort)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpSum)
+	// Outer header destination.
+	ifrm.SetCRC(lneto.IncrementalSum32(ifrm.CRC(), oldAddr, newAddr))
+	*ifrm.DestinationAddr() = entry.InternalAddr
+	nat.stats.Inbound++
+	return true, nil
+}
+
+func (nat *NAT44) unsupported() error {
+	nat.stats.Unsupported++
+	return lneto.ErrUnsupported
+}
+
+func (nat *NAT44) timeout(entry *natEntry) int64 {
+	switch entry.Protocol {
+	case lneto.IPProtoTCP:
+		if entry.closing {
+			return int64(natTransitoryTimeout)
+		}
+		return nat.timeouts[0]
+	case lneto.IPProtoUDP:
+		return nat.timeouts[1]
+	}
+	return nat.timeouts[2]
+}
+
+func (nat *NAT44) expired(entry *natEntry, now int64) bool {
+	return now-entry.lastSeen >= nat.timeout(entry)
+}
+
+func (nat *NAT44) lookupOutbound(key *NATMapping, now int64) *natEntry {
+	for i := range nat.maps {
+		entry := &nat.maps[i]
+		if entry.Protocol == key.Protocol && entry.InternalAddr == key.InternalAddr && entry.InternalPort == key.InternalPort &&
+			entry.RemoteAddr == key.RemoteAddr && entry.RemotePort == key.RemotePort && entry.ExternalAddr == key.ExternalAddr && !nat.expired(entry, now) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (nat *NAT44) lookupInbound(key *NATMapping, now int64) *natEntry {
+	for i := range nat.maps {
+		entry := &nat.maps[i]
+		if entry.Protocol == key.Protocol && entry.ExternalPort == key.ExternalPort && entry.ExternalAddr == key.ExternalAddr &&
+			entry.RemoteAddr == key.RemoteAddr && entry.RemotePort == key.RemotePort && !nat.expired(entry, now) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// newMapping adds a mapping for key. The external port of an existing mapping of the same
+// internal endpoint is reused so that mappings are endpoint independent.
+func (nat *NAT44) newMapping(key *NATMapping, now int64) (*natEntry, error) {
+	slot := -1
+	for i := range nat.maps {
+		entry := &nat.maps[i]
+		if nat.expired(entry, now) {
+			if slot < 0 {
+				slot = i
+			}
+			continue
+		}
+		if key.ExternalPort == 0 && entry.Protocol == key.Protocol && entry.InternalAddr == key.InternalAddr &&
+			entry.InternalPort == key.InternalPort && entry.ExternalAddr == key.ExternalAddr {
+			key.ExternalPort = entry.ExternalPort
+		}
+	}
+	if slot < 0 && len(nat.maps) == cap(nat.maps) {
+		return nil, lneto.ErrExhausted
+	}
+	if key.ExternalPort == 0 {
+		port, ok := nat.allocPort(key, now)
+		if !ok {
+			return nil, lneto.ErrExhausted
+		}
+		key.ExternalPort = port
+	}
+	var entry *natEntry
+	if slot >= 0 {
+		entry = &nat.maps[slot]
+	} else {
+		entry = internal.SliceReclaim(&nat.maps)
+	}
+	*entry = natEntry{NATMapping: *key, lastSeen: now}
+	return entry, nil
+}
+
+// allocPort returns an external port not in use by any live mapping of the key's protocol and external address.
+func (nat *NAT44) allocPort(key *NATMapping, now int64) (uint16, bool) {
+	span := int(nat.portMax-nat.portMin) + 1
+	// Only len(maps) ports can be in use so at most len(maps)+1 candidates are checked.
+	for tries := 0; tries < span && tries <= len(nat.maps); tries++ {
+		port := nat.nextPort
+		if port < nat.portMin || port > nat.portMax {
+			port = nat.portMin
+		}
+		if port == nat.portMax {
+			nat.nextPort = nat.portMin
+		} else {
+			nat.nextPort = port + 1
+		}
+		inUse := false
+		for i := range nat.maps {
+			entry := &nat.maps[i]
+			if entry.ExternalPort == port && entry.Protocol == key.Protocol && entry.ExternalAddr == key.ExternalAddr && !nat.expired(entry, now) {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (nat *NAT44) trackTCP(entry *natEntry, fi natFrameInfo) {
+	const flagFIN, flagRST = 0x01, 0x04
+	if entry.Protocol == lneto.IPProtoTCP && fi.tcpFlags&(flagFIN|flagRST) != 0 {
+		entry.closing = true
+	}
+}
+
+func (nat *NAT44) callALG(ifrm ipv4.Frame, fi natFrameInfo, entry *natEntry, outbound bool) error {
+	for i := range nat.algs {
+		alg := &nat.algs[i]
+		if alg.Protocol != entry.Protocol || alg.Port != entry.RemotePort {
+			continue
+		}
+		modified, err := alg.Translate(ifrm.RawData()[:ifrm.TotalLength()], &entry.NATMapping, outbound)
+		if err != nil {
+			return err
+		} else if modified {
+			fi.recalculateChecksum(ifrm)
+		}
+	}
+	return nil
+}
+
+// natFrameInfo holds the parsed transport fields of a packet being translated.
+type natFrameInfo struct {
+	srcPort, dstPort       uint16
+	srcPortOff, dstPortOff int // Offsets of ports within the IP payload.
+	crcOff                 int // Offset of the transport checksum within the IP payload. -1 if checksum is unused.
+	pseudo                 bool
+	icmpErr                bool
+	tcpFlags               uint8
+}
+
+func (nat *NAT44) parse(ifrm ipv4.Frame) (fi natFrameInfo, err error) {
+	flags := ifrm.Flags()
+	if flags.FragmentOffset() != 0 {
+		return fi, lneto.ErrUnsupported
+	}
+	tl := int(ifrm.TotalLength())
+	hl := ifrm.HeaderLength()
+	if tl > len(ifrm.RawData()) || hl > tl {
+		return fi, lneto.ErrTruncatedFrame
+	}
+	payload := ifrm.RawData()[hl:tl]
+	switch ifrm.Protocol() {
+	case lneto.IPProtoTCP:
+		if len(payload) < 20 {
+			return fi, lneto.ErrTruncatedFrame
+		}
+		fi.tcpFlags = payload[13]
+		fi.crcOff = 16
+		fi.pseudo = true
+	case lneto.IPProtoUDP:
+		if len(payload) < 8 {
+			return fi, lneto.ErrTruncatedFrame
+		}
+		fi.crcOff = 6
+		fi.pseudo = true
+		if binary.BigEndian.Uint16(payload[6:8]) == 0 {
+			fi.crcOff = -1 // Checksum not in use.
+		}
+	case lneto.IPProtoICMP:
+		if len(payload) < 8 {
+			return fi, lneto.ErrTruncatedFrame
+		}
+		fi.crcOff = 2
+		switch icmpv4.Type(payload[0]) {
+		case icmpv4.TypeEcho:
+			fi.srcPortOff, fi.dstPortOff = 4, 4
+			fi.srcPort = binary.BigEndian.Uint16(payload[4:6]) // Identifier acts as port, remote port is zero.
+		case icmpv4.TypeEchoReply:
+			fi.srcPortOff, fi.dstPortOff = 4, 4
+			fi.dstPort = binary.BigEndian.Uint16(payload[4:6])
+		case icmpv4.TypeDestinationUnreachable, icmpv4.TypeTimeExceeded, icmpv4.TypeParameterProblem:
+			if len(payload) < sizeICMPErrHeader+20+8 {
+				return fi, lneto.ErrTruncatedFrame
+			}
+			fi.icmpErr = true
+		default:
+			return fi, lneto.ErrUnsupported
+		}
+		return fi, nil
+	default:
+		return fi, lneto.ErrUnsupported
+	}
+	fi.srcPortOff, fi.dstPortOff = 0, 2
+	fi.srcPort = binary.BigEndian.Uint16(payload[0:2])
+	fi.dstPort = binary.BigEndian.Uint16(payload[2:4])
+	return fi, nil
+}
+
+// rewrite sets the address pointed to by addr to newAddr and the port at portOff to newPort,
+// updating the transport checksum. The IP header checksum must be updated by the caller.
+func (fi *natFrameInfo) rewrite(ifrm ipv4.Frame, addr *[4]byte, newAddr [4]byte, portOff int, newPort uint16) {
+	payload := ifrm.Payload()
+	oldPort := binary.BigEndian.Uint16(payload[portOff:])
+	if fi.crcOff >= 0 {
+		sum := binary.BigEndian.Uint16(payload[fi.crcOff:])
+		if fi.pseudo {
+			sum = lneto.IncrementalSum32(sum, addr4u32(addr), addr4u32(&newAddr))
+		}
+		sum = lneto.IncrementalSum16(sum, oldPort, newPort)
+		if ifrm.Protocol() == lneto.IPProtoUDP {
+			sum = lneto.NeverZeroSum(sum)
+		}
+		binary.BigEndian.PutUint16(payload[fi.crcOff:], sum)
+	}
+	*addr = newAddr
+	binary.BigEndian.PutUint16(payload[portOff:], newPort)
+}
+
+// recalculateChecksum recalculates the full transport checksum of the packet after an ALG rewrite.
+func (fi *natFrameInfo) recalculateChecksum(ifrm ipv4.Frame) {
+	if fi.crcOff < 0 {
+		return
+	}
+	payload := ifrm.RawData()[ifrm.HeaderLength():ifrm.TotalLength()]
+	binary.BigEndian.PutUint16(payload[fi.crcOff:], 0)
+	var crc lneto.CRC791
+	if fi.pseudo {
+		ifrm.CRCWriteTCPPseudo(&crc) // Same pseudo header for UDP since UDP length equals IP payload length.
+	}
+	sum := crc.PayloadSum16(payload)
+	if ifrm.Protocol() == lneto.IPProtoUDP {
+		sum = lneto.NeverZeroSum(sum)
+	}
+	binary.BigEndian.PutUint16(payload[fi.crcOff:], sum)
+}
+
+func addr4u32(addr *[4]byte) uint32 { return binary.BigEndian.Uint32(addr[:]) }
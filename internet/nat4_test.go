@@ -0,0 +1,194 @@
+package internet
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+)
+
+func newTestNAT(t *testing.T, now *int64, algs ...NATALG) *NAT44 {
+	t.Helper()
+	var nat NAT44
+	err := nat.Reset(NATConfig{
+		MaxMappings: 2,
+		Nanotime:    func() int64 { return *now },
+		PortMin:     40000,
+		PortMax:     40001,
+		ALGs:        algs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &nat
+}
+
+func checkUDP4Checksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	ifrm, _ := ipv4.NewFrame(pkt)
+	if ifrm.CalculateHeaderCRC() != 0 {
+		t.Error("bad IP header checksum")
+	}
+	var crc lneto.CRC791
+	ifrm.CRCWriteUDPPseudo(&crc, uint16(len(ifrm.Payload())))
+	if crc.PayloadSum16(ifrm.Payload()) != 0 {
+		t.Error("bad UDP checksum")
+	}
+}
+
+func TestNAT44_UDP(t *testing.T) {
+	var now int64 = 1
+	nat := newTestNAT(t, &now)
+	internalAddr, externalAddr, remote := [4]byte{192, 168, 4, 2}, [4]byte{100, 64, 0, 7}, [4]byte{1, 1, 1, 1}
+	pkt := appendUDP4(nil, internalAddr, remote, 5353, 53, []byte("query"))
+	if err := nat.TranslateOutbound(pkt, externalAddr); err != nil {
+		t.Fatal(err)
+	}
+	ifrm, _ := ipv4.NewFrame(pkt)
+	extPort := binary.BigEndian.Uint16(ifrm.Payload()[0:2])
+	if *ifrm.SourceAddr() != externalAddr || extPort != 40000 {
+		t.Fatalf("bad outbound translation %v:%d", *ifrm.SourceAddr(), extPort)
+	}
+	checkUDP4Checksums(t, pkt)
+
+	// Second session from same internal endpoint reuses the external port.
+	pkt2 := appendUDP4(nil, internalAddr, [4]byte{8, 8, 8, 8}, 5353, 53, []byte("query"))
+	if err := nat.TranslateOutbound(pkt2, externalAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint16(pkt2[20:22]); got != extPort {
+		t.Errorf("want endpoint independent mapping to port %d, got %d", extPort, got)
+	}
+	// Table full.
+	pkt3 := appendUDP4(nil, [4]byte{192, 168, 4, 3}, remote, 5353, 53, []byte("query"))
+	if err := nat.TranslateOutbound(pkt3, externalAddr); err != lneto.ErrExhausted {
+		t.Errorf("want exhausted translation table, got %v", err)
+	}
+
+	reply := appendUDP4(nil, remote, externalAddr, 53, extPort, []byte("answer"))
+	translated, err := nat.TranslateInbound(reply)
+	if err != nil || !translated {
+		t.Fatal("reply not translated", err)
+	}
+	ifrm, _ = ipv4.NewFrame(reply)
+	if *ifrm.DestinationAddr() != internalAddr || binary.BigEndian.Uint16(reply[22:24]) != 5353 {
+		t.Errorf("bad inbound translation %v:%d", *ifrm.DestinationAddr(), binary.BigEndian.Uint16(reply[22:24]))
+	}
+	checkUDP4Checksums(t, reply)
+
+	// Address and port dependent filtering.
+	unsolicited := appendUDP4(nil, remote, externalAddr, 54, extPort, nil)
+	if translated, _ = nat.TranslateInbound(unsolicited); translated {
+		t.Error("packet from unknown remote port was translated")
+	}
+	// Idle timeout.
+	now += int64(2 * time.Minute)
+	reply = appendUDP4(reply[:0], remote, externalAddr, 53, extPort, []byte("answer"))
+	if translated, _ = nat.TranslateInbound(reply); translated {
+		t.Error("packet translated after mapping expired")
+	}
+	if err = nat.TranslateOutbound(pkt3, externalAddr); err != nil {
+		t.Error("expired mappings should be reused:", err)
+	}
+}
+
+func TestNAT44_ICMP(t *testing.T) {
+	var now int64 = 1
+	nat := newTestNAT(t, &now)
+	internalAddr, externalAddr, remote := [4]byte{192, 168, 4, 2}, [4]byte{100, 64, 0, 7}, [4]byte{1, 1, 1, 1}
+	echo := appendICMP4(nil, internalAddr, remote, icmpv4.TypeEcho, 0x1234)
+	if err := nat.TranslateOutbound(echo, externalAddr); err != nil {
+		t.Fatal(err)
+	}
+	var crc lneto.CRC791
+	if crc.PayloadSum16(echo[20:]) != 0 {
+		t.Error("bad ICMP checksum after outbound translation")
+	}
+	id := binary.BigEndian.Uint16(echo[24:26])
+	reply := appendICMP4(nil, remote, externalAddr, icmpv4.TypeEchoReply, id)
+	if translated, err := nat.TranslateInbound(reply); err != nil || !translated {
+		t.Fatal("echo reply not translated", err)
+	}
+	if binary.BigEndian.Uint16(reply[24:26]) != 0x1234 || [4]byte(reply[16:20]) != internalAddr {
+		t.Error("bad echo reply translation")
+	}
+	if crc.PayloadSum16(reply[20:]) != 0 {
+		t.Error("bad ICMP checksum after inbound translation")
+	}
+
+	// ICMP error quoting a translated UDP datagram (RFC 5508).
+	udpOut := appendUDP4(nil, internalAddr, remote, 7000, 33434, nil)
+	nat.TranslateOutbound(udpOut, externalAddr)
+	extPort := binary.BigEndian.Uint16(udpOut[20:22])
+	icmpErr := appendICMP4(nil, [4]byte{10, 9, 9, 9}, externalAddr, icmpv4.TypeTimeExceeded, 0)
+	icmpErr = append(icmpErr, udpOut[:28]...)
+	binary.BigEndian.PutUint16(icmpErr[2:4], uint16(len(icmpErr)))
+	icmpErr[10], icmpErr[11] = 0, 0
+	ifrm, _ := ipv4.NewFrame(icmpErr)
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	icmpErr[22], icmpErr[23] = 0, 0
+	crc.Reset()
+	binary.BigEndian.PutUint16(icmpErr[22:24], crc.PayloadSum16(icmpErr[20:]))
+
+	if translated, err := nat.TranslateInbound(icmpErr); err != nil || !translated {
+		t.Fatal("ICMP error not translated", err)
+	}
+	quote, _ := ipv4.NewFrame(icmpErr[28:])
+	if *ifrm.DestinationAddr() != internalAddr || *quote.SourceAddr() != internalAddr {
+		t.Error("bad ICMP error address translation")
+	}
+	if binary.BigEndian.Uint16(quote.Payload()[0:2]) != 7000 || extPort == 7000 {
+		t.Error("bad quoted port translation")
+	}
+	crc.Reset()
+	if ifrm.CalculateHeaderCRC() != 0 || quote.CalculateHeaderCRC() != 0 || crc.PayloadSum16(icmpErr[20:]) != 0 {
+		t.Error("bad checksums after ICMP error translation")
+	}
+}
+
+func TestNAT44_ALG(t *testing.T) {
+	var now int64 = 1
+	var calls int
+	nat := newTestNAT(t, &now, NATALG{
+		Protocol: lneto.IPProtoUDP,
+		Port:     5060,
+		Translate: func(pkt []byte, mapping *NATMapping, outbound bool) (bool, error) {
+			calls++
+			copy(pkt[28:], mapping.ExternalAddr[:])
+			return true, nil
+		},
+	})
+	pkt := appendUDP4(nil, [4]byte{192, 168, 4, 2}, [4]byte{1, 1, 1, 1}, 5060, 5060, []byte{192, 168, 4, 2})
+	if err := nat.TranslateOutbound(pkt, [4]byte{100, 64, 0, 7}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || [4]byte(pkt[28:32]) != [4]byte{100, 64, 0, 7} {
+		t.Error("ALG did not rewrite payload")
+	}
+	checkUDP4Checksums(t, pkt)
+}
+
+// appendICMP4 appends an IPv4+ICMP echo or error header (8 bytes) with valid checksums to dst.
+func appendICMP4(dst []byte, src, dstAddr [4]byte, icmpType icmpv4.Type, id uint16) []byte {
+	const hdrlen = 20 + 8
+	off := len(dst)
+	dst = append(dst, make([]byte, hdrlen)...)
+	buf := dst[off:]
+	ifrm, _ := ipv4.NewFrame(buf)
+	ifrm.SetVersionAndIHL(4, 5)
+	ifrm.SetTotalLength(hdrlen)
+	ifrm.SetTTL(64)
+	ifrm.SetProtocol(lneto.IPProtoICMP)
+	*ifrm.SourceAddr() = src
+	*ifrm.DestinationAddr() = dstAddr
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	buf[20] = byte(icmpType)
+	binary.BigEndian.PutUint16(buf[24:26], id)
+	binary.BigEndian.PutUint16(buf[26:28], 1)
+	var crc lneto.CRC791
+	binary.BigEndian.PutUint16(buf[22:24], crc.PayloadSum16(buf[20:]))
+	return dst
+}
@@ -0,0 +1,411 @@
+package internet
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/arp"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+)
+
+// RouteIPv4 is a static route of a [RouterIPv4].
+type RouteIPv4 struct {
+	// Destination is the network reachable through this route.
+	Destination ipv4.Prefix
+	// Gateway is the next hop address. The zero value means the destination network is directly
+	// connected to the interface and packets are sent to their destination address.
+	Gateway [4]byte
+	// Interface is the index of the egress interface as returned by [RouterIPv4.AddInterface].
+	Interface int
+}
+
+// RouterIPv4Config configures a [RouterIPv4].
+type RouterIPv4Config struct {
+	// MaxRoutes is the capacity of the route table.
+	MaxRoutes int
+	// MaxInterfaces is the maximum amount of interfaces that can be added to the router.
+	MaxInterfaces int
+}
+
+// RouterInterfaceConfig configures an interface added with [RouterIPv4.AddInterface].
+type RouterInterfaceConfig struct {
+	// Local is the IPv4 stack of the interface. It receives packets addressed to the
+	// interface's address as well as broadcast and multicast traffic. Its address is used
+	// as the source of ICMP errors generated by the router on this interface.
+	Local *StackIPv4
+	// ARP is the ARP handler registered on the interface's link. It is used to resolve next hop hardware addresses.
+	ARP *arp.Handler
+	// QueueBuffer stores packets pending forwarding out of this interface.
+	QueueBuffer []byte
+	// QueueLimit is the maximum number of packets pending forwarding out of this interface.
+	QueueLimit int
+	// MTU is the maximum IP packet size that can be sent out of this interface. Defaults to 1500.
+	MTU int
+	// NAT, if set, masquerades packets forwarded out of this interface behind the interface's address.
+	// Received packets addressed to the interface are translated back and forwarded if they belong to a NAT mapping.
+	NAT *NAT44
+}
+
+// RouterStats holds the forwarding counters of a [RouterIPv4].
+type RouterStats struct {
+	// Forwarded counts packets sent out of an egress interface.
+	Forwarded uint64
+	// NoRoute counts packets dropped due to no matching route.
+	NoRoute uint64
+	// TTLExceeded counts packets dropped due to their TTL expiring.
+	TTLExceeded uint64
+	// NoNextHop counts packets dropped due to an unresolved next hop hardware address.
+	NoNextHop uint64
+	// QueueFull counts packets dropped due to a full egress queue.
+	QueueFull uint64
+	// TooBig counts packets dropped due to exceeding the egress interface MTU.
+	TooBig uint64
+}
+
+// RouterIPv4 is a static IPv4 router that forwards packets between several [StackEthernet] links.
+// Each interface is represented by a [RouterPort] which must be registered on the interface's
+// [StackEthernet] in place of the interface's [StackIPv4]. Routes are selected by longest prefix match.
+//
+// All interfaces are meant to be driven from one event loop:
+//
+//	for {
+//		for i := range links {
+//			n := nics[i].Recv(rxbuf)
+//			links[i].Demux(rxbuf[:n], 0)
+//			n, _ = links[i].Encapsulate(txbuf, -1, 0)
+//			nics[i].Send(txbuf[:n])
+//		}
+//	}
+type RouterIPv4 struct {
+	routes []RouteIPv4
+	ports  []RouterPort
+	stats  RouterStats
+	vld    lneto.Validator
+	// scratch is used to build ICMP errors.
+	scratch [20 + sizeICMPErrHeader + sizeICMPQuote]byte
+	logger
+}
+
+// RouterPort is the StackNode of a [RouterIPv4] interface. It handles IPv4 packets for its link,
+// delivering local traffic to the interface's [StackIPv4] and forwarding the rest.
+type RouterPort struct {
+	connID  uint64
+	router  *RouterIPv4
+	local   *StackIPv4
+	arp     *arp.Handler
+	queue   internal.Ring
+	pending []fwdPacket
+	nat     *NAT44
+	mtu     uint16
+}
+
+type fwdPacket struct {
+	length  uint16
+	nexthop [4]byte
+}
+
+var _ lneto.StackNode = (*RouterPort)(nil)
+
+// Reset clears the route table and removes all interfaces.
+func (r *RouterIPv4) Reset(cfg RouterIPv4Config) error {
+	if cfg.MaxRoutes <= 0 || cfg.MaxInterfaces <= 0 {
+		return lneto.ErrInvalidConfig
+	}
+	for i := range r.ports {
+		r.ports[i].connID++ // Invalidate ports registered on links.
+	}
+	internal.SliceReuse(&r.routes, cfg.MaxRoutes)
+	internal.SliceReuse(&r.ports, cfg.MaxInterfaces)
+	r.stats = RouterStats{}
+	return nil
+}
+
+// SetLogger sets the router's logger.
+func (r *RouterIPv4) SetLogger(log *slog.Logger) { r.log = log }
+
+// Stats returns the router's forwarding counters.
+func (r *RouterIPv4) Stats() RouterStats { return r.stats }
+
+// AddInterface adds an interface to the router and returns the interface index and the
+// [RouterPort] to register on the interface's [StackEthernet].
+func (r *RouterIPv4) AddInterface(cfg RouterInterfaceConfig) (idx int, port *RouterPort, err error) {
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+	if cfg.Local == nil || cfg.ARP == nil || len(cfg.QueueBuffer) < ipv4.MinimumMTU || cfg.QueueLimit <= 0 {
+		return -1, nil, lneto.ErrInvalidConfig
+	} else if mtu < ipv4.MinimumMTU || mtu > ethernet.MaxMTU {
+		return -1, nil, lneto.ErrInvalidConfig
+	} else if len(r.ports) == cap(r.ports) {
+		return -1, nil, lneto.ErrExhausted
+	}
+	idx = len(r.ports)
+	port = internal.SliceReclaim(&r.ports)
+	port.connID++
+	port.router = r
+	port.local = cfg.Local
+	port.arp = cfg.ARP
+	port.queue = internal.Ring{Buf: cfg.QueueBuffer}
+	port.mtu = uint16(mtu)
+	port.nat = cfg.NAT
+	internal.SliceReuse(&port.pending, cfg.QueueLimit)
+	return idx, port, nil
+}
+
+// AddRoute adds a static route. Adding a route with a destination already present replaces it.
+func (r *RouterIPv4) AddRoute(route RouteIPv4) error {
+	if !route.Destination.IsValid() {
+		return lneto.ErrInvalidAddr
+	} else if route.Interface < 0 || route.Interface >= len(r.ports) {
+		return lneto.ErrInvalidConfig
+	}
+	route.Destination = route.Destination.Masked()
+	for i := range r.routes {
+		if r.routes[i].Destination == route.Destination {
+			r.routes[i] = route
+			return nil
+		}
+	}
+	if len(r.routes) == cap(r.routes) {
+		return lneto.ErrExhausted
+	}
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+// RemoveRoute removes the route to destination.
+func (r *RouterIPv4) RemoveRoute(destination ipv4.Prefix) error {
+	destination = destination.Masked()
+	for i := range r.routes {
+		if r.routes[i].Destination == destination {
+			r.routes = append(r.routes[:i], r.routes[i+1:]...)
+			return nil
+		}
+	}
+	return lneto.ErrInvalidAddr
+}
+
+// LookupRoute returns the longest prefix match route to dst.
+func (r *RouterIPv4) LookupRoute(dst [4]byte) (route RouteIPv4, ok bool) {
+	best := -1
+	for i := range r.routes {
+		if r.routes[i].Destination.Contains(dst) && (best < 0 || r.routes[i].Destination.Bits() > r.routes[best].Destination.Bits()) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return route, false
+	}
+	return r.routes[best], true
+}
+
+// forward routes the packet in ifrm received on port in. It consumes the packet in place.
+func (r *RouterIPv4) forward(in *RouterPort, ifrm ipv4.Frame) error {
+	dst := *ifrm.DestinationAddr()
+	route, ok := r.LookupRoute(dst)
+	if !ok {
+		r.stats.NoRoute++
+		r.debug("router:no-route", internal.SlogAddr4("dst", &dst))
+		r.queueICMPError(in, ifrm, icmpv4.TypeDestinationUnreachable, uint8(icmpv4.CodeNetUnreachable), 0)
+		return lneto.ErrPacketDrop
+	}
+	ttl := ifrm.TTL()
+	if ttl <= 1 {
+		r.stats.TTLExceeded++
+		r.queueICMPError(in, ifrm, icmpv4.TypeTimeExceeded, uint8(icmpv4.CodeExceededInTransit), 0)
+		return lneto.ErrPacketDrop
+	}
+	// RFC 1812 §5.3.1: Decrement TTL and update checksum incrementally (RFC 1624).
+	oldWord := binary.BigEndian.Uint16(ifrm.RawData()[8:10])
+	ifrm.SetTTL(ttl - 1)
+	newWord := binary.BigEndian.Uint16(ifrm.RawData()[8:10])
+	ifrm.SetCRC(lneto.IncrementalSum16(ifrm.CRC(), oldWord, newWord))
+	out := &r.ports[route.Interface]
+	if ifrm.TotalLength() > out.mtu {
+		// Fragmentation is not supported.
+		r.stats.TooBig++
+		if ifrm.Flags().DontFragment() {
+			r.queueICMPError(in, ifrm, icmpv4.TypeDestinationUnreachable, uint8(icmpv4.CodeFragNeededAndDFSet), out.mtu)
+		}
+		return lneto.ErrPacketDrop
+	}
+	if out.nat != nil && out != in {
+		err := out.nat.TranslateOutbound(ifrm.RawData(), out.local.Addr4())
+		if err != nil {
+			r.debug("router:nat", slog.String("err", err.Error()))
+			return lneto.ErrPacketDrop
+		}
+	}
+	nexthop := route.Gateway
+	if nexthop == ([4]byte{}) {
+		nexthop = dst
+	}
+	pkt := ifrm.RawData()[:ifrm.TotalLength()]
+	return out.enqueue(pkt, nexthop)
+}
+
+// queueICMPError queues an ICMP error in response to the offending packet in ifrm received on port in.
+func (r *RouterIPv4) queueICMPError(in *RouterPort, ifrm ipv4.Frame, icmpType icmpv4.Type, icmpCode uint8, mtu uint16) {
+	src := *ifrm.SourceAddr()
+	ourAddr := in.local.Addr4()
+	if ourAddr == ([4]byte{}) || src == ([4]byte{}) || ipv4.IsBroadcast(src) || ipv4.IsMulticast(src) ||
+		ipv4.IsMulticast(*ifrm.DestinationAddr()) || ipv4.IsBroadcast(*ifrm.DestinationAddr()) {
+		return // RFC 1122 §3.2.2: ICMP errors are not sent in response to these packets.
+	} else if ifrm.Flags().FragmentOffset() != 0 {
+		return // Only first fragment elicits ICMP errors.
+	} else if ifrm.Protocol() == lneto.IPProtoICMP && len(ifrm.Payload()) > 0 && !isICMPQuery(icmpv4.Type(ifrm.Payload()[0])) {
+		return // Never send ICMP errors about ICMP errors.
+	}
+	route, ok := r.LookupRoute(src)
+	if !ok {
+		return
+	}
+	nexthop := route.Gateway
+	if nexthop == ([4]byte{}) {
+		nexthop = src
+	}
+	hdrlen := ifrm.HeaderLength()
+	quote := ifrm.RawData()[:min(int(ifrm.TotalLength()), hdrlen+8, sizeICMPQuote)]
+	const ihl = 5
+	n := 20 + sizeICMPErrHeader + len(quote)
+	pkt := r.scratch[:n]
+	efrm, _ := ipv4.NewFrame(pkt)
+	efrm.ClearHeader()
+	efrm.SetVersionAndIHL(4, ihl)
+	efrm.SetTotalLength(uint16(n))
+	efrm.SetID(internal.Prand16(ifrm.ID() ^ uint16(n)))
+	efrm.SetTTL(64)
+	efrm.SetProtocol(lneto.IPProtoICMP)
+	*efrm.SourceAddr() = ourAddr
+	*efrm.DestinationAddr() = src
+	efrm.SetCRC(efrm.CalculateHeaderCRC())
+	icmp := pkt[20:]
+	clear(icmp[:sizeICMPErrHeader])
+	icmp[0] = byte(icmpType)
+	icmp[1] = icmpCode
+	binary.BigEndian.PutUint16(icmp[6:8], mtu) // Next-Hop MTU, RFC 1191 §4.
+	copy(icmp[sizeICMPErrHeader:], quote)
+	var crc lneto.CRC791
+	binary.BigEndian.PutUint16(icmp[2:4], crc.PayloadSum16(icmp))
+	r.ports[route.Interface].enqueue(pkt, nexthop)
+}
+
+func isICMPQuery(icmpType icmpv4.Type) bool {
+	switch icmpType {
+	case icmpv4.TypeEchoReply, icmpv4.TypeEcho, icmpv4.TypeTimestamp, icmpv4.TypeTimestampReply,
+		icmpv4.TypeInfoRequest, icmpv4.TypeInfoRequestReply:
+		return true
+	}
+	return false
+}
+
+func (port *RouterPort) enqueue(pkt []byte, nexthop [4]byte) error {
+	r := port.router
+	if len(port.pending) == cap(port.pending) || port.queue.Free() < len(pkt) {
+		r.stats.QueueFull++
+		return lneto.ErrBufferFull
+	}
+	_, err := port.queue.Write(pkt)
+	if err != nil {
+		r.stats.QueueFull++
+		return err
+	}
+	port.pending = append(port.pending, fwdPacket{length: uint16(len(pkt)), nexthop: nexthop})
+	return nil
+}
+
+// Pending returns the number of packets pending forwarding out of the port.
+func (port *RouterPort) Pending() int { return len(port.pending) }
+
+func (port *RouterPort) LocalPort() uint16 { return 0 }
+
+func (port *RouterPort) Protocol() uint64 { return uint64(ethernet.TypeIPv4) }
+
+func (port *RouterPort) ConnectionID() *uint64 { return &port.connID }
+
+// Demux delivers packets addressed to the interface to its local stack and forwards the rest.
+func (port *RouterPort) Demux(carrierData []byte, offset int) error {
+	r := port.router
+	ifrm, err := ipv4.NewFrame(carrierData[offset:])
+	if err != nil {
+		return err
+	}
+	dst := *ifrm.DestinationAddr()
+	if ipv4.IsBroadcast(dst) || ipv4.IsMulticast(dst) {
+		return port.local.Demux(carrierData, offset)
+	}
+	if port.nat != nil && dst == port.local.Addr4() && dst != ([4]byte{}) {
+		if err = r.validate(ifrm); err != nil {
+			return err
+		}
+		translated, err := port.nat.TranslateInbound(ifrm.RawData())
+		if err != nil {
+			return err
+		} else if translated {
+			return r.forward(port, ifrm)
+		}
+	}
+	for i := range r.ports {
+		if local := r.ports[i].local; local.Addr4() == dst {
+			return local.Demux(carrierData, offset)
+		}
+	}
+	if port.local.Addr4() == ([4]byte{}) {
+		return port.local.Demux(carrierData, offset) // Interface not yet configured, i.e: during DHCP.
+	}
+	if err = r.validate(ifrm); err != nil {
+		return err
+	}
+	return r.forward(port, ifrm)
+}
+
+func (r *RouterIPv4) validate(ifrm ipv4.Frame) error {
+	r.vld.ResetErr()
+	ifrm.ValidateExceptCRC(&r.vld)
+	if err := r.vld.ErrPop(); err != nil {
+		return err
+	} else if ifrm.CalculateHeaderCRC() != 0 {
+		return lneto.ErrBadCRC
+	}
+	return nil
+}
+
+// Encapsulate writes packets originating from the local stack and then packets pending forwarding.
+func (port *RouterPort) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	n, err := port.local.Encapsulate(carrierData, offsetToIP, offsetToFrame)
+	if n > 0 || err != nil {
+		return n, err
+	}
+	r := port.router
+	for len(port.pending) > 0 {
+		pkt := port.pending[0]
+		port.pending = port.pending[:copy(port.pending, port.pending[1:])]
+		dst := carrierData[offsetToFrame:]
+		if int(pkt.length) > len(dst) {
+			r.stats.TooBig++ // Link MTU smaller than configured interface MTU.
+			port.queue.ReadDiscard(int(pkt.length))
+			continue
+		}
+		hwaddr, err := port.arp.CacheLookup(pkt.nexthop[:])
+		if err != nil {
+			// Drop packet and resolve next hop so that subsequent packets are forwarded.
+			r.stats.NoNextHop++
+			port.queue.ReadDiscard(int(pkt.length))
+			port.arp.StartQuery(pkt.nexthop[:], false)
+			continue
+		}
+		port.queue.Read(dst[:pkt.length])
+		if offsetToFrame >= 14 {
+			efrm, _ := ethernet.NewFrame(carrierData[offsetToFrame-14:])
+			*efrm.DestinationHardwareAddr() = [6]byte(hwaddr)
+		}
+		r.stats.Forwarded++
+		return int(pkt.length), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,270 @@
+package internet
+
+import (
+	"testing"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/arp"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+)
+
+type testRouterLink struct {
+	link  StackEthernet
+	local StackIPv4
+	arp   arp.Handler
+	port  *RouterPort
+}
+
+func newTestRouter(t *testing.T, macs [][6]byte, addrs [][4]byte) (*RouterIPv4, []*testRouterLink) {
+	t.Helper()
+	var r RouterIPv4
+	err := r.Reset(RouterIPv4Config{MaxRoutes: 4, MaxInterfaces: len(macs)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make([]*testRouterLink, len(macs))
+	for i := range macs {
+		l := new(testRouterLink)
+		links[i] = l
+		err = l.link.Configure(StackEthernetConfig{MTU: 1500, MaxNodes: 2, MAC: macs[i], Gateway: ethernet.BroadcastAddr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.local.Reset(new(lneto.Validator), 1)
+		l.local.SetAddr4(addrs[i])
+		err = l.arp.Reset(arp.HandlerConfig{
+			HardwareAddr: macs[i][:],
+			ProtocolAddr: addrs[i][:],
+			MaxQueries:   2,
+			MaxPending:   2,
+			HardwareType: 1,
+			ProtocolType: ethernet.TypeIPv4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, l.port, err = r.AddInterface(RouterInterfaceConfig{
+			Local:       &l.local,
+			ARP:         &l.arp,
+			QueueBuffer: make([]byte, 2048),
+			QueueLimit:  4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = l.link.RegisterEthernet(&l.arp); err != nil {
+			t.Fatal(err)
+		}
+		if err = l.link.RegisterEthernet(l.port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &r, links
+}
+
+func appendEthernet(dst []byte, dstMAC, srcMAC [6]byte, etype ethernet.Type, payload []byte) []byte {
+	dst = append(dst, dstMAC[:]...)
+	dst = append(dst, srcMAC[:]...)
+	dst = append(dst, byte(etype>>8), byte(etype))
+	dst = append(dst, payload...)
+	for len(dst) < 60 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func TestRouterIPv4_LongestPrefixMatch(t *testing.T) {
+	r, _ := newTestRouter(t, [][6]byte{{0x2: 1}, {0x2: 2}}, [][4]byte{{10, 0, 1, 1}, {10, 0, 2, 1}})
+	gateway := [4]byte{10, 0, 1, 254}
+	routes := []RouteIPv4{
+		{Destination: ipv4.PrefixFrom([4]byte{}, 0), Gateway: gateway, Interface: 0},
+		{Destination: ipv4.PrefixFrom([4]byte{10, 0, 1, 0}, 24), Interface: 0},
+		{Destination: ipv4.PrefixFrom([4]byte{10, 0, 2, 0}, 24), Interface: 1},
+		{Destination: ipv4.PrefixFrom([4]byte{10, 0, 2, 128}, 25), Gateway: [4]byte{10, 0, 2, 3}, Interface: 1},
+	}
+	for _, route := range routes {
+		if err := r.AddRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		dst  [4]byte
+		want int
+	}{
+		{dst: [4]byte{8, 8, 8, 8}, want: 0},
+		{dst: [4]byte{10, 0, 1, 9}, want: 1},
+		{dst: [4]byte{10, 0, 2, 9}, want: 2},
+		{dst: [4]byte{10, 0, 2, 200}, want: 3},
+	}
+	for _, test := range tests {
+		got, ok := r.LookupRoute(test.dst)
+		if !ok {
+			t.Fatalf("no route to %v", test.dst)
+		}
+		want := routes[test.want]
+		want.Destination = want.Destination.Masked()
+		if got != want {
+			t.Errorf("route to %v: want %+v, got %+v", test.dst, routes[test.want], got)
+		}
+	}
+	if err := r.RemoveRoute(routes[0].Destination); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.LookupRoute([4]byte{8, 8, 8, 8}); ok {
+		t.Error("expected no route after default route removal")
+	}
+}
+
+func TestRouterIPv4_Forward(t *testing.T) {
+	macR0, macR1 := [6]byte{0x2, 0, 0, 0, 0, 1}, [6]byte{0x2, 0, 0, 0, 0, 2}
+	macA, macB := [6]byte{0x2, 0, 0, 0, 0, 0xa}, [6]byte{0x2, 0, 0, 0, 0, 0xb}
+	hostA, hostB := [4]byte{10, 0, 1, 2}, [4]byte{10, 0, 2, 2}
+	r, links := newTestRouter(t, [][6]byte{macR0, macR1}, [][4]byte{{10, 0, 1, 1}, {10, 0, 2, 1}})
+	r.AddRoute(RouteIPv4{Destination: ipv4.PrefixFrom([4]byte{10, 0, 1, 0}, 24), Interface: 0})
+	r.AddRoute(RouteIPv4{Destination: ipv4.PrefixFrom([4]byte{10, 0, 2, 0}, 24), Interface: 1})
+	links[1].arp.CacheSeed(hostB[:], macB[:])
+	links[0].arp.CacheSeed(hostA[:], macA[:])
+
+	payload := []byte("routed payload")
+	pkt := appendUDP4(nil, hostA, hostB, 1000, 2000, payload)
+	frame := appendEthernet(nil, macR0, macA, ethernet.TypeIPv4, pkt)
+	if err := links[0].link.Demux(frame, 0); err != nil {
+		t.Fatal(err)
+	}
+	var buf [1600]byte
+	n, err := links[1].link.Encapsulate(buf[:], -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected forwarded packet on egress link")
+	}
+	efrm, _ := ethernet.NewFrame(buf[:n])
+	if *efrm.DestinationHardwareAddr() != macB || *efrm.SourceHardwareAddr() != macR1 {
+		t.Errorf("bad ethernet addressing dst=%x src=%x", *efrm.DestinationHardwareAddr(), *efrm.SourceHardwareAddr())
+	}
+	ifrm, _ := ipv4.NewFrame(efrm.Payload())
+	if ifrm.TTL() != 63 {
+		t.Errorf("want TTL 63, got %d", ifrm.TTL())
+	}
+	if ifrm.CalculateHeaderCRC() != 0 {
+		t.Error("bad IP checksum after TTL decrement")
+	}
+	if string(ifrm.Payload()[8:int(ifrm.TotalLength())-20]) != string(payload) {
+		t.Error("payload mismatch")
+	}
+	if r.Stats().Forwarded != 1 {
+		t.Errorf("want 1 forwarded packet, got %d", r.Stats().Forwarded)
+	}
+
+	// TTL expiry generates ICMP Time Exceeded back to source.
+	ttl1 := appendUDP4(nil, hostA, hostB, 1000, 2000, payload)
+	ifrm, _ = ipv4.NewFrame(ttl1)
+	ifrm.SetTTL(1)
+	ifrm.SetCRC(0)
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	frame = appendEthernet(frame[:0], macR0, macA, ethernet.TypeIPv4, ttl1)
+	if err = links[0].link.Demux(frame, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want drop on TTL expiry, got", err)
+	}
+	if n, _ = links[1].link.Encapsulate(buf[:], -1, 0); n != 0 {
+		t.Fatal("packet with expired TTL was forwarded")
+	}
+	n, err = links[0].link.Encapsulate(buf[:], -1, 0)
+	if err != nil || n == 0 {
+		t.Fatal("expected ICMP time exceeded", n, err)
+	}
+	efrm, _ = ethernet.NewFrame(buf[:n])
+	ifrm, _ = ipv4.NewFrame(efrm.Payload())
+	if ifrm.Protocol() != lneto.IPProtoICMP || *ifrm.DestinationAddr() != hostA || *efrm.DestinationHardwareAddr() != macA {
+		t.Fatalf("bad ICMP error addressing: %s", ifrm.String())
+	}
+	icmp, _ := icmpv4.NewFrame(ifrm.Payload())
+	if icmp.Type() != icmpv4.TypeTimeExceeded {
+		t.Errorf("want time exceeded, got %s", icmp.Type())
+	}
+	var crc lneto.CRC791
+	if crc.PayloadSum16(ifrm.Payload()[:int(ifrm.TotalLength())-20]) != 0 {
+		t.Error("bad ICMP checksum")
+	}
+}
+
+func TestRouterIPv4_ResolveNextHop(t *testing.T) {
+	macR0, macR1 := [6]byte{0x2, 0, 0, 0, 0, 1}, [6]byte{0x2, 0, 0, 0, 0, 2}
+	macA := [6]byte{0x2, 0, 0, 0, 0, 0xa}
+	hostA, hostB := [4]byte{10, 0, 1, 2}, [4]byte{10, 0, 2, 2}
+	r, links := newTestRouter(t, [][6]byte{macR0, macR1}, [][4]byte{{10, 0, 1, 1}, {10, 0, 2, 1}})
+	r.AddRoute(RouteIPv4{Destination: ipv4.PrefixFrom([4]byte{10, 0, 2, 0}, 24), Interface: 1})
+	pkt := appendUDP4(nil, hostA, hostB, 1000, 2000, []byte("x"))
+	frame := appendEthernet(nil, macR0, macA, ethernet.TypeIPv4, pkt)
+	if err := links[0].link.Demux(frame, 0); err != nil {
+		t.Fatal(err)
+	}
+	var buf [1600]byte
+	n, err := links[1].link.Encapsulate(buf[:], -1, 0)
+	if err != nil || n != 0 {
+		t.Fatal("packet with unresolved next hop should be dropped", n, err)
+	}
+	n, err = links[1].link.Encapsulate(buf[:], -1, 0)
+	if err != nil || n == 0 {
+		t.Fatal("expected ARP request on egress link", n, err)
+	}
+	efrm, _ := ethernet.NewFrame(buf[:n])
+	if efrm.EtherTypeOrSize() != ethernet.TypeARP {
+		t.Fatalf("want ARP request, got %s", efrm.EtherTypeOrSize())
+	}
+	afrm, _ := arp.NewFrame(efrm.Payload())
+	_, target := afrm.Target4()
+	if *target != hostB {
+		t.Errorf("want ARP query for %v, got %v", hostB, *target)
+	}
+	if r.Stats().NoNextHop != 1 {
+		t.Errorf("want 1 unresolved next hop drop, got %d", r.Stats().NoNextHop)
+	}
+}
+
+func TestRouterIPv4_NAT(t *testing.T) {
+	var now int64 = 1
+	macR0, macR1 := [6]byte{0x2, 0, 0, 0, 0, 1}, [6]byte{0x2, 0, 0, 0, 0, 2}
+	macA, macUp := [6]byte{0x2, 0, 0, 0, 0, 0xa}, [6]byte{0x2, 0, 0, 0, 0, 0xf}
+	hostA, wanAddr, upstream, remote := [4]byte{192, 168, 4, 2}, [4]byte{100, 64, 0, 7}, [4]byte{100, 64, 0, 1}, [4]byte{1, 1, 1, 1}
+	var nat NAT44
+	if err := nat.Reset(NATConfig{MaxMappings: 4, Nanotime: func() int64 { return now }}); err != nil {
+		t.Fatal(err)
+	}
+	r, links := newTestRouter(t, [][6]byte{macR0, macR1}, [][4]byte{{192, 168, 4, 1}, wanAddr})
+	links[1].port.nat = &nat
+	r.AddRoute(RouteIPv4{Destination: ipv4.PrefixFrom([4]byte{192, 168, 4, 0}, 24), Interface: 0})
+	r.AddRoute(RouteIPv4{Destination: ipv4.PrefixFrom([4]byte{}, 0), Gateway: upstream, Interface: 1})
+	links[0].arp.CacheSeed(hostA[:], macA[:])
+	links[1].arp.CacheSeed(upstream[:], macUp[:])
+
+	var buf [1600]byte
+	pkt := appendUDP4(nil, hostA, remote, 5000, 53, []byte("query"))
+	if err := links[0].link.Demux(appendEthernet(nil, macR0, macA, ethernet.TypeIPv4, pkt), 0); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := links[1].link.Encapsulate(buf[:], -1, 0)
+	if n == 0 {
+		t.Fatal("expected masqueraded packet")
+	}
+	ifrm, _ := ipv4.NewFrame(buf[14:n])
+	if *ifrm.SourceAddr() != wanAddr || *(*[6]byte)(buf[:6]) != macUp {
+		t.Fatalf("bad masquerade: %s", ifrm.String())
+	}
+	extPort := nat.Mapping(0).ExternalPort
+	reply := appendUDP4(nil, remote, wanAddr, 53, extPort, []byte("answer"))
+	if err := links[1].link.Demux(appendEthernet(nil, macR1, macUp, ethernet.TypeIPv4, reply), 0); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = links[0].link.Encapsulate(buf[:], -1, 0)
+	if n == 0 {
+		t.Fatal("expected translated reply")
+	}
+	ifrm, _ = ipv4.NewFrame(buf[14:n])
+	if *ifrm.DestinationAddr() != hostA || *(*[6]byte)(buf[:6]) != macA {
+		t.Fatalf("bad reply translation: %s", ifrm.String())
+	}
+	checkUDP4Checksums(t, buf[14:n])
+}
@@ -30,6 +30,16 @@ type StackEthernetConfig struct {
 	AppendCRC32 bool
 	// CRC32Update is a IEEE CRC32 implementation that should be provided if AppendCRC32 is set.
 	CRC32Update func(crc uint32, p []byte) uint32
+	// VLANID is the IEEE 802.1Q VLAN identifier of the stack's default VLAN. If non-zero,
+	// frames sent by nodes registered with [StackEthernet.RegisterEthernet] are tagged with VLANID
+	// and only received frames tagged with VLANID are delivered to them. Must be less than 4095.
+	VLANID uint16
+	// VLANPriority is the IEEE 802.1p priority code point (0..7) of tagged frames.
+	// A non-zero priority with zero VLANID sends priority tagged frames (VLAN ID 0).
+	VLANPriority uint8
+	// ServiceVLANID, if non-zero, is the IEEE 802.1ad service VLAN identifier (QinQ). Sent frames
+	// carry an outer service tag and received frames must carry a matching service tag. Must be less than 4095.
+	ServiceVLANID uint16
 }
 
 type StackEthernet struct {
@@ -39,6 +49,12 @@ type StackEthernet struct {
 	gwmac           [6]byte
 	mtu             uint16
 	acceptMulticast bool
+	// vlan is the tag of the default VLAN, zero if untagged.
+	vlan ethernet.VLANTag
+	// svid is the 802.1ad service VLAN ID, zero if not double tagging.
+	svid uint16
+	// trunk is set when nodes are registered on VLANs other than the default VLAN.
+	trunk bool
 
 	onSend func(p []byte)
 	// crcupdate set when crc32 has been configured to be appended.
@@ -91,6 +107,8 @@ func (ls *StackEthernet) Configure(cfg StackEthernetConfig) error {
 		return lneto.ErrInvalidConfig
 	} else if cfg.AppendCRC32 && cfg.CRC32Update == nil {
 		return lneto.ErrInvalidConfig
+	} else if cfg.VLANID >= 0xfff || cfg.ServiceVLANID >= 0xfff || cfg.VLANPriority > 7 {
+		return lneto.ErrInvalidConfig
 	}
 	ls.handlers.reset("StackEthernet", cfg.MaxNodes)
 	*ls = StackEthernet{
@@ -100,6 +118,8 @@ func (ls *StackEthernet) Configure(cfg StackEthernetConfig) error {
 		gwmac:           cfg.Gateway,
 		mtu:             uint16(cfg.MTU),
 		acceptMulticast: ls.acceptMulticast,
+		vlan:            ethernet.NewVLANTag(cfg.VLANPriority, false, cfg.VLANID),
+		svid:            cfg.ServiceVLANID,
 	}
 	if cfg.AppendCRC32 {
 		ls.crcupdate = cfg.CRC32Update
@@ -107,10 +127,11 @@ func (ls *StackEthernet) Configure(cfg StackEthernetConfig) error {
 	return nil
 }
 
-// MaxFrameLength returns the maximum ethernet frame length in bytes, which is the MTU plus the Ethernet header (14 bytes) and CRC (4 bytes if enabled).
+// MaxFrameLength returns the maximum ethernet frame length in bytes, which is the MTU plus the Ethernet header (14 bytes),
+// VLAN tags (4 bytes each, if configured) and CRC (4 bytes if enabled).
 // This is the maximum size of an Ethernet frame that can be sent from the stack.
 func (ls *StackEthernet) MaxFrameLength() int {
-	base := int(ls.mtu) + 14
+	base := int(ls.mtu) + ls.maxHeaderLength()
 	if ls.crcupdate != nil {
 		base += 4
 	}
@@ -128,12 +149,49 @@ func (ls *StackEthernet) LocalPort() uint16 { return 0 }
 
 func (ls *StackEthernet) Protocol() uint64 { return 1 }
 
+// RegisterEthernet registers a node on the stack's default VLAN, which is untagged unless
+// [StackEthernetConfig.VLANID] is set. Nodes are demultiplexed by their EtherType protocol.
 func (ls *StackEthernet) RegisterEthernet(h lneto.StackNode) error {
+	return ls.register(0, h)
+}
+
+// RegisterEthernetVLAN registers a node on the VLAN with identifier vid, allowing several
+// stacks to share a trunk link. Frames sent by the node are tagged with vid and
+// only received frames tagged with vid are delivered to it.
+func (ls *StackEthernet) RegisterEthernetVLAN(vid uint16, h lneto.StackNode) error {
+	if vid == 0 || vid >= 0xfff || vid == ls.vlan.VLANIdentifier() {
+		return lneto.ErrInvalidConfig // Default VLAN nodes are registered with RegisterEthernet.
+	}
+	err := ls.register(vid, h)
+	if err == nil {
+		ls.trunk = true
+	}
+	return err
+}
+
+func (ls *StackEthernet) register(vid uint16, h lneto.StackNode) error {
 	proto := h.Protocol()
 	if proto > math.MaxUint16 || proto <= 1500 {
 		return lneto.ErrInvalidConfig
 	}
-	return ls.handlers.registerByProto(nodeFromStackNode(h, 0, proto, nil))
+	// VLAN ID stored as node port so that nodes are registered by VLAN and EtherType.
+	return ls.handlers.registerByPortProto(nodeFromStackNode(h, vid, proto, nil))
+}
+
+// headerLength returns the length of the Ethernet header of frames sent by the stack.
+func (ls *StackEthernet) headerLength(tagged bool) int {
+	hl := 14
+	if ls.svid != 0 {
+		hl += 4
+	}
+	if tagged {
+		hl += 4
+	}
+	return hl
+}
+
+func (ls *StackEthernet) maxHeaderLength() int {
+	return ls.headerLength(ls.vlan != 0 || ls.trunk)
 }
 
 func (ls *StackEthernet) Demux(carrierData []byte, frameOffset int) (err error) {
@@ -145,6 +203,8 @@ func (ls *StackEthernet) Demux(carrierData []byte, frameOffset int) (err error)
 	etype := efrm.EtherTypeOrSize()
 	dstaddr := efrm.DestinationHardwareAddr()
 	var vld lneto.Validator
+	var payload []byte
+	var vid uint16
 	if !efrm.IsBroadcast() && ls.mac != *dstaddr {
 		if !ls.acceptMulticast || dstaddr[0]&1 == 0 {
 			goto DROP
@@ -154,7 +214,16 @@ func (ls *StackEthernet) Demux(carrierData []byte, frameOffset int) (err error)
 	if vld.HasError() {
 		return vld.ErrPop()
 	}
-	if h, err := ls.handlers.demuxByProto(efrm.Payload(), 0, uint16(etype)); h != nil {
+	payload, vid, etype = ls.untag(efrm)
+	if payload == nil {
+		goto DROP
+	}
+	if vid == ls.vlan.VLANIdentifier() {
+		vid = 0 // Default VLAN nodes registered with VLAN ID 0.
+	} else if vid == 0 {
+		goto DROP // Untagged frame on a tagged default VLAN.
+	}
+	if h, err := ls.handlers.demuxByPortProto(payload, 0, vid, uint16(etype)); h != nil || err != lneto.ErrPacketDrop {
 		return err
 	}
 DROP:
@@ -167,10 +236,41 @@ DROP:
 	return lneto.ErrPacketDrop
 }
 
+// untag parses the VLAN tags of a received frame and returns its payload, VLAN ID (zero if untagged or
+// priority tagged) and EtherType. It returns a nil payload if the frame's service tag does not match the stack's.
+func (ls *StackEthernet) untag(efrm ethernet.Frame) (payload []byte, vid uint16, etype ethernet.Type) {
+	pkt := efrm.RawData()
+	etype = efrm.EtherTypeOrSize()
+	hl := 14
+	if etype == ethernet.TypeServiceVLAN {
+		// IEEE 802.1ad service tag.
+		if ls.svid == 0 || len(pkt) < hl+4 || ethernet.VLANTag(binary.BigEndian.Uint16(pkt[14:16])).VLANIdentifier() != ls.svid {
+			return nil, 0, etype
+		}
+		etype = ethernet.Type(binary.BigEndian.Uint16(pkt[16:18]))
+		hl += 4
+	} else if ls.svid != 0 {
+		return nil, 0, etype
+	}
+	if etype == ethernet.TypeVLAN {
+		if len(pkt) < hl+4 {
+			return nil, 0, etype
+		}
+		vid = ethernet.VLANTag(binary.BigEndian.Uint16(pkt[hl:])).VLANIdentifier()
+		etype = ethernet.Type(binary.BigEndian.Uint16(pkt[hl+2:]))
+		hl += 4
+	}
+	if hl == 14 {
+		return efrm.Payload(), 0, etype // Handles 802.3 length field.
+	}
+	return pkt[hl:], vid, etype
+}
+
 func (ls *StackEthernet) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (n int, err error) {
 	mtu := ls.mtu
 	dst := carrierData[offsetToFrame:]
-	requiredSize := int(mtu) + 14
+	maxhl := ls.maxHeaderLength()
+	requiredSize := int(mtu) + maxhl
 	if ls.crcupdate != nil {
 		requiredSize += 4
 	}
@@ -181,22 +281,47 @@ func (ls *StackEthernet) Encapsulate(carrierData []byte, offsetToIP, offsetToFra
 	if err != nil {
 		return 0, err
 	}
-	*efrm.DestinationHardwareAddr() = ls.gwmac
 	var h *node
-	// Children (IP/ARP) start at offset 14 (after ethernet header).
+	// Children (IP/ARP) start after the ethernet header, 14 bytes for untagged frames.
 	// For IP: offsetToIP=14, offsetToFrame=14
 	// For ARP: offsetToIP=-1, offsetToFrame=14 (but ARP ignores offsetToIP)
+	// Regardless of VLAN tagging children see the 14 bytes preceding their frame as an untagged
+	// Ethernet header so they may set the destination hardware address at offsetToFrame-14.
 	// Clip carrierData to MTU to prevent writes beyond MTU limit.
-	payloadOffset := offsetToFrame + 14
+	payloadOffset := offsetToFrame + maxhl
+	vhdr := carrierData[payloadOffset-14 : payloadOffset]
+	copy(vhdr[:6], ls.gwmac[:])
 	mtuLimit := payloadOffset + int(mtu)
 	h, n, err = ls.handlers.encapsulateAny(carrierData[:mtuLimit], payloadOffset, payloadOffset)
 	if n == 0 {
 		return n, err
 	}
 	// Found packet
+	tag := ls.vlan
+	if h.lport != 0 {
+		tag = ethernet.NewVLANTag(ls.vlan.PriorityCodePoint(), false, h.lport)
+	}
+	dstaddr := [6]byte(vhdr[:6])
+	hl := ls.headerLength(tag != 0)
+	if hl != maxhl {
+		// Untagged frame on a trunk: move payload next to the header.
+		copy(dst[hl:], dst[maxhl:maxhl+n])
+	}
+	*efrm.DestinationHardwareAddr() = dstaddr
 	*efrm.SourceHardwareAddr() = ls.mac
-	efrm.SetEtherType(ethernet.Type(h.proto))
-	n += 14
+	off := 12
+	if ls.svid != 0 {
+		binary.BigEndian.PutUint16(dst[off:], uint16(ethernet.TypeServiceVLAN))
+		binary.BigEndian.PutUint16(dst[off+2:], uint16(ethernet.NewVLANTag(ls.vlan.PriorityCodePoint(), false, ls.svid)))
+		off += 4
+	}
+	if tag != 0 {
+		binary.BigEndian.PutUint16(dst[off:], uint16(ethernet.TypeVLAN))
+		binary.BigEndian.PutUint16(dst[off+2:], uint16(tag))
+		off += 4
+	}
+	binary.BigEndian.PutUint16(dst[off:], h.proto)
+	n += hl
 	// Pad to minimum Ethernet frame size (60 bytes without CRC, 64 with).
 	// Frames shorter than this are "runt frames" and may be dropped by switches/routers
 	// according to 802.3 minimum length of 64 octets.
@@ -0,0 +1,336 @@
+package internet
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+)
+
+// FilterAction is the verdict of a [FilterRule] on a matching packet.
+type FilterAction uint8
+
+const (
+	// FilterAccept lets the packet through to its destination.
+	FilterAccept FilterAction = iota
+	// FilterDrop silently discards the packet.
+	FilterDrop
+)
+
+// FilterDirection selects which packets a [FilterRule] applies to.
+type FilterDirection uint8
+
+const (
+	// FilterIngress matches packets received from the network (Demux).
+	FilterIngress FilterDirection = 1 << iota
+	// FilterEgress matches packets sent to the network (Encapsulate).
+	FilterEgress
+	// FilterBoth matches packets in either direction.
+	FilterBoth = FilterIngress | FilterEgress
+)
+
+// PortRange is an inclusive range of TCP/UDP ports. The zero value matches any port.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (pr PortRange) contains(port uint16) bool {
+	return pr == (PortRange{}) || (port >= pr.Min && port <= pr.Max)
+}
+
+// FilterRule is a single rule of a [StackFilter]. Zero valued fields match any packet.
+type FilterRule struct {
+	Action FilterAction
+	// Direction the rule applies to. Zero value is equivalent to [FilterBoth].
+	Direction FilterDirection
+	// Protocol is the IP protocol matched. Zero value matches any protocol.
+	Protocol lneto.IPProto
+	// Source is the source address prefix of the packet. Zero value matches any source
+	// address, a valid prefix only matches IPv4 packets.
+	Source ipv4.Prefix
+	// SrcPorts and DstPorts match source and destination TCP/UDP ports.
+	SrcPorts, DstPorts PortRange
+}
+
+// StackFilterConfig configures a [StackFilter].
+type StackFilterConfig struct {
+	// Rules are evaluated in order; the first matching rule decides the fate of the packet.
+	// Rules are copied on configuration.
+	Rules []FilterRule
+	// DefaultIngress and DefaultEgress are the actions applied to packets that match no rule.
+	DefaultIngress, DefaultEgress FilterAction
+	// ConnTrackSize is the number of tracked outbound flows. Received packets belonging to a
+	// tracked flow are accepted before evaluating rules. Zero disables connection tracking.
+	ConnTrackSize int
+	// ConnTrackTimeout is the idle time after which a tracked flow expires. Defaults to 2 minutes.
+	ConnTrackTimeout time.Duration
+	// Nanotime is a monotonic time source in nanoseconds. Required when ConnTrackSize is non-zero.
+	Nanotime func() int64
+}
+
+// StackFilter is a rule based stateful packet filter that wraps a StackNode. It is
+// meant to sit between a [StackEthernet] and an IP stack or between an IP stack and
+// its protocol child (i.e: [StackPorts]), in both cases the IP header is visible to the filter.
+// Packets not carrying an IP header are let through.
+type StackFilter struct {
+	h        node
+	rules    []FilterRule
+	hits     []uint64
+	conns    []flowEntry
+	defIn    FilterAction
+	defOut   FilterAction
+	timeout  int64
+	nanotime func() int64
+	// conntrackHits counts received packets accepted by connection tracking.
+	conntrackHits uint64
+	// defaultHits counts packets that matched no rule.
+	defaultHits uint64
+}
+
+type flowTuple struct {
+	raddr [16]byte
+	rport uint16
+	lport uint16
+	proto lneto.IPProto
+	alen  uint8
+}
+
+type flowEntry struct {
+	flowTuple
+	lastSeen int64
+}
+
+// Configure resets the filter's rules, counters and connection tracking table.
+func (sf *StackFilter) Configure(cfg StackFilterConfig) error {
+	if cfg.ConnTrackSize < 0 || cfg.ConnTrackTimeout < 0 || (cfg.ConnTrackSize > 0 && cfg.Nanotime == nil) {
+		return lneto.ErrInvalidConfig
+	} else if cfg.DefaultIngress > FilterDrop || cfg.DefaultEgress > FilterDrop {
+		return lneto.ErrInvalidConfig
+	}
+	for i := range cfg.Rules {
+		if cfg.Rules[i].Action > FilterDrop || cfg.Rules[i].Direction > FilterBoth {
+			return lneto.ErrInvalidConfig
+		}
+	}
+	timeout := cfg.ConnTrackTimeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	sf.rules = append(sf.rules[:0], cfg.Rules...)
+	internal.SliceReuse(&sf.hits, len(cfg.Rules))
+	sf.hits = sf.hits[:len(cfg.Rules)]
+	clear(sf.hits)
+	internal.SliceReuse(&sf.conns, cfg.ConnTrackSize)
+	sf.conns = sf.conns[:0:cfg.ConnTrackSize]
+	sf.defIn = cfg.DefaultIngress
+	sf.defOut = cfg.DefaultEgress
+	sf.timeout = int64(timeout)
+	sf.nanotime = cfg.Nanotime
+	sf.conntrackHits = 0
+	sf.defaultHits = 0
+	return nil
+}
+
+// SetStackNode sets the StackNode protected by the filter.
+func (sf *StackFilter) SetStackNode(node lneto.StackNode) {
+	sf.h = nodeFromStackNode(node, node.LocalPort(), node.Protocol(), nil)
+}
+
+// RuleHits returns the number of packets that matched the rule at index ruleIdx of the configured rules.
+func (sf *StackFilter) RuleHits(ruleIdx int) uint64 { return sf.hits[ruleIdx] }
+
+// DefaultHits returns the number of packets that matched no rule and were handled by the default actions.
+func (sf *StackFilter) DefaultHits() uint64 { return sf.defaultHits }
+
+// ConnTrackHits returns the number of received packets accepted as return traffic of tracked flows.
+func (sf *StackFilter) ConnTrackHits() uint64 { return sf.conntrackHits }
+
+// ConnTrackLen returns the number of flows currently tracked, including expired flows not yet evicted.
+func (sf *StackFilter) ConnTrackLen() int { return len(sf.conns) }
+
+func (sf *StackFilter) Protocol() uint64 { return uint64(sf.h.proto) }
+
+func (sf *StackFilter) LocalPort() uint16 { return sf.h.lport }
+
+func (sf *StackFilter) ConnectionID() *uint64 { return sf.h.connID }
+
+// EncapsulatedProto returns the IP protocol of the frame last written by the protected StackNode.
+func (sf *StackFilter) EncapsulatedProto() lneto.IPProto { return sf.h.encapsulatedProto() }
+
+func (sf *StackFilter) Demux(carrierData []byte, frameOffset int) error {
+	if sf.h.IsInvalid() {
+		sf.h.destroy()
+		return net.ErrClosed
+	}
+	pf, ok := parseFlow(carrierData, frameOffset, 0)
+	if ok {
+		if sf.tracked(pf.tuple(true)) {
+			sf.conntrackHits++
+		} else if sf.evaluate(FilterIngress, &pf) == FilterDrop {
+			return lneto.ErrPacketDrop
+		}
+	}
+	err := sf.h.callbacks.Demux(carrierData, frameOffset)
+	if checkNodeErr(&sf.h, err) {
+		sf.h.destroy()
+	}
+	return err
+}
+
+func (sf *StackFilter) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if sf.h.IsInvalid() {
+		sf.h.destroy()
+		return 0, net.ErrClosed
+	}
+	n, err := sf.h.callbacks.Encapsulate(carrierData, offsetToIP, offsetToFrame)
+	if checkNodeErr(&sf.h, err) {
+		sf.h.destroy()
+	}
+	if n == 0 || offsetToIP < 0 {
+		return n, err
+	}
+	var proto lneto.IPProto
+	if sf.h.proto <= 255 {
+		// Wrapping an IP protocol node, not an IP stack: the IP header protocol is not yet
+		// written and the node may emit another protocol, i.e: StackPorts ICMP errors.
+		proto = sf.h.encapsulatedProto()
+	}
+	pf, ok := parseFlow(carrierData[offsetToIP:], offsetToFrame-offsetToIP, proto)
+	if !ok {
+		return n, err
+	}
+	if sf.evaluate(FilterEgress, &pf) == FilterDrop {
+		return 0, err
+	}
+	sf.track(pf.tuple(false))
+	return n, err
+}
+
+// evaluate returns the action for a packet travelling in direction dir.
+func (sf *StackFilter) evaluate(dir FilterDirection, pf *packetFlow) FilterAction {
+	for i := range sf.rules {
+		rule := &sf.rules[i]
+		if rule.Direction != 0 && rule.Direction&dir == 0 {
+			continue
+		} else if rule.Protocol != 0 && rule.Protocol != pf.proto {
+			continue
+		} else if rule.Source.IsValid() && (len(pf.src) != 4 || !rule.Source.Contains([4]byte(pf.src))) {
+			continue
+		} else if !rule.SrcPorts.contains(pf.srcPort) || !rule.DstPorts.contains(pf.dstPort) {
+			continue
+		}
+		sf.hits[i]++
+		return rule.Action
+	}
+	sf.defaultHits++
+	if dir == FilterIngress {
+		return sf.defIn
+	}
+	return sf.defOut
+}
+
+// tracked reports whether the tuple of a received packet belongs to a tracked flow and refreshes it.
+func (sf *StackFilter) tracked(tuple flowTuple) bool {
+	if cap(sf.conns) == 0 {
+		return false
+	}
+	now := sf.nanotime()
+	for i := range sf.conns {
+		entry := &sf.conns[i]
+		if entry.flowTuple == tuple && now-entry.lastSeen < sf.timeout {
+			entry.lastSeen = now
+			return true
+		}
+	}
+	return false
+}
+
+// track adds or refreshes an outbound flow. When the table is full the least recently seen flow is evicted.
+func (sf *StackFilter) track(tuple flowTuple) {
+	if cap(sf.conns) == 0 {
+		return
+	}
+	now := sf.nanotime()
+	oldest := -1
+	for i := range sf.conns {
+		entry := &sf.conns[i]
+		if entry.flowTuple == tuple {
+			entry.lastSeen = now
+			return
+		} else if oldest < 0 || entry.lastSeen < sf.conns[oldest].lastSeen {
+			oldest = i
+		}
+	}
+	if len(sf.conns) < cap(sf.conns) {
+		sf.conns = append(sf.conns, flowEntry{flowTuple: tuple, lastSeen: now})
+	} else {
+		sf.conns[oldest] = flowEntry{flowTuple: tuple, lastSeen: now}
+	}
+}
+
+// packetFlow is the parsed addressing information of an IP packet.
+type packetFlow struct {
+	src, dst         []byte
+	srcPort, dstPort uint16
+	proto            lneto.IPProto
+}
+
+// tuple returns the flow tuple of the packet with the remote endpoint being the source if ingress.
+func (pf *packetFlow) tuple(ingress bool) (tuple flowTuple) {
+	raddr, rport, lport := pf.dst, pf.dstPort, pf.srcPort
+	if ingress {
+		raddr, rport, lport = pf.src, pf.srcPort, pf.dstPort
+	}
+	tuple.alen = uint8(copy(tuple.raddr[:], raddr))
+	tuple.rport = rport
+	tuple.lport = lport
+	tuple.proto = pf.proto
+	return tuple
+}
+
+// parseFlow parses the IP packet at ip[0] whose payload starts at frameOffset. If frameOffset is
+// zero the payload offset is calculated from the IP header.
+// A non-zero proto is used instead of the IP header protocol field, which is not yet written on egress below an IP stack.
+func parseFlow(ip []byte, frameOffset int, proto lneto.IPProto) (pf packetFlow, ok bool) {
+	if len(ip) < 20 {
+		return pf, false
+	}
+	var hdrProto uint8
+	switch ip[0] >> 4 {
+	case 4:
+		if frameOffset == 0 {
+			frameOffset = int(ip[0]&0xf) * 4
+		}
+		hdrProto = ip[9]
+		pf.src = ip[12:16]
+		pf.dst = ip[16:20]
+	case 6:
+		if len(ip) < 40 {
+			return pf, false
+		}
+		if frameOffset == 0 {
+			frameOffset = 40
+		}
+		hdrProto = ip[6]
+		pf.src = ip[8:24]
+		pf.dst = ip[24:40]
+	default:
+		return pf, false
+	}
+	if proto == 0 {
+		proto = lneto.IPProto(hdrProto)
+	}
+	pf.proto = proto
+	switch pf.proto {
+	case lneto.IPProtoTCP, lneto.IPProtoUDP:
+		if frameOffset+4 > len(ip) {
+			return pf, false
+		}
+		pf.srcPort = binary.BigEndian.Uint16(ip[frameOffset:])
+		pf.dstPort = binary.BigEndian.Uint16(ip[frameOffset+2:])
+	}
+	return pf, true
+}
@@ -78,7 +78,8 @@ func (si4 *stackip4) Register4(h lneto.StackNode) error {
 	if proto > 255 {
 		return lneto.ErrInvalidConfig
 	}
-	return si4.handlers.registerByPortProto(nodeFromStackNode(h, h.LocalPort(), proto, nil))
+	n := nodeFromStackNode(h, h.LocalPort(), proto, nil)
+	return si4.handlers.registerByPortProto(n)
 }
 
 func (si4 *stackip4) IsRegistered4(proto lneto.IPProto) bool {
@@ -199,7 +200,7 @@ func (si4 *stackip4) encapsulate4(carrierData []byte, offsetToIP int) (int, erro
 	if n == 0 {
 		return n, err
 	}
-	proto := lneto.IPProto(node.proto)
+	proto := node.encapsulatedProto()
 	totalLen := n + headerlen
 	ifrm.SetTotalLength(uint16(totalLen))
 	ifrm.SetProtocol(proto)
@@ -64,7 +64,8 @@ func (si6 *stackip6) Register6(h lneto.StackNode) error {
 	if proto > 255 {
 		return lneto.ErrInvalidConfig
 	}
-	return si6.handlers.registerByPortProto(nodeFromStackNode(h, h.LocalPort(), proto, nil))
+	n := nodeFromStackNode(h, h.LocalPort(), proto, nil)
+	return si6.handlers.registerByPortProto(n)
 }
 
 func (si6 *stackip6) IsRegistered6(proto lneto.IPProto) bool {
@@ -161,7 +162,7 @@ func (si6 *stackip6) encapsulate6(carrierData []byte, offsetToIP int) (int, erro
 	if n == 0 {
 		return n, err
 	}
-	proto := lneto.IPProto(node.proto)
+	proto := node.encapsulatedProto()
 	ifrm.SetNextHeader(proto)
 	ifrm.SetPayloadLength(uint16(n))
 	var crc lneto.CRC791
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"math"
 	"strconv"
+	"time"
 
 	"github.com/soypat/lneto"
 	"github.com/soypat/lneto/ethernet"
@@ -18,8 +19,34 @@ type StackPorts struct {
 	handlers   handlers
 	dstPortOff uint16
 	protocol   uint16
-	// rstQueue stores pending RST responses for TCP SYNs to unregistered ports.
+	// rstQueue stores pending RST responses for TCP segments to unregistered ports.
 	rstQueue tcp.RSTQueue
+	// icmpQueue stores pending ICMP Port Unreachable responses for UDP datagrams to unregistered ports.
+	icmpQueue icmpErrQueue
+	// disableRST and disableICMP silence replies to packets addressed to unregistered ports.
+	disableRST  bool
+	disableICMP bool
+	// emitted is the protocol of the last frame written by Encapsulate. It differs from
+	// protocol when an ICMP error is emitted on behalf of an unbound UDP port.
+	emitted lneto.IPProto
+}
+
+// UnboundPortConfig configures the replies [StackPorts] emits for packets
+// addressed to ports with no registered StackNode.
+type UnboundPortConfig struct {
+	// DisableICMP disables ICMP/ICMPv6 Destination Unreachable (Port Unreachable)
+	// messages in response to UDP datagrams addressed to unbound ports.
+	DisableICMP bool
+	// DisableRST disables TCP RST replies to segments addressed to unbound ports (RFC 9293 §3.10.7.1).
+	DisableRST bool
+	// Nanotime is a monotonic time source in nanoseconds used to rate limit ICMP errors
+	// with a token bucket. It is required for rate limiting: if nil ICMP errors are not
+	// rate limited and bursts are only bounded by the two entry pending error queue.
+	Nanotime func() int64
+	// ICMPInterval is the time it takes to replenish one ICMP error token. Defaults to 20ms.
+	ICMPInterval time.Duration
+	// ICMPBurst is the maximum number of ICMP errors emitted back-to-back. Defaults to 4.
+	ICMPBurst uint8
 }
 
 func (ps *StackPorts) ResetUDP(maxNodes uint16) error {
@@ -36,11 +63,31 @@ func (ps *StackPorts) Reset(protocol uint64, dstPortOffset, maxNodes uint16) err
 	}
 	ps.handlers.reset("StackPorts(proto="+strconv.Itoa(int(protocol))+")", int(maxNodes))
 	*ps = StackPorts{
-		connID:     ps.connID + 1,
-		handlers:   ps.handlers,
-		dstPortOff: dstPortOffset,
-		protocol:   uint16(protocol),
+		connID:      ps.connID + 1,
+		handlers:    ps.handlers,
+		dstPortOff:  dstPortOffset,
+		protocol:    uint16(protocol),
+		icmpQueue:   ps.icmpQueue,
+		disableRST:  ps.disableRST,
+		disableICMP: ps.disableICMP,
+	}
+	ps.icmpQueue.reset()
+	return nil
+}
+
+// ConfigureUnbound sets how StackPorts replies to packets addressed to ports
+// with no registered StackNode. By default closed TCP ports reply with RST
+// and closed UDP ports reply with an ICMP Port Unreachable message. ICMP errors
+// are only rate limited when [UnboundPortConfig.Nanotime] is set; otherwise at
+// most two errors are held pending and further datagrams go unanswered until
+// they are sent. The configuration persists across calls to Reset.
+func (ps *StackPorts) ConfigureUnbound(cfg UnboundPortConfig) error {
+	if cfg.ICMPInterval < 0 {
+		return lneto.ErrInvalidConfig
 	}
+	ps.disableRST = cfg.DisableRST
+	ps.disableICMP = cfg.DisableICMP
+	ps.icmpQueue.configure(cfg.Nanotime, cfg.ICMPInterval, cfg.ICMPBurst)
 	return nil
 }
 
@@ -48,41 +95,82 @@ func (ps *StackPorts) LocalPort() uint16 { return 0 }
 
 func (ps *StackPorts) Protocol() uint64 { return uint64(ps.protocol) }
 
+// EncapsulatedProto returns the IP protocol of the frame last written by Encapsulate,
+// which is ICMP or ICMPv6 for errors replying to datagrams addressed to unbound UDP ports.
+func (ps *StackPorts) EncapsulatedProto() lneto.IPProto { return ps.emitted }
+
 func (ps *StackPorts) ConnectionID() *uint64 { return &ps.connID }
 
 func (ps *StackPorts) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (n int, err error) {
 	if int(ps.dstPortOff)+offsetToFrame+2 > len(carrierData) {
 		return 0, io.ErrShortBuffer
 	}
+	ps.emitted = lneto.IPProto(ps.protocol)
 	_, n, err = ps.handlers.encapsulateAny(carrierData, offsetToIP, offsetToFrame)
 	if n == 0 {
-		n, _ = ps.rstQueue.Drain(carrierData, offsetToIP, offsetToFrame)
+		n, ps.emitted = ps.drainUnbound(carrierData, offsetToIP, offsetToFrame)
 	}
 	return n, err
 }
 
+// drainUnbound writes one pending reply to a packet addressed to an unbound port
+// and returns the protocol of the reply.
+func (ps *StackPorts) drainUnbound(carrierData []byte, offsetToIP, offsetToFrame int) (n int, proto lneto.IPProto) {
+	n, _ = ps.rstQueue.Drain(carrierData, offsetToIP, offsetToFrame)
+	if n > 0 {
+		return n, lneto.IPProto(ps.protocol)
+	}
+	return ps.icmpQueue.drain(carrierData, offsetToIP, offsetToFrame)
+}
+
 func (ps *StackPorts) Demux(b []byte, offset int) (err error) {
 	if int(ps.dstPortOff)+offset+2 > len(b) {
 		return io.ErrShortBuffer
 	}
 	port := binary.BigEndian.Uint16(b[int(ps.dstPortOff)+offset:])
-	_, err = ps.handlers.demuxByPort(b, offset, port)
-	if err == lneto.ErrPacketDrop && ps.protocol == uint16(lneto.IPProtoTCP) && offset+14 <= len(b) {
-		// RFC 9293 §3.10.7.1: RST for SYN to port with no listener.
-		flags := binary.BigEndian.Uint16(b[offset+12:]) & 0x01ff
-		const flagSYN, flagRST, flagACK = 0x02, 0x04, 0x10
-		if flags&flagSYN != 0 && flags&(flagRST|flagACK) == 0 {
-			srcaddr, _, _, _, iperr := internal.GetIPAddr(b)
-			if iperr == nil {
-				remotePort := binary.BigEndian.Uint16(b[offset:])
-				segSeq := tcp.Value(binary.BigEndian.Uint32(b[offset+4:]))
-				ps.rstQueue.Queue(srcaddr, remotePort, port, 0, segSeq+1, tcp.FlagRST|tcp.FlagACK)
-			}
-		}
+	node, err := ps.handlers.demuxByPort(b, offset, port)
+	if node == nil && err == lneto.ErrPacketDrop {
+		ps.queueUnbound(b, offset, port)
 	}
 	return err
 }
 
+// queueUnbound queues a reply to a packet addressed to a port with no registered node.
+func (ps *StackPorts) queueUnbound(b []byte, offset int, port uint16) {
+	switch lneto.IPProto(ps.protocol) {
+	case lneto.IPProtoUDP:
+		if !ps.disableICMP {
+			ps.icmpQueue.queuePortUnreachable(b, offset)
+		}
+	case lneto.IPProtoTCP:
+		if ps.disableRST {
+			return
+		}
+		tfrm, err := tcp.NewFrame(b[offset:])
+		if err != nil {
+			return
+		}
+		payloadLen := len(b) - offset - tfrm.HeaderLength()
+		if payloadLen < 0 {
+			return
+		}
+		seg := tfrm.Segment(payloadLen)
+		if seg.Flags.HasAny(tcp.FlagRST) {
+			return // RFC 9293 §3.10.7.1: An incoming segment containing a RST is discarded.
+		}
+		srcaddr, _, _, _, err := internal.GetIPAddr(b)
+		if err != nil {
+			return
+		}
+		remotePort := tfrm.SourcePort()
+		if seg.Flags.HasAny(tcp.FlagACK) {
+			ps.rstQueue.Queue(srcaddr, remotePort, port, seg.ACK, 0, tcp.FlagRST)
+		} else {
+			ps.rstQueue.Queue(srcaddr, remotePort, port, 0, seg.SEQ+tcp.Value(seg.LEN()), tcp.FlagRST|tcp.FlagACK)
+		}
+	}
+}
+
 // Register registers a port StackNode on StackPorts.
 // If dstMAC is set to non-nil, length six buffer then
 func (ps *StackPorts) Register(h lneto.StackNode) error {
@@ -132,12 +220,20 @@ func (ps *StackPortsMACFiltered) Reset(protocol uint64, dstPortOffset, maxNodes
 	return ps.sp.Reset(protocol, dstPortOffset, maxNodes)
 }
 
+// ConfigureUnbound sets how the stack replies to packets addressed to unbound ports. See [StackPorts.ConfigureUnbound].
+func (ps *StackPortsMACFiltered) ConfigureUnbound(cfg UnboundPortConfig) error {
+	return ps.sp.ConfigureUnbound(cfg)
+}
+
 func (ps *StackPortsMACFiltered) LocalPort() uint16 { return 0 }
 
 func (ps *StackPortsMACFiltered) Protocol() uint64 { return uint64(ps.sp.protocol) }
 
 func (ps *StackPortsMACFiltered) ConnectionID() *uint64 { return &ps.sp.connID }
 
+// EncapsulatedProto returns the IP protocol of the frame last written by Encapsulate. See [StackPorts.EncapsulatedProto].
+func (ps *StackPortsMACFiltered) EncapsulatedProto() lneto.IPProto { return ps.sp.emitted }
+
 func (ps *StackPortsMACFiltered) Demux(b []byte, offset int) (err error) {
 	// No MAC Filtering on ingress. TODO?
 	return ps.sp.Demux(b, offset)
@@ -147,6 +243,7 @@ func (ps *StackPortsMACFiltered) Encapsulate(carrierData []byte, offsetToIP, off
 	if int(ps.sp.dstPortOff)+offsetToFrame+2 > len(carrierData) {
 		return 0, io.ErrShortBuffer
 	}
+	ps.sp.emitted = lneto.IPProto(ps.sp.protocol)
 	h := &ps.sp.handlers
 	for i := range h.nodes {
 		node := &h.nodes[i]
@@ -168,7 +265,7 @@ func (ps *StackPortsMACFiltered) Encapsulate(carrierData []byte, offsetToIP, off
 			h.error("handlers:encapsulate", slog.String("func", "encapsulateAny"), slog.String("ctx", h.context), slog.String("err", err.Error()))
 		}
 	}
-	if n, _ := ps.sp.rstQueue.Drain(carrierData, offsetToIP, offsetToFrame); n > 0 {
+	if n, ps.sp.emitted = ps.sp.drainUnbound(carrierData, offsetToIP, offsetToFrame); n > 0 {
 		return n, nil
 	}
 	return 0, err // Return last written error.
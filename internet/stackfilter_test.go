@@ -0,0 +1,204 @@
+package internet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+)
+
+// testUDPNode is a minimal UDP StackNode that counts received datagrams and
+// sends a single datagram to raddr:rport when send is set.
+type testUDPNode struct {
+	connID   uint64
+	lport    uint16
+	rport    uint16
+	raddr    [4]byte
+	send     bool
+	received int
+}
+
+func (n *testUDPNode) LocalPort() uint16     { return n.lport }
+func (n *testUDPNode) Protocol() uint64      { return uint64(lneto.IPProtoUDP) }
+func (n *testUDPNode) ConnectionID() *uint64 { return &n.connID }
+
+func (n *testUDPNode) Demux(carrierData []byte, frameOffset int) error {
+	n.received++
+	return nil
+}
+
+func (n *testUDPNode) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if !n.send {
+		return 0, nil
+	}
+	n.send = false
+	ufrm, _ := udp.NewFrame(carrierData[offsetToFrame:])
+	ufrm.SetSourcePort(n.lport)
+	ufrm.SetDestinationPort(n.rport)
+	err := internal.SetIPAddrs(carrierData[offsetToIP:], 0, nil, n.raddr[:])
+	return 8, err
+}
+
+func newFilteredUDPStack(t *testing.T, cfg StackFilterConfig, node *testUDPNode) (*StackIPv4, *StackFilter) {
+	t.Helper()
+	var ip StackIPv4
+	var ports StackPorts
+	var filter StackFilter
+	if err := ip.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	ip.SetAddr4([4]byte{10, 0, 0, 2})
+	if err := ports.ResetUDP(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ports.ConfigureUnbound(UnboundPortConfig{DisableICMP: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ports.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	filter.SetStackNode(&ports)
+	if err := ip.Register4(&filter); err != nil {
+		t.Fatal(err)
+	}
+	return &ip, &filter
+}
+
+func TestStackFilter_Rules(t *testing.T) {
+	node := &testUDPNode{lport: 53}
+	ip, filter := newFilteredUDPStack(t, StackFilterConfig{
+		Rules: []FilterRule{
+			{Action: FilterDrop, Direction: FilterIngress, Source: ipv4.PrefixFrom([4]byte{10, 0, 1, 0}, 24)},
+			{Action: FilterAccept, Direction: FilterIngress, Protocol: lneto.IPProtoUDP, DstPorts: PortRange{Min: 50, Max: 60}},
+		},
+		DefaultIngress: FilterDrop,
+	}, node)
+	trusted := appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 53, []byte("query"))
+	banned := appendUDP4(nil, [4]byte{10, 0, 1, 1}, ip.Addr4(), 5000, 53, []byte("query"))
+	otherPort := appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 80, []byte("query"))
+
+	if err := ip.Demux(trusted, 0); err != nil {
+		t.Fatal("trusted packet:", err)
+	}
+	if err := ip.Demux(banned, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want banned source dropped, got", err)
+	}
+	if err := ip.Demux(otherPort, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want port outside range dropped, got", err)
+	}
+	if node.received != 1 {
+		t.Errorf("want 1 datagram received by node, got %d", node.received)
+	}
+	if filter.RuleHits(0) != 1 || filter.RuleHits(1) != 1 || filter.DefaultHits() != 1 {
+		t.Errorf("unexpected hit counters: rule0=%d rule1=%d default=%d", filter.RuleHits(0), filter.RuleHits(1), filter.DefaultHits())
+	}
+}
+
+func TestStackFilter_ConnTrack(t *testing.T) {
+	var now int64 = 1
+	server := [4]byte{192, 168, 1, 1}
+	node := &testUDPNode{lport: 1234, rport: 123, raddr: server}
+	ip, filter := newFilteredUDPStack(t, StackFilterConfig{
+		DefaultIngress:   FilterDrop,
+		DefaultEgress:    FilterAccept,
+		ConnTrackSize:    2,
+		ConnTrackTimeout: time.Second,
+		Nanotime:         func() int64 { return now },
+	}, node)
+	reply := appendUDP4(nil, server, ip.Addr4(), 123, 1234, []byte("reply"))
+	if err := ip.Demux(reply, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want unsolicited reply dropped, got", err)
+	}
+	var buf [256]byte
+	node.send = true
+	n, err := ip.Encapsulate(buf[:], 0, 0)
+	if err != nil || n == 0 {
+		t.Fatal("expected outbound datagram", n, err)
+	}
+	if filter.ConnTrackLen() != 1 {
+		t.Fatalf("want 1 tracked flow, got %d", filter.ConnTrackLen())
+	}
+	if err := ip.Demux(reply, 0); err != nil {
+		t.Fatal("want reply accepted by connection tracking, got", err)
+	}
+	if filter.ConnTrackHits() != 1 {
+		t.Errorf("want 1 conntrack hit, got %d", filter.ConnTrackHits())
+	}
+	spoofed := appendUDP4(nil, server, ip.Addr4(), 124, 1234, []byte("reply"))
+	if err := ip.Demux(spoofed, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want reply from different port dropped, got", err)
+	}
+	now += int64(2 * time.Second)
+	if err := ip.Demux(reply, 0); err != lneto.ErrPacketDrop {
+		t.Fatal("want reply after flow expiry dropped, got", err)
+	}
+}
+
+func TestStackFilter_EgressDrop(t *testing.T) {
+	node := &testUDPNode{lport: 1234, rport: 25, raddr: [4]byte{192, 168, 1, 1}}
+	ip, filter := newFilteredUDPStack(t, StackFilterConfig{
+		Rules: []FilterRule{
+			{Action: FilterDrop, Direction: FilterEgress, DstPorts: PortRange{Min: 25, Max: 25}},
+		},
+	}, node)
+	var buf [256]byte
+	node.send = true
+	n, _ := ip.Encapsulate(buf[:], 0, 0)
+	if n != 0 {
+		t.Error("egress datagram to blocked port was sent")
+	}
+	if filter.RuleHits(0) != 1 {
+		t.Errorf("want 1 hit on egress rule, got %d", filter.RuleHits(0))
+	}
+}
+
+func TestStackFilter_EgressICMPError(t *testing.T) {
+	var ip StackIPv4
+	var ports StackPorts
+	var filter StackFilter
+	if err := ip.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	ip.SetAddr4([4]byte{10, 0, 0, 2})
+	if err := ports.ResetUDP(2); err != nil {
+		t.Fatal(err)
+	}
+	err := filter.Configure(StackFilterConfig{
+		Rules: []FilterRule{
+			{Action: FilterDrop, Direction: FilterEgress, Protocol: lneto.IPProtoUDP},
+		},
+		ConnTrackSize: 2,
+		Nanotime:      func() int64 { return 1 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.SetStackNode(&ports)
+	if err := ip.Register4(&filter); err != nil {
+		t.Fatal(err)
+	}
+	ip.Demux(appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 9999, []byte("unbound")), 0)
+	var buf [256]byte
+	n, err := ip.Encapsulate(buf[:], 0, 0)
+	if err != nil || n == 0 {
+		t.Fatalf("expected ICMP error through filter: n=%d err=%v", n, err)
+	}
+	ifrm, _ := ipv4.NewFrame(buf[:n])
+	if ifrm.Protocol() != lneto.IPProtoICMP {
+		t.Fatalf("want ICMP protocol, got %s", ifrm.Protocol())
+	}
+	if filter.RuleHits(0) != 0 {
+		t.Error("ICMP error matched UDP egress rule")
+	}
+	for _, flow := range filter.conns {
+		if flow.proto == lneto.IPProtoUDP {
+			t.Errorf("ICMP error tracked as UDP flow %+v", flow.flowTuple)
+		}
+	}
+}
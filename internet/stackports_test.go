@@ -0,0 +1,259 @@
+package internet
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/ipv4/icmpv4"
+	"github.com/soypat/lneto/tcp"
+	"github.com/soypat/lneto/udp"
+)
+
+// appendUDP4 appends an IPv4+UDP datagram with valid checksums to dst.
+func appendUDP4(dst []byte, src, dstAddr [4]byte, srcPort, dstPort uint16, payload []byte) []byte {
+	const hdrlen = 20 + 8
+	off := len(dst)
+	dst = append(dst, make([]byte, hdrlen+len(payload))...)
+	buf := dst[off:]
+	copy(buf[hdrlen:], payload)
+	ifrm, _ := ipv4.NewFrame(buf)
+	ifrm.SetVersionAndIHL(4, 5)
+	ifrm.SetTotalLength(uint16(len(buf)))
+	ifrm.SetTTL(64)
+	ifrm.SetProtocol(lneto.IPProtoUDP)
+	*ifrm.SourceAddr() = src
+	*ifrm.DestinationAddr() = dstAddr
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	ufrm, _ := udp.NewFrame(buf[20:])
+	ufrm.SetSourcePort(srcPort)
+	ufrm.SetDestinationPort(dstPort)
+	ufrm.SetLength(uint16(8 + len(payload)))
+	var crc lneto.CRC791
+	ifrm.CRCWriteUDPPseudo(&crc, ufrm.Length())
+	ufrm.SetCRC(lneto.NeverZeroSum(crc.PayloadSum16(buf[20:])))
+	return dst
+}
+
+func newUDPUnboundStack(t *testing.T, cfg UnboundPortConfig) (*StackIPv4, *StackPorts) {
+	t.Helper()
+	var ip StackIPv4
+	var ports StackPorts
+	if err := ip.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	ip.SetAddr4([4]byte{10, 0, 0, 2})
+	if err := ports.ResetUDP(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ports.ConfigureUnbound(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.Register4(&ports); err != nil {
+		t.Fatal(err)
+	}
+	return &ip, &ports
+}
+
+func TestStackPorts_ICMPPortUnreachable(t *testing.T) {
+	ip, _ := newUDPUnboundStack(t, UnboundPortConfig{})
+	clientIP := [4]byte{10, 0, 0, 1}
+	pkt := appendUDP4(nil, clientIP, ip.Addr4(), 5000, 9999, []byte("hello unbound port"))
+	err := ip.Demux(pkt, 0)
+	if err != lneto.ErrPacketDrop {
+		t.Fatalf("want packet drop for unbound port, got %v", err)
+	}
+	var out [256]byte
+	n, err := ip.Encapsulate(out[:], 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected ICMP port unreachable")
+	}
+	ifrm, _ := ipv4.NewFrame(out[:n])
+	if ifrm.Protocol() != lneto.IPProtoICMP {
+		t.Fatalf("want ICMP protocol, got %s", ifrm.Protocol())
+	} else if *ifrm.DestinationAddr() != clientIP {
+		t.Errorf("want destination %v, got %v", clientIP, *ifrm.DestinationAddr())
+	} else if ifrm.CalculateHeaderCRC() != 0 {
+		t.Error("bad IP header checksum")
+	}
+	payload := ifrm.Payload()
+	var crc lneto.CRC791
+	if crc.PayloadSum16(payload) != 0 {
+		t.Error("bad ICMP checksum")
+	}
+	icmp, _ := icmpv4.NewFrame(payload)
+	if icmp.Type() != icmpv4.TypeDestinationUnreachable {
+		t.Errorf("want destination unreachable, got %s", icmp.Type())
+	}
+	if code := (icmpv4.FrameDestinationUnreachable{Frame: icmp}).Code(); code != icmpv4.CodePortUnreachable {
+		t.Errorf("want port unreachable, got %s", code)
+	}
+	quote := payload[8:]
+	if len(quote) != 28 {
+		t.Fatalf("want IP header+8 bytes quoted, got %d bytes", len(quote))
+	}
+	if string(quote) != string(pkt[:28]) {
+		t.Error("quoted datagram mismatch")
+	}
+	n, _ = ip.Encapsulate(out[:], 0, 0)
+	if n != 0 {
+		t.Error("expected single ICMP error")
+	}
+}
+
+func TestStackPorts_ICMPThroughFilter(t *testing.T) {
+	var ip StackIPv4
+	var ports StackPorts
+	var filter StackFilter
+	if err := ip.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	ip.SetAddr4([4]byte{10, 0, 0, 2})
+	if err := ports.ResetUDP(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Configure(StackFilterConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	filter.SetStackNode(&ports)
+	if err := ip.Register4(&filter); err != nil {
+		t.Fatal(err)
+	}
+	pkt := appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 9999, []byte("hello unbound port"))
+	ip.Demux(pkt, 0)
+	var out [256]byte
+	n, err := ip.Encapsulate(out[:], 0, 0)
+	if err != nil || n == 0 {
+		t.Fatalf("expected ICMP port unreachable: n=%d err=%v", n, err)
+	}
+	ifrm, _ := ipv4.NewFrame(out[:n])
+	if ifrm.Protocol() != lneto.IPProtoICMP {
+		t.Fatalf("want ICMP protocol through filter, got %s", ifrm.Protocol())
+	}
+	payload := ifrm.Payload()
+	var crc lneto.CRC791
+	if crc.PayloadSum16(payload) != 0 {
+		t.Error("bad ICMP checksum")
+	} else if binary.BigEndian.Uint32(payload[4:8]) != 0 {
+		t.Error("UDP length or checksum written into ICMP header")
+	}
+	if string(payload[8:]) != string(pkt[:28]) {
+		t.Error("quoted datagram mismatch")
+	}
+}
+
+func TestStackPorts_ICMPQueueOrder(t *testing.T) {
+	ip, ports := newUDPUnboundStack(t, UnboundPortConfig{})
+	clients := [][4]byte{{10, 0, 0, 1}, {10, 0, 0, 3}}
+	for _, client := range clients {
+		ip.Demux(appendUDP4(nil, client, ip.Addr4(), 5000, 9999, nil), 0)
+	}
+	var out [256]byte
+	// A buffer too short for the error must not lose the pending entry.
+	if n, _ := ports.Encapsulate(out[:40], 0, 20); n != 0 {
+		t.Fatalf("ICMP error written to short buffer: %d bytes", n)
+	}
+	for _, client := range clients {
+		n, err := ip.Encapsulate(out[:], 0, 0)
+		if err != nil || n == 0 {
+			t.Fatalf("expected ICMP error to %v: n=%d err=%v", client, n, err)
+		}
+		ifrm, _ := ipv4.NewFrame(out[:n])
+		if *ifrm.DestinationAddr() != client {
+			t.Errorf("want ICMP errors in arrival order, got destination %v want %v", *ifrm.DestinationAddr(), client)
+		}
+	}
+}
+
+func TestStackPorts_ICMPSuppressed(t *testing.T) {
+	var buf [256]byte
+	t.Run("disabled", func(t *testing.T) {
+		ip, _ := newUDPUnboundStack(t, UnboundPortConfig{DisableICMP: true})
+		pkt := appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 9999, nil)
+		ip.Demux(pkt, 0)
+		if n, _ := ip.Encapsulate(buf[:], 0, 0); n != 0 {
+			t.Error("ICMP error emitted with DisableICMP")
+		}
+	})
+	t.Run("multicast", func(t *testing.T) {
+		ip, _ := newUDPUnboundStack(t, UnboundPortConfig{})
+		ip.SetAcceptMulticast4(true)
+		pkt := appendUDP4(nil, [4]byte{10, 0, 0, 1}, [4]byte{224, 0, 0, 251}, 5353, 5353, nil)
+		ip.Demux(pkt, 0)
+		if n, _ := ip.Encapsulate(buf[:], 0, 0); n != 0 {
+			t.Error("ICMP error emitted for multicast datagram")
+		}
+	})
+	t.Run("ratelimit", func(t *testing.T) {
+		var now int64 = 1
+		ip, _ := newUDPUnboundStack(t, UnboundPortConfig{
+			Nanotime:     func() int64 { return now },
+			ICMPInterval: time.Second,
+			ICMPBurst:    1,
+		})
+		pkt := appendUDP4(nil, [4]byte{10, 0, 0, 1}, ip.Addr4(), 5000, 9999, nil)
+		emitted := func() bool {
+			ip.Demux(pkt, 0)
+			n, _ := ip.Encapsulate(buf[:], 0, 0)
+			return n > 0
+		}
+		if !emitted() {
+			t.Fatal("first ICMP error should be emitted")
+		}
+		if emitted() {
+			t.Fatal("second ICMP error should be rate limited")
+		}
+		now += int64(time.Second)
+		if !emitted() {
+			t.Fatal("ICMP error should be emitted after token refill")
+		}
+	})
+}
+
+func TestStackPorts_RSTOnACKToUnknownPort(t *testing.T) {
+	var sp StackPorts
+	if err := sp.ResetTCP(4); err != nil {
+		t.Fatal(err)
+	}
+	rawBuf := make([]byte, 64)
+	rawBuf[0] = 0x45
+	rawBuf[9] = 6
+	copy(rawBuf[12:16], []byte{10, 0, 0, 1})
+	copy(rawBuf[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(rawBuf[20:], 5000)
+	binary.BigEndian.PutUint16(rawBuf[22:], 443)
+	binary.BigEndian.PutUint32(rawBuf[24:], 700)
+	binary.BigEndian.PutUint32(rawBuf[28:], 1234)
+	rawBuf[32] = 0x50
+	rawBuf[33] = byte(tcp.FlagACK)
+	sp.Demux(rawBuf[:40], 20)
+
+	var outBuf [256]byte
+	outBuf[0] = 0x45
+	n, err := sp.Encapsulate(outBuf[:], 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("no RST produced for ACK to unknown port")
+	}
+	tfrm, _ := tcp.NewFrame(outBuf[20 : 20+n])
+	if _, flags := tfrm.OffsetAndFlags(); flags != tcp.FlagRST {
+		t.Errorf("RST flags: got %s, want [RST]", flags)
+	}
+	if tfrm.Seq() != 1234 {
+		t.Errorf("RST SEQ: got %d, want 1234 (SEG.ACK)", tfrm.Seq())
+	}
+
+	// Stealth mode: no replies.
+	if err := sp.ConfigureUnbound(UnboundPortConfig{DisableRST: true}); err != nil {
+		t.Fatal(err)
+	}
+	sp.Demux(rawBuf[:40], 20)
+	if n, _ := sp.Encapsulate(outBuf[:], 0, 20); n != 0 {
+		t.Error("RST emitted with DisableRST")
+	}
+}
@@ -0,0 +1,144 @@
+package internet
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/soypat/lneto/ethernet"
+)
+
+// testEtherNode is a minimal Ethernet StackNode that records received payloads and
+// sends a single payload to dst when send is set.
+type testEtherNode struct {
+	connID   uint64
+	etype    ethernet.Type
+	dst      [6]byte
+	send     []byte
+	received [][]byte
+}
+
+func (n *testEtherNode) LocalPort() uint16     { return 0 }
+func (n *testEtherNode) Protocol() uint64      { return uint64(n.etype) }
+func (n *testEtherNode) ConnectionID() *uint64 { return &n.connID }
+
+func (n *testEtherNode) Demux(carrierData []byte, frameOffset int) error {
+	n.received = append(n.received, append([]byte(nil), carrierData[frameOffset:]...))
+	return nil
+}
+
+func (n *testEtherNode) Encapsulate(carrierData []byte, _, offsetToFrame int) (int, error) {
+	if n.send == nil {
+		return 0, nil
+	}
+	copy(carrierData[offsetToFrame-14:], n.dst[:])
+	sent := copy(carrierData[offsetToFrame:], n.send)
+	n.send = nil
+	return sent, nil
+}
+
+func TestStackEthernet_VLAN(t *testing.T) {
+	mac, peer := [6]byte{0x2, 0, 0, 0, 0, 1}, [6]byte{0x2, 0, 0, 0, 0, 2}
+	var link StackEthernet
+	err := link.Configure(StackEthernetConfig{MTU: 1500, MaxNodes: 3, MAC: mac, VLANPriority: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgmt := &testEtherNode{etype: ethernet.TypeIPv4, dst: peer}
+	data := &testEtherNode{etype: ethernet.TypeIPv4, dst: peer}
+	if err = link.RegisterEthernet(mgmt); err != nil {
+		t.Fatal(err)
+	}
+	if err = link.RegisterEthernetVLAN(20, data); err != nil {
+		t.Fatal(err)
+	}
+	if err = link.RegisterEthernetVLAN(20, &testEtherNode{etype: ethernet.TypeIPv4}); err == nil {
+		t.Fatal("expected error registering same EtherType twice on a VLAN")
+	}
+	payload := []byte("payload of at least forty six bytes to avoid any padding!!")
+
+	// Ingress demux by VLAN ID.
+	tagged := make([]byte, 18+len(payload))
+	efrm, _ := ethernet.NewFrame(tagged)
+	*efrm.DestinationHardwareAddr() = mac
+	*efrm.SourceHardwareAddr() = peer
+	efrm.SetVLAN(ethernet.NewVLANTag(0, false, 20), ethernet.TypeIPv4)
+	copy(tagged[18:], payload)
+	if err = link.Demux(tagged, 0); err != nil {
+		t.Fatal(err)
+	}
+	untagged := appendEthernet(nil, mac, peer, ethernet.TypeIPv4, payload)
+	if err = link.Demux(untagged, 0); err != nil {
+		t.Fatal(err)
+	}
+	efrm.SetVLAN(ethernet.NewVLANTag(0, false, 30), ethernet.TypeIPv4)
+	if err = link.Demux(tagged, 0); err == nil {
+		t.Fatal("frame on unregistered VLAN should be dropped")
+	}
+	if len(data.received) != 1 || string(data.received[0]) != string(payload) {
+		t.Fatalf("VLAN node received %d frames", len(data.received))
+	}
+	if len(mgmt.received) != 1 || string(mgmt.received[0]) != string(payload) {
+		t.Fatalf("default VLAN node received %d frames", len(mgmt.received))
+	}
+
+	// Egress tagging: VLAN node frames are tagged, default VLAN frames are priority tagged.
+	var buf [1600]byte
+	data.send = payload
+	n, err := link.Encapsulate(buf[:], -1, 0)
+	if err != nil || n != 18+len(payload) {
+		t.Fatal("expected tagged frame", n, err)
+	}
+	efrm, _ = ethernet.NewFrame(buf[:n])
+	tag, etype := efrm.VLAN()
+	if !efrm.IsVLAN() || tag.VLANIdentifier() != 20 || tag.PriorityCodePoint() != 3 || etype != ethernet.TypeIPv4 {
+		t.Errorf("bad VLAN tag %#x etype=%s", uint16(tag), etype)
+	}
+	if *efrm.DestinationHardwareAddr() != peer || *efrm.SourceHardwareAddr() != mac || string(buf[18:n]) != string(payload) {
+		t.Error("bad tagged frame contents")
+	}
+	mgmt.send = payload
+	n, _ = link.Encapsulate(buf[:], -1, 0)
+	efrm, _ = ethernet.NewFrame(buf[:n])
+	tag, _ = efrm.VLAN()
+	if !efrm.IsVLAN() || tag.VLANIdentifier() != 0 || *efrm.DestinationHardwareAddr() != peer || string(buf[18:n]) != string(payload) {
+		t.Errorf("bad priority tagged frame %x", buf[:18])
+	}
+}
+
+func TestStackEthernet_QinQ(t *testing.T) {
+	mac, peer := [6]byte{0x2, 0, 0, 0, 0, 1}, [6]byte{0x2, 0, 0, 0, 0, 2}
+	var link StackEthernet
+	err := link.Configure(StackEthernetConfig{MTU: 1500, MaxNodes: 1, MAC: mac, VLANID: 10, ServiceVLANID: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &testEtherNode{etype: ethernet.TypeIPv4, dst: peer}
+	link.RegisterEthernet(node)
+	if link.MaxFrameLength() != 1500+22 {
+		t.Errorf("want max frame length 1522, got %d", link.MaxFrameLength())
+	}
+	payload := make([]byte, 46)
+	var buf [1600]byte
+	node.send = payload
+	n, err := link.Encapsulate(buf[:], -1, 0)
+	if err != nil || n != 22+len(payload) {
+		t.Fatal("expected double tagged frame", n, err)
+	}
+	want := []byte{0x88, 0xa8, 0, 100, 0x81, 0x00, 0, 10, 0x08, 0x00}
+	if string(buf[12:22]) != string(want) {
+		t.Fatalf("want QinQ header %x, got %x", want, buf[12:22])
+	}
+	// Loop frame back.
+	copy(buf[:6], mac[:])
+	if err = link.Demux(buf[:n], 0); err != nil || len(node.received) != 1 {
+		t.Fatal("double tagged frame not received", err)
+	}
+	binary.BigEndian.PutUint16(buf[14:], 101)
+	if err = link.Demux(buf[:n], 0); err == nil {
+		t.Fatal("frame with wrong service VLAN accepted")
+	}
+	untagged := appendEthernet(nil, mac, peer, ethernet.TypeIPv4, payload)
+	if err = link.Demux(untagged, 0); err == nil {
+		t.Fatal("frame without service tag accepted")
+	}
+}
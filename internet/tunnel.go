@@ -0,0 +1,272 @@
+package internet
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+)
+
+// TunnelMode selects the encapsulation used by a [Tunnel].
+type TunnelMode uint8
+
+const (
+	// TunnelIPIP encapsulates inner packets directly after the outer IPv4 header: IPv4 in IPv4 (RFC 2003)
+	// or IPv6 in IPv4 (RFC 4213) depending on the inner stack.
+	TunnelIPIP TunnelMode = iota + 1
+	// TunnelGRE encapsulates inner packets with Generic Routing Encapsulation (RFC 2784, RFC 2890).
+	TunnelGRE
+)
+
+// GRE header flags, see RFC 2784 section 2 and RFC 2890 section 2.
+const (
+	greFlagChecksum = 0x8000
+	greFlagKey      = 0x2000
+	greFlagSeq      = 0x1000
+	greVersionMask  = 0x0007
+	sizeGREHeader   = 4
+)
+
+// TunnelConfig configures a [Tunnel]. See [Tunnel.Reset].
+type TunnelConfig struct {
+	Mode TunnelMode
+	// Inner is the IP stack packets are tunneled for, usually a [StackIPv4] or [StackIPv6].
+	// Its Protocol method must return [ethernet.TypeIPv4] or [ethernet.TypeIPv6].
+	Inner lneto.StackNode
+	// Remote is the outer destination address, the far tunnel endpoint. Only packets from Remote are decapsulated.
+	Remote [4]byte
+	// Local, if set, overrides the outer source address set by the outer stack.
+	Local [4]byte
+	// TTL is the outer Time-To-Live. Defaults to the outer stack's.
+	TTL uint8
+	// GRE options. Key identifies the tunnel and is sent and required on received packets when UseKey is set.
+	UseKey bool
+	Key    uint32
+	// Sequence numbers outgoing packets and drops received packets without sequence number or out of order (RFC 2890 section 2.2).
+	Sequence bool
+	// Checksum adds a checksum to outgoing packets. Received checksums are always verified.
+	Checksum bool
+}
+
+// TunnelStats holds packet counters of a [Tunnel].
+type TunnelStats struct {
+	RxPackets  uint64
+	TxPackets  uint64
+	RxDropped  uint64
+	RxOutOrder uint64 // Dropped due to sequence number.
+}
+
+// Tunnel is a GRE or IP-in-IP tunnel endpoint. It is a [lneto.StackNode] registered on the
+// outer [StackIPv4] with [StackIPv4.Register4]: received packets are decapsulated and
+// passed to the inner stack and packets of the inner stack are encapsulated towards the remote endpoint.
+// An outer stack may only hold one tunnel of each outer protocol (GRE, IPv4 and IPv6 encapsulation).
+type Tunnel struct {
+	connID  uint64
+	inner   lneto.StackNode
+	proto   lneto.IPProto
+	etype   ethernet.Type
+	remote  [4]byte
+	local   [4]byte
+	ttl     uint8
+	greOpts uint16 // GRE flags sent.
+	key     uint32
+	txSeq   uint32
+	rxSeq   uint32
+	rxSeqOK bool // rxSeq is valid.
+	stats   TunnelStats
+	logger
+}
+
+// Reset configures the tunnel and clears its state and counters.
+func (t *Tunnel) Reset(cfg TunnelConfig) error {
+	if cfg.Inner == nil || cfg.Remote == ([4]byte{}) {
+		return lneto.ErrInvalidConfig
+	}
+	etype := ethernet.Type(cfg.Inner.Protocol())
+	var proto lneto.IPProto
+	switch {
+	case cfg.Mode == TunnelGRE && (etype == ethernet.TypeIPv4 || etype == ethernet.TypeIPv6):
+		proto = lneto.IPProtoGRE
+	case cfg.Mode == TunnelIPIP && etype == ethernet.TypeIPv4:
+		proto = lneto.IPProtoIPv4
+	case cfg.Mode == TunnelIPIP && etype == ethernet.TypeIPv6:
+		proto = lneto.IPProtoIPv6
+	default:
+		return lneto.ErrInvalidConfig
+	}
+	var greOpts uint16
+	if cfg.Mode == TunnelGRE {
+		if cfg.Checksum {
+			greOpts |= greFlagChecksum
+		}
+		if cfg.UseKey {
+			greOpts |= greFlagKey
+		}
+		if cfg.Sequence {
+			greOpts |= greFlagSeq
+		}
+	} else if cfg.Checksum || cfg.UseKey || cfg.Sequence {
+		return lneto.ErrInvalidConfig // GRE options on IP-in-IP tunnel.
+	}
+	*t = Tunnel{
+		connID:  t.connID + 1,
+		inner:   cfg.Inner,
+		proto:   proto,
+		etype:   etype,
+		remote:  cfg.Remote,
+		local:   cfg.Local,
+		ttl:     cfg.TTL,
+		greOpts: greOpts,
+		key:     cfg.Key,
+		logger:  t.logger,
+	}
+	return nil
+}
+
+// SetLogger sets the tunnel's logger.
+func (t *Tunnel) SetLogger(log *slog.Logger) { t.log = log }
+
+// Stats returns the tunnel's packet counters.
+func (t *Tunnel) Stats() TunnelStats { return t.stats }
+
+// Protocol returns the outer IP protocol number: [lneto.IPProtoGRE], [lneto.IPProtoIPv4] or [lneto.IPProtoIPv6].
+func (t *Tunnel) Protocol() uint64 { return uint64(t.proto) }
+
+func (t *Tunnel) LocalPort() uint16 { return 0 }
+
+func (t *Tunnel) ConnectionID() *uint64 { return &t.connID }
+
+// Demux decapsulates the tunneled packet carried by the outer IPv4 packet in carrierData and passes it to the inner stack.
+func (t *Tunnel) Demux(carrierData []byte, frameOffset int) error {
+	ifrm, err := ipv4.NewFrame(carrierData)
+	if err != nil {
+		return err
+	} else if *ifrm.SourceAddr() != t.remote {
+		t.stats.RxDropped++
+		t.debug("tunnel:unknown-remote", internal.SlogAddr4("src", ifrm.SourceAddr()))
+		return lneto.ErrPacketDrop
+	}
+	off := frameOffset
+	if t.proto == lneto.IPProtoGRE {
+		off, err = t.decapGRE(carrierData, frameOffset)
+		if err != nil {
+			t.stats.RxDropped++
+			t.debug("tunnel:gre-drop", slog.String("err", err.Error()))
+			return err
+		}
+	}
+	t.stats.RxPackets++
+	err = t.inner.Demux(carrierData, off)
+	if err == lneto.ErrPacketDrop {
+		err = nil // Do not let inner stack drops close the tunnel node.
+	}
+	return err
+}
+
+// decapGRE validates the GRE header at frameOffset and returns the offset of the inner packet.
+func (t *Tunnel) decapGRE(carrierData []byte, frameOffset int) (int, error) {
+	gre := carrierData[frameOffset:]
+	if len(gre) < sizeGREHeader {
+		return 0, lneto.ErrTruncatedFrame
+	}
+	flags := binary.BigEndian.Uint16(gre[0:2])
+	if flags&greVersionMask != 0 {
+		return 0, lneto.ErrUnsupported
+	} else if ethernet.Type(binary.BigEndian.Uint16(gre[2:4])) != t.etype {
+		return 0, lneto.ErrPacketDrop
+	}
+	hl := greHeaderLen(flags)
+	if len(gre) < hl {
+		return 0, lneto.ErrTruncatedFrame
+	}
+	off := sizeGREHeader
+	if flags&greFlagChecksum != 0 {
+		var crc lneto.CRC791
+		if crc.PayloadSum16(gre) != 0 {
+			return 0, lneto.ErrBadCRC
+		}
+		off += 4
+	}
+	hasKey := flags&greFlagKey != 0
+	if hasKey != (t.greOpts&greFlagKey != 0) || (hasKey && binary.BigEndian.Uint32(gre[off:]) != t.key) {
+		return 0, lneto.ErrPacketDrop
+	} else if hasKey {
+		off += 4
+	}
+	if flags&greFlagSeq != 0 {
+		seq := binary.BigEndian.Uint32(gre[off:])
+		if t.greOpts&greFlagSeq != 0 && t.rxSeqOK && int32(seq-t.rxSeq) <= 0 {
+			t.stats.RxOutOrder++
+			return 0, lneto.ErrPacketDrop
+		}
+		t.rxSeq, t.rxSeqOK = seq, true
+	} else if t.greOpts&greFlagSeq != 0 {
+		return 0, lneto.ErrPacketDrop
+	}
+	return frameOffset + hl, nil
+}
+
+func greHeaderLen(flags uint16) int {
+	n := sizeGREHeader
+	if flags&greFlagChecksum != 0 {
+		n += 4
+	}
+	if flags&greFlagKey != 0 {
+		n += 4
+	}
+	if flags&greFlagSeq != 0 {
+		n += 4
+	}
+	return n
+}
+
+// Encapsulate writes a packet of the inner stack into carrierData after the outer headers and sets the outer IPv4 addresses.
+func (t *Tunnel) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	hl := 0
+	if t.proto == lneto.IPProtoGRE {
+		hl = greHeaderLen(t.greOpts)
+	}
+	innerOff := offsetToFrame + hl
+	if innerOff >= len(carrierData) {
+		return 0, lneto.ErrShortBuffer
+	}
+	n, err := t.inner.Encapsulate(carrierData, innerOff, innerOff)
+	if n == 0 {
+		return 0, err
+	}
+	ifrm, _ := ipv4.NewFrame(carrierData[offsetToIP:])
+	*ifrm.DestinationAddr() = t.remote
+	if t.local != ([4]byte{}) {
+		*ifrm.SourceAddr() = t.local
+	}
+	if t.ttl != 0 {
+		ifrm.SetTTL(t.ttl)
+	}
+	if t.proto == lneto.IPProtoGRE {
+		gre := carrierData[offsetToFrame : innerOff+n]
+		binary.BigEndian.PutUint16(gre[0:2], t.greOpts)
+		binary.BigEndian.PutUint16(gre[2:4], uint16(t.etype))
+		off := sizeGREHeader
+		if t.greOpts&greFlagChecksum != 0 {
+			binary.BigEndian.PutUint32(gre[off:], 0) // Checksum calculated last.
+			off += 4
+		}
+		if t.greOpts&greFlagKey != 0 {
+			binary.BigEndian.PutUint32(gre[off:], t.key)
+			off += 4
+		}
+		if t.greOpts&greFlagSeq != 0 {
+			binary.BigEndian.PutUint32(gre[off:], t.txSeq)
+			t.txSeq++
+		}
+		if t.greOpts&greFlagChecksum != 0 {
+			var crc lneto.CRC791
+			binary.BigEndian.PutUint16(gre[sizeGREHeader:], crc.PayloadSum16(gre))
+		}
+	}
+	t.stats.TxPackets++
+	return hl + n, err
+}
@@ -0,0 +1,153 @@
+package internet
+
+import (
+	"testing"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ipv4"
+)
+
+type testTunnelEnd struct {
+	outer  StackIPv4
+	inner  StackIPv4
+	tunnel Tunnel
+	udp    testUDPNode
+}
+
+func newTestTunnelEnd(t *testing.T, cfg TunnelConfig, outerAddr, innerAddr [4]byte) *testTunnelEnd {
+	t.Helper()
+	end := new(testTunnelEnd)
+	if err := end.outer.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	end.outer.SetAddr4(outerAddr)
+	if err := end.inner.Reset(new(lneto.Validator), 2); err != nil {
+		t.Fatal(err)
+	}
+	end.inner.SetAddr4(innerAddr)
+	end.udp.lport = 9
+	end.udp.rport = 9
+	if err := end.inner.Register4(&end.udp); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Inner = &end.inner
+	if err := end.tunnel.Reset(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := end.outer.Register4(&end.tunnel); err != nil {
+		t.Fatal(err)
+	}
+	return end
+}
+
+// sendTunnel encapsulates a UDP datagram from a's inner stack to peer's inner address.
+func sendTunnel(t *testing.T, a *testTunnelEnd, peerInner [4]byte) []byte {
+	t.Helper()
+	a.udp.send = true
+	a.udp.raddr = peerInner
+	var buf [256]byte
+	n, err := a.outer.Encapsulate(buf[:], 0, 0)
+	if err != nil || n == 0 {
+		t.Fatal("encapsulate failed", n, err)
+	}
+	return buf[:n]
+}
+
+func TestTunnel_GRE(t *testing.T) {
+	outerA, outerB := [4]byte{192, 0, 2, 1}, [4]byte{192, 0, 2, 2}
+	innerA, innerB := [4]byte{10, 9, 0, 1}, [4]byte{10, 9, 0, 2}
+	cfg := TunnelConfig{Mode: TunnelGRE, UseKey: true, Key: 0xcafe, Sequence: true, Checksum: true, TTL: 200}
+	cfg.Remote = outerB
+	a := newTestTunnelEnd(t, cfg, outerA, innerA)
+	cfg.Remote = outerA
+	b := newTestTunnelEnd(t, cfg, outerB, innerB)
+
+	pkt := sendTunnel(t, a, innerB)
+	ifrm, _ := ipv4.NewFrame(pkt)
+	if ifrm.Protocol() != lneto.IPProtoGRE || *ifrm.DestinationAddr() != outerB || ifrm.TTL() != 200 {
+		t.Fatalf("bad outer header %s", ifrm.String())
+	} else if ifrm.CalculateHeaderCRC() != 0 {
+		t.Error("bad outer header checksum")
+	}
+	gre := ifrm.Payload()
+	if len(gre) != 16+20+8 {
+		t.Fatalf("want GRE header with checksum, key and sequence, got length %d", len(gre))
+	}
+	inner, _ := ipv4.NewFrame(gre[16:])
+	if *inner.SourceAddr() != innerA || *inner.DestinationAddr() != innerB {
+		t.Errorf("bad inner addresses %s", inner.String())
+	}
+	first := append([]byte{}, pkt...)
+	if err := b.outer.Demux(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.udp.received != 1 {
+		t.Fatal("inner datagram not received")
+	}
+	// Replayed sequence number is dropped.
+	b.outer.Demux(first, 0)
+	if b.udp.received != 1 || b.tunnel.Stats().RxOutOrder != 1 {
+		t.Error("replayed packet was not dropped")
+	}
+	// Next sequence number is accepted.
+	pkt = sendTunnel(t, a, innerB)
+	if err := b.outer.Demux(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.udp.received != 2 {
+		t.Error("second datagram not received")
+	}
+	// Wrong key is dropped.
+	a.tunnel.key++
+	pkt = sendTunnel(t, a, innerB)
+	b.outer.Demux(pkt, 0)
+	if b.udp.received != 2 {
+		t.Error("packet with wrong key was received")
+	}
+	// Corrupted payload fails GRE checksum.
+	a.tunnel.key--
+	pkt = sendTunnel(t, a, innerB)
+	pkt[len(pkt)-1] ^= 0xff
+	b.outer.Demux(pkt, 0)
+	if b.udp.received != 2 {
+		t.Error("packet with bad GRE checksum was received")
+	}
+	if b.tunnel.Stats().RxDropped != 3 {
+		t.Errorf("want 3 dropped packets, got %d", b.tunnel.Stats().RxDropped)
+	}
+}
+
+func TestTunnel_IPIP(t *testing.T) {
+	outerA, outerB := [4]byte{192, 0, 2, 1}, [4]byte{192, 0, 2, 2}
+	innerA, innerB := [4]byte{10, 9, 0, 1}, [4]byte{10, 9, 0, 2}
+	a := newTestTunnelEnd(t, TunnelConfig{Mode: TunnelIPIP, Remote: outerB}, outerA, innerA)
+	b := newTestTunnelEnd(t, TunnelConfig{Mode: TunnelIPIP, Remote: outerA}, outerB, innerB)
+	if a.tunnel.Protocol() != uint64(lneto.IPProtoIPv4) {
+		t.Fatal("want IP-in-IP protocol number 4")
+	}
+	pkt := sendTunnel(t, a, innerB)
+	ifrm, _ := ipv4.NewFrame(pkt)
+	if ifrm.Protocol() != lneto.IPProtoIPv4 || len(ifrm.Payload()) != 20+8 {
+		t.Fatalf("bad outer packet %s", ifrm.String())
+	}
+	if err := b.outer.Demux(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.udp.received != 1 {
+		t.Fatal("inner datagram not received")
+	}
+	// Packets from an address other than the remote endpoint are dropped.
+	pkt = sendTunnel(t, a, innerB)
+	ifrm, _ = ipv4.NewFrame(pkt)
+	*ifrm.SourceAddr() = [4]byte{192, 0, 2, 99}
+	ifrm.SetCRC(0)
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	b.outer.Demux(pkt, 0)
+	if b.udp.received != 1 {
+		t.Error("packet from unknown remote was received")
+	}
+	var tun Tunnel
+	if err := tun.Reset(TunnelConfig{Mode: TunnelIPIP, Remote: outerA, Inner: &a.inner, UseKey: true}); err == nil {
+		t.Error("want error for GRE key on IP-in-IP tunnel")
+	}
+}
@@ -0,0 +1,80 @@
+// Package ipsec implements the IP Encapsulating Security Payload (ESP) of [RFC4303]
+// with AES-GCM as specified in [RFC4106].
+//
+// An [ESP] is a lneto.StackNode registered on an internet.StackIPv4 that protects traffic
+// with manually keyed security associations (SAs), either in transport mode where the
+// upper layer payload of the IP packet is encrypted or in tunnel mode where an entire
+// inner IP packet is encrypted. Key exchange (IKE), extended sequence numbers, IPv6
+// outer headers and fragmentation of protected packets are not supported.
+//
+// [RFC4303]: https://datatracker.ietf.org/doc/html/rfc4303
+// [RFC4106]: https://datatracker.ietf.org/doc/html/rfc4106
+package ipsec
+
+import (
+	"log/slog"
+
+	"github.com/soypat/lneto/internal"
+)
+
+// Mode is the IPsec mode of a security association.
+type Mode uint8
+
+const (
+	// ModeTransport protects the upper layer payload of IP packets between two hosts.
+	ModeTransport Mode = iota + 1
+	// ModeTunnel protects entire inner IP packets carried between two security gateways.
+	ModeTunnel
+)
+
+const (
+	sizeHeader = 8  // SPI and sequence number.
+	sizeIV     = 8  // Explicit AES-GCM IV, RFC 4106 section 3.1.
+	sizeICV    = 16 // Full length AES-GCM tag.
+	sizeSalt   = 4
+	sizeNonce  = sizeSalt + sizeIV
+	// Largest ESP trailer: 3 bytes of padding, pad length, next header and ICV.
+	maxTrailer = 3 + 2 + sizeICV
+	// replayWindow is the size of the anti-replay window in packets, see RFC 4303 section 3.4.3.
+	replayWindow = 64
+	// protoNoNext is the IPv6 No Next Header value used for ESP dummy packets, RFC 4303 section 2.6.
+	protoNoNext = 59
+)
+
+// SA is a manually keyed security association. See [ESP.AddSA].
+type SA struct {
+	// SPI is the Security Parameters Index that identifies the SA on the receiver. Must be nonzero.
+	SPI uint32
+	// Outbound is set for SAs used to protect sent traffic. Inbound SAs are looked up by SPI.
+	Outbound bool
+	Mode     Mode
+	// Key is the AES key followed by a 4 byte salt, 20, 28 or 36 bytes long as per RFC 4106 section 8.1.
+	Key []byte
+	// Remote is the address of the peer. Outbound transport mode SAs are selected by the destination
+	// address of the packet and tunnel mode SAs send to Remote. Inbound SAs only accept packets
+	// sent from Remote, a zero Remote on an inbound SA accepts any source.
+	Remote [4]byte
+	// InnerDst and InnerPrefixLen select the outbound tunnel mode SA used by the destination address
+	// of the inner packet. A zero InnerPrefixLen matches any inner destination.
+	InnerDst       [4]byte
+	InnerPrefixLen uint8
+}
+
+// Stats holds packet counters of an [ESP].
+type Stats struct {
+	RxPackets  uint64
+	TxPackets  uint64
+	RxNoSA     uint64 // Unknown SPI or source address.
+	RxReplay   uint64 // Duplicated or too old sequence number.
+	RxAuthFail uint64 // Integrity check failed.
+	RxDropped  uint64 // Malformed or unexpected payload.
+	TxNoSA     uint64 // No outbound SA matched the packet.
+}
+
+type logger struct {
+	log *slog.Logger
+}
+
+func (l logger) debug(msg string, attrs ...slog.Attr) {
+	internal.LogAttrs(l.log, slog.LevelDebug, msg, attrs...)
+}
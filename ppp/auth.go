@@ -0,0 +1,108 @@
+package ppp
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/lneto"
+)
+
+// authState authenticates a [Link] to the peer with PAP or CHAP-MD5. Only the
+// authenticatee side is implemented; the Link never demands authentication from the peer.
+type authState struct {
+	proto    Protocol
+	done     bool
+	id       uint8
+	restarts int
+	deadline int64
+	sendReq  bool // PAP Authenticate-Request pending.
+	respLen  int  // CHAP Response pending.
+	resp     [maxCtrlPacket]byte
+}
+
+func (l *Link) hasCredentials() bool { return l.username != "" || l.password != "" }
+
+func (l *Link) startAuth(proto Protocol) {
+	l.auth = authState{proto: proto, id: l.auth.id}
+	if proto == ProtoPAP {
+		l.auth.sendReq = true
+		l.auth.restarts = l.maxConfigure
+	}
+}
+
+func (l *Link) recvAuth(info []byte) {
+	frm, err := NewFrame(info)
+	if err != nil {
+		return
+	}
+	var v lneto.Validator
+	frm.ValidateSize(&v)
+	if v.HasError() {
+		l.debug("ppp:auth-invalid", slog.String("err", v.ErrPop().Error()))
+		return
+	}
+	code, id, data := frm.Code(), frm.Identifier(), frm.Data()
+	switch {
+	case l.auth.proto == ProtoPAP && id == l.auth.id && code == papAuthAck,
+		l.auth.proto == ProtoCHAP && code == chapSuccess:
+		l.auth.done = true
+		l.auth.sendReq = false
+		l.networkUp()
+
+	case l.auth.proto == ProtoPAP && id == l.auth.id && code == papAuthNak,
+		l.auth.proto == ProtoCHAP && code == chapFailure:
+		l.debug("ppp:auth-failed", slog.String("msg", string(data)))
+		l.Close()
+
+	case l.auth.proto == ProtoCHAP && code == chapChallenge:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return
+		}
+		challenge := data[1 : 1+data[0]]
+		// Response value is MD5(Identifier || secret || Challenge), see RFC 1994 section 4.1.
+		var buf [2 * maxCtrlPacket]byte
+		msg := append(buf[:0], id)
+		msg = append(msg, l.password...)
+		msg = append(msg, challenge...)
+		sum := md5.Sum(msg)
+		resp := l.auth.resp[:sizeCtrlHeader]
+		resp[0] = chapResponse
+		resp[1] = id
+		resp = append(resp, md5.Size)
+		resp = append(resp, sum[:]...)
+		resp = append(resp, l.username...)
+		binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)))
+		l.auth.respLen = len(resp)
+	}
+}
+
+// nextAuthPacket writes the next authentication packet into dst and returns it, or nil if there is nothing to send.
+func (l *Link) nextAuthPacket(dst []byte, now int64) []byte {
+	if l.auth.respLen > 0 {
+		n := copy(dst, l.auth.resp[:l.auth.respLen])
+		l.auth.respLen = 0
+		return dst[:n]
+	}
+	if l.auth.proto != ProtoPAP || l.auth.done || (!l.auth.sendReq && now-l.auth.deadline < 0) {
+		return nil
+	}
+	if l.auth.restarts <= 0 {
+		l.debug("ppp:pap-timeout")
+		l.Close()
+		return nil
+	}
+	l.auth.sendReq = false
+	l.auth.restarts--
+	l.auth.deadline = now + l.restartTimer
+	l.auth.id++
+	pkt := dst[:sizeCtrlHeader]
+	pkt[0] = papAuthRequest
+	pkt[1] = l.auth.id
+	pkt = append(pkt, uint8(len(l.username)))
+	pkt = append(pkt, l.username...)
+	pkt = append(pkt, uint8(len(l.password)))
+	pkt = append(pkt, l.password...)
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	return pkt
+}
@@ -0,0 +1,134 @@
+// Package ppp implements the Point-to-Point Protocol over serial links as specified in [RFC1661]
+// with HDLC-like framing as per [RFC1662].
+//
+// A [Link] negotiates the link with LCP, authenticates to the peer with PAP ([RFC1334]) or
+// CHAP-MD5 ([RFC1994]) and negotiates IPv4 ([RFC1332]) and IPv6 ([RFC5072]) addresses with IPCP and IPv6CP.
+// Once the network layer is up IP packets are exchanged with an [IPStack] such as xnet.StackAsync.
+// The Link performs no allocations during operation; all buffers are provided by the user.
+//
+// [RFC1661]: https://datatracker.ietf.org/doc/html/rfc1661
+// [RFC1662]: https://datatracker.ietf.org/doc/html/rfc1662
+// [RFC1334]: https://datatracker.ietf.org/doc/html/rfc1334
+// [RFC1994]: https://datatracker.ietf.org/doc/html/rfc1994
+// [RFC1332]: https://datatracker.ietf.org/doc/html/rfc1332
+// [RFC5072]: https://datatracker.ietf.org/doc/html/rfc5072
+package ppp
+
+import "time"
+
+// Protocol is the PPP protocol field identifying the datagram encapsulated in a PPP frame.
+type Protocol uint16
+
+const (
+	ProtoIPv4   Protocol = 0x0021 // Internet Protocol version 4
+	ProtoIPv6   Protocol = 0x0057 // Internet Protocol version 6
+	ProtoIPCP   Protocol = 0x8021 // IP Control Protocol
+	ProtoIPv6CP Protocol = 0x8057 // IPv6 Control Protocol
+	ProtoLCP    Protocol = 0xc021 // Link Control Protocol
+	ProtoPAP    Protocol = 0xc023 // Password Authentication Protocol
+	ProtoCHAP   Protocol = 0xc223 // Challenge Handshake Authentication Protocol
+)
+
+// Code is the code field of a control protocol packet (LCP, IPCP, IPv6CP). See [RFC1661] section 5.
+//
+// [RFC1661]: https://datatracker.ietf.org/doc/html/rfc1661#section-5
+type Code uint8
+
+const (
+	CodeConfigureRequest Code = 1
+	CodeConfigureAck     Code = 2
+	CodeConfigureNak     Code = 3
+	CodeConfigureReject  Code = 4
+	CodeTerminateRequest Code = 5
+	CodeTerminateAck     Code = 6
+	CodeCodeReject       Code = 7
+	CodeProtocolReject   Code = 8 // LCP only.
+	CodeEchoRequest      Code = 9 // LCP only.
+	CodeEchoReply        Code = 10
+	CodeDiscardRequest   Code = 11
+)
+
+// LCP configuration option types. See [RFC1661] section 6.
+//
+// [RFC1661]: https://datatracker.ietf.org/doc/html/rfc1661#section-6
+const (
+	lcpOptMRU          = 1
+	lcpOptACCM         = 2 // RFC 1662 section 7.1.
+	lcpOptAuthProtocol = 3
+	lcpOptMagicNumber  = 5
+	lcpOptPFC          = 7 // Protocol-Field-Compression.
+	lcpOptACFC         = 8 // Address-and-Control-Field-Compression.
+)
+
+// IPCP and IPv6CP configuration option types.
+const (
+	ipcpOptAddress      = 3   // RFC 1332 section 3.3.
+	ipcpOptPrimaryDNS   = 129 // RFC 1877.
+	ipcpOptSecondaryDNS = 131 // RFC 1877.
+	ipv6cpOptIfaceID    = 1   // RFC 5072 section 4.1.
+)
+
+// Authentication protocol codes.
+const (
+	papAuthRequest = 1
+	papAuthAck     = 2
+	papAuthNak     = 3
+
+	chapChallenge = 1
+	chapResponse  = 2
+	chapSuccess   = 3
+	chapFailure   = 4
+	chapAlgMD5    = 5
+)
+
+// Phase is the link phase as described in [RFC1661] section 3.2.
+//
+// [RFC1661]: https://datatracker.ietf.org/doc/html/rfc1661#section-3.2
+type Phase uint8
+
+const (
+	// PhaseDead is the initial phase and the phase after the link is terminated or negotiation fails.
+	PhaseDead Phase = iota
+	// PhaseEstablish negotiates the link configuration with LCP.
+	PhaseEstablish
+	// PhaseAuthenticate authenticates to the peer with PAP or CHAP.
+	PhaseAuthenticate
+	// PhaseNetwork negotiates and carries network layer protocols.
+	PhaseNetwork
+	// PhaseTerminate closes the link.
+	PhaseTerminate
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseDead:
+		return "dead"
+	case PhaseEstablish:
+		return "establish"
+	case PhaseAuthenticate:
+		return "authenticate"
+	case PhaseNetwork:
+		return "network"
+	case PhaseTerminate:
+		return "terminate"
+	}
+	return "unknown"
+}
+
+const (
+	// DefaultMRU is the Maximum-Receive-Unit in effect until negotiated otherwise.
+	DefaultMRU = 1500
+	// DefaultACCM is the Async-Control-Character-Map in effect until negotiated otherwise:
+	// all control characters are escaped.
+	DefaultACCM = 0xffffffff
+
+	defaultRestartTimer = 3 * time.Second
+	defaultMaxConfigure = 10
+	defaultMaxTerminate = 2
+	// sizeHeader is the size of the address, control and protocol fields of an uncompressed frame.
+	sizeHeader = 4
+	// sizeCtrlHeader is the size of the code, identifier and length fields of a control packet.
+	sizeCtrlHeader = 4
+	// maxCtrlPacket is the largest control packet sent or replied to.
+	maxCtrlPacket = 256
+)
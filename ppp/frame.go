@@ -0,0 +1,76 @@
+package ppp
+
+import (
+	"encoding/binary"
+
+	"github.com/soypat/lneto"
+)
+
+// Frame encapsulates the raw data of a control protocol packet (LCP, IPCP, IPv6CP, PAP or CHAP)
+// which consists of code, identifier and length fields followed by data. See [RFC1661] section 5.
+//
+// [RFC1661]: https://datatracker.ietf.org/doc/html/rfc1661#section-5
+type Frame struct {
+	buf []byte
+}
+
+// NewFrame returns a Frame with data set to buf. An error is returned if
+// the buffer is shorter than the 4 byte control packet header.
+// Users should call [Frame.ValidateSize] before accessing Data.
+func NewFrame(buf []byte) (Frame, error) {
+	if len(buf) < sizeCtrlHeader {
+		return Frame{}, lneto.ErrTruncatedFrame
+	}
+	return Frame{buf: buf}, nil
+}
+
+// RawData returns the underlying slice with which the frame was created.
+func (f Frame) RawData() []byte { return f.buf }
+
+// Code returns the kind of control packet.
+func (f Frame) Code() Code { return Code(f.buf[0]) }
+
+// SetCode sets the code field. See [Frame.Code].
+func (f Frame) SetCode(c Code) { f.buf[0] = uint8(c) }
+
+// Identifier aids in matching requests and replies.
+func (f Frame) Identifier() uint8 { return f.buf[1] }
+
+// SetIdentifier sets the identifier field. See [Frame.Identifier].
+func (f Frame) SetIdentifier(id uint8) { f.buf[1] = id }
+
+// Length is the length of the packet including the code, identifier and length fields.
+func (f Frame) Length() uint16 { return binary.BigEndian.Uint16(f.buf[2:4]) }
+
+// SetLength sets the length field. See [Frame.Length].
+func (f Frame) SetLength(length uint16) { binary.BigEndian.PutUint16(f.buf[2:4], length) }
+
+// Data returns the data field of the packet as delimited by the length field.
+func (f Frame) Data() []byte { return f.buf[sizeCtrlHeader:f.Length()] }
+
+// ValidateSize checks the frame's length field against the buffer size.
+func (f Frame) ValidateSize(v *lneto.Validator) {
+	l := f.Length()
+	if l < sizeCtrlHeader || int(l) > len(f.buf) {
+		v.AddError(lneto.ErrInvalidLengthField)
+	}
+}
+
+// nextOption parses the configuration option at the start of data and returns
+// the option type, its value and the remaining options.
+func nextOption(data []byte) (typ uint8, value, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, lneto.ErrTruncatedFrame
+	}
+	olen := int(data[1])
+	if olen < 2 || olen > len(data) {
+		return 0, nil, nil, lneto.ErrInvalidLengthField
+	}
+	return data[0], data[2:olen], data[olen:], nil
+}
+
+// appendOption appends a configuration option with the given type and value to dst.
+func appendOption(dst []byte, typ uint8, value []byte) []byte {
+	dst = append(dst, typ, uint8(2+len(value)))
+	return append(dst, value...)
+}
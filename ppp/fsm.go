@@ -0,0 +1,289 @@
+package ppp
+
+import (
+	"encoding/binary"
+
+	"github.com/soypat/lneto"
+)
+
+// cpState is a simplified state of the option negotiation automaton described in RFC 1661 section 4.
+// The Initial, Starting, Closed, Stopped and Stopping states are collapsed into cpClosed.
+type cpState uint8
+
+const (
+	cpClosed cpState = iota
+	cpReqSent
+	cpAckRcvd
+	cpAckSent
+	cpOpened
+	cpClosing
+)
+
+// negotiator holds the configuration options of a control protocol.
+type negotiator interface {
+	// appendRequest appends the options of our Configure-Request to dst.
+	appendRequest(dst []byte) []byte
+	// resetPeer is called before the options of a peer's Configure-Request are checked.
+	resetPeer()
+	// checkOption returns whether an option of the peer's Configure-Request is acceptable (CodeConfigureAck),
+	// acceptable with another value written to nak (CodeConfigureNak) or not recognized (CodeConfigureReject).
+	checkOption(typ uint8, value []byte, nak *[8]byte) (verdict Code, naklen int)
+	// nakOption is called for options of our request Nak'd by the peer with the value suggested by the peer.
+	nakOption(typ uint8, value []byte)
+	// rejectOption is called for options of our request rejected by the peer.
+	rejectOption(typ uint8)
+	// up and down are called when the automaton enters and leaves the Opened state.
+	up()
+	down()
+}
+
+// controlProtocol implements the option negotiation automaton shared by LCP, IPCP and IPv6CP.
+type controlProtocol struct {
+	proto    Protocol
+	state    cpState
+	neg      negotiator
+	id       uint8 // Identifier of our last request.
+	restarts int
+	deadline int64
+	sendReq  bool // Configure-Request or Terminate-Request pending, depending on state.
+	replyLen int
+	reply    [maxCtrlPacket]byte
+}
+
+func (cp *controlProtocol) reset(proto Protocol, neg negotiator) {
+	*cp = controlProtocol{proto: proto, neg: neg, id: cp.id}
+}
+
+func (cp *controlProtocol) isOpened() bool { return cp.state == cpOpened }
+
+func (cp *controlProtocol) open(maxConfigure int) {
+	if cp.state != cpClosed && cp.state != cpClosing {
+		return
+	}
+	cp.state = cpReqSent
+	cp.restarts = maxConfigure
+	cp.sendReq = true
+}
+
+// close starts termination of the protocol by sending Terminate-Requests.
+func (cp *controlProtocol) close(maxTerminate int) {
+	switch cp.state {
+	case cpClosed, cpClosing:
+		return
+	case cpOpened:
+		cp.neg.down()
+	}
+	cp.state = cpClosing
+	cp.restarts = maxTerminate
+	cp.sendReq = true
+}
+
+// lowerDown resets the automaton without sending packets, i.e: when the lower layer goes down.
+func (cp *controlProtocol) lowerDown() {
+	if cp.state == cpOpened {
+		cp.neg.down()
+	}
+	cp.state = cpClosed
+	cp.sendReq = false
+	cp.replyLen = 0
+}
+
+func (cp *controlProtocol) queueReply(code Code, id uint8, data []byte) {
+	n := min(len(data), maxCtrlPacket-sizeCtrlHeader)
+	cp.reply[0] = uint8(code)
+	cp.reply[1] = id
+	binary.BigEndian.PutUint16(cp.reply[2:4], uint16(sizeCtrlHeader+n))
+	copy(cp.reply[sizeCtrlHeader:], data[:n])
+	cp.replyLen = sizeCtrlHeader + n
+}
+
+// recv processes a control packet of the protocol.
+func (cp *controlProtocol) recv(pkt Frame, maxConfigure int) error {
+	id := pkt.Identifier()
+	data := pkt.Data()
+	switch pkt.Code() {
+	case CodeConfigureRequest:
+		switch cp.state {
+		case cpClosed:
+			cp.queueReply(CodeTerminateAck, id, nil) // RFC 1661 section 4.3: Closed state.
+			return nil
+		case cpClosing:
+			return nil
+		}
+		verdict, err := cp.checkRequest(id, data)
+		if err != nil {
+			return err
+		}
+		if cp.state == cpOpened {
+			// Peer is renegotiating.
+			cp.neg.down()
+			cp.state = cpReqSent
+			cp.restarts = maxConfigure
+			cp.sendReq = true
+		}
+		if verdict == CodeConfigureAck {
+			switch cp.state {
+			case cpReqSent:
+				cp.state = cpAckSent
+			case cpAckRcvd:
+				cp.state = cpOpened
+				cp.neg.up()
+			}
+		} else if cp.state == cpAckSent {
+			cp.state = cpReqSent
+		}
+
+	case CodeConfigureAck:
+		if id != cp.id {
+			return lneto.ErrMismatch
+		}
+		switch cp.state {
+		case cpReqSent:
+			cp.state = cpAckRcvd
+			cp.restarts = maxConfigure
+		case cpAckSent:
+			cp.state = cpOpened
+			cp.restarts = maxConfigure
+			cp.neg.up()
+		case cpAckRcvd, cpOpened:
+			cp.renegotiate(maxConfigure)
+		}
+
+	case CodeConfigureNak, CodeConfigureReject:
+		if id != cp.id {
+			return lneto.ErrMismatch
+		}
+		for opts := data; len(opts) > 0; {
+			typ, value, rest, err := nextOption(opts)
+			if err != nil {
+				return err
+			}
+			if pkt.Code() == CodeConfigureNak {
+				cp.neg.nakOption(typ, value)
+			} else {
+				cp.neg.rejectOption(typ)
+			}
+			opts = rest
+		}
+		switch cp.state {
+		case cpReqSent, cpAckSent:
+			cp.sendReq = true
+		case cpAckRcvd, cpOpened:
+			cp.renegotiate(maxConfigure)
+		}
+
+	case CodeTerminateRequest:
+		cp.queueReply(CodeTerminateAck, id, nil)
+		cp.lowerDown()
+		cp.replyLen = sizeCtrlHeader // lowerDown discards the reply.
+
+	case CodeTerminateAck:
+		switch cp.state {
+		case cpClosing:
+			cp.state = cpClosed
+			cp.sendReq = false
+		case cpAckRcvd:
+			cp.state = cpReqSent
+		case cpOpened:
+			cp.renegotiate(maxConfigure)
+		}
+
+	case CodeCodeReject:
+		// Rejected codes are never critical for our implementation.
+
+	default:
+		cp.queueReply(CodeCodeReject, cp.id, pkt.RawData()[:pkt.Length()])
+	}
+	return nil
+}
+
+func (cp *controlProtocol) renegotiate(maxConfigure int) {
+	if cp.state == cpOpened {
+		cp.neg.down()
+	}
+	cp.state = cpReqSent
+	cp.restarts = maxConfigure
+	cp.sendReq = true
+}
+
+// checkRequest checks the options of a peer's Configure-Request and queues the reply as per RFC 1661 section 5.
+func (cp *controlProtocol) checkRequest(id uint8, opts []byte) (verdict Code, err error) {
+	// First pass determines reply code, Configure-Reject takes precedence over Configure-Nak.
+	cp.neg.resetPeer()
+	verdict = CodeConfigureAck
+	var nak [8]byte
+	for rem := opts; len(rem) > 0; {
+		typ, value, rest, err := nextOption(rem)
+		if err != nil {
+			return 0, err
+		}
+		v, _ := cp.neg.checkOption(typ, value, &nak)
+		verdict = max(verdict, v)
+		rem = rest
+	}
+	if verdict == CodeConfigureAck {
+		cp.queueReply(CodeConfigureAck, id, opts)
+		return verdict, nil
+	}
+	// Second pass builds the Nak or Reject reply with the offending options.
+	reply := cp.reply[sizeCtrlHeader:sizeCtrlHeader]
+	for rem := opts; len(rem) > 0; {
+		typ, value, rest, _ := nextOption(rem)
+		v, naklen := cp.neg.checkOption(typ, value, &nak)
+		olen := len(rem) - len(rest)
+		if v == verdict && v == CodeConfigureReject && len(reply)+olen <= cap(reply) {
+			reply = append(reply, rem[:olen]...)
+		} else if v == verdict && len(reply)+2+naklen <= cap(reply) {
+			reply = appendOption(reply, typ, nak[:naklen])
+		}
+		rem = rest
+	}
+	cp.reply[0] = uint8(verdict)
+	cp.reply[1] = id
+	binary.BigEndian.PutUint16(cp.reply[2:4], uint16(sizeCtrlHeader+len(reply)))
+	cp.replyLen = sizeCtrlHeader + len(reply)
+	return verdict, nil
+}
+
+// nextPacket writes the next control packet to send into dst and returns it. It returns nil if there is nothing to send.
+// failed is set if the restart counter expired and the automaton gave up on negotiation or termination.
+func (cp *controlProtocol) nextPacket(dst []byte, now, restartTimer int64) (pkt []byte, failed bool) {
+	if cp.replyLen > 0 {
+		n := copy(dst, cp.reply[:cp.replyLen])
+		cp.replyLen = 0
+		return dst[:n], false
+	}
+	switch cp.state {
+	case cpReqSent, cpAckRcvd, cpAckSent, cpClosing:
+		if !cp.sendReq && now-cp.deadline >= 0 {
+			// Restart timer expired.
+			if cp.restarts <= 0 {
+				cp.lowerDown()
+				return nil, true
+			}
+			if cp.state == cpAckRcvd {
+				cp.state = cpReqSent
+			}
+			cp.sendReq = true
+		}
+	default:
+		return nil, false
+	}
+	if !cp.sendReq {
+		return nil, false
+	}
+	cp.sendReq = false
+	cp.restarts--
+	cp.deadline = now + restartTimer
+	cp.id++
+	dst[1] = cp.id
+	pkt = dst[:sizeCtrlHeader]
+	if cp.state == cpClosing {
+		dst[0] = uint8(CodeTerminateRequest)
+	} else {
+		dst[0] = uint8(CodeConfigureRequest)
+		pkt = cp.neg.appendRequest(pkt)
+	}
+	binary.BigEndian.PutUint16(dst[2:4], uint16(len(pkt)))
+	return pkt, false
+}
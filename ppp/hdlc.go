@@ -0,0 +1,172 @@
+package ppp
+
+import (
+	"encoding/binary"
+
+	"github.com/soypat/lneto"
+)
+
+const (
+	hdlcFlag    = 0x7e
+	hdlcEscape  = 0x7d
+	hdlcXOR     = 0x20
+	hdlcAddress = 0xff
+	hdlcControl = 0x03
+	// fcsInit and fcsGood are the initial and "good final" FCS-16 values, see RFC 1662 appendix C.2.
+	fcsInit = 0xffff
+	fcsGood = 0xf0b8
+	sizeFCS = 2
+)
+
+// FCS16 updates the 16-bit Frame Check Sequence fcs with the data in b as described in [RFC1662] appendix C.
+// The FCS of a frame is calculated starting with 0xffff and the complement of the result is transmitted
+// least significant octet first.
+//
+// [RFC1662]: https://datatracker.ietf.org/doc/html/rfc1662#appendix-C
+func FCS16(fcs uint16, b []byte) uint16 {
+	for _, c := range b {
+		fcs ^= uint16(c)
+		for range 8 {
+			if fcs&1 != 0 {
+				fcs = fcs>>1 ^ 0x8408
+			} else {
+				fcs >>= 1
+			}
+		}
+	}
+	return fcs
+}
+
+// Encode writes an HDLC-like framed PPP frame carrying info as protocol proto into dst and returns the number of bytes written.
+// Address and control fields and the protocol field are never compressed. Octets below 0x20 are escaped
+// if their bit is set in accm. It returns [lneto.ErrShortBuffer] if dst cannot fit the frame, which
+// is guaranteed not to happen if dst is at least 2*(len(info)+6)+2 bytes long.
+func Encode(dst []byte, proto Protocol, info []byte, accm uint32) (int, error) {
+	var hdr [sizeHeader]byte
+	hdr[0] = hdlcAddress
+	hdr[1] = hdlcControl
+	binary.BigEndian.PutUint16(hdr[2:], uint16(proto))
+	fcs := FCS16(fcsInit, hdr[:])
+	fcs = ^FCS16(fcs, info)
+	var trailer [sizeFCS]byte
+	binary.LittleEndian.PutUint16(trailer[:], fcs)
+	if len(dst) < 2 {
+		return 0, lneto.ErrShortBuffer
+	}
+	dst[0] = hdlcFlag
+	n := 1
+	var ok bool
+	if n, ok = escape(dst, n, hdr[:], accm); !ok {
+		return 0, lneto.ErrShortBuffer
+	} else if n, ok = escape(dst, n, info, accm); !ok {
+		return 0, lneto.ErrShortBuffer
+	} else if n, ok = escape(dst, n, trailer[:], accm); !ok || n >= len(dst) {
+		return 0, lneto.ErrShortBuffer
+	}
+	dst[n] = hdlcFlag
+	return n + 1, nil
+}
+
+func escape(dst []byte, n int, data []byte, accm uint32) (int, bool) {
+	for _, c := range data {
+		if c == hdlcFlag || c == hdlcEscape || (c < 0x20 && accm&(1<<c) != 0) {
+			if n+2 > len(dst) {
+				return n, false
+			}
+			dst[n] = hdlcEscape
+			dst[n+1] = c ^ hdlcXOR
+			n += 2
+		} else {
+			if n >= len(dst) {
+				return n, false
+			}
+			dst[n] = c
+			n++
+		}
+	}
+	return n, true
+}
+
+// Decoder decodes HDLC-like framed PPP frames from a byte stream. The zero value is not ready for use, call [Decoder.Reset].
+type Decoder struct {
+	buf      []byte
+	n        int
+	accm     uint32
+	esc      bool
+	overflow bool
+}
+
+// Reset sets the buffer used to store frames being received, which should be at least MRU+6 bytes long,
+// and resets the receive Async-Control-Character-Map to [DefaultACCM].
+func (d *Decoder) Reset(buf []byte) {
+	*d = Decoder{buf: buf, accm: DefaultACCM}
+}
+
+// SetACCM sets the receive Async-Control-Character-Map. Unescaped control characters whose bit
+// is set in accm are assumed to be inserted by intermediate equipment and are discarded.
+func (d *Decoder) SetACCM(accm uint32) { d.accm = accm }
+
+// Decode consumes bytes from data until a frame is completed and returns the number of bytes consumed
+// and the frame, without flags, escaping nor FCS. The frame aliases the decoder's buffer and is valid until the next call to Decode.
+// A nil frame with a nil error means data was consumed entirely without completing a frame.
+// Frames with a bad FCS return [lneto.ErrBadCRC] and frames that overflow the buffer return [lneto.ErrBufferFull].
+// In both cases decoding may continue after the consumed bytes.
+func (d *Decoder) Decode(data []byte) (consumed int, frame []byte, err error) {
+	for i, c := range data {
+		switch {
+		case c == hdlcFlag:
+			n, overflow, esc := d.n, d.overflow, d.esc
+			d.n, d.overflow, d.esc = 0, false, false
+			if n == 0 {
+				continue // Interframe fill or back-to-back flags.
+			} else if esc {
+				continue // Abort sequence, see RFC 1662 section 4.3.
+			} else if overflow {
+				return i + 1, nil, lneto.ErrBufferFull
+			} else if n < sizeFCS+2 {
+				continue // Runt frame, silently discarded.
+			} else if FCS16(fcsInit, d.buf[:n]) != fcsGood {
+				return i + 1, nil, lneto.ErrBadCRC
+			}
+			return i + 1, d.buf[:n-sizeFCS], nil
+		case c == hdlcEscape:
+			d.esc = true
+			continue
+		case c < 0x20 && d.accm&(1<<c) != 0:
+			continue // Inserted by DCE.
+		}
+		if d.esc {
+			c ^= hdlcXOR
+			d.esc = false
+		}
+		if d.n >= len(d.buf) {
+			d.overflow = true
+			continue
+		}
+		d.buf[d.n] = c
+		d.n++
+	}
+	return len(data), nil, nil
+}
+
+// ParseFrame returns the protocol and information fields of a decoded frame, handling
+// Address-and-Control-Field-Compression and Protocol-Field-Compression.
+func ParseFrame(frame []byte) (proto Protocol, info []byte, err error) {
+	if len(frame) >= 2 && frame[0] == hdlcAddress && frame[1] == hdlcControl {
+		frame = frame[2:]
+	}
+	if len(frame) < 1 {
+		return 0, nil, lneto.ErrTruncatedFrame
+	}
+	if frame[0]&1 != 0 {
+		// Compressed protocol field: odd first octet.
+		return Protocol(frame[0]), frame[1:], nil
+	} else if len(frame) < 2 {
+		return 0, nil, lneto.ErrTruncatedFrame
+	}
+	proto = Protocol(binary.BigEndian.Uint16(frame))
+	if proto&1 == 0 {
+		return proto, nil, lneto.ErrInvalidField // Protocol field must be odd.
+	}
+	return proto, frame[2:], nil
+}
@@ -0,0 +1,430 @@
+package ppp
+
+import (
+	"cmp"
+	"encoding/binary"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+)
+
+// IPStack exchanges IP packets with a [Link]. It is implemented by xnet.StackAsync.
+type IPStack interface {
+	// IngressIP processes an incoming IPv4 or IPv6 packet.
+	IngressIP(ipFrame []byte) error
+	// EgressIP writes an outgoing IP packet to dst and returns its length, or 0 if there is nothing to send.
+	EgressIP(dst []byte) (int, error)
+}
+
+// LinkConfig configures a [Link]. See [Link.Reset].
+type LinkConfig struct {
+	// RxBuffer stores frames being received. Must be at least MRU+6 bytes long.
+	RxBuffer []byte
+	// TxBuffer stores outgoing IP packets before framing. Required if Stack is set.
+	TxBuffer []byte
+	// MRU is the Maximum-Receive-Unit requested to the peer. Defaults to [DefaultMRU].
+	MRU uint16
+	// Stack receives and sends IP packets once the network phase is reached.
+	Stack IPStack
+	// Username and Password authenticate the link to the peer with PAP or CHAP if the peer demands it.
+	// Their combined length may not exceed 240 bytes.
+	Username string
+	Password string
+	// LocalAddr4 is the IPv4 address requested for the local end. If zero the peer is asked to assign one.
+	LocalAddr4 [4]byte
+	// PeerAddr4, if set, is the IPv4 address assigned to the peer.
+	PeerAddr4 [4]byte
+	// RequestDNS requests primary and secondary DNS server addresses from the peer as per RFC 1877.
+	RequestDNS bool
+	// EnableIPv6 negotiates IPv6 with IPv6CP.
+	EnableIPv6 bool
+	// Nanotime returns the current time in nanoseconds. Used for the restart timer.
+	Nanotime func() int64
+	// RandSeed seeds the Magic-Number and interface identifier generation.
+	RandSeed uint32
+	// RestartTimer is the retransmission interval of requests. Defaults to 3 seconds.
+	RestartTimer time.Duration
+	// MaxConfigure is the number of requests sent before giving up. Defaults to 10.
+	MaxConfigure int
+}
+
+// Link is a PPP endpoint over an asynchronous serial link. Serial data received is passed to [Link.Ingress]
+// and data to transmit is obtained with [Link.Egress].
+type Link struct {
+	dec          Decoder
+	stack        IPStack
+	txbuf        []byte
+	nanotime     func() int64
+	restartTimer int64
+	maxConfigure int
+	prand        uint32
+	username     string
+	password     string
+	enableIPv6   bool
+	phase        Phase
+	lcp          controlProtocol
+	ipcp         controlProtocol
+	ipv6cp       controlProtocol
+	lcpOpts      lcpOptions
+	ipcpOpts     ipcpOptions
+	ipv6cpOpts   ipv6cpOptions
+	auth         authState
+	logger
+}
+
+// Reset configures the link and leaves it in [PhaseDead]. Call [Link.Open] to start negotiation.
+func (l *Link) Reset(cfg LinkConfig) error {
+	mru := cmp.Or(cfg.MRU, DefaultMRU)
+	if len(cfg.RxBuffer) < int(mru)+sizeHeader+sizeFCS || cfg.Nanotime == nil ||
+		(cfg.Stack != nil && len(cfg.TxBuffer) == 0) ||
+		len(cfg.Username)+len(cfg.Password) > maxCtrlPacket-16 ||
+		cfg.RestartTimer < 0 || cfg.MaxConfigure < 0 {
+		return lneto.ErrInvalidConfig
+	}
+	*l = Link{
+		stack:        cfg.Stack,
+		txbuf:        cfg.TxBuffer,
+		nanotime:     cfg.Nanotime,
+		restartTimer: int64(cmp.Or(cfg.RestartTimer, defaultRestartTimer)),
+		maxConfigure: cmp.Or(cfg.MaxConfigure, defaultMaxConfigure),
+		prand:        cmp.Or(cfg.RandSeed, 1),
+		username:     cfg.Username,
+		password:     cfg.Password,
+		enableIPv6:   cfg.EnableIPv6,
+		logger:       l.logger,
+		lcpOpts: lcpOptions{
+			mru: mru,
+		},
+		ipcpOpts: ipcpOptions{
+			addr:       cfg.LocalAddr4,
+			assignPeer: cfg.PeerAddr4,
+			reqDNS:     cfg.RequestDNS,
+		},
+	}
+	l.dec.Reset(cfg.RxBuffer)
+	l.lcpOpts.l = l
+	l.ipcpOpts.l = l
+	l.ipv6cpOpts.l = l
+	l.resetLCPOptions()
+	l.lcp.reset(ProtoLCP, &l.lcpOpts)
+	l.ipcp.reset(ProtoIPCP, &l.ipcpOpts)
+	l.ipv6cp.reset(ProtoIPv6CP, &l.ipv6cpOpts)
+	return nil
+}
+
+// SetLogger sets the link's logger.
+func (l *Link) SetLogger(log *slog.Logger) { l.log = log }
+
+// Open starts link establishment by sending LCP Configure-Requests. Negotiation progresses as [Link.Ingress] and [Link.Egress] are called.
+func (l *Link) Open() error {
+	if l.nanotime == nil {
+		return lneto.ErrInvalidConfig
+	} else if l.phase != PhaseDead {
+		return lneto.ErrBadState
+	}
+	l.phase = PhaseEstablish
+	l.resetLCPOptions()
+	l.lcp.open(l.maxConfigure)
+	return nil
+}
+
+// Close terminates the link by sending LCP Terminate-Requests. The link enters [PhaseDead] once the peer acknowledges or the requests time out.
+func (l *Link) Close() {
+	if l.phase == PhaseDead || l.phase == PhaseTerminate {
+		return
+	}
+	l.ipcp.lowerDown()
+	l.ipv6cp.lowerDown()
+	l.phase = PhaseTerminate
+	l.lcp.close(defaultMaxTerminate)
+	l.checkLCP()
+}
+
+// Phase returns the current link phase.
+func (l *Link) Phase() Phase { return l.phase }
+
+// IPv4Up returns true if IPCP negotiation is complete and IPv4 packets are exchanged.
+func (l *Link) IPv4Up() bool { return l.ipcp.isOpened() }
+
+// IPv6Up returns true if IPv6CP negotiation is complete and IPv6 packets are exchanged.
+func (l *Link) IPv6Up() bool { return l.ipv6cp.isOpened() }
+
+// Addr4 returns the negotiated local IPv4 address.
+func (l *Link) Addr4() [4]byte { return l.ipcpOpts.addr }
+
+// PeerAddr4 returns the negotiated IPv4 address of the peer.
+func (l *Link) PeerAddr4() [4]byte { return l.ipcpOpts.peerAddr }
+
+// DNS4 returns the primary and secondary DNS server addresses provided by the peer. See [LinkConfig.RequestDNS].
+func (l *Link) DNS4() (primary, secondary [4]byte) {
+	return l.ipcpOpts.dns[0], l.ipcpOpts.dns[1]
+}
+
+// InterfaceID6 returns the negotiated local and peer IPv6 interface identifiers used to form link-local addresses.
+func (l *Link) InterfaceID6() (local, peer [8]byte) {
+	return l.ipv6cpOpts.iid, l.ipv6cpOpts.peerIID
+}
+
+// PeerMRU returns the Maximum-Receive-Unit of the peer. IP packets larger than it are dropped by [Link.Egress].
+func (l *Link) PeerMRU() uint16 { return l.lcpOpts.peerMRU }
+
+// Ingress processes serial data received from the peer. Data may contain any number of partial or complete frames.
+// It returns [lneto.ErrBadState] if the link is dead, in which case the data is discarded.
+func (l *Link) Ingress(serialData []byte) error {
+	if l.phase == PhaseDead {
+		return lneto.ErrBadState
+	}
+	for len(serialData) > 0 {
+		n, frame, err := l.dec.Decode(serialData)
+		serialData = serialData[n:]
+		if err != nil {
+			l.debug("ppp:decode", slog.String("err", err.Error()))
+		} else if frame != nil {
+			l.handleFrame(frame)
+		}
+	}
+	l.checkLCP()
+	return nil
+}
+
+func (l *Link) handleFrame(frame []byte) {
+	proto, info, err := ParseFrame(frame)
+	if err != nil {
+		l.debug("ppp:parse", slog.String("err", err.Error()))
+		return
+	}
+	switch proto {
+	case ProtoLCP:
+		l.recvLCP(info)
+
+	case ProtoPAP, ProtoCHAP:
+		if l.phase == PhaseAuthenticate && proto == l.auth.proto {
+			l.recvAuth(info)
+		}
+
+	case ProtoIPCP, ProtoIPv6CP:
+		cp := &l.ipcp
+		if proto == ProtoIPv6CP {
+			if !l.enableIPv6 {
+				l.protocolReject(proto, info)
+				return
+			}
+			cp = &l.ipv6cp
+		}
+		if l.phase == PhaseNetwork {
+			l.recvCtrl(cp, info)
+		}
+
+	case ProtoIPv4, ProtoIPv6:
+		cp := &l.ipcp
+		if proto == ProtoIPv6 {
+			cp = &l.ipv6cp
+		}
+		if !cp.isOpened() || l.stack == nil {
+			l.debug("ppp:ip-drop", slog.Uint64("proto", uint64(proto)))
+			return
+		}
+		err = l.stack.IngressIP(info)
+		if err != nil {
+			l.debug("ppp:ingress-ip", slog.String("err", err.Error()))
+		}
+
+	default:
+		l.protocolReject(proto, info)
+	}
+}
+
+func (l *Link) recvCtrl(cp *controlProtocol, info []byte) {
+	frm, err := NewFrame(info)
+	if err == nil {
+		var v lneto.Validator
+		frm.ValidateSize(&v)
+		err = v.ErrPop()
+	}
+	if err == nil {
+		err = cp.recv(frm, l.maxConfigure)
+	}
+	if err != nil {
+		l.debug("ppp:ctrl", slog.Uint64("proto", uint64(cp.proto)), slog.String("err", err.Error()))
+	}
+}
+
+func (l *Link) recvLCP(info []byte) {
+	if len(info) < sizeCtrlHeader {
+		return
+	}
+	frm, _ := NewFrame(info)
+	var v lneto.Validator
+	frm.ValidateSize(&v)
+	if v.HasError() {
+		return
+	}
+	data := frm.Data()
+	switch frm.Code() {
+	case CodeProtocolReject:
+		if len(data) < 2 {
+			return
+		}
+		switch Protocol(binary.BigEndian.Uint16(data)) {
+		case ProtoIPCP:
+			l.ipcp.lowerDown()
+		case ProtoIPv6CP:
+			l.ipv6cp.lowerDown()
+			l.enableIPv6 = false
+		}
+	case CodeEchoRequest:
+		if l.lcp.isOpened() && len(data) >= 4 {
+			l.lcp.queueReply(CodeEchoReply, frm.Identifier(), data)
+			binary.BigEndian.PutUint32(l.lcp.reply[sizeCtrlHeader:], l.lcpOpts.magic)
+		}
+	case CodeEchoReply, CodeDiscardRequest:
+		// Nothing to do.
+	default:
+		l.recvCtrl(&l.lcp, info)
+	}
+}
+
+// protocolReject queues an LCP Protocol-Reject for an unsupported protocol, see RFC 1661 section 5.7.
+func (l *Link) protocolReject(proto Protocol, info []byte) {
+	if !l.lcp.isOpened() {
+		return
+	}
+	l.debug("ppp:proto-reject", slog.Uint64("proto", uint64(proto)))
+	const hdr = sizeCtrlHeader + 2
+	n := min(len(info), maxCtrlPacket-hdr)
+	l.lcp.id++
+	l.lcp.reply[0] = uint8(CodeProtocolReject)
+	l.lcp.reply[1] = l.lcp.id
+	binary.BigEndian.PutUint16(l.lcp.reply[2:4], uint16(hdr+n))
+	binary.BigEndian.PutUint16(l.lcp.reply[4:6], uint16(proto))
+	copy(l.lcp.reply[hdr:], info[:n])
+	l.lcp.replyLen = hdr + n
+}
+
+// Egress writes the next frame to transmit over the serial link to dst and returns the number of bytes written.
+// Control packets are sent first, IP packets from the stack are sent once the network phase is reached.
+// dst must be at least 2*(len(TxBuffer)+6)+2 bytes long to fit an escaped IP packet.
+func (l *Link) Egress(dst []byte) (int, error) {
+	now := l.nanotime()
+	var buf [maxCtrlPacket]byte
+	pkt, _ := l.lcp.nextPacket(buf[:], now, l.restartTimer)
+	l.checkLCP()
+	if pkt != nil {
+		// RFC 1662 section 7.1: LCP packets are always sent with the default ACCM.
+		return Encode(dst, ProtoLCP, pkt, DefaultACCM)
+	}
+	switch l.phase {
+	case PhaseAuthenticate:
+		pkt = l.nextAuthPacket(buf[:], now)
+		if pkt != nil {
+			return Encode(dst, l.auth.proto, pkt, l.lcpOpts.txACCM)
+		}
+	case PhaseNetwork:
+		for _, cp := range [...]*controlProtocol{&l.ipcp, &l.ipv6cp} {
+			pkt, failed := cp.nextPacket(buf[:], now, l.restartTimer)
+			if failed {
+				l.debug("ppp:ncp-failed", slog.Uint64("proto", uint64(cp.proto)))
+			} else if pkt != nil {
+				return Encode(dst, cp.proto, pkt, l.lcpOpts.txACCM)
+			}
+		}
+		return l.egressIP(dst)
+	}
+	return 0, nil
+}
+
+func (l *Link) egressIP(dst []byte) (int, error) {
+	if l.stack == nil || !(l.ipcp.isOpened() || l.ipv6cp.isOpened()) {
+		return 0, nil
+	} else if len(dst) < 2*(len(l.txbuf)+sizeHeader+sizeFCS)+2 {
+		return 0, lneto.ErrShortBuffer
+	}
+	n, err := l.stack.EgressIP(l.txbuf)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	var proto Protocol
+	switch l.txbuf[0] >> 4 {
+	case 4:
+		if l.ipcp.isOpened() {
+			proto = ProtoIPv4
+		}
+	case 6:
+		if l.ipv6cp.isOpened() {
+			proto = ProtoIPv6
+		}
+	}
+	if proto == 0 || n > int(l.lcpOpts.peerMRU) {
+		return 0, lneto.ErrPacketDrop
+	}
+	return Encode(dst, proto, l.txbuf[:n], l.lcpOpts.txACCM)
+}
+
+// checkLCP moves the link to the dead phase if LCP finished terminating or gave up negotiating.
+func (l *Link) checkLCP() {
+	if l.phase != PhaseDead && l.lcp.state == cpClosed {
+		l.debug("ppp:link-dead")
+		l.phase = PhaseDead
+		l.ipcp.lowerDown()
+		l.ipv6cp.lowerDown()
+		l.dec.SetACCM(DefaultACCM)
+	}
+}
+
+func (l *Link) lcpUp() {
+	l.debug("ppp:lcp-up", slog.Uint64("auth", uint64(l.lcpOpts.auth)))
+	l.dec.SetACCM(l.lcpOpts.rxACCM)
+	if l.lcpOpts.auth != 0 {
+		l.phase = PhaseAuthenticate
+		l.startAuth(l.lcpOpts.auth)
+	} else {
+		l.networkUp()
+	}
+}
+
+func (l *Link) lcpDown() {
+	l.debug("ppp:lcp-down")
+	l.ipcp.lowerDown()
+	l.ipv6cp.lowerDown()
+	l.auth = authState{id: l.auth.id}
+	l.dec.SetACCM(DefaultACCM)
+	if l.phase != PhaseTerminate {
+		l.phase = PhaseEstablish
+	}
+}
+
+func (l *Link) networkUp() {
+	l.phase = PhaseNetwork
+	l.ipcp.open(l.maxConfigure)
+	if l.enableIPv6 {
+		l.ipv6cp.open(l.maxConfigure)
+	}
+}
+
+func (l *Link) resetLCPOptions() {
+	l.lcpOpts.rxACCM = 0
+	l.lcpOpts.rejected = 0
+	l.lcpOpts.magic = l.rand()
+	l.lcpOpts.resetPeer()
+}
+
+func (l *Link) rand() uint32 {
+	l.prand = internal.Prand32(l.prand)
+	return l.prand
+}
+
+func (l *Link) randIID() (iid [8]byte) {
+	binary.BigEndian.PutUint32(iid[:4], l.rand())
+	binary.BigEndian.PutUint32(iid[4:], l.rand())
+	return iid
+}
+
+type logger struct {
+	log *slog.Logger
+}
+
+func (l logger) debug(msg string, attrs ...slog.Attr) {
+	internal.LogAttrs(l.log, slog.LevelDebug, msg, attrs...)
+}
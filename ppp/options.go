@@ -0,0 +1,263 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/lneto/internal"
+)
+
+// Bits set in the rejected fields of the negotiators for options of our requests rejected by the peer.
+const (
+	rejMRU = 1 << iota
+	rejACCM
+	rejMagic
+)
+
+const (
+	rejAddr = 1 << iota
+	rejPrimaryDNS
+	rejSecondaryDNS
+)
+
+// lcpOptions negotiates the LCP configuration options of a [Link].
+type lcpOptions struct {
+	l        *Link
+	mru      uint16 // MRU we request.
+	rxACCM   uint32 // ACCM we request, characters the peer must escape.
+	magic    uint32
+	rejected uint8
+	// Peer's options, reset on each Configure-Request received.
+	peerMRU uint16
+	txACCM  uint32
+	auth    Protocol // Authentication protocol demanded by peer.
+}
+
+func (o *lcpOptions) appendRequest(dst []byte) []byte {
+	var buf [4]byte
+	if o.mru != DefaultMRU && o.rejected&rejMRU == 0 {
+		binary.BigEndian.PutUint16(buf[:2], o.mru)
+		dst = appendOption(dst, lcpOptMRU, buf[:2])
+	}
+	if o.rejected&rejACCM == 0 {
+		binary.BigEndian.PutUint32(buf[:], o.rxACCM)
+		dst = appendOption(dst, lcpOptACCM, buf[:])
+	}
+	if o.rejected&rejMagic == 0 {
+		binary.BigEndian.PutUint32(buf[:], o.magic)
+		dst = appendOption(dst, lcpOptMagicNumber, buf[:])
+	}
+	return dst
+}
+
+func (o *lcpOptions) resetPeer() {
+	o.peerMRU = DefaultMRU
+	o.txACCM = DefaultACCM
+	o.auth = 0
+}
+
+func (o *lcpOptions) checkOption(typ uint8, value []byte, nak *[8]byte) (Code, int) {
+	switch typ {
+	case lcpOptMRU:
+		if len(value) != 2 {
+			break
+		}
+		o.peerMRU = binary.BigEndian.Uint16(value)
+		return CodeConfigureAck, 0
+
+	case lcpOptACCM:
+		if len(value) != 4 {
+			break
+		}
+		o.txACCM = binary.BigEndian.Uint32(value)
+		return CodeConfigureAck, 0
+
+	case lcpOptAuthProtocol:
+		if len(value) < 2 || !o.l.hasCredentials() {
+			break // Can't authenticate, reject so peer may proceed without.
+		}
+		switch Protocol(binary.BigEndian.Uint16(value)) {
+		case ProtoPAP:
+			o.auth = ProtoPAP
+			return CodeConfigureAck, 0
+		case ProtoCHAP:
+			if len(value) == 3 && value[2] == chapAlgMD5 {
+				o.auth = ProtoCHAP
+				return CodeConfigureAck, 0
+			}
+		}
+		// Suggest CHAP with MD5.
+		binary.BigEndian.PutUint16(nak[:2], uint16(ProtoCHAP))
+		nak[2] = chapAlgMD5
+		return CodeConfigureNak, 3
+
+	case lcpOptMagicNumber:
+		if len(value) != 4 {
+			break
+		}
+		magic := binary.BigEndian.Uint32(value)
+		if magic != 0 && magic == o.magic && o.rejected&rejMagic == 0 {
+			// Possibly a looped-back link, see RFC 1661 section 6.4.
+			o.l.debug("ppp:magic-collision", slog.Uint64("magic", uint64(magic)))
+			binary.BigEndian.PutUint32(nak[:4], o.l.rand())
+			return CodeConfigureNak, 4
+		}
+		return CodeConfigureAck, 0
+
+	case lcpOptPFC, lcpOptACFC:
+		// Compressed frames are accepted on reception, they are never sent compressed.
+		if len(value) == 0 {
+			return CodeConfigureAck, 0
+		}
+	}
+	return CodeConfigureReject, 0
+}
+
+func (o *lcpOptions) nakOption(typ uint8, value []byte) {
+	switch typ {
+	case lcpOptMRU:
+		if len(value) == 2 {
+			o.mru = min(binary.BigEndian.Uint16(value), o.mru)
+		}
+	case lcpOptACCM:
+		if len(value) == 4 {
+			o.rxACCM |= binary.BigEndian.Uint32(value)
+		}
+	case lcpOptMagicNumber:
+		o.magic = o.l.rand()
+	}
+}
+
+func (o *lcpOptions) rejectOption(typ uint8) {
+	switch typ {
+	case lcpOptMRU:
+		o.rejected |= rejMRU
+	case lcpOptACCM:
+		o.rejected |= rejACCM
+		o.rxACCM = DefaultACCM
+	case lcpOptMagicNumber:
+		o.rejected |= rejMagic
+	}
+}
+
+func (o *lcpOptions) up()   { o.l.lcpUp() }
+func (o *lcpOptions) down() { o.l.lcpDown() }
+
+// ipcpOptions negotiates the IPCP configuration options of a [Link].
+type ipcpOptions struct {
+	l          *Link
+	addr       [4]byte
+	dns        [2][4]byte
+	reqDNS     bool
+	rejected   uint8
+	peerAddr   [4]byte
+	assignPeer [4]byte // Address to assign to peer, if nonzero.
+}
+
+func (o *ipcpOptions) appendRequest(dst []byte) []byte {
+	if o.rejected&rejAddr == 0 {
+		dst = appendOption(dst, ipcpOptAddress, o.addr[:])
+	}
+	if o.reqDNS && o.rejected&rejPrimaryDNS == 0 {
+		dst = appendOption(dst, ipcpOptPrimaryDNS, o.dns[0][:])
+	}
+	if o.reqDNS && o.rejected&rejSecondaryDNS == 0 {
+		dst = appendOption(dst, ipcpOptSecondaryDNS, o.dns[1][:])
+	}
+	return dst
+}
+
+func (o *ipcpOptions) resetPeer() {}
+
+func (o *ipcpOptions) checkOption(typ uint8, value []byte, nak *[8]byte) (Code, int) {
+	if typ != ipcpOptAddress || len(value) != 4 {
+		return CodeConfigureReject, 0 // We are not a DNS server.
+	}
+	addr := [4]byte(value)
+	if o.assignPeer != ([4]byte{}) && addr != o.assignPeer {
+		copy(nak[:], o.assignPeer[:])
+		return CodeConfigureNak, 4
+	} else if addr == ([4]byte{}) {
+		return CodeConfigureReject, 0 // Peer requests an address and we have none to assign.
+	}
+	o.peerAddr = addr
+	return CodeConfigureAck, 0
+}
+
+func (o *ipcpOptions) nakOption(typ uint8, value []byte) {
+	if len(value) != 4 {
+		return
+	}
+	switch typ {
+	case ipcpOptAddress:
+		o.addr = [4]byte(value)
+	case ipcpOptPrimaryDNS:
+		o.dns[0] = [4]byte(value)
+	case ipcpOptSecondaryDNS:
+		o.dns[1] = [4]byte(value)
+	}
+}
+
+func (o *ipcpOptions) rejectOption(typ uint8) {
+	switch typ {
+	case ipcpOptAddress:
+		o.rejected |= rejAddr
+	case ipcpOptPrimaryDNS:
+		o.rejected |= rejPrimaryDNS
+	case ipcpOptSecondaryDNS:
+		o.rejected |= rejSecondaryDNS
+	}
+}
+
+func (o *ipcpOptions) up() {
+	o.l.debug("ppp:ipcp-up", internal.SlogAddr4("addr", &o.addr), internal.SlogAddr4("peer", &o.peerAddr))
+}
+
+func (o *ipcpOptions) down() { o.l.debug("ppp:ipcp-down") }
+
+// ipv6cpOptions negotiates the IPv6CP interface identifiers of a [Link].
+type ipv6cpOptions struct {
+	l       *Link
+	iid     [8]byte
+	peerIID [8]byte
+}
+
+func (o *ipv6cpOptions) appendRequest(dst []byte) []byte {
+	if o.iid == ([8]byte{}) {
+		o.iid = o.l.randIID()
+	}
+	return appendOption(dst, ipv6cpOptIfaceID, o.iid[:])
+}
+
+func (o *ipv6cpOptions) resetPeer() {}
+
+func (o *ipv6cpOptions) checkOption(typ uint8, value []byte, nak *[8]byte) (Code, int) {
+	if typ != ipv6cpOptIfaceID || len(value) != 8 {
+		return CodeConfigureReject, 0
+	}
+	iid := [8]byte(value)
+	if iid == ([8]byte{}) || iid == o.iid {
+		// RFC 5072 section 4.1: suggest a different identifier.
+		for iid == ([8]byte{}) || iid == o.iid {
+			iid = o.l.randIID()
+		}
+		copy(nak[:], iid[:])
+		return CodeConfigureNak, 8
+	}
+	o.peerIID = iid
+	return CodeConfigureAck, 0
+}
+
+func (o *ipv6cpOptions) nakOption(typ uint8, value []byte) {
+	if typ == ipv6cpOptIfaceID && len(value) == 8 {
+		iid := [8]byte(value)
+		if iid != ([8]byte{}) && iid != o.peerIID {
+			o.iid = iid
+		}
+	}
+}
+
+func (o *ipv6cpOptions) rejectOption(typ uint8) {}
+
+func (o *ipv6cpOptions) up()   { o.l.debug("ppp:ipv6cp-up") }
+func (o *ipv6cpOptions) down() { o.l.debug("ppp:ipv6cp-down") }
@@ -0,0 +1,297 @@
+package ppp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+
+	"github.com/soypat/lneto"
+)
+
+func TestHDLC(t *testing.T) {
+	// FCS of "123456789" for the X.25 CRC.
+	if fcs := ^FCS16(fcsInit, []byte("123456789")); fcs != 0x906e {
+		t.Fatalf("want FCS 0x906e, got %#x", fcs)
+	}
+	info := []byte{0x7e, 0x7d, 0x00, 0x11, 0x20, 0xff, 'h', 'i'}
+	var buf [64]byte
+	n, err := Encode(buf[:], ProtoIPv4, info, DefaultACCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf[:n]
+	if encoded[0] != hdlcFlag || encoded[n-1] != hdlcFlag || bytes.IndexByte(encoded[1:n-1], hdlcFlag) >= 0 {
+		t.Fatalf("flag not escaped or missing: %x", encoded)
+	}
+	for _, c := range encoded[1 : n-1] {
+		if c < 0x20 {
+			t.Fatalf("control character %#x not escaped with default ACCM", c)
+		}
+	}
+	_, err = Encode(buf[:n-1], ProtoIPv4, info, DefaultACCM)
+	if err != lneto.ErrShortBuffer {
+		t.Fatal("expected short buffer error, got", err)
+	}
+
+	var dec Decoder
+	dec.Reset(make([]byte, 64))
+	// Feed byte by byte with interframe fill to test stream reassembly.
+	stream := append([]byte{hdlcFlag, hdlcFlag}, encoded...)
+	var frame []byte
+	for len(stream) > 0 {
+		n, frm, err := dec.Decode(stream[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+		if frm != nil {
+			frame = frm
+			break
+		}
+	}
+	proto, got, err := ParseFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	} else if proto != ProtoIPv4 || !bytes.Equal(got, info) {
+		t.Fatalf("want proto %#x info %x, got %#x %x", ProtoIPv4, info, proto, got)
+	}
+
+	// Corrupted frame.
+	encoded[5] ^= 1
+	_, _, err = dec.Decode(encoded)
+	if err != lneto.ErrBadCRC {
+		t.Fatal("expected bad CRC, got", err)
+	}
+	// Compressed address, control and protocol fields.
+	proto, got, err = ParseFrame([]byte{0x21, 'x'})
+	if err != nil || proto != ProtoIPv4 || string(got) != "x" {
+		t.Fatal("bad compressed frame parse", proto, got, err)
+	}
+}
+
+type testStack struct {
+	rx [][]byte
+	tx [][]byte
+}
+
+func (s *testStack) IngressIP(frame []byte) error {
+	s.rx = append(s.rx, append([]byte(nil), frame...))
+	return nil
+}
+
+func (s *testStack) EgressIP(dst []byte) (int, error) {
+	if len(s.tx) == 0 {
+		return 0, nil
+	}
+	n := copy(dst, s.tx[0])
+	s.tx = s.tx[1:]
+	return n, nil
+}
+
+func newTestLink(t *testing.T, now *int64, cfg LinkConfig) *Link {
+	t.Helper()
+	cfg.RxBuffer = make([]byte, 1600)
+	cfg.TxBuffer = make([]byte, 1500)
+	cfg.Nanotime = func() int64 { return *now }
+	var l Link
+	err := l.Reset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &l
+}
+
+// exchange passes frames between two links until neither has anything to send.
+func exchange(t *testing.T, a, b *Link) {
+	t.Helper()
+	buf := make([]byte, 2*1600)
+	for range 64 {
+		sent := false
+		for _, pair := range [2][2]*Link{{a, b}, {b, a}} {
+			n, err := pair[0].Egress(buf)
+			if err != nil {
+				t.Fatal(err)
+			} else if n > 0 {
+				sent = true
+				pair[1].Ingress(buf[:n])
+			}
+		}
+		if !sent {
+			return
+		}
+	}
+	t.Fatal("links did not settle")
+}
+
+func TestLink_Negotiate(t *testing.T) {
+	var now int64 = 1
+	var stackA, stackB testStack
+	a := newTestLink(t, &now, LinkConfig{
+		Stack:      &stackA,
+		RequestDNS: true,
+		EnableIPv6: true,
+		RandSeed:   1,
+	})
+	b := newTestLink(t, &now, LinkConfig{
+		Stack:      &stackB,
+		LocalAddr4: [4]byte{10, 0, 0, 1},
+		PeerAddr4:  [4]byte{10, 0, 0, 2},
+		EnableIPv6: true,
+		RandSeed:   2,
+	})
+	exchange(t, a, b)
+	for _, l := range []*Link{a, b} {
+		if l.Phase() != PhaseNetwork || !l.IPv4Up() || !l.IPv6Up() {
+			t.Fatalf("link not up: phase=%s ipv4=%v ipv6=%v", l.Phase(), l.IPv4Up(), l.IPv6Up())
+		}
+	}
+	if a.Addr4() != [4]byte{10, 0, 0, 2} || a.PeerAddr4() != [4]byte{10, 0, 0, 1} || b.PeerAddr4() != a.Addr4() {
+		t.Fatal("bad negotiated addresses", a.Addr4(), a.PeerAddr4(), b.PeerAddr4())
+	}
+	localA, peerA := a.InterfaceID6()
+	localB, peerB := b.InterfaceID6()
+	if localA != peerB || localB != peerA || localA == localB {
+		t.Fatal("bad interface identifiers", localA, peerA, localB, peerB)
+	}
+
+	// IP packets flow once NCPs are open.
+	pkt := []byte{0x45, 0, 0, 20, 0x7e, 0x7d, 0, 0, 64, 17, 0, 0, 10, 0, 0, 2, 10, 0, 0, 1}
+	stackA.tx = append(stackA.tx, pkt)
+	exchange(t, a, b)
+	if len(stackB.rx) != 1 || !bytes.Equal(stackB.rx[0], pkt) {
+		t.Fatalf("IP packet not delivered: %x", stackB.rx)
+	}
+
+	// Echo-Request is answered.
+	var echo [8]byte
+	echo[0], echo[1] = uint8(CodeEchoRequest), 9
+	binary.BigEndian.PutUint16(echo[2:], 8)
+	if got := roundTrip(t, b, ProtoLCP, echo[:]); got[0] != uint8(CodeEchoReply) || got[1] != 9 {
+		t.Fatalf("bad echo reply %x", got)
+	}
+
+	// Termination.
+	a.Close()
+	exchange(t, a, b)
+	if a.Phase() != PhaseDead || b.Phase() != PhaseDead || b.IPv4Up() {
+		t.Fatal("link not terminated", a.Phase(), b.Phase())
+	}
+}
+
+func TestLink_Timeout(t *testing.T) {
+	var now int64 = 1
+	l := newTestLink(t, &now, LinkConfig{MaxConfigure: 2})
+	buf := make([]byte, 512)
+	for i := 0; i < 2; i++ {
+		n, _ := l.Egress(buf)
+		if n == 0 {
+			t.Fatal("expected Configure-Request", i)
+		}
+		n, _ = l.Egress(buf)
+		if n != 0 {
+			t.Fatal("request sent before restart timer expired")
+		}
+		now += int64(defaultRestartTimer)
+	}
+	l.Egress(buf)
+	if l.Phase() != PhaseDead {
+		t.Fatal("expected dead link after restart counter expired, got", l.Phase())
+	}
+}
+
+func TestLink_CHAP(t *testing.T) {
+	var now int64 = 1
+	l := newTestLink(t, &now, LinkConfig{Username: "user", Password: "secret", RandSeed: 3})
+	// Peer requests CHAP-MD5.
+	req := ctrlPacket(CodeConfigureRequest, 1, []byte{lcpOptAuthProtocol, 5, 0xc2, 0x23, chapAlgMD5})
+	if got := roundTrip(t, l, ProtoLCP, req); Code(got[0]) != CodeConfigureAck {
+		t.Fatalf("expected ack of CHAP auth option, got %x", got)
+	}
+	// Ack our Configure-Request.
+	ourReq := egressCtrl(t, l, ProtoLCP)
+	ourReq[0] = uint8(CodeConfigureAck)
+	ingressCtrl(t, l, ProtoLCP, ourReq)
+	if l.Phase() != PhaseAuthenticate {
+		t.Fatal("expected authenticate phase, got", l.Phase())
+	}
+	challenge := []byte("0123456789abcdef")
+	chal := ctrlPacket(chapChallenge, 7, append(append([]byte{16}, challenge...), "srv"...))
+	resp := roundTrip(t, l, ProtoCHAP, chal)
+	want := md5.Sum(append(append([]byte{7}, "secret"...), challenge...))
+	if resp[0] != chapResponse || resp[1] != 7 || resp[4] != 16 || !bytes.Equal(resp[5:21], want[:]) || string(resp[21:]) != "user" {
+		t.Fatalf("bad CHAP response %x", resp)
+	}
+	ingressCtrl(t, l, ProtoCHAP, ctrlPacket(chapSuccess, 7, nil))
+	if l.Phase() != PhaseNetwork {
+		t.Fatal("expected network phase, got", l.Phase())
+	}
+	if got := egressCtrl(t, l, ProtoIPCP); Code(got[0]) != CodeConfigureRequest {
+		t.Fatalf("expected IPCP request, got %x", got)
+	}
+	// Unknown protocol is rejected.
+	rej := roundTrip(t, l, 0x0281, []byte{1, 2, 3})
+	if Code(rej[0]) != CodeProtocolReject || binary.BigEndian.Uint16(rej[4:]) != 0x0281 {
+		t.Fatalf("expected protocol reject, got %x", rej)
+	}
+}
+
+func ctrlPacket(code Code, id uint8, data []byte) []byte {
+	pkt := []byte{uint8(code), id, 0, 0}
+	pkt = append(pkt, data...)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	return pkt
+}
+
+func ingressCtrl(t *testing.T, l *Link, proto Protocol, pkt []byte) {
+	t.Helper()
+	buf := make([]byte, 2*len(pkt)+16)
+	n, err := Encode(buf, proto, pkt, DefaultACCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Ingress(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func egressCtrl(t *testing.T, l *Link, wantProto Protocol) []byte {
+	t.Helper()
+	buf := make([]byte, 4096)
+	n, err := l.Egress(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected outgoing frame")
+	}
+	var dec Decoder
+	dec.Reset(make([]byte, 1600))
+	_, frame, err := dec.Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, info, err := ParseFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	} else if proto != wantProto {
+		t.Fatalf("want protocol %#x, got %#x", wantProto, proto)
+	}
+	return append([]byte(nil), info...)
+}
+
+func roundTrip(t *testing.T, l *Link, proto Protocol, pkt []byte) []byte {
+	t.Helper()
+	ingressCtrl(t, l, proto, pkt)
+	if proto != ProtoLCP && proto != ProtoIPCP {
+		proto = ProtoLCP
+		if l.Phase() == PhaseAuthenticate {
+			proto = ProtoCHAP
+		}
+	}
+	return egressCtrl(t, l, proto)
+}
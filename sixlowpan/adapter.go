@@ -0,0 +1,389 @@
+package sixlowpan
+
+import (
+	"cmp"
+	"encoding/binary"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/internet"
+	"github.com/soypat/lneto/ipv6"
+)
+
+// AdapterConfig configures an [Adapter]. See [Adapter.Reset].
+type AdapterConfig struct {
+	// Stack is the IPv6 stack run over the radio. If its address is unset
+	// it is set to the link-local address derived from Addr.
+	Stack *internet.StackIPv6
+	// PANID is the Personal Area Network identifier of the radio.
+	PANID uint16
+	// Addr is the short or extended address of the radio, used as source address of frames.
+	Addr Addr
+	// Gateway is the link-layer address of the border router to which packets to non-link-local
+	// destinations are sent. If unset the link-layer address is derived from the destination's interface identifier.
+	Gateway Addr
+	// Nanotime returns the current time in nanoseconds. Used for reassembly timeouts.
+	Nanotime func() int64
+	// MaxReassembly is the number of datagrams that can be reassembled concurrently. Defaults to 2.
+	MaxReassembly int
+	// ReassemblyTimeout is the time after which incomplete datagrams are discarded. Defaults to [DefaultReassemblyTimeout].
+	ReassemblyTimeout time.Duration
+	// AppendFCS makes the adapter append and check the Frame Check Sequence of frames.
+	// Leave unset if the radio calculates it in hardware. Either way, 2 bytes of [MaxFrameSize] are reserved for it.
+	AppendFCS bool
+}
+
+// Adapter runs an IPv6 stack over an IEEE 802.15.4 radio. Received radio frames are passed to [Adapter.Ingress] and
+// frames to transmit are obtained with [Adapter.Egress]. IPv6 and UDP headers are compressed with IPHC and datagrams
+// that do not fit in a single frame are fragmented; one fragment is returned per call to Egress.
+// Unicast frames request acknowledgement, which is expected to be handled by the radio.
+type Adapter struct {
+	stack     *internet.StackIPv6
+	nanotime  func() int64
+	timeout   int64
+	pan       uint16
+	addr      Addr
+	gateway   Addr
+	appendFCS bool
+	seq       uint8
+	tag       uint16
+	reasm     []reassembly
+	// Fragmented transmission state of datagram in txbuf.
+	txlen int // Zero when no datagram pending.
+	txoff int
+	txtag uint16
+	txdst Addr
+	txbuf [MTU]byte
+	rxbuf [MTU]byte
+	logger
+}
+
+// reassembly holds the fragments received of a datagram.
+type reassembly struct {
+	used     bool
+	src      Addr
+	size     uint16
+	tag      uint16
+	deadline int64
+	nunits   int
+	units    [MTU / 64]byte // Bitmap of 8 byte units received.
+	buf      [MTU]byte
+}
+
+// Reset configures the adapter and discards datagrams being fragmented or reassembled.
+func (a *Adapter) Reset(cfg AdapterConfig) error {
+	if cfg.Stack == nil || cfg.Nanotime == nil || cfg.MaxReassembly < 0 || cfg.ReassemblyTimeout < 0 ||
+		(cfg.Addr.Mode != AddrModeShort && cfg.Addr.Mode != AddrModeExtended) || cfg.Addr.IsBroadcast() {
+		return lneto.ErrInvalidConfig
+	}
+	nreasm := cmp.Or(cfg.MaxReassembly, 2)
+	reasm := a.reasm
+	internal.SliceReuse(&reasm, nreasm)
+	reasm = reasm[:nreasm]
+	for i := range reasm {
+		reasm[i].used = false
+	}
+	*a = Adapter{
+		stack:     cfg.Stack,
+		nanotime:  cfg.Nanotime,
+		timeout:   int64(cmp.Or(cfg.ReassemblyTimeout, DefaultReassemblyTimeout)),
+		pan:       cfg.PANID,
+		addr:      cfg.Addr,
+		gateway:   cfg.Gateway,
+		appendFCS: cfg.AppendFCS,
+		tag:       uint16(cfg.Nanotime()),
+		reasm:     reasm,
+		logger:    a.logger,
+	}
+	if cfg.Stack.Addr6() == ([16]byte{}) {
+		cfg.Stack.SetAddr6(LinkLocalAddr(cfg.Addr))
+	}
+	return nil
+}
+
+// SetLogger sets the adapter's logger.
+func (a *Adapter) SetLogger(log *slog.Logger) { a.log = log }
+
+// Addr returns the link-layer address of the adapter.
+func (a *Adapter) Addr() Addr { return a.addr }
+
+// LinkLocalAddr returns the link-local IPv6 address derived from the adapter's link-layer address.
+func (a *Adapter) LinkLocalAddr() [16]byte { return LinkLocalAddr(a.addr) }
+
+// Ingress processes a received IEEE 802.15.4 frame. Data frames addressed to the adapter carrying IPv6
+// datagrams are decompressed, reassembled and passed to the stack.
+func (a *Adapter) Ingress(frame []byte) error {
+	if a.appendFCS {
+		if len(frame) < 3+sizeFCS {
+			return lneto.ErrTruncatedFrame
+		}
+		end := len(frame) - sizeFCS
+		if FCS(frame[:end]) != binary.LittleEndian.Uint16(frame[end:]) {
+			return lneto.ErrBadCRC
+		}
+		frame = frame[:end]
+	}
+	h, n, err := ParseMACHeader(frame)
+	if err != nil {
+		return err
+	} else if h.Type != FrameData || !a.isForUs(&h) {
+		return lneto.ErrPacketDrop
+	}
+	payload := frame[n:]
+	if len(payload) == 0 {
+		return lneto.ErrTruncatedFrame
+	}
+	switch {
+	case payload[0] == dispatchIPv6:
+		n = copy(a.rxbuf[:], payload[1:])
+		return a.demux(a.rxbuf[:n])
+
+	case payload[0]&dispatchIPHCMask == dispatchIPHC:
+		hl, consumed, err := Decompress(a.rxbuf[:], payload, 0, h.Src, h.Dst)
+		if err != nil {
+			return err
+		}
+		rest := payload[consumed:]
+		if hl+len(rest) > len(a.rxbuf) {
+			return lneto.ErrPacketDrop
+		}
+		copy(a.rxbuf[hl:], rest)
+		return a.demux(a.rxbuf[:hl+len(rest)])
+
+	case payload[0]&dispatchFragMask == dispatchFrag1, payload[0]&dispatchFragMask == dispatchFragN:
+		return a.reassemble(&h, payload)
+	}
+	a.debug("6lo:unsupported-dispatch", slog.Uint64("dispatch", uint64(payload[0])))
+	return lneto.ErrUnsupported // Mesh and broadcast headers.
+}
+
+func (a *Adapter) isForUs(h *MACHeader) bool {
+	if h.DstPAN != a.pan && h.DstPAN != BroadcastShort {
+		return false
+	}
+	return h.Dst.IsBroadcast() || h.Dst == a.addr
+}
+
+func (a *Adapter) demux(datagram []byte) error {
+	err := a.stack.Demux(datagram, 0)
+	if err != nil {
+		a.debug("6lo:demux", slog.String("err", err.Error()))
+	}
+	return err
+}
+
+func (a *Adapter) reassemble(h *MACHeader, payload []byte) error {
+	first := payload[0]&dispatchFragMask == dispatchFrag1
+	hdrlen := sizeFragN
+	if first {
+		hdrlen = sizeFrag1
+	}
+	if len(payload) <= hdrlen {
+		return lneto.ErrTruncatedFrame
+	}
+	size := binary.BigEndian.Uint16(payload[0:2]) & 0x07ff
+	tag := binary.BigEndian.Uint16(payload[2:4])
+	if size > MTU || size < sizeIPv6Header {
+		return lneto.ErrPacketDrop
+	}
+	now := a.nanotime()
+	r := a.reassemblySlot(h.Src, size, tag, now)
+	if r == nil {
+		a.debug("6lo:reassembly-full")
+		return lneto.ErrExhausted
+	}
+	data := payload[hdrlen:]
+	var offset int
+	if first {
+		hl, consumed, err := Decompress(r.buf[:], data, int(size), h.Src, h.Dst)
+		if err != nil {
+			r.used = false
+			return err
+		}
+		data = data[consumed:]
+		if hl+len(data) > int(size) {
+			r.used = false
+			return lneto.ErrInvalidLengthField
+		}
+		copy(r.buf[hl:], data)
+		r.markUnits(0, hl+len(data), int(size))
+	} else {
+		offset = int(payload[4]) * 8
+		if offset+len(data) > int(size) {
+			r.used = false
+			return lneto.ErrInvalidLengthField
+		}
+		copy(r.buf[offset:], data)
+		r.markUnits(offset, len(data), int(size))
+	}
+	if r.nunits*8 < int(size) {
+		return nil // Datagram incomplete.
+	}
+	r.used = false
+	return a.demux(r.buf[:size])
+}
+
+// reassemblySlot returns the reassembly buffer of the datagram or allocates one, possibly evicting an expired datagram.
+func (a *Adapter) reassemblySlot(src Addr, size, tag uint16, now int64) *reassembly {
+	var free *reassembly
+	for i := range a.reasm {
+		r := &a.reasm[i]
+		if r.used && now-r.deadline >= 0 {
+			a.debug("6lo:reassembly-timeout", slog.Uint64("tag", uint64(r.tag)))
+			r.used = false
+		}
+		if !r.used {
+			if free == nil {
+				free = r
+			}
+			continue
+		}
+		if r.src == src && r.size == size && r.tag == tag {
+			return r
+		}
+	}
+	if free != nil {
+		free.used = true
+		free.src = src
+		free.size = size
+		free.tag = tag
+		free.deadline = now + a.timeout
+		free.nunits = 0
+		free.units = [len(free.units)]byte{}
+	}
+	return free
+}
+
+// markUnits marks the 8 byte units of the datagram covered by a fragment as received.
+// A fragment not ending at the datagram end only covers whole units, see RFC 4944 section 5.3.
+func (r *reassembly) markUnits(offset, length, size int) {
+	end := offset + length
+	if end < size {
+		end &^= 7
+	}
+	for u := offset / 8; u*8 < end; u++ {
+		bit := uint8(1) << (u % 8)
+		if r.units[u/8]&bit == 0 {
+			r.units[u/8] |= bit
+			r.nunits++
+		}
+	}
+}
+
+// Egress writes the next IEEE 802.15.4 frame to transmit into dst, which must be at least [MaxFrameSize] bytes long,
+// and returns its length. Remaining fragments of a datagram are sent before a new datagram is requested from the stack.
+// If AppendFCS is not set the returned frame excludes the 2 byte FCS.
+func (a *Adapter) Egress(dst []byte) (int, error) {
+	if len(dst) < MaxFrameSize {
+		return 0, lneto.ErrShortBuffer
+	} else if a.txlen > 0 {
+		return a.nextFragment(dst)
+	}
+	n, err := a.stack.Encapsulate(a.txbuf[:], 0, 0)
+	if n == 0 {
+		return 0, err
+	}
+	datagram := a.txbuf[:n]
+	ifrm, _ := ipv6.NewFrame(datagram)
+	macDst := a.resolve(ifrm.DestinationAddr())
+	if macDst.Mode == AddrModeNone {
+		a.debug("6lo:no-route")
+		return 0, lneto.ErrPacketDrop
+	}
+	var iphc [maxIPHCSize]byte
+	c, consumed, err := Compress(iphc[:], datagram, a.addr, macDst)
+	if err != nil {
+		return 0, err
+	}
+	const budget = MaxFrameSize - sizeFCS
+	hlen := a.putMACHeader(dst, macDst)
+	rest := datagram[consumed:]
+	if hlen+c+len(rest) <= budget {
+		off := hlen + copy(dst[hlen:], iphc[:c])
+		off += copy(dst[off:], rest)
+		return a.finish(dst, off), nil
+	}
+
+	// Fragment: FRAG1 carries the compressed header and payload up to an 8 byte boundary of the uncompressed datagram.
+	x := budget - hlen - sizeFrag1 - c
+	x = (consumed+x)&^7 - consumed
+	if x <= 0 {
+		return 0, lneto.ErrShortBuffer
+	}
+	a.tag++
+	binary.BigEndian.PutUint16(dst[hlen:], dispatchFrag1<<8|uint16(n))
+	binary.BigEndian.PutUint16(dst[hlen+2:], a.tag)
+	off := hlen + sizeFrag1
+	off += copy(dst[off:], iphc[:c])
+	off += copy(dst[off:], rest[:x])
+	a.txlen = n
+	a.txoff = consumed + x
+	a.txtag = a.tag
+	a.txdst = macDst
+	return a.finish(dst, off), nil
+}
+
+func (a *Adapter) nextFragment(dst []byte) (int, error) {
+	const budget = MaxFrameSize - sizeFCS
+	hlen := a.putMACHeader(dst, a.txdst)
+	x := min(budget-hlen-sizeFragN, a.txlen-a.txoff)
+	if a.txoff+x < a.txlen {
+		x &^= 7
+	}
+	binary.BigEndian.PutUint16(dst[hlen:], dispatchFragN<<8|uint16(a.txlen))
+	binary.BigEndian.PutUint16(dst[hlen+2:], a.txtag)
+	dst[hlen+4] = uint8(a.txoff / 8)
+	off := hlen + sizeFragN
+	off += copy(dst[off:], a.txbuf[a.txoff:a.txoff+x])
+	a.txoff += x
+	if a.txoff >= a.txlen {
+		a.txlen = 0
+	}
+	return a.finish(dst, off), nil
+}
+
+// resolve returns the link-layer address IPv6 packets to addr are sent to.
+func (a *Adapter) resolve(addr *[16]byte) Addr {
+	switch {
+	case addr[0] == 0xff:
+		return ShortAddr(BroadcastShort)
+	case !isLinkLocal6(addr) && a.gateway.Mode != AddrModeNone:
+		return a.gateway
+	}
+	return addrFromIID(addr[8:])
+}
+
+func (a *Adapter) putMACHeader(dst []byte, macDst Addr) int {
+	h := MACHeader{
+		Type:             FrameData,
+		AckRequest:       !macDst.IsBroadcast(),
+		PANIDCompression: true,
+		Version:          FrameVersion2006,
+		Seq:              a.seq,
+		DstPAN:           a.pan,
+		Dst:              macDst,
+		SrcPAN:           a.pan,
+		Src:              a.addr,
+	}
+	a.seq++
+	n, _ := h.Put(dst)
+	return n
+}
+
+func (a *Adapter) finish(dst []byte, n int) int {
+	if a.appendFCS {
+		binary.LittleEndian.PutUint16(dst[n:], FCS(dst[:n]))
+		n += sizeFCS
+	}
+	return n
+}
+
+type logger struct {
+	log *slog.Logger
+}
+
+func (l logger) debug(msg string, attrs ...slog.Attr) {
+	internal.LogAttrs(l.log, slog.LevelDebug, msg, attrs...)
+}
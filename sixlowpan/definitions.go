@@ -0,0 +1,114 @@
+// Package sixlowpan implements transmission of IPv6 packets over IEEE 802.15.4 radios (6LoWPAN).
+//
+// It provides an IEEE 802.15.4 MAC frame codec, stateless IPv6 and UDP header compression as
+// specified in [RFC6282] and the fragmentation and reassembly scheme of [RFC4944] needed to carry
+// the 1280 byte IPv6 minimum MTU over 127 byte radio frames. An [Adapter] runs an
+// internet.StackIPv6 over a radio, deriving link-local addresses from the radio's short or extended address.
+//
+// Context-based address compression, mesh addressing and MAC layer security are not supported.
+//
+// [RFC6282]: https://datatracker.ietf.org/doc/html/rfc6282
+// [RFC4944]: https://datatracker.ietf.org/doc/html/rfc4944
+package sixlowpan
+
+import "time"
+
+// AddrMode is the addressing mode of an IEEE 802.15.4 address field.
+type AddrMode uint8
+
+const (
+	AddrModeNone     AddrMode = 0 // Address field not present.
+	AddrModeShort    AddrMode = 2 // 16-bit short address.
+	AddrModeExtended AddrMode = 3 // 64-bit extended address (EUI-64).
+)
+
+// BroadcastShort is the 16-bit broadcast short address.
+const BroadcastShort = 0xffff
+
+// Addr is an IEEE 802.15.4 device address. Extended addresses are stored in
+// canonical EUI-64 order, that is, reversed with respect to their order on air.
+type Addr struct {
+	Mode     AddrMode
+	Short    uint16
+	Extended [8]byte
+}
+
+// ShortAddr returns a short mode address.
+func ShortAddr(short uint16) Addr { return Addr{Mode: AddrModeShort, Short: short} }
+
+// ExtendedAddr returns an extended mode address.
+func ExtendedAddr(eui64 [8]byte) Addr { return Addr{Mode: AddrModeExtended, Extended: eui64} }
+
+// IsBroadcast returns true if a is the short broadcast address.
+func (a Addr) IsBroadcast() bool { return a.Mode == AddrModeShort && a.Short == BroadcastShort }
+
+func (a Addr) size() int {
+	switch a.Mode {
+	case AddrModeShort:
+		return 2
+	case AddrModeExtended:
+		return 8
+	}
+	return 0
+}
+
+// InterfaceID returns the IPv6 interface identifier derived from an IEEE 802.15.4 address.
+// Extended addresses form a modified EUI-64 identifier with the Universal/Local bit inverted.
+// Short addresses form the identifier 0000:00ff:fe00:XXXX as per [RFC6282] section 3.2.2.
+//
+// [RFC6282]: https://datatracker.ietf.org/doc/html/rfc6282#section-3.2.2
+func InterfaceID(a Addr) (iid [8]byte) {
+	switch a.Mode {
+	case AddrModeShort:
+		iid = [8]byte{0, 0, 0, 0xff, 0xfe, 0, byte(a.Short >> 8), byte(a.Short)}
+	case AddrModeExtended:
+		iid = a.Extended
+		iid[0] ^= 0x02
+	}
+	return iid
+}
+
+// LinkLocalAddr returns the fe80::/64 link-local IPv6 address derived from an IEEE 802.15.4 address. See [InterfaceID].
+func LinkLocalAddr(a Addr) (addr [16]byte) {
+	addr[0] = 0xfe
+	addr[1] = 0x80
+	iid := InterfaceID(a)
+	copy(addr[8:], iid[:])
+	return addr
+}
+
+// addrFromIID returns the IEEE 802.15.4 address the interface identifier was derived from.
+func addrFromIID(iid []byte) Addr {
+	if iid[0] == 0 && iid[1] == 0 && iid[2] == 0 && iid[3] == 0xff && iid[4] == 0xfe && iid[5] == 0 {
+		return ShortAddr(uint16(iid[6])<<8 | uint16(iid[7]))
+	}
+	a := Addr{Mode: AddrModeExtended, Extended: [8]byte(iid)}
+	a.Extended[0] ^= 0x02
+	return a
+}
+
+func isLinkLocal6(addr *[16]byte) bool {
+	return addr[0] == 0xfe && addr[1] == 0x80 && addr[2]|addr[3]|addr[4]|addr[5]|addr[6]|addr[7] == 0
+}
+
+const (
+	// MaxFrameSize is the largest IEEE 802.15.4 PHY payload (aMaxPHYPacketSize), including the 2 byte FCS.
+	MaxFrameSize = 127
+	// MTU is the IPv6 MTU offered over 6LoWPAN, see RFC 4944 section 4.
+	MTU = 1280
+	// DefaultReassemblyTimeout is the time fragments of an incomplete datagram are kept, see RFC 4944 section 5.3.
+	DefaultReassemblyTimeout = 60 * time.Second
+	sizeFCS                  = 2
+)
+
+// 6LoWPAN dispatch values, see RFC 4944 section 5.1 and RFC 6282 section 3.1.
+const (
+	dispatchIPv6     = 0x41 // Uncompressed IPv6 header.
+	dispatchIPHC     = 0x60 // 011xxxxx
+	dispatchIPHCMask = 0xe0
+	dispatchFrag1    = 0xc0 // 11000xxx
+	dispatchFragN    = 0xe0 // 11100xxx
+	dispatchFragMask = 0xf8
+	sizeFrag1        = 4
+	sizeFragN        = 5
+)
@@ -0,0 +1,336 @@
+package sixlowpan
+
+import (
+	"encoding/binary"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ipv6"
+)
+
+// IPHC encoding bits, see RFC 6282 section 3.1.1.
+const (
+	iphcTFPos   = 3 // Traffic Class and Flow Label, first byte.
+	iphcNH      = 1 << 2
+	iphcHLIMPos = 0
+	iphcCID     = 1 << 7 // Second byte.
+	iphcSAC     = 1 << 6
+	iphcSAMPos  = 4
+	iphcM       = 1 << 3
+	iphcDAC     = 1 << 2
+	iphcDAMPos  = 0
+
+	nhcUDP     = 0xf0 // 11110CPP, see RFC 6282 section 4.3.3.
+	nhcUDPMask = 0xf8
+	nhcUDPC    = 1 << 2
+
+	sizeIPv6Header = 40
+	sizeUDPHeader  = 8
+	// maxIPHCSize is the largest compressed header: IPHC, TF, NH, HLIM, addresses and NHC UDP.
+	maxIPHCSize = 2 + 4 + 1 + 1 + 16 + 16 + 7
+)
+
+// Compress writes the [RFC6282] compressed form of the IPv6 header of packet into dst, followed by the compressed
+// UDP header if the packet carries UDP. It returns the bytes written to dst and the bytes of packet consumed, that is,
+// the header length of the uncompressed packet. The remainder of packet must be sent inline after the compressed header.
+// macSrc and macDst are the link-layer addresses of the frame, which allow full elision of link-local interface identifiers.
+//
+// [RFC6282]: https://datatracker.ietf.org/doc/html/rfc6282
+func Compress(dst, packet []byte, macSrc, macDst Addr) (n, consumed int, err error) {
+	ifrm, err := ipv6.NewFrame(packet)
+	if err != nil {
+		return 0, 0, err
+	}
+	var hdr [maxIPHCSize]byte
+	b := hdr[:2]
+	var iphc0, iphc1 uint8 = dispatchIPHC, 0
+
+	// Traffic class and flow label.
+	_, tos, flow := ifrm.VersionTrafficAndFlow()
+	ecn, dscp := tos.ECN(), tos.DS()
+	switch {
+	case tos == 0 && flow == 0:
+		iphc0 |= 0b11 << iphcTFPos
+	case flow == 0:
+		iphc0 |= 0b10 << iphcTFPos
+		b = append(b, ecn<<6|dscp)
+	case dscp == 0:
+		iphc0 |= 0b01 << iphcTFPos
+		b = append(b, ecn<<6|uint8(flow>>16)&0x0f, uint8(flow>>8), uint8(flow))
+	default:
+		b = append(b, ecn<<6|dscp, uint8(flow>>16)&0x0f, uint8(flow>>8), uint8(flow))
+	}
+
+	// Next header.
+	proto := ifrm.NextHeader()
+	isUDP := proto == lneto.IPProtoUDP && len(packet) >= sizeIPv6Header+sizeUDPHeader
+	if isUDP {
+		iphc0 |= iphcNH
+	} else {
+		b = append(b, uint8(proto))
+	}
+
+	// Hop limit.
+	switch hop := ifrm.HopLimit(); hop {
+	case 1:
+		iphc0 |= 0b01 << iphcHLIMPos
+	case 64:
+		iphc0 |= 0b10 << iphcHLIMPos
+	case 255:
+		iphc0 |= 0b11 << iphcHLIMPos
+	default:
+		b = append(b, hop)
+	}
+
+	// Addresses.
+	src, dstAddr := ifrm.SourceAddr(), ifrm.DestinationAddr()
+	if *src == ([16]byte{}) {
+		iphc1 |= iphcSAC // Unspecified address, SAM=00.
+	} else {
+		var mode uint8
+		mode, b = compressUnicast(b, src, macSrc)
+		iphc1 |= mode << iphcSAMPos
+	}
+	if dstAddr[0] == 0xff {
+		var mode uint8
+		mode, b = compressMulticast(b, dstAddr)
+		iphc1 |= iphcM | mode<<iphcDAMPos
+	} else {
+		var mode uint8
+		mode, b = compressUnicast(b, dstAddr, macDst)
+		iphc1 |= mode << iphcDAMPos
+	}
+	hdr[0], hdr[1] = iphc0, iphc1
+	consumed = sizeIPv6Header
+
+	if isUDP {
+		udp := packet[sizeIPv6Header:]
+		sport, dport := binary.BigEndian.Uint16(udp[0:2]), binary.BigEndian.Uint16(udp[2:4])
+		switch {
+		case sport&0xfff0 == 0xf0b0 && dport&0xfff0 == 0xf0b0:
+			b = append(b, nhcUDP|0b11, uint8(sport&0xf)<<4|uint8(dport&0xf))
+		case dport&0xff00 == 0xf000:
+			b = append(b, nhcUDP|0b01, udp[0], udp[1], udp[3])
+		case sport&0xff00 == 0xf000:
+			b = append(b, nhcUDP|0b10, udp[1], udp[2], udp[3])
+		default:
+			b = append(b, nhcUDP, udp[0], udp[1], udp[2], udp[3])
+		}
+		b = append(b, udp[6], udp[7]) // Checksum always carried inline.
+		consumed += sizeUDPHeader
+	}
+	if len(dst) < len(b) {
+		return 0, 0, lneto.ErrShortBuffer
+	}
+	return copy(dst, b), consumed, nil
+}
+
+// compressUnicast appends the stateless compressed form of a unicast address and returns the address mode.
+func compressUnicast(dst []byte, addr *[16]byte, mac Addr) (mode uint8, _ []byte) {
+	if !isLinkLocal6(addr) {
+		return 0b00, append(dst, addr[:]...)
+	}
+	iid := InterfaceID(mac)
+	switch {
+	case mac.Mode != AddrModeNone && [8]byte(addr[8:]) == iid:
+		return 0b11, dst // Fully elided, derived from link-layer address.
+	case addr[8]|addr[9]|addr[10] == 0 && addr[11] == 0xff && addr[12] == 0xfe && addr[13] == 0:
+		return 0b10, append(dst, addr[14:]...)
+	}
+	return 0b01, append(dst, addr[8:]...)
+}
+
+// compressMulticast appends the stateless compressed form of a multicast address and returns the address mode.
+func compressMulticast(dst []byte, addr *[16]byte) (mode uint8, _ []byte) {
+	zerosFrom2 := func(end int) bool {
+		for _, c := range addr[2:end] {
+			if c != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case addr[1] == 0x02 && zerosFrom2(15):
+		return 0b11, append(dst, addr[15]) // ff02::00XX
+	case zerosFrom2(13):
+		return 0b10, append(dst, addr[1], addr[13], addr[14], addr[15]) // ffXX::00XX:XXXX
+	case zerosFrom2(11):
+		return 0b01, append(dst, addr[1], addr[11], addr[12], addr[13], addr[14], addr[15]) // ffXX::00XX:XXXX:XXXX
+	}
+	return 0b00, append(dst, addr[:]...)
+}
+
+// Decompress reconstructs the IPv6 header, and UDP header if compressed with NHC, from the IPHC compressed header at the start of src.
+// It returns the bytes written to dst, which must be at least 48 bytes long, and the bytes of src consumed. The payload following
+// the compressed header in src is not copied. datagramSize is the size of the uncompressed datagram as given by a fragment
+// header, if zero the datagram is assumed to be unfragmented and its size is calculated from len(src).
+// Context-based compression and NHC extension headers are not supported and return [lneto.ErrUnsupported].
+func Decompress(dst, src []byte, datagramSize int, macSrc, macDst Addr) (n, consumed int, err error) {
+	if len(dst) < sizeIPv6Header+sizeUDPHeader {
+		return 0, 0, lneto.ErrShortBuffer
+	} else if len(src) < 2 {
+		return 0, 0, lneto.ErrTruncatedFrame
+	} else if src[0]&dispatchIPHCMask != dispatchIPHC {
+		return 0, 0, lneto.ErrInvalidField
+	}
+	iphc0, iphc1 := src[0], src[1]
+	if iphc1&(iphcCID|iphcDAC) != 0 {
+		return 0, 0, lneto.ErrUnsupported
+	}
+	r := reader{buf: src, off: 2}
+	hdr := dst[:sizeIPv6Header]
+	clear(hdr)
+	ifrm, _ := ipv6.NewFrame(hdr)
+
+	// Traffic class and flow label.
+	var ecn, dscp uint8
+	var flow uint32
+	switch (iphc0 >> iphcTFPos) & 0b11 {
+	case 0b00:
+		b := r.next(4)
+		ecn, dscp = b[0]>>6, b[0]&0x3f
+		flow = uint32(b[1]&0x0f)<<16 | uint32(b[2])<<8 | uint32(b[3])
+	case 0b01:
+		b := r.next(3)
+		ecn = b[0] >> 6
+		flow = uint32(b[0]&0x0f)<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 0b10:
+		b := r.next(1)
+		ecn, dscp = b[0]>>6, b[0]&0x3f
+	}
+	ifrm.SetVersionTrafficAndFlow(6, ipv6.ToS(dscp<<2|ecn), flow)
+
+	// Next header.
+	nhc := iphc0&iphcNH != 0
+	if !nhc {
+		ifrm.SetNextHeader(lneto.IPProto(r.next(1)[0]))
+	}
+
+	// Hop limit.
+	switch iphc0 >> iphcHLIMPos & 0b11 {
+	case 0b00:
+		ifrm.SetHopLimit(r.next(1)[0])
+	case 0b01:
+		ifrm.SetHopLimit(1)
+	case 0b10:
+		ifrm.SetHopLimit(64)
+	case 0b11:
+		ifrm.SetHopLimit(255)
+	}
+
+	// Addresses.
+	sam := iphc1 >> iphcSAMPos & 0b11
+	if iphc1&iphcSAC != 0 {
+		if sam != 0 {
+			return 0, 0, lneto.ErrUnsupported // Context-based.
+		} // else unspecified address, already zeroed.
+	} else {
+		decompressUnicast(ifrm.SourceAddr(), &r, sam, macSrc)
+	}
+	dam := iphc1 >> iphcDAMPos & 0b11
+	if iphc1&iphcM != 0 {
+		decompressMulticast(ifrm.DestinationAddr(), &r, dam)
+	} else {
+		decompressUnicast(ifrm.DestinationAddr(), &r, dam, macDst)
+	}
+	n = sizeIPv6Header
+
+	if nhc {
+		nh := r.next(1)
+		if r.err != nil {
+			return 0, 0, r.err
+		} else if nh[0]&nhcUDPMask != nhcUDP || nh[0]&nhcUDPC != 0 {
+			return 0, 0, lneto.ErrUnsupported // Extension header or elided UDP checksum.
+		}
+		ifrm.SetNextHeader(lneto.IPProtoUDP)
+		udp := dst[sizeIPv6Header : sizeIPv6Header+sizeUDPHeader]
+		switch nh[0] & 0b11 {
+		case 0b00:
+			copy(udp[0:4], r.next(4))
+		case 0b01:
+			b := r.next(3)
+			udp[0], udp[1], udp[2], udp[3] = b[0], b[1], 0xf0, b[2]
+		case 0b10:
+			b := r.next(3)
+			udp[0], udp[1], udp[2], udp[3] = 0xf0, b[0], b[1], b[2]
+		case 0b11:
+			b := r.next(1)
+			udp[0], udp[1], udp[2], udp[3] = 0xf0, 0xb0|b[0]>>4, 0xf0, 0xb0|b[0]&0xf
+		}
+		copy(udp[6:8], r.next(2))
+		n += sizeUDPHeader
+	}
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	consumed = r.off
+	if datagramSize == 0 {
+		datagramSize = n + len(src) - consumed
+	}
+	plen := datagramSize - sizeIPv6Header
+	if plen < n-sizeIPv6Header || plen > 0xffff {
+		return 0, 0, lneto.ErrInvalidLengthField
+	}
+	ifrm.SetPayloadLength(uint16(plen))
+	if nhc {
+		binary.BigEndian.PutUint16(dst[sizeIPv6Header+4:], uint16(plen))
+	}
+	return n, consumed, nil
+}
+
+func decompressUnicast(addr *[16]byte, r *reader, mode uint8, mac Addr) {
+	if mode == 0b00 {
+		copy(addr[:], r.next(16))
+		return
+	}
+	addr[0], addr[1] = 0xfe, 0x80
+	switch mode {
+	case 0b01:
+		copy(addr[8:], r.next(8))
+	case 0b10:
+		addr[11], addr[12] = 0xff, 0xfe
+		copy(addr[14:], r.next(2))
+	case 0b11:
+		iid := InterfaceID(mac)
+		copy(addr[8:], iid[:])
+	}
+}
+
+func decompressMulticast(addr *[16]byte, r *reader, mode uint8) {
+	addr[0] = 0xff
+	switch mode {
+	case 0b00:
+		copy(addr[:], r.next(16))
+	case 0b01:
+		b := r.next(6)
+		addr[1] = b[0]
+		copy(addr[11:], b[1:])
+	case 0b10:
+		b := r.next(4)
+		addr[1] = b[0]
+		copy(addr[13:], b[1:])
+	case 0b11:
+		addr[1] = 0x02
+		addr[15] = r.next(1)[0]
+	}
+}
+
+// reader consumes inline fields of a compressed header. After a short read
+// err is set and zeroed scratch data is returned so parsing may continue unchecked.
+type reader struct {
+	buf     []byte
+	off     int
+	err     error
+	scratch [16]byte
+}
+
+func (r *reader) next(n int) []byte {
+	if r.off+n > len(r.buf) {
+		r.err = lneto.ErrTruncatedFrame
+		r.scratch = [16]byte{}
+		return r.scratch[:n]
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
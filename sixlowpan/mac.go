@@ -0,0 +1,190 @@
+package sixlowpan
+
+import (
+	"encoding/binary"
+
+	"github.com/soypat/lneto"
+)
+
+// FrameType is the IEEE 802.15.4 MAC frame type.
+type FrameType uint8
+
+const (
+	FrameBeacon  FrameType = 0
+	FrameData    FrameType = 1
+	FrameAck     FrameType = 2
+	FrameCommand FrameType = 3
+)
+
+// IEEE 802.15.4 frame versions.
+const (
+	FrameVersion2003 = 0
+	FrameVersion2006 = 1
+)
+
+// Frame Control field bit positions.
+const (
+	fcSecurity      = 1 << 3
+	fcFramePending  = 1 << 4
+	fcAckRequest    = 1 << 5
+	fcPANIDCompress = 1 << 6
+	fcDstModePos    = 10
+	fcVersionPos    = 12
+	fcSrcModePos    = 14
+)
+
+// MACHeader is the IEEE 802.15.4 MAC header of a frame: frame control, sequence number and addressing fields.
+// Only 2003 and 2006 frame versions are supported.
+type MACHeader struct {
+	Type         FrameType
+	Security     bool
+	FramePending bool
+	AckRequest   bool
+	// PANIDCompression set means the source PAN identifier is elided and equal to the destination's.
+	PANIDCompression bool
+	Version          uint8
+	Seq              uint8
+	DstPAN           uint16
+	Dst              Addr
+	SrcPAN           uint16
+	Src              Addr
+}
+
+// Len returns the size of the header when encoded.
+func (h *MACHeader) Len() int {
+	n := 3
+	if h.Dst.Mode != AddrModeNone {
+		n += 2 + h.Dst.size()
+	}
+	if h.Src.Mode != AddrModeNone {
+		if !h.PANIDCompression {
+			n += 2
+		}
+		n += h.Src.size()
+	}
+	return n
+}
+
+// Put encodes the header into b and returns the number of bytes written.
+func (h *MACHeader) Put(b []byte) (int, error) {
+	if h.Dst.Mode == 1 || h.Src.Mode == 1 || h.Version > FrameVersion2006 || h.Type > FrameCommand {
+		return 0, lneto.ErrInvalidField
+	} else if h.PANIDCompression && (h.Dst.Mode == AddrModeNone || h.Src.Mode == AddrModeNone) {
+		return 0, lneto.ErrInvalidField
+	}
+	n := h.Len()
+	if len(b) < n {
+		return 0, lneto.ErrShortBuffer
+	}
+	fc := uint16(h.Type) | uint16(h.Dst.Mode)<<fcDstModePos | uint16(h.Version)<<fcVersionPos | uint16(h.Src.Mode)<<fcSrcModePos
+	if h.Security {
+		fc |= fcSecurity
+	}
+	if h.FramePending {
+		fc |= fcFramePending
+	}
+	if h.AckRequest {
+		fc |= fcAckRequest
+	}
+	if h.PANIDCompression {
+		fc |= fcPANIDCompress
+	}
+	binary.LittleEndian.PutUint16(b, fc)
+	b[2] = h.Seq
+	off := 3
+	if h.Dst.Mode != AddrModeNone {
+		binary.LittleEndian.PutUint16(b[off:], h.DstPAN)
+		off = putAddr(b, off+2, h.Dst)
+	}
+	if h.Src.Mode != AddrModeNone {
+		if !h.PANIDCompression {
+			binary.LittleEndian.PutUint16(b[off:], h.SrcPAN)
+			off += 2
+		}
+		putAddr(b, off, h.Src)
+	}
+	return n, nil
+}
+
+func putAddr(b []byte, off int, a Addr) int {
+	if a.Mode == AddrModeShort {
+		binary.LittleEndian.PutUint16(b[off:], a.Short)
+		return off + 2
+	}
+	for i := range 8 {
+		b[off+i] = a.Extended[7-i]
+	}
+	return off + 8
+}
+
+// ParseMACHeader decodes the MAC header at the start of frame and returns it along with its length.
+// Frames with security enabled return [lneto.ErrUnsupported].
+func ParseMACHeader(frame []byte) (h MACHeader, n int, err error) {
+	if len(frame) < 3 {
+		return h, 0, lneto.ErrTruncatedFrame
+	}
+	fc := binary.LittleEndian.Uint16(frame)
+	h = MACHeader{
+		Type:             FrameType(fc & 0b111),
+		Security:         fc&fcSecurity != 0,
+		FramePending:     fc&fcFramePending != 0,
+		AckRequest:       fc&fcAckRequest != 0,
+		PANIDCompression: fc&fcPANIDCompress != 0,
+		Version:          uint8(fc>>fcVersionPos) & 0b11,
+		Seq:              frame[2],
+		Dst:              Addr{Mode: AddrMode(fc>>fcDstModePos) & 0b11},
+		Src:              Addr{Mode: AddrMode(fc>>fcSrcModePos) & 0b11},
+	}
+	if h.Type > FrameCommand || h.Version > FrameVersion2006 || h.Dst.Mode == 1 || h.Src.Mode == 1 {
+		return h, 0, lneto.ErrUnsupported
+	} else if h.Security {
+		return h, 0, lneto.ErrUnsupported
+	}
+	n = h.Len()
+	if len(frame) < n {
+		return h, 0, lneto.ErrTruncatedFrame
+	}
+	off := 3
+	if h.Dst.Mode != AddrModeNone {
+		h.DstPAN = binary.LittleEndian.Uint16(frame[off:])
+		off = getAddr(frame, off+2, &h.Dst)
+	}
+	if h.Src.Mode != AddrModeNone {
+		if h.PANIDCompression {
+			h.SrcPAN = h.DstPAN
+		} else {
+			h.SrcPAN = binary.LittleEndian.Uint16(frame[off:])
+			off += 2
+		}
+		getAddr(frame, off, &h.Src)
+	}
+	return h, n, nil
+}
+
+func getAddr(b []byte, off int, a *Addr) int {
+	if a.Mode == AddrModeShort {
+		a.Short = binary.LittleEndian.Uint16(b[off:])
+		return off + 2
+	}
+	for i := range 8 {
+		a.Extended[7-i] = b[off+i]
+	}
+	return off + 8
+}
+
+// FCS returns the 16-bit ITU-T CRC used as IEEE 802.15.4 Frame Check Sequence over b.
+// It is transmitted least significant octet first.
+func FCS(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,110 @@
+// Package slip implements the Serial Line Internet Protocol framing as described in [RFC1055].
+// SLIP delimits IP packets sent over a serial line with END characters and escapes occurrences
+// of END and ESC within the packet. It provides no addressing, type identification nor error detection.
+//
+// [RFC1055]: https://datatracker.ietf.org/doc/html/rfc1055
+package slip
+
+import "github.com/soypat/lneto"
+
+// SLIP special characters.
+const (
+	END    = 0xc0 // Frame delimiter.
+	ESC    = 0xdb // Escape character.
+	EscEND = 0xdc // ESC EscEND encodes an END data byte.
+	EscESC = 0xdd // ESC EscESC encodes an ESC data byte.
+)
+
+// Encode writes packet framed with END characters to dst and returns the number of bytes written.
+// A leading END is written to flush any line noise received by the peer as recommended by RFC 1055.
+// It returns [lneto.ErrShortBuffer] if dst cannot fit the encoded packet, which is guaranteed
+// not to happen if dst is at least 2*len(packet)+2 bytes long.
+func Encode(dst, packet []byte) (int, error) {
+	if len(dst) < len(packet)+2 {
+		return 0, lneto.ErrShortBuffer
+	}
+	dst[0] = END
+	n := 1
+	for _, c := range packet {
+		if n+2 > len(dst) {
+			return 0, lneto.ErrShortBuffer
+		}
+		switch c {
+		case END:
+			dst[n] = ESC
+			dst[n+1] = EscEND
+			n += 2
+		case ESC:
+			dst[n] = ESC
+			dst[n+1] = EscESC
+			n += 2
+		default:
+			dst[n] = c
+			n++
+		}
+	}
+	if n >= len(dst) {
+		return 0, lneto.ErrShortBuffer
+	}
+	dst[n] = END
+	return n + 1, nil
+}
+
+// Decoder decodes SLIP framed packets from a byte stream. The zero value is not ready for use, call [Decoder.Reset].
+type Decoder struct {
+	buf      []byte
+	n        int
+	esc      bool
+	overflow bool
+	invalid  bool
+}
+
+// Reset sets the buffer used to store the packet being received which limits the largest packet received.
+func (d *Decoder) Reset(buf []byte) {
+	*d = Decoder{buf: buf}
+}
+
+// Decode consumes bytes from data until a packet is completed and returns the number of bytes consumed
+// and the packet. The packet aliases the decoder's buffer and is valid until the next call to Decode.
+// A nil packet with a nil error means data was consumed entirely without completing a packet.
+// Packets that overflow the buffer return [lneto.ErrBufferFull] and packets with an invalid escape
+// sequence return [lneto.ErrInvalidField]. In both cases decoding may continue after the consumed bytes.
+func (d *Decoder) Decode(data []byte) (consumed int, packet []byte, err error) {
+	for i, c := range data {
+		if c == END {
+			n, overflow, invalid := d.n, d.overflow, d.invalid || d.esc
+			d.n, d.overflow, d.invalid, d.esc = 0, false, false, false
+			if overflow {
+				return i + 1, nil, lneto.ErrBufferFull
+			} else if invalid {
+				return i + 1, nil, lneto.ErrInvalidField
+			} else if n == 0 {
+				continue // Empty packet from back-to-back END characters.
+			}
+			return i + 1, d.buf[:n], nil
+		}
+		if d.esc {
+			d.esc = false
+			switch c {
+			case EscEND:
+				c = END
+			case EscESC:
+				c = ESC
+			default:
+				// RFC 1055 leaves protocol violations undefined, we discard the packet.
+				d.invalid = true
+				continue
+			}
+		} else if c == ESC {
+			d.esc = true
+			continue
+		}
+		if d.n >= len(d.buf) {
+			d.overflow = true
+			continue
+		}
+		d.buf[d.n] = c
+		d.n++
+	}
+	return len(data), nil, nil
+}
@@ -0,0 +1,70 @@
+package slip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/soypat/lneto"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	packets := [][]byte{
+		{0x45, 0, 0, 20},
+		{END, ESC, EscEND, EscESC, END, END},
+		{1},
+	}
+	var stream []byte
+	var buf [64]byte
+	for _, pkt := range packets {
+		n, err := Encode(buf[:], pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.IndexByte(buf[1:n-1], END) >= 0 {
+			t.Fatalf("END not escaped: %x", buf[:n])
+		}
+		stream = append(stream, buf[:n]...)
+	}
+	var dec Decoder
+	dec.Reset(make([]byte, 16))
+	var got [][]byte
+	// Feed in small chunks to test reassembly across calls.
+	for len(stream) > 0 {
+		chunk := stream[:min(3, len(stream))]
+		n, pkt, err := dec.Decode(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+		if pkt != nil {
+			got = append(got, append([]byte(nil), pkt...))
+		}
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("want %d packets, got %d", len(packets), len(got))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("packet %d: want %x, got %x", i, packets[i], got[i])
+		}
+	}
+
+	_, err := Encode(buf[:7], packets[1])
+	if err != lneto.ErrShortBuffer {
+		t.Fatal("expected short buffer, got", err)
+	}
+	// Overflow and invalid escape are reported and decoding resumes.
+	stream = []byte{END, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, END, ESC, 1, END, 0xaa, END}
+	dec.Reset(make([]byte, 16))
+	wantErrs := []error{lneto.ErrBufferFull, lneto.ErrInvalidField, nil}
+	for i, wantErr := range wantErrs {
+		n, pkt, err := dec.Decode(stream)
+		if err != wantErr {
+			t.Fatalf("decode %d: want error %v, got %v", i, wantErr, err)
+		}
+		stream = stream[n:]
+		if wantErr == nil && (len(pkt) != 1 || pkt[0] != 0xaa) {
+			t.Fatalf("want packet aa after errors, got %x", pkt)
+		}
+	}
+}
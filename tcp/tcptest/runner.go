@@ -0,0 +1,264 @@
+package tcptest
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/soypat/lneto/tcp"
+)
+
+const sizeHeaderTCP = 20
+
+// Runner runs scripts against a [tcp.Handler]. The zero value is ready to use.
+type Runner struct {
+	// ISS is the initial send sequence number of the handler. Script sequence numbers are relative to it.
+	ISS tcp.Value
+	// PeerISS is the initial sequence number of the scripted peer.
+	PeerISS tcp.Value
+	// PeerPort is the port of the scripted peer on passive opens. Defaults to 40000.
+	PeerPort uint16
+	// BufferSize is the size of the handler's receive and transmit buffers. Defaults to 1024.
+	BufferSize int
+	// MSS is the maximum segment size of the handler, set by the size of the buffer passed to Send. Defaults to 1460.
+	MSS int
+	// Packets is the number of packets the handler's transmit buffer tracks. Defaults to 4.
+	Packets int
+	// Logf, if set, logs each line as it is run. Usually set to testing.T.Logf.
+	Logf func(format string, args ...any)
+}
+
+type run struct {
+	s      *Script
+	cfg    *Runner
+	h      tcp.Handler
+	now    int64
+	lport  uint16
+	rport  uint16
+	wrote  int // Bytes written by the application, used to generate payloads.
+	read   int // Bytes read by the application, used to verify payloads.
+	rxbuf  []byte
+	txbuf  []byte
+	segbuf []byte
+}
+
+// Run runs the script on a new [tcp.Handler] and returns the first mismatch between
+// the script and the behavior of the handler, if any.
+func (r *Runner) Run(s *Script) error {
+	bufsize := cmp.Or(r.BufferSize, 1024)
+	mss := cmp.Or(r.MSS, 1460)
+	rn := &run{
+		s:      s,
+		cfg:    r,
+		rxbuf:  make([]byte, bufsize),
+		txbuf:  make([]byte, bufsize),
+		segbuf: make([]byte, sizeHeaderTCP+mss),
+	}
+	err := rn.h.SetBuffers(rn.txbuf, rn.rxbuf, cmp.Or(r.Packets, 4))
+	if err != nil {
+		return err
+	}
+	for i := range s.lines {
+		ln := &s.lines[i]
+		rn.now = ln.at
+		if r.Logf != nil {
+			r.Logf("%s:%d: t=%.3f state=%s", s.name, ln.num, float64(ln.at)/1e9, rn.h.State())
+		}
+		if err = rn.runLine(ln); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.name, ln.num, err)
+		}
+	}
+	return nil
+}
+
+func (rn *run) nanotime() int64 { return rn.now }
+
+func (rn *run) runLine(ln *line) (err error) {
+	switch ln.kind {
+	case lineInbound:
+		err = rn.h.Recv(rn.inboundSegment(&ln.seg))
+	case lineOutbound, lineNoOutbound:
+		return rn.checkOutbound(ln)
+	case lineCommand:
+		err = rn.runCommand(ln)
+		if err != nil && ln.expect == expectAny {
+			return err // Commands expect success by default.
+		}
+	}
+	switch {
+	case ln.expect == expectOK && err != nil:
+		return fmt.Errorf("want no error, got %v", err)
+	case ln.expect == expectError && err == nil:
+		return fmt.Errorf("want error")
+	}
+	return nil
+}
+
+func (rn *run) runCommand(ln *line) error {
+	h := &rn.h
+	switch ln.cmd {
+	case "listen":
+		rn.lport, rn.rport = uint16(ln.args[0]), cmp.Or(rn.cfg.PeerPort, 40000)
+		rn.wrote, rn.read = 0, 0
+		return h.OpenListen(rn.lport, rn.cfg.ISS)
+	case "connect":
+		rn.lport, rn.rport = uint16(ln.args[0]), uint16(ln.args[1])
+		rn.wrote, rn.read = 0, 0
+		return h.OpenActive(rn.lport, rn.rport, rn.cfg.ISS)
+	case "write":
+		data := make([]byte, ln.args[0])
+		fillPayload(data, tcp.Value(rn.wrote+1))
+		n, err := h.Write(data)
+		rn.wrote += n
+		if err == nil && n != len(data) {
+			err = fmt.Errorf("wrote %d bytes, want %d", n, len(data))
+		}
+		return err
+	case "read":
+		data := make([]byte, ln.args[0])
+		n, err := h.Read(data)
+		if err != nil {
+			return err
+		} else if n != len(data) {
+			return fmt.Errorf("read %d bytes, want %d", n, len(data))
+		} else if i := checkPayload(data, tcp.Value(rn.read+1)); i >= 0 {
+			return fmt.Errorf("read byte %d does not match sequence space", rn.read+i)
+		}
+		rn.read += n
+		return nil
+	case "close":
+		return h.Close()
+	case "abort":
+		h.Abort()
+	case "shutdown_read":
+		h.ShutdownRead()
+	case "requeue":
+		h.RequeueControl()
+	case "rto":
+		h.SetLossRecovery(new(tcp.RTO), rn.nanotime)
+	case "state":
+		if got := h.State().String(); got != ln.name {
+			return fmt.Errorf("state is %s, want %s", got, ln.name)
+		}
+	}
+	return nil
+}
+
+// inboundSegment encodes the scripted peer's segment into a TCP frame.
+func (rn *run) inboundSegment(spec *segmentSpec) []byte {
+	hl := sizeHeaderTCP + len(spec.opts)
+	frame := make([]byte, hl+spec.datalen)
+	tfrm, _ := tcp.NewFrame(frame)
+	seg := tcp.Segment{
+		SEQ:     rn.cfg.PeerISS + spec.seq,
+		DATALEN: tcp.Size(spec.datalen),
+		WND:     tcp.Size(65535),
+		Flags:   spec.flags,
+	}
+	if spec.hasAck {
+		seg.ACK = rn.cfg.ISS + spec.ack
+	}
+	if spec.hasWin {
+		seg.WND = tcp.Size(spec.win)
+	}
+	tfrm.SetSourcePort(rn.rport)
+	tfrm.SetDestinationPort(rn.lport)
+	tfrm.SetSegment(seg, uint8(hl/4))
+	copy(frame[sizeHeaderTCP:], spec.opts)
+	fillPayload(frame[hl:], dataStart(spec.seq, spec.flags))
+	return frame
+}
+
+func (rn *run) checkOutbound(ln *line) error {
+	n, err := rn.h.Send(rn.segbuf)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	} else if ln.kind == lineNoOutbound {
+		if n > 0 {
+			return fmt.Errorf("want no segment, got %s", rn.describe(rn.segbuf[:n]))
+		}
+		return nil
+	} else if n == 0 {
+		return fmt.Errorf("want segment, got none")
+	}
+	frame := rn.segbuf[:n]
+	tfrm, err := tcp.NewFrame(frame)
+	if err != nil {
+		return err
+	}
+	hl := tfrm.HeaderLength()
+	seg := tfrm.Segment(n - hl)
+	want := &ln.seg
+	relSeq := seg.SEQ - rn.cfg.ISS
+	mismatch := seg.Flags != want.flags || relSeq != want.seq || int(seg.DATALEN) != want.datalen ||
+		(want.hasAck && seg.ACK-rn.cfg.PeerISS != want.ack) ||
+		(want.hasWin && uint16(seg.WND) != want.win) ||
+		(want.hasOpts && !bytes.Equal(tfrm.Options(), want.opts))
+	if mismatch {
+		return fmt.Errorf("segment mismatch, got %s", rn.describe(frame))
+	} else if i := checkPayload(frame[hl:], dataStart(relSeq, seg.Flags)); i >= 0 {
+		return fmt.Errorf("payload byte %d does not match sequence space", i)
+	} else if tfrm.SourcePort() != rn.lport || tfrm.DestinationPort() != rn.rport {
+		return fmt.Errorf("bad ports %d->%d", tfrm.SourcePort(), tfrm.DestinationPort())
+	}
+	return nil
+}
+
+// describe formats an outbound frame in script syntax.
+func (rn *run) describe(frame []byte) string {
+	tfrm, _ := tcp.NewFrame(frame)
+	hl := tfrm.HeaderLength()
+	seg := tfrm.Segment(len(frame) - hl)
+	seq := seg.SEQ - rn.cfg.ISS
+	var b strings.Builder
+	b.WriteString(formatFlags(seg.Flags))
+	fmt.Fprintf(&b, " %d:%d(%d)", seq, seq+tcp.Value(seg.DATALEN), seg.DATALEN)
+	if seg.Flags&tcp.FlagACK != 0 {
+		b.WriteString(" ack " + strconv.FormatUint(uint64(seg.ACK-rn.cfg.PeerISS), 10))
+	}
+	b.WriteString(" win " + strconv.Itoa(int(seg.WND)))
+	if opts := tfrm.Options(); len(opts) > 0 {
+		fmt.Fprintf(&b, " <%x>", opts)
+	}
+	return b.String()
+}
+
+func formatFlags(flags tcp.Flags) string {
+	const chars = "SFRPUEW."
+	all := [...]tcp.Flags{tcp.FlagSYN, tcp.FlagFIN, tcp.FlagRST, tcp.FlagPSH, tcp.FlagURG, tcp.FlagECE, tcp.FlagCWR, tcp.FlagACK}
+	var s []byte
+	for i, f := range all {
+		if flags&f != 0 {
+			s = append(s, chars[i])
+		}
+	}
+	return string(s)
+}
+
+// dataStart returns the relative sequence number of the first data octet of a segment.
+func dataStart(seq tcp.Value, flags tcp.Flags) tcp.Value {
+	if flags&tcp.FlagSYN != 0 {
+		return seq + 1
+	}
+	return seq
+}
+
+// fillPayload writes the payload of data starting at relative sequence number seq.
+func fillPayload(data []byte, seq tcp.Value) {
+	for i := range data {
+		data[i] = byte(seq + tcp.Value(i))
+	}
+}
+
+// checkPayload returns the index of the first byte of data not matching the payload
+// starting at relative sequence number seq or -1 if all match.
+func checkPayload(data []byte, seq tcp.Value) int {
+	for i := range data {
+		if data[i] != byte(seq+tcp.Value(i)) {
+			return i
+		}
+	}
+	return -1
+}
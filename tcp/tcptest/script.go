@@ -0,0 +1,360 @@
+// Package tcptest runs packetdrill-style scripts against a [tcp.Handler].
+//
+// A script is a text file where each line holds a timestamp followed by an event:
+//
+//	# Passive open, receive data and read it.
+//	0     listen 80
+//	+0    < S 0:0(0) win 1000 <mss 1000>
+//	+0    > S. 0:0(0) ack 1 <mss 1460>
+//	+0.1  < . 1:1(0) ack 1 win 1000
+//	+0    state ESTABLISHED
+//	+0    < P. 1:11(10) ack 1 win 1000
+//	+0    > . 1:1(0) ack 11
+//	+0    read 10
+//
+// Timestamps are in seconds, either absolute or relative to the previous line when prefixed with '+'.
+// Events are one of:
+//   - Inbound segment: '<' FLAGS SEQ:END(LEN) [ack N] [win N] [<OPTIONS>] [= ok|error].
+//     The segment is passed to [tcp.Handler.Recv]. Errors are ignored unless an expectation is given.
+//   - Expected outbound segment: '>' FLAGS SEQ:END(LEN) [ack N] [win N] [<OPTIONS>].
+//     [tcp.Handler.Send] is called and must emit a segment with the flags and sequence given.
+//     The acknowledgment, window and options are only checked when present.
+//   - No outbound segment: '> none'. [tcp.Handler.Send] must not emit a segment.
+//   - Socket call: listen PORT, connect LPORT RPORT, write N, read N, close, abort,
+//     shutdown_read, requeue, rto or state NAME, optionally followed by '= ok' or '= error'.
+//     rto enables [tcp.RTO] loss recovery driven by the script's clock and state asserts
+//     the connection state, i.e: ESTABLISHED or SYN-RECEIVED.
+//
+// FLAGS are written as in packetdrill: S (SYN), F (FIN), R (RST), P (PSH), U (URG),
+// E (ECE), W (CWR) and '.' (ACK). Sequence and acknowledgment numbers are relative
+// to the initial sequence number of their sender. Options are a comma separated list
+// of mss N, wscale N, sackOK, ts VAL ECR, nop and eol.
+//
+// Payloads are generated and verified by the runner: the data octet with relative
+// sequence number s holds byte(s), so that read and retransmitted data is checked
+// against the sequence space it belongs to. Text after '#' or '//' is a comment.
+package tcptest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/soypat/lneto/tcp"
+)
+
+// Script is a parsed script. See the package documentation for the syntax.
+type Script struct {
+	name  string
+	lines []line
+}
+
+// Name returns the name of the script used in error messages.
+func (s *Script) Name() string { return s.name }
+
+type lineKind uint8
+
+const (
+	lineInbound lineKind = iota + 1
+	lineOutbound
+	lineNoOutbound
+	lineCommand
+)
+
+type expectation uint8
+
+const (
+	expectAny expectation = iota
+	expectOK
+	expectError
+)
+
+type line struct {
+	num    int
+	at     int64 // Absolute time in nanoseconds.
+	kind   lineKind
+	seg    segmentSpec
+	cmd    string
+	args   []int
+	name   string // State name of state command.
+	expect expectation
+}
+
+type segmentSpec struct {
+	flags   tcp.Flags
+	seq     tcp.Value // Relative to the sender's ISS.
+	datalen int
+	ack     tcp.Value // Relative to the receiver's ISS.
+	win     uint16
+	opts    []byte // Encoded options padded to 4 bytes.
+	hasAck  bool
+	hasWin  bool
+	hasOpts bool
+}
+
+// commands maps socket calls to their number of integer arguments.
+var commands = map[string]int{
+	"listen":        1,
+	"connect":       2,
+	"write":         1,
+	"read":          1,
+	"close":         0,
+	"abort":         0,
+	"shutdown_read": 0,
+	"requeue":       0,
+	"rto":           0,
+	"state":         -1, // Takes a state name.
+}
+
+// ParseFile parses the script file at path.
+func ParseFile(path string) (*Script, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return Parse(path, fp)
+}
+
+// Parse parses a script read from r. name identifies the script in error messages.
+func Parse(name string, r io.Reader) (*Script, error) {
+	s := &Script{name: name}
+	scanner := bufio.NewScanner(r)
+	var now int64
+	num := 0
+	for scanner.Scan() {
+		num++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		ln, err := parseLine(text, &now)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, num, err)
+		}
+		ln.num = num
+		s.lines = append(s.lines, ln)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseLine(text string, now *int64) (ln line, err error) {
+	timestr, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+	relative := strings.HasPrefix(timestr, "+")
+	secs, err := strconv.ParseFloat(strings.TrimPrefix(timestr, "+"), 64)
+	if err != nil || secs < 0 {
+		return ln, fmt.Errorf("bad timestamp %q", timestr)
+	}
+	at := int64(math.Round(secs * 1e9))
+	if relative {
+		at += *now
+	} else if at < *now {
+		return ln, fmt.Errorf("timestamp %q goes back in time", timestr)
+	}
+	*now = at
+	ln.at = at
+	if before, after, ok := strings.Cut(rest, " = "); ok {
+		switch strings.TrimSpace(after) {
+		case "ok":
+			ln.expect = expectOK
+		case "error":
+			ln.expect = expectError
+		default:
+			return ln, fmt.Errorf("bad expectation %q", after)
+		}
+		rest = strings.TrimSpace(before)
+	}
+	switch {
+	case rest == "":
+		return ln, errors.New("missing event")
+	case rest == "> none":
+		ln.kind = lineNoOutbound
+	case rest[0] == '<' || rest[0] == '>':
+		ln.kind = lineInbound
+		if rest[0] == '>' {
+			ln.kind = lineOutbound
+			if ln.expect != expectAny {
+				return ln, errors.New("outbound segments take no expectation")
+			}
+		}
+		ln.seg, err = parseSegment(strings.TrimSpace(rest[1:]))
+	default:
+		err = parseCommand(&ln, strings.Fields(rest))
+	}
+	return ln, err
+}
+
+func parseCommand(ln *line, fields []string) error {
+	ln.kind = lineCommand
+	ln.cmd = fields[0]
+	nargs, ok := commands[ln.cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q", ln.cmd)
+	} else if nargs < 0 {
+		if len(fields) != 2 {
+			return fmt.Errorf("%s takes one argument", ln.cmd)
+		}
+		ln.name = fields[1]
+		return nil
+	} else if len(fields)-1 != nargs {
+		return fmt.Errorf("%s takes %d arguments", ln.cmd, nargs)
+	}
+	for _, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 16)
+		if err != nil {
+			return fmt.Errorf("bad %s argument %q", ln.cmd, f)
+		}
+		ln.args = append(ln.args, int(v))
+	}
+	return nil
+}
+
+func parseSegment(text string) (seg segmentSpec, err error) {
+	if start := strings.IndexByte(text, '<'); start >= 0 {
+		end := strings.IndexByte(text, '>')
+		if end < start {
+			return seg, errors.New("unterminated options")
+		}
+		seg.opts, err = parseOptions(text[start+1 : end])
+		if err != nil {
+			return seg, err
+		}
+		seg.hasOpts = true
+		text = text[:start] + text[end+1:]
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return seg, errors.New("segment needs flags and sequence")
+	}
+	seg.flags, err = parseFlags(fields[0])
+	if err != nil {
+		return seg, err
+	}
+	var seq, end uint32
+	_, err = fmt.Sscanf(fields[1], "%d:%d(%d)", &seq, &end, &seg.datalen)
+	if err != nil || end != seq+uint32(seg.datalen) {
+		return seg, fmt.Errorf("bad sequence %q, want SEQ:END(LEN)", fields[1])
+	}
+	seg.seq = tcp.Value(seq)
+	fields = fields[2:]
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return seg, fmt.Errorf("missing value for %q", fields[0])
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return seg, fmt.Errorf("bad %s value %q", fields[0], fields[1])
+		}
+		switch fields[0] {
+		case "ack":
+			seg.ack, seg.hasAck = tcp.Value(v), true
+		case "win":
+			if v > math.MaxUint16 {
+				return seg, fmt.Errorf("window %d overflows", v)
+			}
+			seg.win, seg.hasWin = uint16(v), true
+		default:
+			return seg, fmt.Errorf("unknown segment field %q", fields[0])
+		}
+		fields = fields[2:]
+	}
+	return seg, nil
+}
+
+func parseFlags(s string) (flags tcp.Flags, err error) {
+	for _, c := range s {
+		switch c {
+		case 'S':
+			flags |= tcp.FlagSYN
+		case 'F':
+			flags |= tcp.FlagFIN
+		case 'R':
+			flags |= tcp.FlagRST
+		case 'P':
+			flags |= tcp.FlagPSH
+		case 'U':
+			flags |= tcp.FlagURG
+		case 'E':
+			flags |= tcp.FlagECE
+		case 'W':
+			flags |= tcp.FlagCWR
+		case '.':
+			flags |= tcp.FlagACK
+		default:
+			return 0, fmt.Errorf("bad flags %q", s)
+		}
+	}
+	return flags, nil
+}
+
+func parseOptions(s string) (opts []byte, err error) {
+	for opt := range strings.SplitSeq(s, ",") {
+		fields := strings.Fields(opt)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty option in %q", s)
+		}
+		var vals []uint64
+		for _, f := range fields[1:] {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad option value %q", f)
+			}
+			vals = append(vals, v)
+		}
+		want := 0
+		switch fields[0] {
+		case "eol":
+			opts = append(opts, byte(tcp.OptEnd))
+		case "nop":
+			opts = append(opts, byte(tcp.OptNop))
+		case "sackOK":
+			opts = append(opts, byte(tcp.OptSACKPermitted), 2)
+		case "mss":
+			want = 1
+			if len(vals) == want {
+				opts = binary.BigEndian.AppendUint16(append(opts, byte(tcp.OptMaxSegmentSize), 4), uint16(vals[0]))
+			}
+		case "wscale":
+			want = 1
+			if len(vals) == want {
+				opts = append(opts, byte(tcp.OptWindowScale), 3, byte(vals[0]))
+			}
+		case "ts":
+			want = 2
+			if len(vals) == want {
+				opts = append(opts, byte(tcp.OptTimestamps), 10)
+				opts = binary.BigEndian.AppendUint32(opts, uint32(vals[0]))
+				opts = binary.BigEndian.AppendUint32(opts, uint32(vals[1]))
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", fields[0])
+		}
+		if len(vals) != want {
+			return nil, fmt.Errorf("option %s takes %d values", fields[0], want)
+		}
+	}
+	for len(opts)%4 != 0 {
+		opts = append(opts, byte(tcp.OptEnd))
+	}
+	if len(opts) > 40 {
+		return nil, errors.New("options exceed 40 bytes")
+	}
+	return opts, nil
+}
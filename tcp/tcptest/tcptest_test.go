@@ -0,0 +1,65 @@
+package tcptest
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScripts(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.pkt")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) == 0 {
+		t.Fatal("no scripts found")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			s, err := ParseFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Sequence numbers close to wraparound exercise modular arithmetic.
+			r := Runner{ISS: 0xffff_fff0, PeerISS: 1_000_000, Logf: t.Logf}
+			if err = r.Run(s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRunner_Mismatch(t *testing.T) {
+	const script = `
+0    listen 80
++0   < S 0:0(0) win 1000
++0   > S. 0:0(0) ack 2
+`
+	s, err := Parse("mismatch", strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Runner
+	err = r.Run(s)
+	if err == nil || !strings.Contains(err.Error(), "mismatch:4:") || !strings.Contains(err.Error(), "got S. 0:0(0) ack 1") {
+		t.Errorf("want mismatch on line 4 describing segment, got %v", err)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, script := range []string{
+		"x listen 80",
+		"1\n0 close",
+		"0 listen",
+		"0 bind 80",
+		"0 < S 0:1(0)",
+		"0 < Z 0:0(0)",
+		"0 < S 0:0(0) <mss>",
+		"0 < S 0:0(0) ack",
+		"0 > S 0:0(0) = error",
+		"0 close = maybe",
+	} {
+		if _, err := Parse("bad", strings.NewReader(script)); err == nil {
+			t.Errorf("want error parsing %q", script)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Package dot implements a DNS-over-TLS (DoT) resolver as specified in RFC 7858.
+//
+// A [Resolver] keeps a single TLS session to the server open and pipelines
+// queries over it with the 2-byte length framing of RFC 7766 §8: several
+// lookups may be in flight at the same time and responses are matched to
+// queries by transaction ID in whichever order the server sends them.
+//
+// The TCP connection is established by a caller-provided dial function, such as
+// xnet.StackGo's DialContext, so that DNS traffic runs over an lneto stack. A Resolver
+// replaces the stack's plaintext DNS client when set as the Resolver of xnet.StackGoConfig.
+//
+// The server is authenticated with the certificate validation of [tls.Config],
+// with pinned SubjectPublicKeyInfo digests (RFC 7858 §4.2), or both. See [ResolverConfig].
+package dot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/dns"
+)
+
+// Port is the IANA-assigned TCP port for DNS-over-TLS.
+const Port = 853
+
+const (
+	defaultTimeout = 5 * time.Second
+	// maxAnswers is the number of answer records decoded from a response, including CNAME records.
+	maxAnswers = 16
+	// paddingBlock is the block size queries are padded to, as recommended by RFC 8467 §4.1.
+	paddingBlock = 128
+	// ednsUDPSize is the payload size advertised in the OPT record. It bears no meaning over TCP (RFC 7766 §8).
+	ednsUDPSize = 4096
+)
+
+var (
+	errPinMismatch = errors.New("dot: server certificate matches no pinned SPKI")
+	errConnClosed  = errors.New("dot: connection closed before response")
+	errNotResponse = errors.New("dot: malformed response")
+	errNoAddr      = errors.New("dot: no address in DNS answer")
+	errClosed      = errors.New("dot: resolver closed")
+)
+
+// ResolverConfig configures a [Resolver]. Used in [Resolver.Reset].
+type ResolverConfig struct {
+	// Dial establishes the TCP connection to the DoT server, usually on [Port]. Required.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// TLS configures the TLS session. If ServerName is set the server certificate is
+	// validated against it (RFC 8310 strict privacy profile). The config is cloned.
+	TLS *tls.Config
+	// PinnedSPKI are SHA-256 digests of SubjectPublicKeyInfo, see [SPKIPin]. If set, a certificate
+	// of the validated chain must match one of them. If TLS.ServerName is empty the pins alone
+	// authenticate the server: chain validation is skipped and the server's leaf certificate
+	// must match a pin (RFC 7858 §4.2).
+	PinnedSPKI [][sha256.Size]byte
+	// Timeout bounds each lookup whose context has no earlier deadline. Defaults to 5s.
+	Timeout time.Duration
+	// DisablePadding disables padding of queries to blocks of 128 bytes with the
+	// EDNS0 Padding option (RFC 7830), which hides the length of the queried names.
+	DisablePadding bool
+}
+
+// Resolver resolves names over a persistent DNS-over-TLS session. It is safe for concurrent use.
+// The session is established on the first lookup and re-established on demand after the server closes it.
+type Resolver struct {
+	cfg    ResolverConfig
+	tlscfg *tls.Config
+
+	mu      sync.Mutex // Guards fields below.
+	raw     net.Conn
+	conn    *tls.Conn
+	pending map[uint16]chan result
+	txid    uint16
+	closed  bool
+	// wmu serializes writes of queries so frames are not interleaved.
+	// It is not held together with mu so a blocked write does not stall dispatch of responses.
+	wmu sync.Mutex
+}
+
+type result struct {
+	msg []byte
+	err error
+}
+
+// SPKIPin returns the pin of cert for [ResolverConfig.PinnedSPKI].
+func SPKIPin(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// Reset configures the resolver, closing its session if open.
+func (r *Resolver) Reset(cfg ResolverConfig) error {
+	if cfg.Dial == nil || ((cfg.TLS == nil || cfg.TLS.ServerName == "") && len(cfg.PinnedSPKI) == 0) {
+		return lneto.ErrInvalidConfig // Server would not be authenticated.
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	tlscfg := &tls.Config{}
+	if cfg.TLS != nil {
+		tlscfg = cfg.TLS.Clone()
+	}
+	tlscfg.MinVersion = max(tlscfg.MinVersion, tls.VersionTLS12) // RFC 8310 §8.1.
+	if len(tlscfg.NextProtos) == 0 {
+		tlscfg.NextProtos = []string{"dot"}
+	}
+	if len(cfg.PinnedSPKI) > 0 {
+		pins := slices.Clone(cfg.PinnedSPKI)
+		pinOnly := tlscfg.ServerName == ""
+		tlscfg.InsecureSkipVerify = pinOnly
+		tlscfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if pinOnly {
+				// Only the leaf key is proven held by the server in the handshake,
+				// other certificates presented are unauthenticated and may be anyone's.
+				if len(cs.PeerCertificates) > 0 && slices.Contains(pins, SPKIPin(cs.PeerCertificates[0])) {
+					return nil
+				}
+				return errPinMismatch
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if slices.Contains(pins, SPKIPin(cert)) {
+						return nil
+					}
+				}
+			}
+			return errPinMismatch
+		}
+	}
+	r.Close()
+	var seed [2]byte
+	rand.Read(seed[:])
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = cfg
+	r.tlscfg = tlscfg
+	r.pending = make(map[uint16]chan result)
+	r.txid = binary.BigEndian.Uint16(seed[:])
+	r.closed = false
+	return nil
+}
+
+// Close closes the TLS session. Lookups in flight fail. The resolver may be used again after [Resolver.Reset].
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	conn := r.conn
+	if conn != nil {
+		r.dropLocked(errClosed)
+	}
+	r.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// LookupNetIP looks up host and returns its IP addresses, like [net.Resolver.LookupNetIP].
+// network is "ip" or "ip4" for IPv4 addresses and "ip6" for IPv6 addresses. If host is an IP address it is returned as is.
+// Failed lookups whose response carries an Extended DNS Error (RFC 8914) return it as a *[dns.ExtendedError].
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	qtype := dns.TypeA
+	switch network {
+	case "ip", "ip4":
+	case "ip6":
+		qtype = dns.TypeAAAA
+	default:
+		return nil, lneto.ErrUnsupported
+	}
+	name, err := dns.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+	var msg dns.Message
+	rcode, err := r.Exchange(ctx, &msg, dns.Question{Name: name, Type: qtype, Class: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	var addrs [maxAnswers]netip.Addr
+	n, err := msg.WriteAnswers(addrs[:], host)
+	if n > 0 {
+		return slices.Clone(addrs[:n]), nil
+	}
+	if ede, ok := msg.ExtendedError(); ok {
+		ede.RCode = rcode
+		return nil, &ede
+	} else if rcode != dns.RCodeSuccess {
+		return nil, rcode
+	} else if err == nil {
+		err = errNoAddr
+	}
+	return nil, err
+}
+
+// Exchange sends a recursive query for q and decodes the response into dst, returning its
+// extended response code (see [dns.Message.ResponseCode]). Answers beyond 16 records are not decoded.
+func (r *Resolver) Exchange(ctx context.Context, dst *dns.Message, q dns.Question) (dns.RCode, error) {
+	r.mu.Lock()
+	timeout := r.cfg.Timeout
+	padding := !r.cfg.DisablePadding
+	r.mu.Unlock()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var opt dns.Resource
+	opt.SetEDNS0(ednsUDPSize, 0, 0, nil)
+	query := dns.Message{
+		Questions:   []dns.Question{q},
+		Additionals: []dns.Resource{opt},
+	}
+	if padding {
+		pad := dns.EDNSPaddingLen(int(query.Len()), paddingBlock)
+		query.Additionals[0].SetEDNS0(ednsUDPSize, 0, 0, dns.AppendEDNSPadding(nil, pad))
+	}
+	frame := make([]byte, 2, 2+int(query.Len()))
+	frame, err := query.AppendTo(frame, 0, dns.NewClientHeaderFlags(dns.OpCodeQuery, true))
+	if err != nil {
+		return 0, err
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	resp, err := r.roundTrip(ctx, frame)
+	if err != nil {
+		return 0, err
+	}
+	f, err := dns.NewFrame(resp)
+	if err != nil {
+		return 0, err
+	}
+	flags := f.Flags()
+	if !flags.IsResponse() {
+		return 0, errNotResponse
+	}
+	dst.LimitResourceDecoding(1, maxAnswers, 1, 2)
+	_, incompleteButOK, err := dst.Decode(resp)
+	if err != nil && !incompleteButOK {
+		return 0, err
+	} else if len(dst.Questions) != 1 || !dns.NamesEqualFold(dst.Questions[0].Name, q.Name) || dst.Questions[0].Type != q.Type {
+		return 0, errNotResponse // RFC 7858 §3.3: Responses must be matched on question too.
+	}
+	return dst.ResponseCode(flags), nil
+}
+
+// roundTrip writes the framed query in frame with a fresh transaction ID and waits for the response.
+// A query that fails because the server closed an idle session is retried once on a new session.
+func (r *Resolver) roundTrip(ctx context.Context, frame []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, errClosed
+		}
+		reused := r.conn != nil
+		conn, err := r.connectLocked(ctx)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		txid := r.nextTxIDLocked()
+		binary.BigEndian.PutUint16(frame[2:], txid)
+		ch := make(chan result, 1)
+		r.pending[txid] = ch
+		r.mu.Unlock()
+
+		r.wmu.Lock()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+		_, err = conn.Write(frame)
+		r.wmu.Unlock()
+		if err != nil {
+			r.drop(conn, err)
+		}
+		select {
+		case res := <-ch:
+			if res.err == errConnClosed && reused && attempt == 0 {
+				continue // Server closed idle session (RFC 7858 §3.4).
+			}
+			return res.msg, res.err
+		case <-ctx.Done():
+			r.mu.Lock()
+			if r.pending[txid] == ch {
+				delete(r.pending, txid)
+			}
+			r.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// connectLocked returns the TLS session, establishing it if needed. r.mu must be held.
+func (r *Resolver) connectLocked(ctx context.Context) (*tls.Conn, error) {
+	if r.conn != nil {
+		return r.conn, nil
+	} else if r.cfg.Dial == nil {
+		return nil, lneto.ErrInvalidConfig // Not configured.
+	}
+	raw, err := r.cfg.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, r.tlscfg)
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	r.raw = raw
+	r.conn = conn
+	go r.readLoop(conn)
+	return conn, nil
+}
+
+func (r *Resolver) nextTxIDLocked() uint16 {
+	for {
+		r.txid++
+		if _, inUse := r.pending[r.txid]; !inUse {
+			return r.txid
+		}
+	}
+}
+
+// readLoop dispatches the responses received over conn to the lookups waiting for them until conn fails.
+func (r *Resolver) readLoop(conn *tls.Conn) {
+	var hdr [2]byte
+	for {
+		_, err := io.ReadFull(conn, hdr[:])
+		var msg []byte
+		if err == nil {
+			msg = make([]byte, binary.BigEndian.Uint16(hdr[:]))
+			_, err = io.ReadFull(conn, msg)
+		}
+		if err != nil {
+			r.drop(conn, err)
+			return
+		} else if len(msg) < dns.SizeHeader {
+			continue
+		}
+		txid := binary.BigEndian.Uint16(msg)
+		r.mu.Lock()
+		if ch, ok := r.pending[txid]; ok {
+			delete(r.pending, txid)
+			ch <- result{msg: msg}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// drop closes conn after it failed with err, if it is still the resolver's session.
+func (r *Resolver) drop(conn *tls.Conn, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != conn {
+		return
+	}
+	r.raw.Close() // Skip close_notify, the session is broken.
+	r.dropLocked(err)
+}
+
+// dropLocked forgets the session and fails all lookups in flight.
+func (r *Resolver) dropLocked(err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+		err = errConnClosed
+	}
+	r.conn = nil
+	r.raw = nil
+	for txid, ch := range r.pending {
+		delete(r.pending, txid)
+		ch <- result{err: err}
+	}
+}
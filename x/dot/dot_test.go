@@ -0,0 +1,266 @@
+package dot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto/dns"
+)
+
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key, Leaf: cert}
+}
+
+// mockServer is a DoT server answering A queries with fixed addresses. It reads
+// batch queries before answering them in reverse order to exercise pipelining.
+type mockServer struct {
+	t       *testing.T
+	cfg     *tls.Config
+	answers map[string]netip.Addr
+	batch   int
+	// closeAfter closes each session after answering that many queries, if not zero.
+	closeAfter int
+	mu         sync.Mutex
+	dials      int
+}
+
+// dial connects over loopback TCP. net.Pipe is not used since its unbuffered writes
+// deadlock when the client aborts the handshake while the server is still writing.
+func (ms *mockServer) dial(ctx context.Context) (net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	var d net.Dialer
+	clientConn, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	ms.mu.Lock()
+	ms.dials++
+	ms.mu.Unlock()
+	go ms.serve(serverConn)
+	return clientConn, nil
+}
+
+func (ms *mockServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := tls.Server(conn, ms.cfg)
+	if tc.Handshake() != nil {
+		return
+	}
+	var queries [][]byte
+	answered := 0
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(tc, hdr[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(tc, query); err != nil {
+			return
+		}
+		if len(query)%paddingBlock != 0 {
+			ms.t.Errorf("query length %d not padded", len(query))
+		}
+		queries = append(queries, query)
+		if len(queries) < ms.batch {
+			continue
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			tc.Write(ms.respond(queries[i]))
+			answered++
+		}
+		queries = queries[:0]
+		if ms.closeAfter > 0 && answered >= ms.closeAfter {
+			return
+		}
+	}
+}
+
+func (ms *mockServer) respond(query []byte) []byte {
+	var msg dns.Message
+	msg.LimitResourceDecoding(1, 0, 0, 1)
+	if _, _, err := msg.Decode(query); err != nil {
+		ms.t.Error(err)
+		return nil
+	}
+	q := msg.Questions[0]
+	resp := dns.Message{Questions: []dns.Question{q}}
+	flags := dns.HeaderFlags(1<<15 | 1<<8 | 1<<7)
+	if addr, ok := ms.answers[q.Name.String()]; ok {
+		resp.Answers = []dns.Resource{dns.NewResource(q.Name, dns.TypeA, dns.ClassINET, 300, addr.AsSlice())}
+	} else {
+		flags |= dns.HeaderFlags(dns.RCodeNameError)
+	}
+	frame, err := resp.AppendTo(make([]byte, 2, 512), binary.BigEndian.Uint16(query), flags)
+	if err != nil {
+		ms.t.Error(err)
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	return frame
+}
+
+func newTestResolver(t *testing.T, ms *mockServer, cfg ResolverConfig) *Resolver {
+	t.Helper()
+	cert := generateSelfSignedCert(t)
+	ms.t = t
+	ms.cfg = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"dot"}}
+	cfg.Dial = ms.dial
+	if cfg.TLS == nil && len(cfg.PinnedSPKI) == 0 {
+		pool := x509.NewCertPool()
+		pool.AddCert(cert.Leaf)
+		cfg.TLS = &tls.Config{RootCAs: pool, ServerName: "dns.example"}
+	}
+	var r Resolver
+	err := r.Reset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return &r
+}
+
+func TestResolverPipelined(t *testing.T) {
+	ms := &mockServer{
+		batch: 2,
+		answers: map[string]netip.Addr{
+			"a.example.": netip.MustParseAddr("192.0.2.1"),
+			"b.example.": netip.MustParseAddr("192.0.2.2"),
+		},
+	}
+	r := newTestResolver(t, ms, ResolverConfig{})
+	var wg sync.WaitGroup
+	for _, host := range []string{"a.example", "b.example"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupNetIP(context.Background(), "ip4", host)
+			if err != nil || len(addrs) != 1 || addrs[0] != ms.answers[host+"."] {
+				t.Errorf("%s: addrs=%v err=%v", host, addrs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ms.dials != 1 {
+		t.Errorf("lookups used %d sessions, want 1", ms.dials)
+	}
+}
+
+func TestResolverReconnect(t *testing.T) {
+	ms := &mockServer{
+		batch:      1,
+		closeAfter: 1,
+		answers:    map[string]netip.Addr{"a.example.": netip.MustParseAddr("192.0.2.1")},
+	}
+	r := newTestResolver(t, ms, ResolverConfig{})
+	for range 3 {
+		_, err := r.LookupNetIP(context.Background(), "ip4", "a.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := r.LookupNetIP(context.Background(), "ip4", "missing.example")
+	if !errors.Is(err, dns.RCodeNameError) {
+		t.Errorf("want NXDOMAIN, got %v", err)
+	}
+}
+
+func TestResolverSPKIPin(t *testing.T) {
+	ms := &mockServer{batch: 1, answers: map[string]netip.Addr{"a.example.": netip.MustParseAddr("192.0.2.1")}}
+	r := newTestResolver(t, ms, ResolverConfig{PinnedSPKI: [][sha256.Size]byte{{1, 2, 3}}, Timeout: time.Second})
+	_, err := r.LookupNetIP(context.Background(), "ip4", "a.example")
+	if !errors.Is(err, errPinMismatch) {
+		t.Errorf("want pin mismatch, got %v", err)
+	}
+	// Pin of server certificate without ServerName: pin alone authenticates server.
+	pin := SPKIPin(ms.cfg.Certificates[0].Leaf)
+	err = r.Reset(ResolverConfig{Dial: ms.dial, PinnedSPKI: [][sha256.Size]byte{pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "a.example")
+	if err != nil || len(addrs) != 1 {
+		t.Errorf("addrs=%v err=%v", addrs, err)
+	}
+	if err = r.Reset(ResolverConfig{Dial: ms.dial}); err == nil {
+		t.Error("expected error for unauthenticated server")
+	}
+}
+
+func TestResolverSPKIPinAttacker(t *testing.T) {
+	ms := &mockServer{batch: 1, answers: map[string]netip.Addr{"a.example.": netip.MustParseAddr("6.6.6.6")}}
+	r := newTestResolver(t, ms, ResolverConfig{PinnedSPKI: [][sha256.Size]byte{{}}, Timeout: time.Second})
+	pinned := generateSelfSignedCert(t)
+	// Attacker holds only its own key and appends the public certificate of the pinned server to its chain.
+	attacker := ms.cfg.Certificates[0]
+	attacker.Certificate = append(attacker.Certificate, pinned.Certificate[0])
+	ms.cfg.Certificates = []tls.Certificate{attacker}
+	err := r.Reset(ResolverConfig{Dial: ms.dial, PinnedSPKI: [][sha256.Size]byte{SPKIPin(pinned.Leaf)}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "a.example")
+	if !errors.Is(err, errPinMismatch) {
+		t.Errorf("attacker chain accepted: addrs=%v err=%v", addrs, err)
+	}
+	// With chain validation pins only match certificates of the verified chain.
+	pool := x509.NewCertPool()
+	pool.AddCert(attacker.Leaf)
+	err = r.Reset(ResolverConfig{
+		Dial:       ms.dial,
+		TLS:        &tls.Config{RootCAs: pool, ServerName: "dns.example"},
+		PinnedSPKI: [][sha256.Size]byte{SPKIPin(pinned.Leaf)},
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = r.LookupNetIP(context.Background(), "ip4", "a.example")
+	if !errors.Is(err, errPinMismatch) {
+		t.Errorf("unverified pinned certificate accepted: addrs=%v err=%v", addrs, err)
+	}
+}
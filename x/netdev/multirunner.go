@@ -0,0 +1,330 @@
+package netdev
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/soypat/lneto"
+)
+
+// MultiRunner drives several [Interface]s, each with its own [Stack], from a single event loop.
+// It is meant for boards with more than one network device, i.e: Ethernet (LAN8720) and Wi-Fi (CYW43439),
+// where each interface has its own MAC, IP configuration and DHCP client held by its Stack.
+//
+// Interfaces are serviced round robin starting at a different interface each round so
+// that a busy interface cannot starve the rest. Each interface gets at most
+// [MultiRunnerConfig.Budget] Rx-then-Tx cycles per round. Interfaces whose [Netlink]
+// reports a disconnection are skipped until it reports a connection again.
+type MultiRunner[C any] struct {
+	running   atomic.Uint32
+	ifaces    []*multiIface[C]
+	backoff   lneto.BackoffStrategy
+	budget    int
+	next      int // Index of the interface serviced first in the next round.
+	noBackoff bool
+	wake      chan struct{}
+	waketimer *time.Timer
+	asyncOn   bool
+}
+
+// multiIface is an interface driven by a MultiRunner along with its own Runner holding buffers and statistics.
+type multiIface[C any] struct {
+	r          Runner[C]
+	iface      *Interface[C]
+	stack      Stack
+	notify     NotifyCallback[C]
+	retries    int
+	linkDown   atomic.Bool
+	linkDowns  atomic.Uint64
+	poll       bool
+	async      bool
+	bufsize    int
+	reconnectP *C
+}
+
+// MultiRunnerConfig configures a [MultiRunner]. Used in [MultiRunner.Configure].
+type MultiRunnerConfig struct {
+	// Backoff is the idle wait strategy between rounds. Required.
+	Backoff lneto.BackoffStrategy
+	// Budget is the maximum number of Rx-then-Tx cycles an interface is serviced
+	// for in a round while it has traffic. Defaults to 1.
+	Budget int
+}
+
+// MultiRunnerInterface configures an interface driven by a [MultiRunner]. Used in [MultiRunner.AddInterface].
+type MultiRunnerInterface[C any] struct {
+	// Interface is the initialized interface to drive. Required.
+	Interface *Interface[C]
+	// Stack processes the interface's packets. Required.
+	Stack Stack
+	// Runner configures the interface's buffers, flags and reconnection parameters as for a [Runner].
+	// Backoff is ignored, the MultiRunner's is used. [RunnerNoBackoff] is only honored if set on every interface.
+	Runner RunnerConfig[C]
+	// LinkNotify, if set, is called when the interface's [Netlink] connects or disconnects
+	// and its return value is passed back to the Netlink. Optional.
+	LinkNotify NotifyCallback[C]
+	// ReconnectRetries is the number of immediate reconnection attempts requested from the
+	// Netlink after a disconnection when LinkNotify is not set and Runner.ReconnectParams is. Defaults to 1.
+	ReconnectRetries int
+}
+
+// Configure applies cfg to the MultiRunner and removes all interfaces. Call before [MultiRunner.AddInterface].
+func (m *MultiRunner[C]) Configure(cfg MultiRunnerConfig) error {
+	if cfg.Backoff == nil {
+		return lneto.ErrMissingHALConfig
+	} else if cfg.Budget < 0 {
+		return lneto.ErrInvalidConfig
+	}
+	if !m.acquire() {
+		return errRunnerAcquired
+	}
+	defer m.release()
+	m.teardownAsync()
+	m.ifaces = m.ifaces[:0]
+	m.backoff = cfg.Backoff
+	m.budget = max(cfg.Budget, 1)
+	m.next = 0
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+		m.waketimer = time.NewTimer(24 * time.Hour)
+		m.waketimer.Stop()
+	}
+	return nil
+}
+
+// AddInterface adds an interface to be driven by the MultiRunner and returns its index,
+// used to identify it in [MultiRunner.ReadInterfaceStatistics]. It registers a callback
+// with the interface's [Netlink] through [Netlink.LinkNotify].
+func (m *MultiRunner[C]) AddInterface(cfg MultiRunnerInterface[C]) (index int, err error) {
+	if cfg.Interface == nil || cfg.Stack == nil || cfg.ReconnectRetries < 0 {
+		return -1, lneto.ErrInvalidConfig
+	} else if m.backoff == nil {
+		return -1, lneto.ErrMissingHALConfig
+	}
+	if !m.acquire() {
+		return -1, errRunnerAcquired
+	}
+	defer m.release()
+	mi := &multiIface[C]{
+		iface:      cfg.Interface,
+		stack:      cfg.Stack,
+		notify:     cfg.LinkNotify,
+		retries:    max(cfg.ReconnectRetries, 1),
+		bufsize:    cfg.Interface.bufsize(),
+		reconnectP: cfg.Runner.ReconnectParams,
+	}
+	// Share the wake channel so received frames on any interface wake the loop.
+	mi.r.wake = m.wake
+	rcfg := cfg.Runner
+	rcfg.Backoff = m.backoff
+	if err = mi.r.Configure(rcfg); err != nil {
+		return -1, err
+	}
+	mi.poll = rcfg.Flags.HasAny(RunnerInterfacePoll)
+	mi.async = rcfg.Flags.HasAny(RunnerInterfaceAsync)
+	m.ifaces = append(m.ifaces, mi)
+	m.noBackoff = true
+	for _, other := range m.ifaces {
+		m.noBackoff = m.noBackoff && other.r.getFlags().HasAny(RunnerNoBackoff)
+	}
+	if m.asyncOn && mi.async {
+		mi.r.asyncH = mi.iface
+		mi.iface.dev.SetEthRecvHandler(mi.r.recvEthHandler)
+	}
+	cfg.Interface.netlink.LinkNotify(mi.linkNotify)
+	return len(m.ifaces) - 1, nil
+}
+
+// NumInterfaces returns the number of interfaces added to the MultiRunner.
+func (m *MultiRunner[C]) NumInterfaces() int { return len(m.ifaces) }
+
+// LinkUp reports whether the interface at index is serviced, that is, its [Netlink]
+// has not reported a disconnection since it last reported a connection.
+func (m *MultiRunner[C]) LinkUp(index int) bool { return !m.ifaces[index].linkDown.Load() }
+
+// ReadInterfaceStatistics reads the statistics of the interface at index into stats.
+func (m *MultiRunner[C]) ReadInterfaceStatistics(index int, stats *RunnerStatistics) {
+	mi := m.ifaces[index]
+	mi.r.ReadStatistics(stats)
+	stats.LinkDowns = mi.linkDowns.Load()
+}
+
+// ReadStatistics reads the sum of the statistics of all interfaces into stats.
+func (m *MultiRunner[C]) ReadStatistics(stats *RunnerStatistics) {
+	*stats = RunnerStatistics{}
+	var s RunnerStatistics
+	for i := range m.ifaces {
+		m.ReadInterfaceStatistics(i, &s)
+		stats.Rx += s.Rx
+		stats.RxPacketsDropped += s.RxPacketsDropped
+		stats.RxPollErrs += s.RxPollErrs
+		stats.RxStackErrs += s.RxStackErrs
+		stats.TxStackErrs += s.TxStackErrs
+		stats.TxSendErrs += s.TxSendErrs
+		stats.BufAcquireFail += s.BufAcquireFail
+		stats.LinkDowns += s.LinkDowns
+	}
+}
+
+// Wake unblocks a [MultiRunner] waiting out its backoff so it services all interfaces immediately.
+// Signals coalesce and never block. Safe to call from any goroutine.
+func (m *MultiRunner[C]) Wake() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// EnableAsyncHandling installs the receive handlers of all async interfaces.
+// Use it to drive async interfaces with [MultiRunner.RunOnce]. See [Runner.EnableAsyncHandling].
+func (m *MultiRunner[C]) EnableAsyncHandling() error {
+	if !m.acquire() {
+		return errRunnerAcquired
+	}
+	defer m.release()
+	m.installAsync()
+	return nil
+}
+
+// DisableAsyncHandling removes the receive handlers installed by [MultiRunner.EnableAsyncHandling].
+func (m *MultiRunner[C]) DisableAsyncHandling() error {
+	if !m.acquire() {
+		return errRunnerAcquired
+	}
+	defer m.release()
+	m.teardownAsync()
+	return nil
+}
+
+func (m *MultiRunner[C]) installAsync() {
+	for _, mi := range m.ifaces {
+		if mi.async {
+			mi.r.asyncH = mi.iface
+			mi.iface.dev.SetEthRecvHandler(mi.r.recvEthHandler)
+		}
+	}
+	m.asyncOn = true
+}
+
+func (m *MultiRunner[C]) teardownAsync() {
+	for _, mi := range m.ifaces {
+		mi.r.teardownAsync()
+	}
+	m.asyncOn = false
+}
+
+// RunOnce performs a single round servicing every connected interface and returns the
+// total bytes received and transmitted. Like [Runner.RunOnce] it does not install receive
+// handlers, see [MultiRunner.EnableAsyncHandling].
+func (m *MultiRunner[C]) RunOnce() (nrx, ntx int, err error) {
+	if !m.acquire() {
+		return 0, 0, errRunnerAcquired
+	}
+	defer m.release()
+	return m.round()
+}
+
+// Run drives all interfaces until ctx is cancelled, backing off when no interface has traffic.
+// Statistics of all interfaces are reset. Returns ctx.Err().
+func (m *MultiRunner[C]) Run(ctx context.Context) error {
+	if !m.acquire() {
+		return errRunnerAcquired
+	}
+	defer m.release()
+	if m.asyncOn {
+		return errAsyncHandlingWithRun
+	} else if len(m.ifaces) == 0 {
+		return lneto.ErrInvalidConfig
+	}
+	for _, mi := range m.ifaces {
+		mi.r.bufs.releaseAll()
+		mi.r.resetStatistics()
+		mi.linkDowns.Store(0)
+	}
+	m.installAsync()
+	defer m.teardownAsync()
+	var backoffs uint
+	for ctx.Err() == nil {
+		nrx, ntx, err := m.round()
+		if err != nil {
+			return err
+		}
+		if nrx > 0 || ntx > 0 {
+			backoffs = 0
+			continue
+		}
+		if !m.noBackoff {
+			d := m.backoff(backoffs)
+			backoffs++
+			switch d {
+			case lneto.BackoffFlagGosched:
+				runtime.Gosched()
+				fallthrough
+			case lneto.BackoffFlagNop:
+				continue
+			}
+			m.waketimer.Reset(max(d, 100*time.Microsecond))
+		}
+		select {
+		case <-m.wake:
+			backoffs = 0
+		case <-ctx.Done():
+		case <-m.waketimer.C:
+		}
+		m.waketimer.Stop()
+	}
+	return ctx.Err()
+}
+
+func (m *MultiRunner[C]) round() (nrx, ntx int, err error) {
+	n := len(m.ifaces)
+	if n == 0 {
+		return 0, 0, nil
+	}
+	start := m.next
+	m.next = (start + 1) % n
+	for i := range n {
+		mi := m.ifaces[(start+i)%n]
+		if mi.linkDown.Load() {
+			continue
+		}
+		for range m.budget {
+			rx, tx, err := mi.r.service(mi.iface, mi.stack, mi.bufsize, mi.poll, mi.async)
+			nrx += rx
+			ntx += tx
+			if err != nil {
+				return nrx, ntx, err
+			} else if rx == 0 && tx == 0 {
+				break
+			}
+		}
+	}
+	return nrx, ntx, nil
+}
+
+// linkNotify is registered with the interface's Netlink. Called from the Netlink's goroutine.
+func (mi *multiIface[C]) linkNotify(connected bool) (reconnectNowRetries int, reconnectParams C) {
+	mi.linkDown.Store(!connected)
+	if !connected {
+		mi.linkDowns.Add(1)
+	}
+	if mi.notify != nil {
+		return mi.notify(connected)
+	} else if !connected && mi.reconnectP != nil {
+		return mi.retries, *mi.reconnectP
+	}
+	return 0, reconnectParams
+}
+
+func (m *MultiRunner[C]) acquire() bool {
+	return m.running.CompareAndSwap(0, 1)
+}
+
+func (m *MultiRunner[C]) release() {
+	if m.running.Load()&1 == 0 {
+		panic("release of unacquired resource")
+	}
+	m.running.Store(0)
+}
@@ -0,0 +1,197 @@
+package netdev_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto/x/netdev"
+)
+
+// notifyNetlink records the callback registered with LinkNotify.
+type notifyNetlink struct {
+	cb netdev.NotifyCallback[int]
+}
+
+func (n *notifyNetlink) LinkConnect(int) error                    { return nil }
+func (n *notifyNetlink) LinkDisconnect()                          {}
+func (n *notifyNetlink) LinkNotify(cb netdev.NotifyCallback[int]) { n.cb = cb }
+
+type multiTestIface struct {
+	dev     *mockDev
+	stack   *mockStack
+	netlink *notifyNetlink
+	iface   netdev.Interface[int]
+}
+
+func newMultiRunner(t *testing.T, budget int, backoff time.Duration, ifaces []*multiTestIface, cfgs []netdev.MultiRunnerInterface[int]) *netdev.MultiRunner[int] {
+	t.Helper()
+	var m netdev.MultiRunner[int]
+	err := m.Configure(netdev.MultiRunnerConfig{
+		Backoff: func(uint) time.Duration { return backoff },
+		Budget:  budget,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mi := range ifaces {
+		mi.dev.frameSize = 1514
+		mi.netlink = new(notifyNetlink)
+		err = mi.iface.Init(mi.netlink, mi.dev, netdev.InterfaceConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := cfgs[i]
+		cfg.Interface = &mi.iface
+		cfg.Stack = mi.stack
+		cfg.Runner.Buffers = mi.iface.RunnerBuffers(2)
+		idx, err := m.AddInterface(cfg)
+		if err != nil {
+			t.Fatal(err)
+		} else if idx != i {
+			t.Fatalf("got index %d, want %d", idx, i)
+		}
+	}
+	return &m
+}
+
+func newMultiTestIfaces(n int) []*multiTestIface {
+	ifaces := make([]*multiTestIface, n)
+	for i := range ifaces {
+		ifaces[i] = &multiTestIface{dev: &mockDev{}, stack: &mockStack{}}
+	}
+	return ifaces
+}
+
+func TestMultiRunnerBudget(t *testing.T) {
+	const fsize = 64
+	for _, budget := range []int{1, 3} {
+		ifaces := newMultiTestIfaces(2)
+		poll := netdev.MultiRunnerInterface[int]{Runner: netdev.RunnerConfig[int]{Flags: netdev.RunnerInterfacePoll}}
+		m := newMultiRunner(t, budget, time.Millisecond, ifaces, []netdev.MultiRunnerInterface[int]{poll, poll})
+		busy, quiet := ifaces[0], ifaces[1]
+		for seq := range uint32(10) {
+			busy.dev.queueRx(testFrame(seq, fsize))
+		}
+		quiet.dev.queueRx(testFrame(100, fsize))
+		quiet.stack.queueEgress(testFrame(101, fsize))
+
+		nrx, ntx, err := m.RunOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if busy.stack.numIngress() != budget {
+			t.Errorf("budget %d: busy interface ingressed %d frames in a round", budget, busy.stack.numIngress())
+		}
+		if quiet.stack.numIngress() != 1 || quiet.dev.numSent() != 1 {
+			t.Errorf("budget %d: quiet interface starved: ingress=%d sent=%d", budget, quiet.stack.numIngress(), quiet.dev.numSent())
+		}
+		if nrx != (budget+1)*fsize || ntx != fsize {
+			t.Errorf("budget %d: nrx=%d ntx=%d", budget, nrx, ntx)
+		}
+		var stats netdev.RunnerStatistics
+		m.ReadInterfaceStatistics(1, &stats)
+		if stats.Rx != fsize {
+			t.Errorf("quiet interface Rx=%d, want %d", stats.Rx, fsize)
+		}
+		m.ReadStatistics(&stats)
+		if stats.Rx != uint64(nrx) {
+			t.Errorf("aggregate Rx=%d, want %d", stats.Rx, nrx)
+		}
+	}
+}
+
+func TestMultiRunnerLinkNotify(t *testing.T) {
+	const fsize = 64
+	ifaces := newMultiTestIfaces(2)
+	reconnect := 7
+	var notified []bool
+	cfgs := []netdev.MultiRunnerInterface[int]{
+		{Runner: netdev.RunnerConfig[int]{Flags: netdev.RunnerInterfacePoll, ReconnectParams: &reconnect}, ReconnectRetries: 3},
+		{Runner: netdev.RunnerConfig[int]{Flags: netdev.RunnerInterfacePoll}, LinkNotify: func(connected bool) (int, int) {
+			notified = append(notified, connected)
+			return 0, 0
+		}},
+	}
+	m := newMultiRunner(t, 1, time.Millisecond, ifaces, cfgs)
+	a, b := ifaces[0], ifaces[1]
+
+	retries, params := a.netlink.cb(false)
+	if retries != 3 || params != reconnect {
+		t.Errorf("got reconnect retries=%d params=%d, want 3, %d", retries, params, reconnect)
+	}
+	if m.LinkUp(0) || !m.LinkUp(1) {
+		t.Fatal("link state not tracked per interface")
+	}
+	a.dev.queueRx(testFrame(1, fsize))
+	b.dev.queueRx(testFrame(2, fsize))
+	if _, _, err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if a.stack.numIngress() != 0 || b.stack.numIngress() != 1 {
+		t.Fatalf("disconnected interface serviced: a=%d b=%d", a.stack.numIngress(), b.stack.numIngress())
+	}
+	a.netlink.cb(true)
+	if _, _, err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if a.stack.numIngress() != 1 {
+		t.Fatal("reconnected interface not serviced")
+	}
+
+	b.netlink.cb(false)
+	if len(notified) != 1 || notified[0] {
+		t.Errorf("interface callback got %v, want [false]", notified)
+	}
+	var stats netdev.RunnerStatistics
+	m.ReadInterfaceStatistics(0, &stats)
+	if stats.LinkDowns != 1 {
+		t.Errorf("interface 0 LinkDowns=%d, want 1", stats.LinkDowns)
+	}
+	m.ReadStatistics(&stats)
+	if stats.LinkDowns != 2 {
+		t.Errorf("aggregate LinkDowns=%d, want 2", stats.LinkDowns)
+	}
+}
+
+func TestMultiRunnerRunAsyncWake(t *testing.T) {
+	const fsize = 64
+	ifaces := newMultiTestIfaces(2)
+	async := netdev.MultiRunnerInterface[int]{Runner: netdev.RunnerConfig[int]{Flags: netdev.RunnerInterfaceAsync | netdev.RunnerAsyncWakeOnRx}}
+	// Long backoff: frames must be serviced by the wake signal, not the timer.
+	m := newMultiRunner(t, 1, time.Hour, ifaces, []netdev.MultiRunnerInterface[int]{async, async})
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error, 1)
+	go func() { runDone <- m.Run(ctx) }()
+	for _, mi := range ifaces {
+		for !mi.dev.handlerInstalled() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // Let the runner go idle.
+	for i, mi := range ifaces {
+		mi.dev.deliver(testFrame(uint32(i), fsize))
+	}
+	deadline := time.Now().Add(time.Second)
+	for (ifaces[0].stack.numIngress() == 0 || ifaces[1].stack.numIngress() == 0) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-runDone; !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	for i, mi := range ifaces {
+		if mi.stack.numIngress() != 1 {
+			t.Errorf("interface %d ingressed %d frames, want 1", i, mi.stack.numIngress())
+		}
+		if mi.dev.handlerInstalled() {
+			t.Errorf("interface %d handler not removed after Run", i)
+		}
+		var stats netdev.RunnerStatistics
+		m.ReadInterfaceStatistics(i, &stats)
+		if stats.Rx != fsize {
+			t.Errorf("interface %d Rx=%d, want %d", i, stats.Rx, fsize)
+		}
+	}
+}
@@ -124,6 +124,9 @@ type RunnerStatistics struct {
 	TxSendErrs uint64
 	// BufAcquireFail increments by 1 each time a buffer is unable to be acquired for Rx/Tx.
 	BufAcquireFail uint64
+	// LinkDowns increments by 1 each time the interface's [Netlink] reports a disconnection.
+	// Only counted by [MultiRunner].
+	LinkDowns uint64
 }
 
 // ReadStatistics reads statistics of Runner into [RunnerStatistics].
@@ -139,6 +142,15 @@ func (r *Runner[C]) ReadStatistics(stats *RunnerStatistics) {
 	}
 }
 
+func (r *Runner[C]) resetStatistics() {
+	r.rx.Store(0)
+	r.pktlost.Store(0)
+	r.rxStackErrs.Store(0)
+	r.rxPollErrs.Store(0)
+	r.txStackErrs.Store(0)
+	r.txSendErrs.Store(0)
+}
+
 func (r *Runner[C]) getFlags() RunnerFlags { return RunnerFlags(r.flags.Load()) }
 
 // Wake unblocks a [Runner] sleeping in [RunnerAsyncWakeOnRx] mode so it services the
@@ -264,12 +276,7 @@ func (r *Runner[C]) Run(ctx context.Context, iface *Interface[C], stack Stack) e
 		return errAsyncHandlingWithRun
 	}
 	r.bufs.releaseAll()
-	r.rx.Store(0)
-	r.pktlost.Store(0)
-	r.rxStackErrs.Store(0)
-	r.rxPollErrs.Store(0)
-	r.txStackErrs.Store(0)
-	r.txSendErrs.Store(0)
+	r.resetStatistics()
 	bufsize := iface.bufsize()
 	flags := r.getFlags()
 	async := flags.HasAny(RunnerInterfaceAsync)
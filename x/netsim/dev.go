@@ -0,0 +1,104 @@
+package netsim
+
+import (
+	"sync"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+)
+
+// Dev is a simulated Ethernet device attached to a [Network]. It implements netdev.DevEthernet
+// so it can be driven by a netdev.Runner. Received frames are passed to the handler set with
+// [Dev.SetEthRecvHandler] as they arrive or otherwise queued for [Dev.EthPoll] up to
+// the QueueLimit of the device's [LinkConfig].
+type Dev struct {
+	port *Port
+	mac  [6]byte
+	// hmu is held while the receive handler runs to honor the SetEthRecvHandler quiescence guarantee.
+	hmu     sync.Mutex
+	handler func(rxEthframe []byte)
+	rx      [][]byte // Received frames pending EthPoll, guarded by Network.mu.
+}
+
+// NewDev adds a device endpoint with the given MAC address to the network.
+func (n *Network) NewDev(mac [6]byte, link LinkConfig) (*Dev, error) {
+	if internal.IsZeroed(mac) {
+		return nil, lneto.ErrInvalidAddr
+	}
+	d := &Dev{mac: mac}
+	p, err := n.addPort(&Port{link: link, mac: mac, dev: d})
+	if err != nil {
+		return nil, err
+	}
+	d.port = p
+	return d, nil
+}
+
+// Port returns the device's attachment to the network.
+func (d *Dev) Port() *Port { return d.port }
+
+// HardwareAddr6 returns the device's MAC address.
+func (d *Dev) HardwareAddr6() ([6]byte, error) { return d.mac, nil }
+
+// SendOffsetEthFrame sends the Ethernet frame over the network. The frame is copied.
+func (d *Dev) SendOffsetEthFrame(offsetTxEthFrame []byte) error {
+	d.port.net.send(d.port, offsetTxEthFrame)
+	return nil
+}
+
+// SetEthRecvHandler sets the function received frames are passed to as they are delivered by the network.
+func (d *Dev) SetEthRecvHandler(handler func(rxEthframe []byte)) {
+	d.hmu.Lock()
+	d.handler = handler
+	d.hmu.Unlock()
+}
+
+// EthPoll writes the oldest queued received frame into buf when no receive handler is set.
+func (d *Dev) EthPoll(buf []byte) (ethFrameOff, ethernetBytes int, err error) {
+	d.hmu.Lock()
+	handlerSet := d.handler != nil
+	d.hmu.Unlock()
+	if handlerSet {
+		return 0, 0, nil
+	}
+	n := d.port.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(d.rx) == 0 {
+		return 0, 0, nil
+	}
+	frame := internal.SliceDequeueFront(&d.rx)
+	if len(frame) > len(buf) {
+		err = lneto.ErrShortBuffer
+	} else {
+		ethernetBytes = copy(buf, frame)
+	}
+	n.free = append(n.free, frame)
+	return 0, ethernetBytes, err
+}
+
+// MaxFrameSizeAndOffset returns the largest frame the device's link carries and a zero offset.
+func (d *Dev) MaxFrameSizeAndOffset() (maxFrameSize int, sendEthFrameOff int) {
+	n := d.port.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return sizeHeader + d.port.link.mtu(), 0
+}
+
+// deliver passes frame to the receive handler or queues it. retained is true if frame was queued.
+func (d *Dev) deliver(frame []byte) (retained bool, err error) {
+	d.hmu.Lock()
+	defer d.hmu.Unlock()
+	if d.handler != nil {
+		d.handler(frame)
+		return false, nil
+	}
+	n := d.port.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(d.rx) >= d.port.link.queueLimit() {
+		return false, lneto.ErrBufferFull
+	}
+	d.rx = append(d.rx, frame)
+	return true, nil
+}
@@ -0,0 +1,401 @@
+// Package netsim implements an in-memory Ethernet network for deterministic testing of
+// networking stacks.
+//
+// A [Network] is a hub that connects any number of endpoints, either stacks that are driven
+// directly such as xnet.StackAsync (see [Network.AttachStack]) or [Dev] devices implementing
+// netdev.DevEthernet (see [Network.NewDev]). Frames travel over links that may add latency,
+// jitter, loss, duplication, reordering, bandwidth limits and an MTU, see [LinkConfig].
+//
+// Time in the network is virtual and only moves forward through [Network.Advance] and
+// [Network.Flush]. All impairments are drawn from a single seeded pseudo random source
+// and endpoints are serviced in the order they were added, so a given seed and sequence
+// of calls replays exactly. Stacks implementing [Clocked] are switched to the virtual clock
+// when attached. Other endpoints that accept a time source (i.e: the Nanotime field of
+// tcp.ConnConfig) should be given [Network.Nanotime] so that their timers run on the same clock.
+package netsim
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+)
+
+const (
+	sizeHeader        = 14
+	defaultQueueLimit = 64
+	// maxEgressPerPoll limits the frames taken from a stack endpoint each time it is polled.
+	maxEgressPerPoll = 64
+)
+
+// Stack is an endpoint that is driven directly by the network, i.e: xnet.StackAsync.
+type Stack interface {
+	IngressEthernet(ethernetFrame []byte) error
+	EgressEthernet(dstEthernetFrame []byte) (int, error)
+}
+
+// Clocked is implemented by stack endpoints whose timers can run on the network's
+// virtual clock, i.e: xnet.StackAsync.
+type Clocked interface {
+	SetNanotime(nanotime func() int64)
+}
+
+// Config configures a [Network]. See [Network.Reset].
+type Config struct {
+	// Seed seeds the pseudo random source used for all impairments.
+	Seed int64
+	// Capture, if set, is called with every frame delivered to a port. frame must not be retained.
+	Capture func(nanotime int64, dst *Port, frame []byte)
+}
+
+// LinkConfig configures the impairments of the link frames sent by a port travel over.
+// The zero value is an ideal link with no delay and a 1500 byte MTU.
+type LinkConfig struct {
+	// Latency is the fixed propagation delay of every frame.
+	Latency time.Duration
+	// Jitter adds a uniformly distributed delay in [0, Jitter) to each frame. Jitter may reorder frames.
+	Jitter time.Duration
+	// Loss is the probability in [0, 1] a frame is lost.
+	Loss float64
+	// Duplicate is the probability in [0, 1] a frame is delivered twice.
+	Duplicate float64
+	// Reorder is the probability in [0, 1] a frame skips the latency and jitter
+	// and so overtakes frames sent before it.
+	Reorder float64
+	// Bandwidth limits the link rate in bits per second. Frames queue behind each other
+	// for their serialization time. Zero is unlimited.
+	Bandwidth int64
+	// MTU is the maximum Ethernet payload. Larger frames are dropped. Defaults to [ethernet.MaxMTU].
+	MTU int
+	// QueueLimit is the maximum number of frames in flight on the link. Frames sent
+	// when the queue is full are dropped. It also limits the receive queue of a [Dev]. Defaults to 64.
+	QueueLimit int
+}
+
+func (cfg *LinkConfig) validate() error {
+	switch {
+	case cfg.Latency < 0, cfg.Jitter < 0, cfg.Bandwidth < 0, cfg.QueueLimit < 0:
+		return lneto.ErrInvalidConfig
+	case !isProbability(cfg.Loss), !isProbability(cfg.Duplicate), !isProbability(cfg.Reorder):
+		return lneto.ErrInvalidConfig
+	case cfg.MTU != 0 && (cfg.MTU < ethernet.MinimumMTU || cfg.MTU > ethernet.MaxMTU):
+		return lneto.ErrInvalidConfig
+	}
+	return nil
+}
+
+func isProbability(p float64) bool { return p >= 0 && p <= 1 }
+
+func (cfg *LinkConfig) mtu() int {
+	if cfg.MTU == 0 {
+		return ethernet.MaxMTU
+	}
+	return cfg.MTU
+}
+
+func (cfg *LinkConfig) queueLimit() int {
+	if cfg.QueueLimit == 0 {
+		return defaultQueueLimit
+	}
+	return cfg.QueueLimit
+}
+
+// PortStats holds frame counters of a [Port].
+type PortStats struct {
+	TxFrames     uint64 // Frames sent by the port.
+	RxFrames     uint64 // Frames delivered to the port.
+	Lost         uint64 // Frames sent by the port lost on the link.
+	Duplicated   uint64 // Frames sent by the port duplicated on the link.
+	Reordered    uint64 // Frames sent by the port that skipped the link delay.
+	DroppedMTU   uint64 // Frames sent by the port exceeding the link MTU.
+	DroppedQueue uint64 // Frames sent by the port while the link queue was full.
+	TxErrors     uint64 // Errors returned by the endpoint generating frames.
+	RxErrors     uint64 // Errors returned by the endpoint processing frames, excluding [lneto.ErrPacketDrop].
+}
+
+// Port is an endpoint's attachment to a [Network].
+type Port struct {
+	net      *Network
+	link     LinkConfig
+	mac      [6]byte // Learned from sent frames, used to forward unicast frames.
+	stack    Stack
+	dev      *Dev
+	egress   []byte // Stack egress buffer.
+	busy     int64  // Time the link finishes serializing the last frame sent.
+	inflight int
+	stats    PortStats
+}
+
+// Stats returns the port's frame counters.
+func (p *Port) Stats() PortStats {
+	p.net.mu.Lock()
+	defer p.net.mu.Unlock()
+	return p.stats
+}
+
+// SetLink replaces the impairments of the port's link. Frames in flight are not affected.
+func (p *Port) SetLink(cfg LinkConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	p.net.mu.Lock()
+	defer p.net.mu.Unlock()
+	p.link = cfg
+	return nil
+}
+
+// Network is a simulated Ethernet hub with a virtual clock. Frames sent by a port are
+// forwarded to the port that last sent from the destination MAC address or flooded to
+// all other ports if unknown, multicast or broadcast.
+//
+// Network methods are safe for concurrent use. [Network.Advance] and [Network.Flush]
+// must not be called concurrently with each other.
+type Network struct {
+	mu      sync.Mutex
+	now     int64
+	rng     *rand.Rand
+	seq     uint64
+	ports   []*Port
+	events  eventQueue
+	free    [][]byte
+	capture func(nanotime int64, dst *Port, frame []byte)
+}
+
+// Reset clears the network, removing all ports and frames in flight, and sets the virtual clock to zero.
+func (n *Network) Reset(cfg Config) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.now = 0
+	n.rng = rand.New(rand.NewSource(cfg.Seed))
+	n.seq = 0
+	n.ports = n.ports[:0]
+	n.events = n.events[:0]
+	n.capture = cfg.Capture
+	return nil
+}
+
+// Nanotime returns the virtual time of the network in nanoseconds.
+func (n *Network) Nanotime() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now
+}
+
+// Pending returns the number of frames in flight.
+func (n *Network) Pending() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.events)
+}
+
+// AttachStack adds a stack endpoint to the network. The stack is polled for frames
+// to send and fed the frames it receives during [Network.Advance] and [Network.Flush].
+// If s implements [Clocked] its time source is set to [Network.Nanotime].
+func (n *Network) AttachStack(s Stack, link LinkConfig) (*Port, error) {
+	if s == nil {
+		return nil, lneto.ErrInvalidConfig
+	}
+	p, err := n.addPort(&Port{link: link, stack: s, egress: make([]byte, sizeHeader+ethernet.MaxMTU)})
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := s.(Clocked); ok {
+		c.SetNanotime(n.Nanotime)
+	}
+	return p, nil
+}
+
+func (n *Network) addPort(p *Port) (*Port, error) {
+	if err := p.link.validate(); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rng == nil {
+		return nil, lneto.ErrBadState // Network not Reset.
+	}
+	p.net = n
+	n.ports = append(n.ports, p)
+	return p, nil
+}
+
+// Advance moves the virtual clock forward by d, delivering frames in order of arrival
+// and servicing stack endpoints after each delivery.
+func (n *Network) Advance(d time.Duration) {
+	n.run(n.Nanotime()+int64(d), true)
+}
+
+// Flush delivers frames until none are in flight, moving the virtual clock at most max forward.
+// Unlike [Network.Advance] the clock stops at the arrival of the last frame delivered.
+// It reports whether the network went idle.
+func (n *Network) Flush(max time.Duration) (idle bool) {
+	n.run(n.Nanotime()+int64(max), false)
+	return n.Pending() == 0
+}
+
+func (n *Network) run(end int64, jump bool) {
+	for {
+		n.pollStacks()
+		n.mu.Lock()
+		if len(n.events) == 0 || n.events[0].at > end {
+			if !jump || n.now == end {
+				n.mu.Unlock()
+				return
+			}
+			n.now = end
+			n.mu.Unlock()
+			continue // Service stacks once more at the end time.
+		}
+		ev := heap.Pop(&n.events).(event)
+		n.now = ev.at
+		ev.src.inflight--
+		n.mu.Unlock()
+		n.deliver(ev)
+	}
+}
+
+// pollStacks sends the frames stack endpoints have pending.
+func (n *Network) pollStacks() {
+	n.mu.Lock()
+	ports := n.ports
+	n.mu.Unlock()
+	for _, p := range ports {
+		if p.stack == nil {
+			continue
+		}
+		for range maxEgressPerPoll {
+			nw, err := p.stack.EgressEthernet(p.egress)
+			if err != nil || nw == 0 {
+				if err != nil {
+					n.mu.Lock()
+					p.stats.TxErrors++
+					n.mu.Unlock()
+				}
+				break
+			}
+			n.send(p, p.egress[:nw])
+		}
+	}
+}
+
+// send queues frame sent by src for delivery.
+func (n *Network) send(src *Port, frame []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	src.stats.TxFrames++
+	if len(frame) < sizeHeader || len(frame)-sizeHeader > src.link.mtu() {
+		src.stats.DroppedMTU++
+		return
+	}
+	dstMAC := [6]byte(frame[0:6])
+	if frame[6]&1 == 0 {
+		src.mac = [6]byte(frame[6:12])
+	}
+	link := &src.link
+	depart := max(n.now, src.busy)
+	if link.Bandwidth > 0 {
+		depart += int64(len(frame)) * 8 * int64(time.Second) / link.Bandwidth
+		src.busy = depart
+	}
+	unicast := dstMAC[0]&1 == 0
+	var dst *Port
+	if unicast {
+		for _, p := range n.ports {
+			if p != src && p.mac == dstMAC {
+				dst = p
+				break
+			}
+		}
+	}
+	for _, p := range n.ports {
+		if p == src || (dst != nil && p != dst) {
+			continue
+		}
+		if link.Loss > 0 && n.rng.Float64() < link.Loss {
+			src.stats.Lost++
+			continue
+		}
+		copies := 1
+		if link.Duplicate > 0 && n.rng.Float64() < link.Duplicate {
+			src.stats.Duplicated++
+			copies = 2
+		}
+		for range copies {
+			delay := int64(link.Latency)
+			if link.Jitter > 0 {
+				delay += n.rng.Int63n(int64(link.Jitter))
+			}
+			if link.Reorder > 0 && n.rng.Float64() < link.Reorder {
+				src.stats.Reordered++
+				delay = 0
+			}
+			if src.inflight >= link.queueLimit() {
+				src.stats.DroppedQueue++
+				continue
+			}
+			src.inflight++
+			n.seq++
+			heap.Push(&n.events, event{at: depart + delay, seq: n.seq, src: src, dst: p, frame: n.copyFrame(frame)})
+		}
+	}
+}
+
+func (n *Network) deliver(ev event) {
+	p := ev.dst
+	if n.capture != nil {
+		n.capture(ev.at, p, ev.frame)
+	}
+	var err error
+	retained := false
+	if p.stack != nil {
+		err = p.stack.IngressEthernet(ev.frame)
+	} else {
+		retained, err = p.dev.deliver(ev.frame)
+	}
+	n.mu.Lock()
+	p.stats.RxFrames++
+	if err != nil && err != lneto.ErrPacketDrop {
+		p.stats.RxErrors++
+	}
+	if !retained {
+		n.free = append(n.free, ev.frame)
+	}
+	n.mu.Unlock()
+}
+
+// copyFrame returns a copy of frame using a previously freed buffer if available. Must be called with mu held.
+func (n *Network) copyFrame(frame []byte) []byte {
+	var buf []byte
+	if len(n.free) > 0 {
+		buf = n.free[len(n.free)-1]
+		n.free = n.free[:len(n.free)-1]
+	}
+	return append(buf[:0], frame...)
+}
+
+type event struct {
+	at    int64
+	seq   uint64 // Keeps frames arriving at the same time in send order.
+	src   *Port
+	dst   *Port
+	frame []byte
+}
+
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	return q[i].at < q[j].at || (q[i].at == q[j].at && q[i].seq < q[j].seq)
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	ev := old[len(old)-1]
+	old[len(old)-1] = event{}
+	*q = old[:len(old)-1]
+	return ev
+}
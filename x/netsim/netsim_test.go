@@ -0,0 +1,355 @@
+package netsim_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/tcp"
+	"github.com/soypat/lneto/x/netsim"
+	"github.com/soypat/lneto/x/xnet"
+)
+
+var _ netsim.Clocked = (*xnet.StackAsync)(nil)
+
+var (
+	macA = [6]byte{0x02, 0, 0, 0, 0, 1}
+	macB = [6]byte{0x02, 0, 0, 0, 0, 2}
+)
+
+func newNetwork(t *testing.T, seed int64) *netsim.Network {
+	t.Helper()
+	var n netsim.Network
+	if err := n.Reset(netsim.Config{Seed: seed}); err != nil {
+		t.Fatal(err)
+	}
+	return &n
+}
+
+func newDev(t *testing.T, n *netsim.Network, mac [6]byte, link netsim.LinkConfig) *netsim.Dev {
+	t.Helper()
+	d, err := n.NewDev(mac, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testFrame returns an Ethernet frame of size bytes carrying id.
+func testFrame(dst, src [6]byte, id uint32, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], src[:])
+	binary.BigEndian.PutUint16(frame[12:14], uint16(ethernet.TypeIPv4))
+	binary.BigEndian.PutUint32(frame[14:18], id)
+	return frame
+}
+
+// pollIDs drains the frames queued in d and returns the ids they carry.
+func pollIDs(d *netsim.Dev) (ids []uint32) {
+	var buf [ethernet.MaxFrameLength]byte
+	for {
+		_, n, err := d.EthPoll(buf[:])
+		if err != nil || n == 0 {
+			return ids
+		}
+		ids = append(ids, binary.BigEndian.Uint32(buf[14:18]))
+	}
+}
+
+func TestNetwork_LatencyBandwidth(t *testing.T) {
+	n := newNetwork(t, 1)
+	// 1000 byte frames take 8ms to serialize at 1Mbit/s.
+	a := newDev(t, n, macA, netsim.LinkConfig{Latency: 10 * time.Millisecond, Bandwidth: 1e6})
+	b := newDev(t, n, macB, netsim.LinkConfig{})
+	a.SendOffsetEthFrame(testFrame(macB, macA, 1, 1000))
+	a.SendOffsetEthFrame(testFrame(macB, macA, 2, 1000))
+	n.Advance(17 * time.Millisecond)
+	if ids := pollIDs(b); len(ids) != 0 {
+		t.Fatalf("frames delivered early: %v", ids)
+	}
+	n.Advance(time.Millisecond)
+	if ids := pollIDs(b); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("want first frame at 18ms, got %v", ids)
+	}
+	if !n.Flush(time.Second) {
+		t.Fatal("network not idle")
+	}
+	if now := n.Nanotime(); now != int64(26*time.Millisecond) {
+		t.Errorf("want flush to stop at last arrival 26ms, got %s", time.Duration(now))
+	}
+	if ids := pollIDs(b); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("want second frame, got %v", ids)
+	}
+	// Replies are forwarded only to the learned port.
+	c := newDev(t, n, [6]byte{0x02, 0, 0, 0, 0, 3}, netsim.LinkConfig{})
+	b.SendOffsetEthFrame(testFrame(macA, macB, 3, 64))
+	n.Flush(time.Second)
+	if ids := pollIDs(c); len(ids) != 0 {
+		t.Errorf("unicast frame flooded to unrelated port: %v", ids)
+	}
+	if ids := pollIDs(a); len(ids) != 1 {
+		t.Errorf("want reply delivered, got %v", ids)
+	}
+}
+
+func TestNetwork_MTU(t *testing.T) {
+	n := newNetwork(t, 1)
+	a := newDev(t, n, macA, netsim.LinkConfig{MTU: 576})
+	b := newDev(t, n, macB, netsim.LinkConfig{})
+	a.SendOffsetEthFrame(testFrame(macB, macA, 1, 14+577))
+	a.SendOffsetEthFrame(testFrame(macB, macA, 2, 14+576))
+	n.Flush(time.Second)
+	if ids := pollIDs(b); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("want only frame within MTU delivered, got %v", ids)
+	}
+	if a.Port().Stats().DroppedMTU != 1 {
+		t.Error("want oversized frame counted")
+	}
+}
+
+// impairedRun sends frames over a heavily impaired link and returns the order they were received in.
+func impairedRun(t *testing.T, seed int64) ([]uint32, netsim.PortStats) {
+	n := newNetwork(t, seed)
+	a := newDev(t, n, macA, netsim.LinkConfig{
+		Latency:    5 * time.Millisecond,
+		Jitter:     3 * time.Millisecond,
+		Loss:       0.2,
+		Duplicate:  0.1,
+		Reorder:    0.1,
+		Bandwidth:  10e6,
+		QueueLimit: 1000,
+	})
+	b := newDev(t, n, macB, netsim.LinkConfig{QueueLimit: 1000})
+	for i := range uint32(200) {
+		a.SendOffsetEthFrame(testFrame(macB, macA, i, 100))
+		n.Advance(100 * time.Microsecond)
+	}
+	n.Flush(time.Second)
+	return pollIDs(b), a.Port().Stats()
+}
+
+func TestNetwork_Deterministic(t *testing.T) {
+	ids1, stats := impairedRun(t, 42)
+	ids2, _ := impairedRun(t, 42)
+	ids3, _ := impairedRun(t, 43)
+	if !slices.Equal(ids1, ids2) {
+		t.Fatal("same seed produced different deliveries")
+	} else if slices.Equal(ids1, ids3) {
+		t.Error("different seeds produced same deliveries")
+	}
+	if stats.Lost == 0 || stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Errorf("impairments not applied: %+v", stats)
+	}
+	if got := uint64(len(ids1)); got != stats.TxFrames-stats.Lost+stats.Duplicated {
+		t.Errorf("got %d frames, want %d (%+v)", got, stats.TxFrames-stats.Lost+stats.Duplicated, stats)
+	}
+	inOrder := true
+	for i := 1; i < len(ids1); i++ {
+		inOrder = inOrder && ids1[i] >= ids1[i-1]
+	}
+	if inOrder {
+		t.Error("want reordered frames")
+	}
+}
+
+func TestNetwork_StackAsyncTCP(t *testing.T) {
+	n := newNetwork(t, 1)
+	var s1, s2 xnet.StackAsync
+	for i, s := range []*xnet.StackAsync{&s1, &s2} {
+		err := s.Reset(xnet.StackConfig{
+			Hostname:          "Stack" + string(rune('1'+i)),
+			RandSeed:          int64(i + 1),
+			StaticAddress4:    [4]byte{10, 0, 0, byte(i + 1)},
+			HardwareAddress:   [6]byte{0x02, 0, 0, 0, 0, byte(i + 1)},
+			MaxActiveTCPPorts: 1,
+			MTU:               ethernet.MaxMTU,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = n.AttachStack(s, netsim.LinkConfig{Latency: 20 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s1.SetGatewayHardwareAddr(s2.HardwareAddr())
+	s2.SetGatewayHardwareAddr(s1.HardwareAddr())
+	var sv, cl tcp.Conn
+	for _, conn := range []*tcp.Conn{&sv, &cl} {
+		err := conn.Configure(tcp.ConnConfig{RxBuf: make([]byte, 1024), TxBuf: make([]byte, 1024), TxPacketQueueSize: 4, RWBackoff: backoffYield})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s1.ListenTCP4(&sv, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.DialTCP(&cl, 1337, netip.AddrPortFrom(netip.AddrFrom4(s1.Addr4()), 80)); err != nil {
+		t.Fatal(err)
+	}
+	n.Flush(time.Second)
+	if sv.State() != tcp.StateEstablished || cl.State() != tcp.StateEstablished {
+		t.Fatalf("connection not established: server %s client %s", sv.State(), cl.State())
+	}
+	// SYN, SYN-ACK and ACK each take one link latency.
+	if now := n.Nanotime(); now != int64(60*time.Millisecond) {
+		t.Errorf("want handshake to take 60ms of virtual time, got %s", time.Duration(now))
+	}
+	data := []byte("hello over a simulated link")
+	if _, err := cl.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	n.Flush(time.Second)
+	if sv.BufferedInput() != len(data) {
+		t.Fatalf("want %d bytes received, got %d", len(data), sv.BufferedInput())
+	}
+	got := make([]byte, len(data))
+	sv.Read(got)
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+// tcpLossRun transfers data over a lossy link between two stacks with RTO loss recovery on the
+// network's virtual clock. It returns a trace of every delivered frame and the number of data
+// segments the client retransmitted.
+func tcpLossRun(t *testing.T, seed int64, data []byte) (trace []uint64, retransmits int) {
+	t.Helper()
+	var n netsim.Network
+	err := n.Reset(netsim.Config{
+		Seed: seed,
+		Capture: func(nanotime int64, _ *netsim.Port, frame []byte) {
+			trace = append(trace, uint64(nanotime), uint64(crc32.ChecksumIEEE(frame)))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s1, s2 xnet.StackAsync
+	client := &egressRecorder{StackAsync: &s2, sent: make(map[uint32]bool)}
+	var ports [2]*netsim.Port
+	for i, s := range []*xnet.StackAsync{&s1, &s2} {
+		err := s.Reset(xnet.StackConfig{
+			Hostname:          "Stack" + string(rune('1'+i)),
+			RandSeed:          int64(i + 1),
+			StaticAddress4:    [4]byte{10, 0, 0, byte(i + 1)},
+			HardwareAddress:   [6]byte{0x02, 0, 0, 0, 0, byte(i + 1)},
+			MaxActiveTCPPorts: 1,
+			MTU:               576,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, s := range []netsim.Stack{&s1, client} {
+		ports[i], err = n.AttachStack(s, netsim.LinkConfig{Latency: 20 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s1.SetGatewayHardwareAddr(s2.HardwareAddr())
+	s2.SetGatewayHardwareAddr(s1.HardwareAddr())
+	var sv, cl tcp.Conn
+	for _, conn := range []*tcp.Conn{&sv, &cl} {
+		err := conn.Configure(tcp.ConnConfig{
+			RxBuf:             make([]byte, 2048),
+			TxBuf:             make([]byte, 2048),
+			TxPacketQueueSize: 8,
+			RWBackoff:         backoffYield,
+			LossRecovery:      new(tcp.RTO),
+			Nanotime:          n.Nanotime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s1.ListenTCP4(&sv, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.DialTCP(&cl, 1337, netip.AddrPortFrom(netip.AddrFrom4(s1.Addr4()), 80)); err != nil {
+		t.Fatal(err)
+	}
+	n.Flush(time.Second)
+	if sv.State() != tcp.StateEstablished || cl.State() != tcp.StateEstablished {
+		t.Fatalf("connection not established: server %s client %s", sv.State(), cl.State())
+	}
+	// Impair the links once established: RTO does not cover lost SYNs.
+	for _, p := range ports {
+		if err := p.SetLink(netsim.LinkConfig{Latency: 20 * time.Millisecond, Loss: 0.25}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cl.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 0, len(data))
+	var buf [512]byte
+	for range 600 {
+		n.Advance(100 * time.Millisecond)
+		for sv.BufferedInput() > 0 {
+			nr, _ := sv.Read(buf[:])
+			got = append(got, buf[:nr]...)
+		}
+		if len(got) == len(data) {
+			break
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("seed %d: received %d of %d bytes intact", seed, len(got), len(data))
+	}
+	return trace, client.retransmits
+}
+
+// egressRecorder counts TCP data segments sent more than once by the wrapped stack.
+type egressRecorder struct {
+	*xnet.StackAsync
+	sent        map[uint32]bool
+	retransmits int
+}
+
+func (r *egressRecorder) EgressEthernet(dst []byte) (int, error) {
+	n, err := r.StackAsync.EgressEthernet(dst)
+	const tcpOff = 14 + 20
+	if n < tcpOff+20 {
+		return n, err
+	}
+	tfrm, _ := tcp.NewFrame(dst[tcpOff:n])
+	_, flags := tfrm.OffsetAndFlags()
+	// Size payload by the IP total length, short frames carry Ethernet padding.
+	payload := int(binary.BigEndian.Uint16(dst[16:18])) - 20 - tfrm.HeaderLength()
+	if payload > 0 && !flags.HasAny(tcp.FlagSYN) {
+		seq := uint32(tfrm.Seq())
+		if r.sent[seq] {
+			r.retransmits++
+		}
+		r.sent[seq] = true
+	}
+	return n, err
+}
+
+func TestNetwork_TCPRetransmitReplay(t *testing.T) {
+	data := make([]byte, 1800)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	const seed = 8
+	trace1, retransmits := tcpLossRun(t, seed, data)
+	trace2, _ := tcpLossRun(t, seed, data)
+	if retransmits == 0 {
+		t.Fatal("want lost data segments retransmitted")
+	}
+	if !slices.Equal(trace1, trace2) {
+		t.Error("same seed did not replay the same frames at the same virtual times")
+	}
+	trace3, _ := tcpLossRun(t, seed+1, data)
+	if slices.Equal(trace1, trace3) {
+		t.Error("different seeds replayed the same frames")
+	}
+}
+
+func backoffYield(uint) time.Duration { return time.Microsecond }
@@ -0,0 +1,409 @@
+// Package qemunet implements netdev.DevEthernet over the socket transports of QEMU's
+// user-space network backends, letting lneto stacks talk to a QEMU guest, a VDE switch
+// or another lneto process without raw socket privileges or a host interface.
+//
+// Two framings are supported, matching QEMU:
+//   - Stream: each Ethernet frame is preceded by its length as a 4 byte big-endian integer.
+//     Used by "-netdev socket,connect=|listen=" and "-netdev stream" over TCP or Unix sockets.
+//     See [DialStream] and [NewStream].
+//   - Datagram: one Ethernet frame per datagram with no header. Used by "-netdev socket,udp="
+//     and "-netdev dgram" over UDP or Unix datagram sockets. See [ListenDgram] and [NewDgram].
+//
+// [DialVDE] connects to a VDE switch (vde_switch, vde_plug) through its control socket and
+// exchanges frames over a Unix datagram socket, as QEMU's "-netdev vde" does.
+//
+// For example, to connect to a guest started with
+//
+//	qemu-system-x86_64 -netdev stream,id=n0,server=on,addr.type=inet,addr.host=127.0.0.1,addr.port=1234 -device e1000,netdev=n0
+//
+// call DialStream("tcp", "127.0.0.1:1234", cfg) and pass the returned [Dev] to netdev.Interface.Init.
+package qemunet
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/internal"
+)
+
+const (
+	sizeHeaderEth     = 14
+	sizeStreamHeader  = 4
+	defaultMTU        = 1500
+	defaultQueueLimit = 16
+)
+
+// Framing is how Ethernet frames are delimited on the underlying socket.
+type Framing uint8
+
+const (
+	_ Framing = iota
+	// FramingStream prefixes each frame with its 4 byte big-endian length.
+	FramingStream
+	// FramingDgram sends one frame per datagram.
+	FramingDgram
+)
+
+// Config configures a [Dev].
+type Config struct {
+	// MAC is the hardware address of the device. Required.
+	MAC [6]byte
+	// MTU is the largest Ethernet payload the device sends and receives. Defaults to 1500.
+	// Larger received frames are dropped.
+	MTU int
+	// QueueLimit is the number of received frames queued for [Dev.EthPoll] when no
+	// receive handler is set. Frames received with a full queue are dropped. Defaults to 16.
+	QueueLimit int
+}
+
+// Stats holds device counters.
+type Stats struct {
+	RxFrames  uint64
+	TxFrames  uint64
+	RxDropped uint64 // Oversized frames, frames from unknown peers and frames received on a full queue.
+}
+
+// Dev is an Ethernet device backed by a socket. It implements netdev.DevEthernet.
+// Received frames are read by a goroutine started on creation and passed to the handler
+// set with [Dev.SetEthRecvHandler] or otherwise queued for [Dev.EthPoll].
+type Dev struct {
+	framing Framing
+	mac     [6]byte
+	mtu     int
+	stream  net.Conn
+	dgram   net.PacketConn
+	closers []io.Closer // Additional resources released on Close, i.e: VDE control socket.
+	cleanup func()
+
+	txmu  sync.Mutex
+	txbuf []byte
+	// raddr is the datagram peer. If nil it is learned from the first received datagram.
+	raddr net.Addr
+
+	// hmu is held while the receive handler runs to honor the SetEthRecvHandler quiescence guarantee.
+	hmu     sync.Mutex
+	handler func(rxEthframe []byte)
+
+	mu     sync.Mutex
+	rx     [][]byte // Received frames pending EthPoll.
+	free   [][]byte
+	limit  int
+	rxerr  error // Set when the reader goroutine exits.
+	stats  Stats
+	closed bool
+}
+
+// DialStream connects to a stream socket backend such as QEMU's "-netdev stream,server=on"
+// or "-netdev socket,listen=". network is "tcp" or "unix".
+func DialStream(network, addr string, cfg Config) (*Dev, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewStream(conn, cfg)
+	if err != nil {
+		conn.Close()
+	}
+	return d, err
+}
+
+// NewStream returns a device using stream framing over an established connection.
+// It is used to serve QEMU's "-netdev stream,server=off" or "-netdev socket,connect=" with
+// a connection accepted from a [net.Listener]. The device takes ownership of conn.
+func NewStream(conn net.Conn, cfg Config) (*Dev, error) {
+	d, err := newDev(FramingStream, cfg)
+	if err != nil {
+		return nil, err
+	}
+	d.stream = conn
+	go d.readLoop()
+	return d, nil
+}
+
+// ListenDgram opens a datagram socket on laddr exchanging frames with raddr, as configured with
+// QEMU's "-netdev dgram,local.*=raddr,remote.*=laddr" or "-netdev socket,udp=laddr,localaddr=raddr".
+// network is "udp" or "unixgram". If raddr is empty the peer is learned from the first received frame.
+func ListenDgram(network, laddr, raddr string, cfg Config) (*Dev, error) {
+	var remote net.Addr
+	var conn net.PacketConn
+	var err error
+	switch network {
+	case "udp", "udp4", "udp6":
+		if raddr != "" {
+			remote, err = net.ResolveUDPAddr(network, raddr)
+		}
+	case "unixgram":
+		if raddr != "" {
+			remote = &net.UnixAddr{Name: raddr, Net: network}
+		}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err = net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDgram(conn, remote, cfg)
+	if err != nil {
+		conn.Close()
+	}
+	return d, err
+}
+
+// NewDgram returns a device using datagram framing over conn. Frames are sent to raddr
+// and only frames received from raddr are accepted. If raddr is nil the peer is learned
+// from the first received frame and frames are not sent until then. The device takes ownership of conn.
+func NewDgram(conn net.PacketConn, raddr net.Addr, cfg Config) (*Dev, error) {
+	d, err := newDev(FramingDgram, cfg)
+	if err != nil {
+		return nil, err
+	}
+	d.dgram = conn
+	d.raddr = raddr
+	go d.readLoop()
+	return d, nil
+}
+
+func newDev(framing Framing, cfg Config) (*Dev, error) {
+	if internal.IsZeroed(cfg.MAC) {
+		return nil, lneto.ErrInvalidAddr
+	} else if cfg.MTU < 0 || cfg.QueueLimit < 0 {
+		return nil, lneto.ErrInvalidConfig
+	}
+	mtu := cmp.Or(cfg.MTU, defaultMTU)
+	return &Dev{
+		framing: framing,
+		mac:     cfg.MAC,
+		mtu:     mtu,
+		limit:   cmp.Or(cfg.QueueLimit, defaultQueueLimit),
+		txbuf:   make([]byte, sizeStreamHeader+sizeHeaderEth+mtu),
+	}, nil
+}
+
+// Framing returns the framing used by the device.
+func (d *Dev) Framing() Framing { return d.framing }
+
+// LocalAddr returns the local address of the underlying socket.
+func (d *Dev) LocalAddr() net.Addr {
+	if d.stream != nil {
+		return d.stream.LocalAddr()
+	}
+	return d.dgram.LocalAddr()
+}
+
+// Stats returns the device counters.
+func (d *Dev) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// Close closes the underlying sockets and stops the receive goroutine.
+func (d *Dev) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return net.ErrClosed
+	}
+	d.closed = true
+	d.mu.Unlock()
+	var err error
+	if d.stream != nil {
+		err = d.stream.Close()
+	} else {
+		err = d.dgram.Close()
+	}
+	for _, c := range d.closers {
+		err = cmp.Or(err, c.Close())
+	}
+	if d.cleanup != nil {
+		d.cleanup()
+	}
+	return err
+}
+
+// HardwareAddr6 returns the device's MAC address.
+func (d *Dev) HardwareAddr6() ([6]byte, error) { return d.mac, nil }
+
+// SendOffsetEthFrame writes the Ethernet frame to the socket.
+func (d *Dev) SendOffsetEthFrame(offsetTxEthFrame []byte) error {
+	if len(offsetTxEthFrame) > sizeHeaderEth+d.mtu {
+		return lneto.ErrShortBuffer
+	} else if len(offsetTxEthFrame) < sizeHeaderEth {
+		return lneto.ErrTruncatedFrame
+	}
+	d.txmu.Lock()
+	defer d.txmu.Unlock()
+	var err error
+	switch d.framing {
+	case FramingStream:
+		// Single write so the header and frame are never interleaved with another writer's.
+		binary.BigEndian.PutUint32(d.txbuf, uint32(len(offsetTxEthFrame)))
+		n := copy(d.txbuf[sizeStreamHeader:], offsetTxEthFrame)
+		_, err = d.stream.Write(d.txbuf[:sizeStreamHeader+n])
+	case FramingDgram:
+		d.mu.Lock()
+		raddr := d.raddr
+		d.mu.Unlock()
+		if raddr == nil {
+			return nil // Peer not yet known, frame is dropped as it would be on an unplugged link.
+		}
+		_, err = d.dgram.WriteTo(offsetTxEthFrame, raddr)
+	}
+	if err == nil {
+		d.mu.Lock()
+		d.stats.TxFrames++
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// SetEthRecvHandler sets the function received frames are passed to by the receive goroutine.
+func (d *Dev) SetEthRecvHandler(handler func(rxEthframe []byte)) {
+	d.hmu.Lock()
+	d.handler = handler
+	d.hmu.Unlock()
+}
+
+// EthPoll writes the oldest queued received frame into buf when no receive handler is set.
+// Once the socket is closed and no frames remain queued it returns the error that stopped the receive goroutine.
+func (d *Dev) EthPoll(buf []byte) (ethFrameOff, ethernetBytes int, err error) {
+	d.hmu.Lock()
+	handlerSet := d.handler != nil
+	d.hmu.Unlock()
+	if handlerSet {
+		return 0, 0, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rx) == 0 {
+		return 0, 0, d.rxerr
+	}
+	frame := internal.SliceDequeueFront(&d.rx)
+	if len(frame) > len(buf) {
+		err = lneto.ErrShortBuffer
+	} else {
+		ethernetBytes = copy(buf, frame)
+	}
+	d.free = append(d.free, frame[:0])
+	return 0, ethernetBytes, err
+}
+
+// MaxFrameSizeAndOffset returns the largest Ethernet frame the device sends and a zero offset.
+func (d *Dev) MaxFrameSizeAndOffset() (maxFrameSize int, sendEthFrameOff int) {
+	return sizeHeaderEth + d.mtu, 0
+}
+
+func (d *Dev) readLoop() {
+	// One byte over the largest frame so oversized datagrams are detected instead of truncated.
+	buf := make([]byte, sizeHeaderEth+d.mtu+1)
+	var err error
+	for {
+		var n int
+		var ok bool
+		if d.framing == FramingStream {
+			n, ok, err = d.readStream(buf)
+		} else {
+			n, ok, err = d.readDgram(buf)
+		}
+		if err != nil {
+			break
+		} else if ok {
+			d.deliver(buf[:n])
+		} else {
+			d.mu.Lock()
+			d.stats.RxDropped++
+			d.mu.Unlock()
+		}
+	}
+	d.mu.Lock()
+	if d.closed || errors.Is(err, io.EOF) {
+		err = net.ErrClosed
+	}
+	d.rxerr = err
+	d.mu.Unlock()
+}
+
+// readStream reads a length prefixed frame. ok is false if the frame was discarded.
+func (d *Dev) readStream(buf []byte) (n int, ok bool, err error) {
+	var hdr [sizeStreamHeader]byte
+	_, err = io.ReadFull(d.stream, hdr[:])
+	if err != nil {
+		return 0, false, err
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[:]))
+	if size > int64(sizeHeaderEth+d.mtu) {
+		_, err = io.CopyN(io.Discard, d.stream, size)
+		return 0, false, err
+	}
+	n, err = io.ReadFull(d.stream, buf[:size])
+	return n, err == nil && n >= sizeHeaderEth, err
+}
+
+// readDgram reads a single datagram frame. ok is false if the frame was discarded.
+func (d *Dev) readDgram(buf []byte) (n int, ok bool, err error) {
+	n, from, err := d.dgram.ReadFrom(buf)
+	if err != nil {
+		return 0, false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.raddr == nil && from != nil {
+		d.raddr = from
+	} else if from != nil && !samePeer(d.raddr, from) {
+		return 0, false, nil // Not from our peer.
+	}
+	return n, n >= sizeHeaderEth && n <= sizeHeaderEth+d.mtu, nil
+}
+
+// samePeer reports whether a and b are the same datagram peer without allocating for UDP and unixgram addresses.
+func samePeer(a, b net.Addr) bool {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		b, ok := b.(*net.UDPAddr)
+		return ok && unmapAddrPort(a.AddrPort()) == unmapAddrPort(b.AddrPort())
+	case *net.UnixAddr:
+		b, ok := b.(*net.UnixAddr)
+		return ok && a.Name == b.Name
+	}
+	return a.String() == b.String()
+}
+
+// unmapAddrPort unmaps IPv4-mapped IPv6 addresses so both forms of an IPv4 peer compare equal.
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// deliver passes frame to the receive handler or copies it to the EthPoll queue.
+func (d *Dev) deliver(frame []byte) {
+	d.hmu.Lock()
+	defer d.hmu.Unlock()
+	d.mu.Lock()
+	d.stats.RxFrames++
+	d.mu.Unlock()
+	if d.handler != nil {
+		d.handler(frame)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rx) >= d.limit {
+		d.stats.RxDropped++
+		return
+	}
+	var buf []byte
+	if len(d.free) > 0 {
+		buf = d.free[len(d.free)-1]
+		d.free = d.free[:len(d.free)-1]
+	}
+	d.rx = append(d.rx, append(buf, frame...))
+}
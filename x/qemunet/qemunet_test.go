@@ -0,0 +1,249 @@
+package qemunet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/x/netdev"
+	"github.com/soypat/lneto/x/qemunet"
+)
+
+var _ netdev.DevEthernet = (*qemunet.Dev)(nil)
+
+var (
+	macA = [6]byte{0x02, 0, 0, 0, 0, 1}
+	macB = [6]byte{0x02, 0, 0, 0, 0, 2}
+)
+
+func testFrame(dst, src [6]byte, id uint32, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], src[:])
+	binary.BigEndian.PutUint16(frame[12:14], uint16(ethernet.TypeIPv4))
+	binary.BigEndian.PutUint32(frame[14:18], id)
+	return frame
+}
+
+// pollFrame polls d until a frame arrives or a second elapses.
+func pollFrame(t *testing.T, d *qemunet.Dev) []byte {
+	t.Helper()
+	var buf [ethernet.MaxFrameLength]byte
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		off, n, err := d.EthPoll(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if n > 0 {
+			return buf[off : off+n]
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for frame")
+	return nil
+}
+
+// exchange sends frames in both directions between a and b checking they arrive intact,
+// through EthPoll and through the receive handler.
+func exchange(t *testing.T, a, b *qemunet.Dev) {
+	t.Helper()
+	for i, size := range []int{60, 1514, 100} {
+		frame := testFrame(macB, macA, uint32(i), size)
+		if err := a.SendOffsetEthFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		if got := pollFrame(t, b); !bytes.Equal(got, frame) {
+			t.Fatalf("frame %d corrupted: got %d bytes", i, len(got))
+		}
+	}
+	got := make(chan []byte, 1)
+	a.SetEthRecvHandler(func(rxEthframe []byte) { got <- append([]byte{}, rxEthframe...) })
+	defer a.SetEthRecvHandler(nil)
+	frame := testFrame(macA, macB, 99, 200)
+	if err := b.SendOffsetEthFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rx := <-got:
+		if !bytes.Equal(rx, frame) {
+			t.Fatal("frame corrupted on handler path")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for handler")
+	}
+	if err := a.SendOffsetEthFrame(make([]byte, 1515)); err == nil {
+		t.Error("want error sending frame over MTU")
+	}
+}
+
+func TestStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	a, err := qemunet.DialStream("tcp", l.Addr().String(), qemunet.Config{MAC: macA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	conn := <-accepted
+	// Oversized frame on the wire is discarded without losing stream sync.
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], 3000)
+	conn.Write(append(hdr[:], make([]byte, 3000)...))
+
+	b, err := qemunet.NewStream(conn, qemunet.Config{MAC: macB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, a, b)
+	if a.Stats().RxDropped != 1 {
+		t.Errorf("want oversized frame dropped, got stats %+v", a.Stats())
+	}
+	b.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, _, err = a.EthPoll(make([]byte, 1514))
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != net.ErrClosed {
+		t.Errorf("want ErrClosed after peer closed, got %v", err)
+	}
+}
+
+func TestDgram(t *testing.T) {
+	// b learns its peer from the first frame received.
+	b, err := qemunet.ListenDgram("udp", "127.0.0.1:0", "", qemunet.Config{MAC: macB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	baddr := b.LocalAddr().String()
+	a, err := qemunet.ListenDgram("udp", "127.0.0.1:0", baddr, qemunet.Config{MAC: macA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	exchange(t, a, b)
+}
+
+func TestDgramDrop(t *testing.T) {
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	b, err := qemunet.ListenDgram("udp", "127.0.0.1:0", peer.LocalAddr().String(), qemunet.Config{MAC: macB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// Datagrams one byte over the MTU must be dropped, not truncated and delivered.
+	peer.WriteTo(testFrame(macB, macA, 1, 1515), b.LocalAddr())
+	stranger.WriteTo(testFrame(macB, macA, 2, 60), b.LocalAddr())
+	frame := testFrame(macB, macA, 3, 1514)
+	peer.WriteTo(frame, b.LocalAddr())
+	if got := pollFrame(t, b); !bytes.Equal(got, frame) {
+		t.Fatalf("want last frame, got %d bytes id=%d", len(got), binary.BigEndian.Uint32(got[14:18]))
+	}
+	if b.Stats().RxDropped != 2 {
+		t.Errorf("want oversized and stranger frames dropped, got stats %+v", b.Stats())
+	}
+}
+
+func TestVDE(t *testing.T) {
+	dir := t.TempDir()
+	ctlListener, err := net.Listen("unix", filepath.Join(dir, "ctl"))
+	if err != nil {
+		t.Skip("unix sockets unavailable:", err)
+	}
+	defer ctlListener.Close()
+	dataPath := filepath.Join(dir, "data")
+	sw, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: dataPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw.Close()
+
+	// Minimal switch: accept one port and echo its frames with swapped addresses.
+	swErr := make(chan error, 1)
+	go func() {
+		ctl, err := ctlListener.Accept()
+		if err != nil {
+			swErr <- err
+			return
+		}
+		defer ctl.Close()
+		req := make([]byte, 4+4+4+110+128)
+		if _, err = io.ReadFull(ctl, req); err != nil {
+			swErr <- err
+			return
+		}
+		if binary.NativeEndian.Uint32(req) != 0xfeedface || binary.NativeEndian.Uint32(req[4:]) != 3 ||
+			binary.NativeEndian.Uint32(req[8:]) != 5<<8 {
+			swErr <- io.ErrUnexpectedEOF
+			return
+		}
+		clientPath := string(bytes.TrimRight(req[14:122], "\x00"))
+		reply := make([]byte, 110)
+		binary.NativeEndian.PutUint16(reply, 1)
+		copy(reply[2:], dataPath)
+		ctl.Write(reply)
+		buf := make([]byte, 1514)
+		n, _, err := sw.ReadFrom(buf)
+		if err != nil {
+			swErr <- err
+			return
+		}
+		var tmp [6]byte
+		copy(tmp[:], buf[:6])
+		copy(buf[:6], buf[6:12])
+		copy(buf[6:12], tmp[:])
+		_, err = sw.WriteTo(buf[:n], &net.UnixAddr{Name: clientPath, Net: "unixgram"})
+		swErr <- err
+		io.Copy(io.Discard, ctl) // Keep port open until client leaves.
+	}()
+
+	d, err := qemunet.DialVDE(dir, 5, qemunet.Config{MAC: macA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := testFrame(macB, macA, 1, 64)
+	if err = d.SendOffsetEthFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-swErr; err != nil {
+		t.Fatal(err)
+	}
+	got := pollFrame(t, d)
+	if !bytes.Equal(got[:6], macA[:]) || !bytes.Equal(got[14:], frame[14:]) {
+		t.Fatal("bad echoed frame")
+	}
+	local := d.LocalAddr().String()
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(local); !os.IsNotExist(err) {
+		t.Error("VDE data socket not removed on close")
+	}
+}
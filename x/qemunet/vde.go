@@ -0,0 +1,121 @@
+package qemunet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// VDE switch control protocol (libvdeplug request_v3).
+const (
+	vdeMagic       = 0xfeedface
+	vdeVersion     = 3
+	vdeReqNew      = 0
+	sizeSockaddrUn = 2 + 108 // Linux struct sockaddr_un: sun_family and sun_path.
+	sizeVDEDescr   = 128
+	afUnix         = 1
+)
+
+var vdeSeq atomic.Uint32
+
+// DialVDE connects to the VDE switch whose control directory is dir, i.e: the path passed to
+// "vde_switch -s". port selects the switch port, zero lets the switch choose.
+// The device binds a Unix datagram socket in the system's temporary directory that is removed on Close.
+//
+// The control protocol exchanges C structures in host byte order with the Linux sockaddr_un layout,
+// so DialVDE is only expected to interoperate with switches running on Linux.
+func DialVDE(dir string, port int, cfg Config) (_ *Dev, err error) {
+	if port < 0 || port > 0xffffff {
+		return nil, errors.New("qemunet: bad VDE port")
+	}
+	ctl, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: filepath.Join(dir, "ctl"), Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ctl.Close()
+		}
+	}()
+	local := filepath.Join(os.TempDir(), "lneto-vde-"+strconv.Itoa(os.Getpid())+"-"+strconv.Itoa(int(vdeSeq.Add(1)))+".sock")
+	os.Remove(local)
+	data, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.Remove(local) }
+	defer func() {
+		if err != nil {
+			data.Close()
+			cleanup()
+		}
+	}()
+	req, err := appendVDERequest(nil, port, local, "lneto")
+	if err != nil {
+		return nil, err
+	}
+	ctl.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ctl.Write(req); err != nil {
+		return nil, err
+	}
+	var reply [sizeSockaddrUn]byte
+	if _, err = io.ReadFull(ctl, reply[:]); err != nil {
+		return nil, fmt.Errorf("qemunet: VDE switch refused connection: %w", err)
+	}
+	ctl.SetDeadline(time.Time{})
+	remote, err := parseSockaddrUn(reply[:])
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDev(FramingDgram, cfg)
+	if err != nil {
+		return nil, err
+	}
+	d.dgram = data
+	d.raddr = &net.UnixAddr{Name: remote, Net: "unixgram"}
+	d.closers = []io.Closer{ctl}
+	d.cleanup = cleanup
+	go d.readLoop()
+	return d, nil
+}
+
+// appendVDERequest appends a REQ_NEW request for port announcing the datagram socket at path.
+func appendVDERequest(dst []byte, port int, path, descr string) ([]byte, error) {
+	if len(path) >= sizeSockaddrUn-2 {
+		return nil, errors.New("qemunet: socket path too long")
+	}
+	dst = binary.NativeEndian.AppendUint32(dst, vdeMagic)
+	dst = binary.NativeEndian.AppendUint32(dst, vdeVersion)
+	dst = binary.NativeEndian.AppendUint32(dst, uint32(vdeReqNew|port<<8))
+	sockaddr := len(dst)
+	dst = append(dst, make([]byte, sizeSockaddrUn+sizeVDEDescr)...)
+	binary.NativeEndian.PutUint16(dst[sockaddr:], afUnix)
+	copy(dst[sockaddr+2:sockaddr+sizeSockaddrUn-1], path)
+	copy(dst[sockaddr+sizeSockaddrUn:len(dst)-1], descr)
+	return dst, nil
+}
+
+// parseSockaddrUn returns the path of a struct sockaddr_un.
+func parseSockaddrUn(b []byte) (string, error) {
+	if len(b) < sizeSockaddrUn || binary.NativeEndian.Uint16(b) != afUnix {
+		return "", errors.New("qemunet: bad VDE switch reply")
+	}
+	path := b[2:sizeSockaddrUn]
+	for i, c := range path {
+		if c == 0 {
+			path = path[:i]
+			break
+		}
+	}
+	if len(path) == 0 {
+		return "", errors.New("qemunet: empty VDE data socket path")
+	}
+	return string(path), nil
+}
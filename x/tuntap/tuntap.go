@@ -0,0 +1,97 @@
+// Package tuntap opens Linux TAP and TUN devices through /dev/net/tun so that an lneto
+// stack can own a private interface on the host instead of sharing the host's address
+// and fighting the host's TCP stack over a raw socket.
+//
+//   - TAP devices carry Ethernet frames. [Dev] implements netdev.DevEthernet in TAP mode
+//     so it can be passed to netdev.Interface.Init or driven by hand with xnet.StackAsync.IngressEthernet/EgressEthernet.
+//   - TUN devices carry IP packets. Use [Dev.PollIP] to move packets between the device
+//     and an IP-only stack such as xnet.StackAsync through its IngressIP/EgressIP methods.
+//
+// The host side of the interface is configured with [Dev.SetUp], [Dev.SetMTU] and [Dev.SetAddr4]
+// or at open time through [Config]. Creating devices requires CAP_NET_ADMIN.
+//
+// A TAP device has two ends: the host kernel's interface with its own MAC address (see [Dev.HostHardwareAddr6])
+// and the lneto stack writing to /dev/net/tun, which uses the MAC in [Config]. They must differ.
+package tuntap
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// Mode selects whether the device carries Ethernet frames or IP packets.
+type Mode uint8
+
+const (
+	_ Mode = iota
+	// ModeTAP is an Ethernet device (IFF_TAP).
+	ModeTAP
+	// ModeTUN is an IP device (IFF_TUN).
+	ModeTUN
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeTAP:
+		return "TAP"
+	case ModeTUN:
+		return "TUN"
+	}
+	return "Mode(?)"
+}
+
+// Offload flags passed to the kernel with TUNSETOFFLOAD. See linux/if_tun.h.
+type Offload uint32
+
+const (
+	OffloadCSUM   Offload = 0x01 // TUN_F_CSUM: the stack may send packets with partial checksums.
+	OffloadTSO4   Offload = 0x02 // TUN_F_TSO4: the stack accepts TCP segmentation offload over IPv4.
+	OffloadTSO6   Offload = 0x04 // TUN_F_TSO6: the stack accepts TCP segmentation offload over IPv6.
+	OffloadTSOECN Offload = 0x08 // TUN_F_TSO_ECN: the stack accepts TSO with ECN.
+	OffloadUFO    Offload = 0x10 // TUN_F_UFO: the stack accepts UDP fragmentation offload.
+)
+
+// Config configures a device opened with [Open].
+type Config struct {
+	// Name of the interface, i.e: "tap0". It may contain a "%d" which the kernel
+	// replaces with the first free number. Defaults to "tap%d" or "tun%d" according to Mode.
+	Name string
+	// Mode selects a TAP or TUN device. Required.
+	Mode Mode
+	// MAC is the hardware address of the lneto end of a TAP device. Required in TAP mode.
+	MAC [6]byte
+	// MTU of the interface. Zero keeps the kernel's default of 1500.
+	MTU int
+	// PacketInfo keeps the 4 byte packet information header the kernel prepends to
+	// every frame by omitting IFF_NO_PI. [Dev] strips and adds the header transparently.
+	// Most users want the default of IFF_NO_PI.
+	PacketInfo bool
+	// Offload are the offloads enabled on the device. lneto does not parse virtio-net headers
+	// so the zero value, which disables all offloads and makes the kernel pass complete
+	// packets with valid checksums, is what almost every user wants.
+	Offload Offload
+	// HostPrefix, if valid, is an IPv4 address and prefix assigned to the host side of
+	// the interface. The interface is also brought up.
+	HostPrefix netip.Prefix
+}
+
+// IPStack is an IP-only networking stack driven by [Dev.PollIP], i.e: xnet.StackAsync.
+type IPStack interface {
+	// IngressIP processes an incoming IPv4 or IPv6 packet.
+	IngressIP(ipFrame []byte) error
+	// EgressIP writes an outgoing IP packet to dst and returns its length, or 0 if there is nothing to send.
+	EgressIP(dst []byte) (int, error)
+}
+
+var (
+	errWrongMode = errors.New("tuntap: operation not supported in device mode")
+	errBadName   = errors.New("tuntap: interface name too long")
+)
+
+const (
+	sizeHeaderEth = 14
+	sizePI        = 4
+	defaultMTU    = 1500
+	// maxEgressPerPoll bounds the packets written in one PollIP call so reads are not starved.
+	maxEgressPerPoll = 64
+)
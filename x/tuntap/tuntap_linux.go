@@ -0,0 +1,508 @@
+//go:build linux && !tinygo
+
+package tuntap
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/internal"
+)
+
+// Dev is an open TAP or TUN device. The interface is removed when the device is closed.
+type Dev struct {
+	f    *os.File
+	rc   syscall.RawConn
+	name string
+	mode Mode
+	pi   bool
+	mac  [6]byte
+	mtu  int
+
+	txmu  sync.Mutex
+	txbuf []byte // Used to prepend the packet information header on writes that have no room for it.
+	rxbuf []byte // Used to strip the packet information header on Read.
+
+	// hmu is held while the receive handler runs to honor the SetEthRecvHandler quiescence guarantee.
+	hmu     sync.Mutex
+	handler func(rxEthframe []byte)
+	reading bool // A goroutine is delivering frames to handler.
+}
+
+// Open creates the TAP or TUN interface described by cfg.
+func Open(cfg Config) (_ *Dev, err error) {
+	var flags uint16
+	switch cfg.Mode {
+	case ModeTAP:
+		if internal.IsZeroed(cfg.MAC) {
+			return nil, lneto.ErrInvalidAddr
+		}
+		flags = syscall.IFF_TAP
+	case ModeTUN:
+		flags = syscall.IFF_TUN
+	default:
+		return nil, lneto.ErrInvalidConfig
+	}
+	if cfg.MTU < 0 {
+		return nil, lneto.ErrInvalidConfig
+	}
+	if !cfg.PacketInfo {
+		flags |= syscall.IFF_NO_PI
+	}
+	name := cfg.Name
+	if name == "" {
+		name = "tap%d"
+		if cfg.Mode == ModeTUN {
+			name = "tun%d"
+		}
+	}
+	ifr, err := makeifreq(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("tuntap: open /dev/net/tun: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}()
+	ifr.setUint16(flags)
+	if err = ioctl(fd, syscall.TUNSETIFF, ifr.ptr()); err != nil {
+		return nil, fmt.Errorf("tuntap: create %s interface: %w", cfg.Mode, err)
+	}
+	if err = ioctlValue(fd, syscall.TUNSETOFFLOAD, uintptr(cfg.Offload)); err != nil {
+		return nil, fmt.Errorf("tuntap: set offloads: %w", err)
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	d := &Dev{
+		name: ifr.name(),
+		mode: cfg.Mode,
+		pi:   cfg.PacketInfo,
+		mac:  cfg.MAC,
+	}
+	d.f = os.NewFile(uintptr(fd), "/dev/net/tun")
+	if d.rc, err = d.f.SyscallConn(); err != nil {
+		d.f.Close()
+		return nil, err
+	}
+	fd = -1 // Owned by d.f from here on.
+	defer func() {
+		if err != nil {
+			d.f.Close()
+		}
+	}()
+	if cfg.MTU > 0 {
+		err = d.SetMTU(cfg.MTU)
+	} else {
+		d.mtu, err = d.MTU()
+	}
+	if err == nil && cfg.HostPrefix.IsValid() {
+		err = d.SetAddr4(cfg.HostPrefix)
+		if err == nil {
+			err = d.SetUp(true)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Name returns the name of the interface as assigned by the kernel.
+func (d *Dev) Name() string { return d.name }
+
+// Mode returns whether the device is a TAP or TUN device.
+func (d *Dev) Mode() Mode { return d.mode }
+
+// Close closes the device which removes the interface and stops frame delivery to the receive handler.
+func (d *Dev) Close() error { return d.f.Close() }
+
+// SetOffload sets the offloads enabled on the device. See [Config.Offload].
+func (d *Dev) SetOffload(offload Offload) error {
+	var err error
+	cerr := d.rc.Control(func(fd uintptr) {
+		err = ioctlValue(int(fd), syscall.TUNSETOFFLOAD, uintptr(offload))
+	})
+	return cmp.Or(cerr, err)
+}
+
+// SetUp brings the interface up or down.
+func (d *Dev) SetUp(up bool) error {
+	return d.hostIoctl(func(sock int) error {
+		ifr, _ := makeifreq(d.name)
+		if err := ioctl(sock, syscall.SIOCGIFFLAGS, ifr.ptr()); err != nil {
+			return err
+		}
+		flags := ifr.uint16()
+		if up {
+			flags |= syscall.IFF_UP
+		} else {
+			flags &^= syscall.IFF_UP
+		}
+		ifr.setUint16(flags)
+		return ioctl(sock, syscall.SIOCSIFFLAGS, ifr.ptr())
+	})
+}
+
+// MTU returns the MTU of the interface.
+func (d *Dev) MTU() (mtu int, err error) {
+	err = d.hostIoctl(func(sock int) error {
+		ifr, _ := makeifreq(d.name)
+		err := ioctl(sock, syscall.SIOCGIFMTU, ifr.ptr())
+		mtu = int(int32(binary.NativeEndian.Uint32(ifr.data[:])))
+		return err
+	})
+	return mtu, err
+}
+
+// SetMTU sets the MTU of the interface.
+func (d *Dev) SetMTU(mtu int) error {
+	if mtu < 68 || mtu > 65535 {
+		return lneto.ErrInvalidConfig
+	}
+	err := d.hostIoctl(func(sock int) error {
+		ifr, _ := makeifreq(d.name)
+		binary.NativeEndian.PutUint32(ifr.data[:], uint32(mtu))
+		return ioctl(sock, syscall.SIOCSIFMTU, ifr.ptr())
+	})
+	if err == nil {
+		d.txmu.Lock()
+		d.mtu = mtu
+		d.txmu.Unlock()
+	}
+	return err
+}
+
+// SetAddr4 sets the IPv4 address and netmask of the host side of the interface,
+// replacing the primary address if one is set.
+func (d *Dev) SetAddr4(prefix netip.Prefix) error {
+	if !prefix.Addr().Is4() {
+		return lneto.ErrInvalidAddr
+	}
+	mask := ^uint32(0) << (32 - prefix.Bits())
+	if prefix.Bits() == 0 {
+		mask = 0
+	}
+	return d.hostIoctl(func(sock int) error {
+		ifr, _ := makeifreq(d.name)
+		ifr.setSockaddr4(prefix.Addr().As4())
+		if err := ioctl(sock, syscall.SIOCSIFADDR, ifr.ptr()); err != nil {
+			return err
+		}
+		var maskAddr [4]byte
+		binary.BigEndian.PutUint32(maskAddr[:], mask)
+		ifr.setSockaddr4(maskAddr)
+		return ioctl(sock, syscall.SIOCSIFNETMASK, ifr.ptr())
+	})
+}
+
+// HostHardwareAddr6 returns the MAC address of the host side of a TAP interface.
+func (d *Dev) HostHardwareAddr6() (hw [6]byte, err error) {
+	if d.mode != ModeTAP {
+		return hw, errWrongMode
+	}
+	err = d.hostIoctl(func(sock int) error {
+		ifr, _ := makeifreq(d.name)
+		err := ioctl(sock, syscall.SIOCGIFHWADDR, ifr.ptr())
+		copy(hw[:], ifr.data[2:]) // Skip sa_family.
+		return err
+	})
+	return hw, err
+}
+
+// hostIoctl runs fn with a socket for configuring the interface in the host's network stack.
+func (d *Dev) hostIoctl(fn func(sock int) error) error {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+	if err = fn(sock); err != nil {
+		return fmt.Errorf("tuntap: configure %s: %w", d.name, err)
+	}
+	return nil
+}
+
+// HardwareAddr6 returns the MAC address of the lneto end of a TAP device.
+func (d *Dev) HardwareAddr6() ([6]byte, error) {
+	if d.mode != ModeTAP {
+		return [6]byte{}, errWrongMode
+	}
+	return d.mac, nil
+}
+
+// SendOffsetEthFrame writes an Ethernet frame to a TAP device. With [Config.PacketInfo]
+// the frame starts after the 4 byte offset returned by [Dev.MaxFrameSizeAndOffset] and the header is written there.
+func (d *Dev) SendOffsetEthFrame(offsetTxEthFrame []byte) error {
+	if d.mode != ModeTAP {
+		return errWrongMode
+	}
+	off := d.piSize()
+	if len(offsetTxEthFrame) < off+sizeHeaderEth {
+		return lneto.ErrTruncatedFrame
+	}
+	if d.pi {
+		proto := binary.BigEndian.Uint16(offsetTxEthFrame[off+12:])
+		putPI(offsetTxEthFrame, ethernet.Type(proto))
+	}
+	_, err := d.f.Write(offsetTxEthFrame)
+	return err
+}
+
+// SetEthRecvHandler sets the function received frames on a TAP device are passed to.
+// A goroutine delivers frames while a handler is set.
+func (d *Dev) SetEthRecvHandler(handler func(rxEthframe []byte)) {
+	d.hmu.Lock()
+	defer d.hmu.Unlock()
+	d.handler = handler
+	if handler != nil && !d.reading && d.mode == ModeTAP {
+		d.reading = true
+		go d.readLoop()
+	}
+}
+
+// EthPoll reads a pending frame from a TAP device into buf without blocking when no receive handler is set.
+func (d *Dev) EthPoll(buf []byte) (ethFrameOff, ethernetBytes int, err error) {
+	if d.mode != ModeTAP {
+		return 0, 0, errWrongMode
+	}
+	d.hmu.Lock()
+	handlerSet := d.handler != nil
+	d.hmu.Unlock()
+	if handlerSet {
+		return 0, 0, nil
+	}
+	n, err := d.readNonblock(buf)
+	off := d.piSize()
+	if err != nil || n <= off {
+		return 0, 0, err
+	}
+	return off, n - off, nil
+}
+
+// MaxFrameSizeAndOffset returns the largest frame read from or written to a TAP device
+// and the offset of the Ethernet frame, which is nonzero with [Config.PacketInfo].
+func (d *Dev) MaxFrameSizeAndOffset() (maxFrameSize int, sendEthFrameOff int) {
+	d.txmu.Lock()
+	defer d.txmu.Unlock()
+	off := d.piSize()
+	return off + sizeHeaderEth + d.mtu, off
+}
+
+// Read reads a packet from a TUN device or a frame from a TAP device, blocking until one arrives.
+// The packet information header is stripped. Read should not be called concurrently.
+func (d *Dev) Read(b []byte) (int, error) {
+	if !d.pi {
+		return d.f.Read(b)
+	}
+	d.txmu.Lock()
+	size := sizePI + sizeHeaderEth + d.mtu
+	d.txmu.Unlock()
+	internal.SliceReuse(&d.rxbuf, size)
+	n, err := d.f.Read(d.rxbuf[:size])
+	if err != nil {
+		return 0, err
+	} else if n < sizePI {
+		return 0, lneto.ErrTruncatedFrame
+	}
+	return copy(b, d.rxbuf[sizePI:n]), nil
+}
+
+// Write writes a packet to a TUN device or a frame to a TAP device, adding the packet information header if enabled.
+func (d *Dev) Write(b []byte) (int, error) {
+	if !d.pi {
+		return d.f.Write(b)
+	} else if len(b) == 0 {
+		return 0, lneto.ErrTruncatedFrame
+	}
+	d.txmu.Lock()
+	defer d.txmu.Unlock()
+	internal.SliceReuse(&d.txbuf, sizePI+len(b))
+	d.txbuf = d.txbuf[:sizePI+len(b)]
+	copy(d.txbuf[sizePI:], b)
+	proto := ethernet.TypeIPv4
+	if d.mode == ModeTAP && len(b) >= sizeHeaderEth {
+		proto = ethernet.Type(binary.BigEndian.Uint16(b[12:]))
+	} else if b[0]>>4 == 6 {
+		proto = ethernet.TypeIPv6
+	}
+	putPI(d.txbuf, proto)
+	n, err := d.f.Write(d.txbuf)
+	return max(n-sizePI, 0), err
+}
+
+// PollIP moves packets between a TUN device and stack. It writes the packets the stack
+// has pending to the device, then waits up to timeout for an incoming packet and passes it to the stack.
+// A zero timeout does not wait. buf must fit the interface's MTU.
+// It returns the number of packets moved. Packets dropped by the stack are not reported as errors.
+func (d *Dev) PollIP(stack IPStack, buf []byte, timeout time.Duration) (packets int, err error) {
+	if d.mode != ModeTUN {
+		return 0, errWrongMode
+	}
+	for packets < maxEgressPerPoll {
+		n, err := stack.EgressIP(buf)
+		if err != nil {
+			return packets, err
+		} else if n == 0 {
+			break
+		}
+		if _, err = d.Write(buf[:n]); err != nil {
+			return packets, err
+		}
+		packets++
+	}
+	var n int
+	if timeout <= 0 {
+		n, err = d.readNonblock(buf)
+		if d.pi && n > 0 {
+			n = copy(buf, buf[sizePI:n])
+		}
+	} else {
+		d.f.SetReadDeadline(time.Now().Add(timeout))
+		n, err = d.Read(buf)
+		d.f.SetReadDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return packets, nil
+		}
+	}
+	if err != nil || n == 0 {
+		return packets, err
+	}
+	packets++
+	err = stack.IngressIP(buf[:n])
+	if errors.Is(err, lneto.ErrPacketDrop) {
+		err = nil
+	}
+	return packets, err
+}
+
+// readNonblock reads a single frame into buf including the packet information header.
+// It returns 0 and no error if there is no frame to read.
+func (d *Dev) readNonblock(buf []byte) (n int, err error) {
+	cerr := d.rc.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), buf)
+		return true
+	})
+	if err == syscall.EAGAIN {
+		return 0, nil
+	} else if n < 0 {
+		n = 0
+	}
+	return n, cmp.Or(cerr, err)
+}
+
+func (d *Dev) readLoop() {
+	size, off := d.MaxFrameSizeAndOffset()
+	buf := make([]byte, size)
+	for {
+		stop := false
+		var rerr error
+		err := d.rc.Read(func(fd uintptr) bool {
+			d.hmu.Lock()
+			defer d.hmu.Unlock()
+			if d.handler == nil {
+				// Leave pending frames to EthPoll.
+				d.reading = false
+				stop = true
+				return true
+			}
+			n, err := syscall.Read(int(fd), buf)
+			if err == syscall.EAGAIN {
+				return false // Wait for the device to become readable.
+			} else if err != nil {
+				rerr = err
+			} else if n > off {
+				d.handler(buf[off:n])
+			}
+			return true
+		})
+		if stop {
+			return
+		} else if err != nil || rerr != nil {
+			d.hmu.Lock()
+			d.reading = false
+			d.hmu.Unlock()
+			return
+		}
+	}
+}
+
+func (d *Dev) piSize() int {
+	if d.pi {
+		return sizePI
+	}
+	return 0
+}
+
+// putPI writes the packet information header: zero flags followed by the protocol.
+func putPI(b []byte, proto ethernet.Type) {
+	binary.BigEndian.PutUint16(b[0:2], 0)
+	binary.BigEndian.PutUint16(b[2:4], uint16(proto))
+}
+
+func ioctl(fd int, request uintptr, argp unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(argp))
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+func ioctlValue(fd int, request, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, arg)
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// ifreq is the Linux struct ifreq: an interface name followed by a union.
+type ifreq struct {
+	ifname [syscall.IFNAMSIZ]byte
+	data   [24]byte
+}
+
+func makeifreq(name string) (ifr ifreq, err error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return ifr, errBadName
+	}
+	copy(ifr.ifname[:], name)
+	return ifr, nil
+}
+
+func (ifr *ifreq) name() string {
+	for i, c := range ifr.ifname {
+		if c == 0 {
+			return string(ifr.ifname[:i])
+		}
+	}
+	return string(ifr.ifname[:])
+}
+
+func (ifr *ifreq) ptr() unsafe.Pointer { return unsafe.Pointer(ifr) }
+
+func (ifr *ifreq) uint16() uint16 { return binary.NativeEndian.Uint16(ifr.data[:]) }
+
+func (ifr *ifreq) setUint16(v uint16) { binary.NativeEndian.PutUint16(ifr.data[:], v) }
+
+// setSockaddr4 sets the union to a struct sockaddr_in with addr.
+func (ifr *ifreq) setSockaddr4(addr [4]byte) {
+	ifr.data = [24]byte{}
+	binary.NativeEndian.PutUint16(ifr.data[:], syscall.AF_INET)
+	copy(ifr.data[4:8], addr[:])
+}
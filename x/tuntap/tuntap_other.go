@@ -0,0 +1,35 @@
+//go:build tinygo || !linux
+
+package tuntap
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// Dev is an open TAP or TUN device. Unsupported on this platform.
+type Dev struct{}
+
+// Open creates the TAP or TUN interface described by cfg. Unsupported on this platform.
+func Open(cfg Config) (*Dev, error) { return nil, errors.ErrUnsupported }
+
+func (d *Dev) Name() string                           { return "" }
+func (d *Dev) Mode() Mode                             { return 0 }
+func (d *Dev) Close() error                           { return errors.ErrUnsupported }
+func (d *Dev) SetOffload(offload Offload) error       { return errors.ErrUnsupported }
+func (d *Dev) SetUp(up bool) error                    { return errors.ErrUnsupported }
+func (d *Dev) MTU() (int, error)                      { return 0, errors.ErrUnsupported }
+func (d *Dev) SetMTU(mtu int) error                   { return errors.ErrUnsupported }
+func (d *Dev) SetAddr4(prefix netip.Prefix) error     { return errors.ErrUnsupported }
+func (d *Dev) HostHardwareAddr6() ([6]byte, error)    { return [6]byte{}, errors.ErrUnsupported }
+func (d *Dev) HardwareAddr6() ([6]byte, error)        { return [6]byte{}, errors.ErrUnsupported }
+func (d *Dev) SendOffsetEthFrame(frame []byte) error  { return errors.ErrUnsupported }
+func (d *Dev) SetEthRecvHandler(handler func([]byte)) {}
+func (d *Dev) EthPoll(buf []byte) (int, int, error)   { return 0, 0, errors.ErrUnsupported }
+func (d *Dev) MaxFrameSizeAndOffset() (int, int)      { return 0, 0 }
+func (d *Dev) Read(b []byte) (int, error)             { return 0, errors.ErrUnsupported }
+func (d *Dev) Write(b []byte) (int, error)            { return 0, errors.ErrUnsupported }
+func (d *Dev) PollIP(stack IPStack, buf []byte, timeout time.Duration) (int, error) {
+	return 0, errors.ErrUnsupported
+}
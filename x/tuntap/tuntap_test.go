@@ -0,0 +1,229 @@
+//go:build linux && !tinygo
+
+package tuntap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/arp"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+)
+
+func openOrSkip(t *testing.T, cfg Config) *Dev {
+	t.Helper()
+	d, err := Open(cfg)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, os.ErrNotExist) {
+		t.Skip("requires CAP_NET_ADMIN and /dev/net/tun:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// testStack is an IP-only stack that sends queued packets and records received UDP payloads to port 9.
+type testStack struct {
+	tx       [][]byte
+	received []byte
+}
+
+func (s *testStack) IngressIP(ipFrame []byte) error {
+	ifrm, err := ipv4.NewFrame(ipFrame)
+	if err != nil || ifrm.Protocol() != lneto.IPProtoUDP {
+		return lneto.ErrPacketDrop
+	}
+	ufrm, _ := udp.NewFrame(ifrm.Payload())
+	if ufrm.DestinationPort() != 9 {
+		return lneto.ErrPacketDrop
+	}
+	s.received = append([]byte{}, ufrm.Payload()...)
+	return nil
+}
+
+func (s *testStack) EgressIP(dst []byte) (int, error) {
+	if len(s.tx) == 0 {
+		return 0, nil
+	}
+	n := copy(dst, s.tx[0])
+	s.tx = s.tx[1:]
+	return n, nil
+}
+
+// udpPacket returns an IPv4 datagram without UDP checksum.
+func udpPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	ifrm, _ := ipv4.NewFrame(pkt)
+	ifrm.SetVersionAndIHL(4, 5)
+	ifrm.SetTotalLength(uint16(len(pkt)))
+	ifrm.SetTTL(64)
+	ifrm.SetProtocol(lneto.IPProtoUDP)
+	*ifrm.SourceAddr() = src.Addr().As4()
+	*ifrm.DestinationAddr() = dst.Addr().As4()
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	ufrm, _ := udp.NewFrame(pkt[20:])
+	ufrm.SetSourcePort(src.Port())
+	ufrm.SetDestinationPort(dst.Port())
+	ufrm.SetLength(uint16(8 + len(payload)))
+	copy(pkt[28:], payload)
+	return pkt
+}
+
+func TestTUN(t *testing.T) {
+	for _, pi := range []bool{false, true} {
+		d := openOrSkip(t, Config{Mode: ModeTUN, MTU: 1400, PacketInfo: pi, HostPrefix: netip.MustParsePrefix("10.199.1.1/24")})
+		if mtu, err := d.MTU(); err != nil || mtu != 1400 {
+			t.Fatalf("want MTU 1400, got %d (%v)", mtu, err)
+		} else if !strings.HasPrefix(d.Name(), "tun") {
+			t.Fatalf("unexpected interface name %q", d.Name())
+		}
+		host, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(10, 199, 1, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostAddr := host.LocalAddr().(*net.UDPAddr).AddrPort()
+		stackAddr := netip.MustParseAddrPort("10.199.1.2:9")
+
+		// Stack to host.
+		var stack testStack
+		stack.tx = append(stack.tx, udpPacket(stackAddr, hostAddr, []byte("from lneto")))
+		buf := make([]byte, 1500)
+		if _, err = d.PollIP(&stack, buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		host.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := host.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "from lneto" || from != stackAddr {
+			t.Fatalf("host received %q from %s", buf[:n], from)
+		}
+
+		// Host to stack.
+		if _, err = host.WriteToUDPAddrPort([]byte("from host"), stackAddr); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for stack.received == nil && time.Now().Before(deadline) {
+			if _, err = d.PollIP(&stack, buf, 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(stack.received) != "from host" {
+			t.Fatalf("stack received %q", stack.received)
+		}
+		host.Close()
+		d.Close()
+	}
+}
+
+func TestTAP(t *testing.T) {
+	mac := [6]byte{0x02, 0, 0, 0, 0xaa, 1}
+	d := openOrSkip(t, Config{Mode: ModeTAP, MAC: mac, PacketInfo: true, HostPrefix: netip.MustParsePrefix("10.199.2.1/24")})
+	if err := d.SetOffload(0); err != nil {
+		t.Fatal(err)
+	}
+	hostMAC, err := d.HostHardwareAddr6()
+	if err != nil {
+		t.Fatal(err)
+	} else if hostMAC == mac {
+		t.Fatal("host and device MAC must differ")
+	}
+	size, off := d.MaxFrameSizeAndOffset()
+	if off != sizePI {
+		t.Fatalf("want offset %d with packet information, got %d", sizePI, off)
+	}
+	stackIP := [4]byte{10, 199, 2, 2}
+	host, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: stackIP[:], Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	if _, err = host.Write([]byte("from host")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The host resolves the stack's address first: poll for its ARP request.
+	buf := make([]byte, size)
+	var request []byte
+	deadline := time.Now().Add(2 * time.Second)
+	for request == nil && time.Now().Before(deadline) {
+		foff, n, err := d.EthPoll(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		efrm, err := ethernet.NewFrame(buf[foff : foff+n])
+		if n == 0 || err != nil || efrm.EtherTypeOrSize() != ethernet.TypeARP {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		afrm, _ := arp.NewFrame(efrm.Payload())
+		if _, target := afrm.Target4(); afrm.Operation() == arp.OpRequest && *target == stackIP {
+			request = append([]byte{}, buf[foff:foff+n]...)
+		}
+	}
+	if request == nil {
+		t.Fatal("no ARP request received")
+	}
+
+	received := make(chan []byte, 8)
+	d.SetEthRecvHandler(func(rxEthframe []byte) { received <- append([]byte{}, rxEthframe...) })
+	defer d.SetEthRecvHandler(nil)
+
+	// Reply so the host sends the pending datagram to the stack's MAC.
+	reply := make([]byte, off+len(request))
+	copy(reply[off:], request)
+	efrm, _ := ethernet.NewFrame(reply[off:])
+	*efrm.DestinationHardwareAddr() = hostMAC
+	*efrm.SourceHardwareAddr() = mac
+	afrm, _ := arp.NewFrame(efrm.Payload())
+	afrm.SwapTargetSender()
+	afrm.SetOperation(arp.OpReply)
+	senderHW, senderIP := afrm.Sender4()
+	*senderHW, *senderIP = mac, stackIP
+	if err = d.SendOffsetEthFrame(reply); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame := <-received:
+			efrm, _ := ethernet.NewFrame(frame)
+			if efrm.EtherTypeOrSize() != ethernet.TypeIPv4 || *efrm.DestinationHardwareAddr() != mac {
+				continue
+			}
+			if !bytes.HasSuffix(frame, []byte("from host")) {
+				t.Fatalf("bad frame %x", frame)
+			}
+			if ifrm, _ := ipv4.NewFrame(efrm.Payload()); binary.BigEndian.Uint16(ifrm.Payload()[2:4]) != 9 {
+				t.Fatal("bad destination port")
+			}
+			return
+		case <-timeout:
+			t.Fatal("no datagram received after ARP reply")
+		}
+	}
+}
+
+func TestOpen_BadConfig(t *testing.T) {
+	if _, err := Open(Config{Mode: ModeTAP}); err != lneto.ErrInvalidAddr {
+		t.Errorf("want ErrInvalidAddr for TAP without MAC, got %v", err)
+	}
+	if _, err := Open(Config{}); err != lneto.ErrInvalidConfig {
+		t.Errorf("want ErrInvalidConfig without mode, got %v", err)
+	}
+	if _, err := Open(Config{Mode: ModeTUN, Name: "a-very-long-interface-name"}); err != errBadName {
+		t.Errorf("want errBadName, got %v", err)
+	}
+}
@@ -0,0 +1,611 @@
+package xnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/dns"
+	"github.com/soypat/lneto/internal"
+	"github.com/soypat/lneto/internet"
+	"github.com/soypat/lneto/tcp"
+)
+
+const (
+	defaultDNSQueries      = 2 // A and AAAA lookups in parallel.
+	defaultDNSRetries      = 2
+	defaultDNSRetryTimeout = 500 * time.Millisecond
+	maxDNSServers          = 4
+	dnsTCPTxBuf            = 512 // Queries are small, responses are what need buffering.
+	dnsTCPQueueSize        = 4
+)
+
+var (
+	errDNSTimeout   = errors.New("DNS query timed out on all attempts")
+	errDNSNoLookup  = errors.New("no DNS lookup started for host")
+	errDNSExhausted = errors.New("all DNS queries in flight")
+	errDNSNoTCP     = errors.New("DNS over TCP disabled; set StackConfig.DNSTCPBufferSize")
+	errDNSNoRoute   = errors.New("no DNS server reachable: stack has no address of the servers' IP version")
+)
+
+// resolver runs DNS lookups over a fixed pool of queries so that several lookups,
+// i.e: A and AAAA for the same host, can be in flight at the same time.
+// Unanswered queries are retransmitted with exponential backoff with a new
+// transaction ID and source port to the healthiest of the configured servers.
+type resolver struct {
+	queries []dnsQuery
+	servers []dnsServer
+	retries uint8
+	// rto is the time waited for a response to the first attempt of a query in nanoseconds. Doubles on every retransmission.
+	rto int64
+	// seq is incremented on every started lookup to find the most recent lookup of a host.
+	seq uint32
+
+	// A single TCP connection is shared by queries whose UDP response was truncated
+	// or that were started over TCP. tcpOwner is the query using it.
+	tcpConn   tcp.Conn
+	tcpClient dns.TCPClient
+	tcpOwner  *dnsQuery
+	tcpBuf    []byte
+
+	// optData holds the EDNS0 options of the query being sent.
+	optData [4 + dns.SizeClientCookie + dns.MaxSizeServerCookie]byte
+}
+
+type dnsQueryState uint8
+
+const (
+	dnsQueryFree    dnsQueryState = iota
+	dnsQueryPending               // Awaiting response from server.
+	dnsQueryDone                  // Response received or all attempts timed out.
+	dnsQueryCached                // Result is in the stack's DNS cache.
+)
+
+type dnsQuery struct {
+	udp      internet.StackUDPPort
+	client   dns.Client
+	name     dns.Name
+	qtype    dns.Type
+	state    dnsQueryState
+	timedOut bool
+	// tcp is set when the query is carried over the resolver's TCP connection.
+	tcp bool
+	// read is set once the result of a finished query has been read.
+	read bool
+	// cached is set once the response is inserted in the DNS cache.
+	cached bool
+	// server is the address of the server the current attempt was sent to. It is kept
+	// by address as the server list may change while the query is in flight.
+	server  netip.Addr
+	attempt uint8
+	seq     uint32
+	// deadline is the time at which the current attempt is considered failed.
+	deadline int64
+}
+
+type dnsServer struct {
+	addr netip.Addr
+	// fails counts consecutive failed attempts. Servers with fewer fails are preferred.
+	fails uint8
+	// cookie is the client cookie sent to the server, generated on first use (RFC 7873 §4.1).
+	// Responses that echo a different client cookie are discarded as spoofed.
+	cookie [dns.SizeClientCookie]byte
+	// srvCookie is the server cookie last received from the server.
+	srvCookie    [dns.MaxSizeServerCookie]byte
+	srvCookieLen uint8
+}
+
+func (r *resolver) reset(maxQueries, retries uint8, rto time.Duration) {
+	for i := range r.queries {
+		r.release(&r.queries[i])
+	}
+	if cap(r.queries) < int(maxQueries) {
+		r.queries = make([]dnsQuery, maxQueries)
+	}
+	r.queries = r.queries[:maxQueries]
+	for i := range r.queries {
+		r.queries[i].state = dnsQueryFree
+	}
+	if r.servers == nil {
+		r.servers = make([]dnsServer, 0, maxDNSServers)
+	}
+	r.retries = retries
+	r.rto = int64(rto)
+}
+
+// resetTCP configures the TCP connection used for DNS over TCP. A bufSize of zero disables DNS over TCP.
+func (r *resolver) resetTCP(bufSize uint16) error {
+	r.tcpConn.Abort()
+	r.tcpClient.Abort()
+	r.tcpOwner = nil
+	if bufSize == 0 {
+		r.tcpBuf = r.tcpBuf[:0]
+		return nil
+	} else if bufSize < 512 {
+		return lneto.ErrInvalidConfig
+	}
+	size := int(bufSize)
+	internal.SliceReuse(&r.tcpBuf, 2*size+dnsTCPTxBuf)
+	r.tcpBuf = r.tcpBuf[:cap(r.tcpBuf)]
+	err := r.tcpClient.Configure(dns.TCPClientConfig{Buffer: r.tcpBuf[:size]})
+	if err != nil {
+		return err
+	}
+	return r.tcpConn.Configure(tcp.ConnConfig{
+		RxBuf:             r.tcpBuf[size : 2*size],
+		TxBuf:             r.tcpBuf[2*size:],
+		TxPacketQueueSize: dnsTCPQueueSize,
+		RWBackoff:         dnsTCPBackoff,
+	})
+}
+
+// dnsTCPBackoff is never called in practice: the resolver only reads buffered data and writes when there is room.
+func dnsTCPBackoff(uint) time.Duration { return lneto.BackoffFlagGosched }
+
+func (r *resolver) tcpEnabled() bool { return len(r.tcpBuf) > 0 }
+
+// tcpAvailable reports whether q may take over the TCP connection. The connection is
+// held by a finished query until its result is read so the response is not lost.
+func (r *resolver) tcpAvailable(q *dnsQuery) bool {
+	owner := r.tcpOwner
+	return owner == nil || owner == q || (owner.state != dnsQueryPending && owner.read)
+}
+
+// takeTCP hands the TCP connection to q. The previous owner can still serve its result from the cache.
+func (r *resolver) takeTCP(q *dnsQuery) {
+	if prev := r.tcpOwner; prev != nil && prev != q {
+		if prev.cached {
+			prev.state = dnsQueryCached
+		} else {
+			prev.state = dnsQueryFree
+		}
+	}
+	r.tcpConn.Abort()
+	r.tcpOwner = q
+}
+
+// release frees the network resources held by q.
+func (r *resolver) release(q *dnsQuery) {
+	q.client.Abort()
+	if r.tcpOwner == q {
+		r.tcpConn.Abort()
+		r.tcpClient.Abort()
+		r.tcpOwner = nil
+	}
+}
+
+// setServers replaces the DNS server list. Addresses beyond the first [maxDNSServers] distinct ones are ignored.
+// Servers kept in the list keep their health and cookies.
+func (r *resolver) setServers(servers []netip.Addr) error {
+	for _, addr := range servers {
+		if !addr.IsValid() {
+			return lneto.ErrInvalidAddr
+		}
+	}
+	var old [maxDNSServers]dnsServer
+	nold := copy(old[:], r.servers)
+	r.servers = r.servers[:0]
+	for _, addr := range servers {
+		if len(r.servers) == cap(r.servers) {
+			break
+		} else if r.serverIndex(addr) >= 0 {
+			continue
+		}
+		sv := dnsServer{addr: addr}
+		for i := range old[:nold] {
+			if old[i].addr == addr {
+				sv = old[i]
+			}
+		}
+		r.servers = append(r.servers, sv)
+	}
+	return nil
+}
+
+func (r *resolver) serverIndex(addr netip.Addr) int {
+	for i := range r.servers {
+		if r.servers[i].addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// pickServer returns the index of the usable server with fewest consecutive failures or -1 if there are none.
+// Servers are usable if the stack can reach their IP version, given by has4 and has6.
+// The search begins at index start so that servers of equal health are used in rotation.
+func (r *resolver) pickServer(start int, has4, has6 bool) int {
+	best := -1
+	for i := range r.servers {
+		idx := (start + i) % len(r.servers)
+		sv := &r.servers[idx]
+		if (sv.addr.Is4() && !has4) || (sv.addr.Is6() && !has6) {
+			continue
+		}
+		if best < 0 || sv.fails < r.servers[best].fails {
+			best = idx
+		}
+	}
+	return best
+}
+
+func (r *resolver) serverFailed(addr netip.Addr) {
+	if idx := r.serverIndex(addr); idx >= 0 && r.servers[idx].fails < 255 {
+		r.servers[idx].fails++
+	}
+}
+
+func (r *resolver) serverOK(addr netip.Addr) {
+	if idx := r.serverIndex(addr); idx >= 0 {
+		r.servers[idx].fails = 0
+	}
+}
+
+// acquire returns the query to use for a lookup of name and qtype. A pending query for the
+// same name and type is returned as is. Otherwise a free query or the oldest finished query is returned.
+func (r *resolver) acquire(name dns.Name, qtype dns.Type) (q *dnsQuery, pending bool) {
+	for i := range r.queries {
+		c := &r.queries[i]
+		if c.state == dnsQueryPending && c.qtype == qtype && dns.NamesEqualFold(c.name, name) {
+			return c, true
+		}
+	}
+	for i := range r.queries {
+		c := &r.queries[i]
+		if c.state == dnsQueryFree {
+			return c, false
+		} else if c.state != dnsQueryPending && (q == nil || c.seq < q.seq) {
+			q = c
+		}
+	}
+	return q, false
+}
+
+// find returns the most recently started query for host. If anyType is set qtype is ignored.
+func (r *resolver) find(host string, qtype dns.Type, anyType bool) *dnsQuery {
+	var found *dnsQuery
+	for i := range r.queries {
+		q := &r.queries[i]
+		if q.state == dnsQueryFree || (!anyType && q.qtype != qtype) || !q.name.EqualString(host) {
+			continue
+		}
+		if found == nil || q.seq > found.seq {
+			found = q
+		}
+	}
+	return found
+}
+
+// findName returns the most recently started query for name and qtype.
+func (r *resolver) findName(name dns.Name, qtype dns.Type) *dnsQuery {
+	var found *dnsQuery
+	for i := range r.queries {
+		q := &r.queries[i]
+		if q.state == dnsQueryFree || q.qtype != qtype || !dns.NamesEqualFold(q.name, name) {
+			continue
+		}
+		if found == nil || q.seq > found.seq {
+			found = q
+		}
+	}
+	return found
+}
+
+// pickDNSServer returns the index of the healthiest DNS server reachable over an IP version
+// for which the stack has an address, or -1 if there is none. See [resolver.pickServer].
+func (s *StackAsync) pickDNSServer(start int) int {
+	has4 := s.ip4.Addr4() != [4]byte{}
+	has6 := s.ipv6enabled && s.stack6.Addr6() != [16]byte{}
+	return s.dnsr.pickServer(start, has4, has6)
+}
+
+// startQuery sends the first attempt of a query to the healthiest DNS server.
+func (s *StackAsync) startQuery(q *dnsQuery, now int64) error {
+	sv := s.pickDNSServer(0)
+	if sv < 0 {
+		return s.errNoDNSTransport()
+	}
+	q.attempt = 0
+	q.timedOut = false
+	q.cached = false
+	q.read = false
+	return s.sendQuery(q, sv, now)
+}
+
+func (s *StackAsync) errNoDNSTransport() error {
+	if len(s.dnsr.servers) == 0 {
+		return errNoDNSServer
+	}
+	return errDNSNoRoute
+}
+
+// resolveConfig returns the configuration of a query for q to server sv, carrying
+// a DNS Cookie (RFC 7873) in its EDNS0 options.
+func (s *StackAsync) resolveConfig(q *dnsQuery, sv int) dns.ResolveConfig {
+	server := &s.dnsr.servers[sv]
+	if server.cookie == [dns.SizeClientCookie]byte{} {
+		binary.LittleEndian.PutUint32(server.cookie[:4], s.prand32())
+		binary.LittleEndian.PutUint32(server.cookie[4:], s.prand32())
+	}
+	opts, _ := dns.AppendEDNSCookie(s.dnsr.optData[:0], server.cookie, server.srvCookie[:server.srvCookieLen])
+	// EDNS0 buffer size: MTU minus overhead for IP+UDP headers and safety margin.
+	// 100 bytes covers IPv4 max header (60) + UDP (8) + 32 byte margin.
+	s.ednsopt.SetEDNS0(uint16(s.link.MTU())-100, 0, 0, opts)
+	return dns.ResolveConfig{
+		Questions: []dns.Question{
+			{
+				Name:  q.name,
+				Type:  q.qtype,
+				Class: dns.ClassINET,
+			},
+		},
+		Additional: []dns.Resource{
+			s.ednsopt,
+		},
+		EnableRecursion:        true,
+		MaxResponseAnswers:     uint16(len(s.addrbufnip)) + dns.MaxCNAMEChain, // Room for CNAME chain.
+		MaxResponseAuthorities: 1,                                             // SOA for negative caching.
+		MaxResponseAdditionals: 2,                                             // OPT record.
+	}
+}
+
+// sendQuery (re)transmits q to server sv with a new transaction ID and local port.
+func (s *StackAsync) sendQuery(q *dnsQuery, sv int, now int64) error {
+	if q.tcp {
+		return s.sendQueryTCP(q, sv, now)
+	}
+	txid := uint16(s.prand32())
+	err := q.client.StartResolve(s.dnsLocalPort(), txid, s.resolveConfig(q, sv))
+	if err != nil {
+		q.state = dnsQueryFree
+		return err
+	}
+	addr := s.dnsr.servers[sv].addr
+	q.state = dnsQueryPending
+	q.server = addr
+	q.deadline = now + s.dnsr.rto<<q.attempt
+	if addr.Is4() {
+		*(*[4]byte)(s.addrBuf[:4]) = addr.As4()
+		q.udp.SetStackNode(&q.client, s.addrBuf[:4], dns.ServerPort)
+		err = s.udps.RegisterMACFiltered(&q.udp, nil)
+	} else {
+		s.addrBuf = addr.As16()
+		q.udp.SetStackNode(&q.client, s.addrBuf[:], dns.ServerPort)
+		err = s.stack6.RegisterUDPPort6(&q.udp, s.addrBuf)
+	}
+	if err != nil {
+		q.client.Abort()
+		q.state = dnsQueryFree
+	}
+	return err
+}
+
+// dnsLocalPort returns a random local port for a query in [1024, 65535], drawn
+// independently of the transaction ID so that both must be guessed to spoof a response.
+func (s *StackAsync) dnsLocalPort() uint16 {
+	return uint16(1024 + s.prand32()%(65536-1024))
+}
+
+// sendQueryTCP connects to server sv and queues q to be written once connected.
+// If another query holds the TCP connection q waits for it without its deadline running.
+func (s *StackAsync) sendQueryTCP(q *dnsQuery, sv int, now int64) error {
+	r := &s.dnsr
+	q.state = dnsQueryPending
+	q.server = r.servers[sv].addr
+	if !r.tcpAvailable(q) {
+		return nil
+	}
+	r.takeTCP(q)
+	q.client.Abort() // Release UDP port.
+	q.deadline = now + r.rto<<q.attempt
+	err := r.tcpClient.StartResolve(uint16(s.prand32()), s.resolveConfig(q, sv))
+	if err == nil {
+		lport := s.dnsLocalPort()
+		addr := r.servers[sv].addr
+		if addr.Is4() {
+			err = s.dialTCP4(&r.tcpConn, lport, addr.As4(), dns.ServerPort)
+		} else {
+			err = s.stack6.DialTCP6(&r.tcpConn, lport, addr.As16(), dns.ServerPort, tcp.Value(s.prand32()))
+		}
+	}
+	if err != nil {
+		r.release(q)
+		q.state = dnsQueryFree
+	}
+	return err
+}
+
+// pollTCP exchanges the query over the TCP connection to server sv and reports whether the attempt failed.
+func (s *StackAsync) pollTCP(q *dnsQuery, sv int, now int64) (failed bool) {
+	r := &s.dnsr
+	if r.tcpOwner != q {
+		if r.tcpAvailable(q) && s.sendQueryTCP(q, sv, now) != nil {
+			q.state = dnsQueryDone
+			q.timedOut = true
+		}
+		return false
+	}
+	state := r.tcpConn.State()
+	if state.IsSynchronized() {
+		_, err := r.tcpClient.Poll(&r.tcpConn)
+		failed = err != nil
+	} else if state.IsClosed() {
+		failed = true // Connection refused or reset.
+	}
+	return failed || now >= q.deadline
+}
+
+// pollQuery advances the state of a pending query: it records the response or
+// retransmits to the next healthiest server when the current attempt fails.
+func (s *StackAsync) pollQuery(q *dnsQuery, now int64) {
+	if q.state != dnsQueryPending {
+		return
+	}
+	sv := s.dnsr.serverIndex(q.server)
+	if sv < 0 {
+		// Server removed from the list while the query was in flight, its response is not trusted.
+		s.retryQuery(q, s.pickDNSServer(0), now)
+		return
+	}
+	var flags dns.HeaderFlags
+	var ok, failed bool
+	if q.tcp {
+		failed = s.pollTCP(q, sv, now)
+		if q.state != dnsQueryPending || s.dnsr.tcpOwner != q {
+			return
+		}
+		flags, ok = s.dnsr.tcpClient.ResponseFlags()
+	} else {
+		flags, ok = q.client.ResponseFlags()
+		failed = now >= q.deadline
+	}
+	failed = failed && !ok
+	var rcode dns.RCode
+	if ok {
+		var valid bool
+		rcode, valid = s.checkCookie(q, sv, flags)
+		if !valid || rcode == dns.RCodeBadCookie {
+			// RFC 7873 §5.3: Discard spoofed responses and resend with the new server cookie after BADCOOKIE.
+			s.retryQuery(q, sv, now)
+			return
+		}
+	}
+	if ok && !q.tcp && flags.IsTruncated() && s.dnsr.tcpEnabled() {
+		// RFC 7766 §5: Retry truncated response over TCP to the same server.
+		s.dnsr.serverOK(q.server)
+		q.tcp = true
+		if s.sendQueryTCP(q, sv, now) != nil {
+			q.state = dnsQueryDone
+			q.timedOut = true
+		}
+		return
+	}
+	if ok {
+		// Server failure and refusal are properties of the server and not the name, try another.
+		failed = rcode == dns.RCodeServerFailure || rcode == dns.RCodeRefused
+		if !failed || q.attempt >= s.dnsr.retries {
+			if failed {
+				s.dnsr.serverFailed(q.server)
+			} else {
+				s.dnsr.serverOK(q.server)
+			}
+			if q.tcp {
+				s.dnsr.tcpConn.Close() // Response kept in tcpClient.
+			}
+			q.state = dnsQueryDone
+			return
+		}
+	}
+	if !failed {
+		return
+	}
+	s.dnsr.serverFailed(q.server)
+	s.retryQuery(q, s.pickDNSServer(sv+1), now)
+}
+
+// retryQuery retransmits q to server sv, or finishes q as timed out if it
+// has no attempts left or sv is negative.
+func (s *StackAsync) retryQuery(q *dnsQuery, sv int, now int64) {
+	if q.attempt >= s.dnsr.retries || sv < 0 {
+		s.dnsr.release(q)
+		q.state = dnsQueryDone
+		q.timedOut = true
+		return
+	}
+	q.attempt++
+	if s.sendQuery(q, sv, now) != nil {
+		s.dnsr.release(q)
+		q.state = dnsQueryDone
+		q.timedOut = true
+	}
+}
+
+// checkCookie returns the extended response code of the response to q from server sv and reports whether the
+// response is valid according to its DNS Cookie (RFC 7873 §5.3). Responses echoing a client cookie other
+// than the one sent were not sent by the server and are not valid. The server cookie of valid responses is kept
+// for the next queries to the server. Responses without cookie are only accepted from servers that never sent one.
+func (s *StackAsync) checkCookie(q *dnsQuery, sv int, flags dns.HeaderFlags) (rcode dns.RCode, valid bool) {
+	s.dnsr.response(q).ResponseCopyTo(&s.lookup)
+	rcode = s.lookup.ResponseCode(flags)
+	server := &s.dnsr.servers[sv]
+	var data []byte
+	ok := false
+	if opt := s.lookup.OPT(); opt != nil {
+		data, ok = opt.EDNSOption(dns.EDNSOptionCookie)
+	}
+	if !ok {
+		// Server implementing cookies omitted them, could be an off-path spoofer.
+		return rcode, server.srvCookieLen == 0
+	}
+	client, srvCookie, err := dns.DecodeEDNSCookie(data)
+	if err != nil || client != server.cookie {
+		return rcode, false
+	}
+	server.srvCookieLen = uint8(copy(server.srvCookie[:], srvCookie))
+	return rcode, true
+}
+
+// extendedError returns err annotated with the Extended DNS Error (RFC 8914) of the response to q, if any.
+// The returned error is held by the stack and its text, truncated to fit, is valid until the next lookup result.
+func (s *StackAsync) extendedError(q *dnsQuery, err error) error {
+	resp := s.dnsr.response(q)
+	resp.ResponseCopyTo(&s.lookup)
+	opt := s.lookup.OPT()
+	if opt == nil {
+		return err
+	}
+	data, ok := opt.EDNSOption(dns.EDNSOptionExtendedError)
+	if !ok {
+		return err
+	}
+	code, text, decErr := dns.DecodeEDNSExtendedError(data)
+	if decErr != nil {
+		return err
+	}
+	flags, _ := resp.ResponseFlags()
+	n := copy(s.edeText[:], text)
+	s.ede = dns.ExtendedError{
+		RCode: s.lookup.ResponseCode(flags),
+		Code:  code,
+		Text:  unsafe.String(&s.edeText[0], n), // Avoid heap allocation on failed lookups.
+		Err:   err,
+	}
+	return &s.ede
+}
+
+// DNSServers appends the DNS servers used by the stack to dst, in order of configuration.
+func (s *StackAsync) DNSServers(dst []netip.Addr) []netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.dnsr.servers {
+		dst = append(dst, s.dnsr.servers[i].addr)
+	}
+	return dst
+}
+
+// SetDNSServers replaces the DNS servers used for lookups. Servers are tried in order of
+// preference; a server that fails to respond is demoted until it answers again. Up to 4 servers are kept.
+// Addresses learned through DHCPv4 and DHCPv6 (i.e: AppendDNSServers methods) may be combined in servers.
+func (s *StackAsync) SetDNSServers(servers []netip.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dnsr.setServers(servers)
+}
+
+// dnsResponse is implemented by [dns.Client] and [dns.TCPClient].
+type dnsResponse interface {
+	ResponseFlags() (dns.HeaderFlags, bool)
+	ResponseCopyTo(dst *dns.Message) (bool, error)
+	ResponseAnswerLookup(dst []netip.Addr, host string) (uint16, error)
+}
+
+// response returns the client holding the response to q.
+func (r *resolver) response(q *dnsQuery) dnsResponse {
+	if q.tcp {
+		return &r.tcpClient
+	}
+	return &q.client
+}
@@ -47,22 +47,30 @@ type StackAsync struct {
 	dhcpResults DHCPResults
 	arpt        subnetTable
 
-	dnsUDP  internet.StackUDPPort
-	dns     dns.Client
-	ednsopt dns.Resource
-	lookup  dns.Message
-	dnssv   netip.Addr
+	dnsr     resolver
+	ednsopt  dns.Resource
+	lookup   dns.Message
+	dnsCache dns.Cache
+	// revName and ptrNames hold the reverse lookup name and results of PTR lookups.
+	revName  dns.Name
+	ptrNames [4]dns.Name
+	// ede and edeText hold the Extended DNS Error of the last failed lookup result.
+	ede     dns.ExtendedError
+	edeText [64]byte
 
 	ntpUDP internet.StackUDPPort
 	ntp    ntp.Client
 
+	// _nanotime is the time source set with [StackConfig.Nanotime] or [StackAsync.SetNanotime].
+	_nanotime func() int64
+
 	userUDPs []internet.StackUDPPort
 
 	sysprec int8 // NTP system precision.
 
 	prng uint32
 
-	addrBuf    [6]byte // Temporary buffer for As4()/HardwareAddr6() results to avoid heap escapes.
+	addrBuf    [16]byte // Temporary buffer for As4()/As16()/HardwareAddr6() results to avoid heap escapes.
 	addrbufnip [4]netip.Addr
 
 	stats Statistics
@@ -77,9 +85,14 @@ type StackConfig struct {
 	HardwareAddress [6]byte
 	StaticAddress4  [4]byte
 	StaticAddress6  [16]byte
+	// Subnet6 is the on-link prefix of the IPv6 address. Destinations outside of it, other than
+	// link-local addresses, are sent to the gateway hardware address instead of being resolved with NDP.
+	// Defaults to the /64 prefix of the stack's IPv6 address.
+	Subnet6 netip.Prefix
 
 	IPv6Stack Stack6
 
+	// DNSServer is the preferred DNS server. More servers may be set with [StackAsync.SetDNSServers].
 	DNSServer netip.Addr
 	NTPServer netip.Addr
 	RandSeed  int64
@@ -99,6 +112,23 @@ type StackConfig struct {
 	// number of simultaneous open TCP/UDP ports. The memory impact at the stack level
 	// of a port corresponds to ~64 bytes excluding the registered StackNode i.e: [tcp.Conn] or [udp.Conn].
 	MaxActiveTCPPorts, MaxActiveUDPPorts uint16
+	// DNSCacheEntries is the number of (name, type) lookup results cached by the stack.
+	// Cached lookups complete without network round trips until their TTL expires. Zero disables the cache.
+	DNSCacheEntries uint16
+	// MaxDNSQueries is the number of DNS lookups that may be in flight at the same time.
+	// Defaults to 2 so that A and AAAA records of a host can be resolved in parallel.
+	MaxDNSQueries uint8
+	// DNSRetries is the number of times an unanswered DNS query is retransmitted, each time
+	// to the next healthiest DNS server. Defaults to 2. Negative values disable retransmissions.
+	DNSRetries int8
+	// DNSRetryTimeout is the time waited for a DNS response before retransmitting the query.
+	// It doubles on every retransmission. Defaults to 500ms.
+	DNSRetryTimeout time.Duration
+	// DNSTCPBufferSize is the size of the response buffer used for DNS over TCP, at least 512.
+	// When set, lookups whose UDP response is truncated are retried over TCP and [StackAsync.StartLookupIPTypeTCP]
+	// may be used. Uses one TCP port in addition to MaxActiveTCPPorts and ~2*DNSTCPBufferSize+512 bytes of memory.
+	// Zero disables DNS over TCP and truncated responses are returned as received.
+	DNSTCPBufferSize uint16
 	// MTU sets the maximum transmission unit, which is the maximum size of the Ethernet payload
 	// not including ethernet header, ethernet CRC. It is determined by the NIC hardware and the route the packets take over the network.
 	// By far the most common value for MTU is 1500 as specified by IEEE 802.3.
@@ -107,15 +137,71 @@ type StackConfig struct {
 	AcceptMulticast bool
 	// Accept broadcast IPv4 packets. Needed for managing access points and DHCPv4 servers.
 	AcceptIPv4Broadcast bool
+	// StealthPorts disables ICMP Port Unreachable and TCP RST replies to packets
+	// addressed to ports with no open connection, hiding closed ports from scanners.
+	StealthPorts bool
 	// Logger receives the stack's Debug and DebugErr output. A nil Logger silences
 	// them; the heap allocation probe still runs so allocation bisection keeps working.
 	Logger *slog.Logger
+	// Nanotime is the time source in nanoseconds of the stack's timers: DNS retransmissions
+	// and cache expiry, ICMP error rate limiting and NTP timestamps. Simulated networks
+	// set it to a virtual clock for reproducible runs. If nil the wall clock is used.
+	Nanotime func() int64
 }
 
 func (cfg *StackConfig) id() uint16 {
 	return uint16(cfg.Hostname[len(cfg.Hostname)-1] - '0')
 }
 
+func (cfg *StackConfig) unboundPortConfig() internet.UnboundPortConfig {
+	return internet.UnboundPortConfig{
+		DisableICMP: cfg.StealthPorts,
+		DisableRST:  cfg.StealthPorts,
+		Nanotime:    cfg.nanotime(),
+	}
+}
+
+// nanotime returns the configured time source or the wall clock if none is set.
+func (cfg *StackConfig) nanotime() func() int64 {
+	if cfg.Nanotime != nil {
+		return cfg.Nanotime
+	}
+	return wallNanotime
+}
+
+// dnsQueries returns the size of the DNS query pool, see [StackConfig.MaxDNSQueries].
+func (cfg *StackConfig) dnsQueries() uint8 {
+	if cfg.MaxDNSQueries == 0 {
+		return defaultDNSQueries
+	}
+	return cfg.MaxDNSQueries
+}
+
+func wallNanotime() int64 { return time.Now().UnixNano() }
+
+// SetNanotime replaces the time source of the stack's timers, see [StackConfig.Nanotime].
+// A nil nanotime selects the wall clock.
+func (s *StackAsync) SetNanotime(nanotime func() int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s._nanotime = nanotime
+}
+
+func (s *StackAsync) nanotime() int64 {
+	if s._nanotime != nil {
+		return s._nanotime()
+	}
+	return wallNanotime()
+}
+
+// wallTime is the NTP client clock, which follows the stack's time source.
+func (s *StackAsync) wallTime() time.Time {
+	if s._nanotime == nil {
+		return time.Now()
+	}
+	return time.Unix(0, s._nanotime())
+}
+
 func (s *StackAsync) Hostname() string {
 	return s.hostname
 }
@@ -207,6 +293,8 @@ func (s *StackAsync) Reset(cfg StackConfig) (err error) {
 	defer s.mu.Unlock()
 	s.prng = uint32(cfg.RandSeed)
 	s.hostname = cfg.Hostname
+	s._nanotime = cfg.Nanotime
+	cfg.Nanotime = s.nanotime // Unbound port rate limiting follows SetNanotime.
 	s.log = cfg.Logger
 	// Treat last character of hostname as number.
 	id := cfg.id()
@@ -253,14 +341,22 @@ func (s *StackAsync) Reset(cfg StackConfig) (err error) {
 	if err != nil {
 		return err
 	}
-	udpConns := 3 + cfg.MaxActiveUDPPorts // DHCP, DNS, NTP + user-registered.
+	maxQueries := cfg.dnsQueries()
+	udpConns := 2 + uint16(maxQueries) + cfg.MaxActiveUDPPorts // DHCP, NTP, DNS queries + user-registered.
 	s.udps.ResetUDP(udpConns)
+	unbound := cfg.unboundPortConfig()
+	s.udps.ConfigureUnbound(unbound)
+	s.tcps.ConfigureUnbound(unbound)
 
 	internal.SliceReuse(&s.userUDPs, int(cfg.MaxActiveUDPPorts))
 
 	// Enable TCP if connections present.
-	if cfg.MaxActiveTCPPorts > 0 {
-		s.tcps.ResetTCP(cfg.MaxActiveTCPPorts)
+	tcpConns := cfg.MaxActiveTCPPorts
+	if cfg.DNSTCPBufferSize > 0 {
+		tcpConns++ // DNS over TCP.
+	}
+	if tcpConns > 0 {
+		s.tcps.ResetTCP(tcpConns)
 		err = s.ip4.Register4(&s.tcps)
 		if err != nil {
 			return err
@@ -295,8 +391,28 @@ func (s *StackAsync) Reset(cfg StackConfig) (err error) {
 		s.clientID = "lneto-" + s.hostname
 	}
 	s.stats = Statistics{}
+	err = s.dnsCache.Reset(dns.CacheConfig{
+		MaxEntries: int(cfg.DNSCacheEntries),
+		MaxAddrs:   len(s.addrbufnip),
+	})
+	if err != nil {
+		return err
+	}
+	retries := uint8(max(cfg.DNSRetries, 0))
+	if cfg.DNSRetries == 0 {
+		retries = defaultDNSRetries
+	}
+	rto := cfg.DNSRetryTimeout
+	if rto <= 0 {
+		rto = defaultDNSRetryTimeout
+	}
+	s.dnsr.reset(maxQueries, retries, rto)
+	err = s.dnsr.resetTCP(cfg.DNSTCPBufferSize)
+	if err != nil {
+		return err
+	}
 	if cfg.DNSServer.IsValid() {
-		s.dnssv = cfg.DNSServer
+		s.dnsr.setServers([]netip.Addr{cfg.DNSServer})
 	}
 	if s.ipv6enabled {
 		s.Debug("registering IPv6 to ethernet")
@@ -507,6 +623,10 @@ func (s *StackAsync) DialUDP4(conn *udp.Conn, localPort uint16, raddr [4]byte, r
 func (s *StackAsync) DialTCP4(conn *tcp.Conn, localPort uint16, raddr [4]byte, rport uint16) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.dialTCP4(conn, localPort, raddr, rport)
+}
+
+func (s *StackAsync) dialTCP4(conn *tcp.Conn, localPort uint16, raddr [4]byte, rport uint16) (err error) {
 	mac, err := s.arpt.hwDynamicResolve(raddr, &s.arp)
 	if err != nil {
 		return err
@@ -591,75 +711,211 @@ func (s *StackAsync) RegisterListenerUDP6(pktconn *udp.PacketConn) (err error) {
 
 var errNoDNSServer = errors.New("no DNS server- did DHCP complete? You can set a predetermined DNS server in Stack configuration")
 
-var errDNSv6Transport = errors.New("DNS query over IPv6 transport not supported; configure an IPv4 DNS server")
-
 func (s *StackAsync) StartLookupIP(host string) error {
 	return s.StartLookupIPType(host, dns.TypeA)
 }
 
 // StartLookupIPType begins resolving host for the given record type (e.g. dns.TypeA
-// or dns.TypeAAAA). The DNS query is always carried over IPv4 to the configured DNS
-// server; resolving over an IPv6 DNS transport is not yet supported.
+// or dns.TypeAAAA). Queries are carried over IPv4 or IPv6 depending on the DNS server used;
+// servers whose IP version has no address configured on the stack are skipped.
+// Up to [StackConfig.MaxDNSQueries] lookups may be in flight at the same time.
+// If the result is cached (see [StackConfig.DNSCacheEntries]) no query is sent and
+// [StackAsync.ResultLookupIPType] returns it immediately.
 func (s *StackAsync) StartLookupIPType(host string, qtype dns.Type) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if !s.dnssv.IsValid() {
-		return errNoDNSServer
-	}
-	if !s.dnssv.Is4() {
-		return errDNSv6Transport
+	return s.startLookup(host, qtype, false)
+}
+
+// StartLookupIPTypeTCP is like [StackAsync.StartLookupIPType] but the query is sent over TCP (RFC 7766),
+// useful when the response is known to exceed the UDP payload size. Requires [StackConfig.DNSTCPBufferSize].
+func (s *StackAsync) StartLookupIPTypeTCP(host string, qtype dns.Type) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dnsr.tcpEnabled() {
+		return errDNSNoTCP
 	}
+	return s.startLookup(host, qtype, true)
+}
+
+func (s *StackAsync) startLookup(host string, qtype dns.Type, useTCP bool) error {
 	name, err := dns.NewName(host)
 	if err != nil {
 		return err
 	}
+	return s.startLookupName(name, qtype, useTCP)
+}
 
-	// EDNS0 buffer size: MTU minus overhead for IP+UDP headers and safety margin.
-	// 100 bytes covers IPv4 max header (60) + UDP (8) + 32 byte margin.
-	s.ednsopt.SetEDNS0(uint16(s.link.MTU())-100, 0, 0, nil)
-	rand := s.prand32()
-	err = s.dns.StartResolve(uint16(rand>>1)+1024, uint16(rand), dns.ResolveConfig{
-		Questions: []dns.Question{
-			{
-				Name:  name,
-				Type:  qtype,
-				Class: dns.ClassINET,
-			},
-		},
-		Additional: []dns.Resource{
-			s.ednsopt,
-		},
-		EnableRecursion:    true,
-		MaxResponseAnswers: uint16(len(s.addrbufnip)),
-	})
-	if err != nil {
-		return err
+func (s *StackAsync) startLookupName(name dns.Name, qtype dns.Type, useTCP bool) error {
+	now := s.nanotime()
+	_, _, hit := s.dnsCache.Lookup(nil, name, qtype, now)
+	if !hit && s.pickDNSServer(0) < 0 {
+		return s.errNoDNSTransport()
 	}
-	*(*[4]byte)(s.addrBuf[:4]) = s.dnssv.As4()
-	s.dnsUDP.SetStackNode(&s.dns, s.addrBuf[:4], dns.ServerPort)
-	err = s.udps.RegisterMACFiltered(&s.dnsUDP, nil)
-	return err
+	q, pending := s.dnsr.acquire(name, qtype)
+	if q == nil {
+		if hit {
+			return nil // Result is read from cache.
+		}
+		return errDNSExhausted
+	}
+	s.dnsr.seq++
+	q.seq = s.dnsr.seq
+	if pending {
+		return nil // Same lookup already in flight.
+	}
+	s.dnsr.release(q) // Release ports of previous lookup.
+	q.name.CopyFrom(name)
+	q.qtype = qtype
+	q.tcp = useTCP
+	if hit {
+		q.state = dnsQueryCached
+		return nil
+	}
+	return s.startQuery(q, now)
 }
 
 var (
 	errDNSNotDone = errors.New("DNS not done")
 	errDNSNoAns   = errors.New("no address in DNS answer")
+	errDNSNoPTR   = errors.New("no PTR record in DNS answer")
 )
 
+// ResultLookupIP returns the result of the most recently started lookup of host, of any record type.
+// The bool is false while the lookup is in progress. See [StackAsync.ResultLookupIPType].
 func (s *StackAsync) ResultLookupIP(host string) ([]netip.Addr, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, ok := s.dns.ResponseFlags()
-	if !ok {
-		return nil, false, errDNSNotDone
+	return s.resultLookup(host, dns.TypeA, true)
+}
+
+// ResultLookupIPType returns the result of the lookup of host for record type qtype started with
+// [StackAsync.StartLookupIPType]. The bool is false while the lookup is in progress. Polling the result
+// retransmits the query when a DNS server takes too long to respond. The returned slice is valid until the next call.
+func (s *StackAsync) ResultLookupIPType(host string, qtype dns.Type) ([]netip.Addr, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resultLookup(host, qtype, false)
+}
+
+func (s *StackAsync) resultLookup(host string, qtype dns.Type, anyType bool) ([]netip.Addr, bool, error) {
+	now := s.nanotime()
+	q := s.dnsr.find(host, qtype, anyType)
+	if q == nil || q.state == dnsQueryCached {
+		if q != nil {
+			qtype = q.qtype
+		}
+		name, err := dns.NewName(host)
+		if err != nil {
+			return nil, true, err
+		}
+		n, rcode, hit := s.dnsCache.Lookup(s.addrbufnip[:], name, qtype, now)
+		if hit {
+			var err error
+			if rcode != dns.RCodeSuccess {
+				err = rcode
+			} else if n == 0 {
+				err = errDNSNoAns
+			}
+			return s.addrbufnip[:n], true, err
+		} else if q == nil {
+			return nil, true, errDNSNoLookup
+		}
+		// Cache entry expired since lookup started, go to the network.
+		err = s.startQuery(q, now)
+		if err != nil {
+			q.state = dnsQueryFree
+			return nil, true, err
+		}
 	}
-	n, err := s.dns.ResponseAnswerLookup(s.addrbufnip[:], host)
+	s.pollQuery(q, now)
+	if q.state == dnsQueryPending {
+		return nil, false, errDNSNotDone
+	} else if q.timedOut {
+		return nil, true, errDNSTimeout
+	}
+	resp := s.dnsr.response(q)
+	flags, _ := resp.ResponseFlags()
+	if !q.cached && s.dnsCache.Cap() > 0 && !flags.IsTruncated() {
+		q.cached = true
+		resp.ResponseCopyTo(&s.lookup)
+		s.dnsCache.Insert(&s.lookup, flags.ResponseCode(), now)
+	}
+	q.read = true
+	n, err := resp.ResponseAnswerLookup(s.addrbufnip[:], host)
 	if n == 0 && err == nil {
 		err = errDNSNoAns
 	}
+	if n == 0 {
+		err = s.extendedError(q, err) // Tell the user why the lookup failed, if the server did.
+	}
 	return s.addrbufnip[:n], true, err
 }
 
+// StartLookupAddr begins a reverse lookup of addr by querying the PTR records of its
+// "in-addr.arpa" or "ip6.arpa" name. Poll [StackAsync.ResultLookupAddr] for the result.
+// PTR lookups share the query pool of [StackAsync.StartLookupIPType] and are not cached.
+func (s *StackAsync) StartLookupAddr(addr netip.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.revName.SetReverseAddr(addr)
+	if err != nil {
+		return err
+	}
+	return s.startLookupName(s.revName, dns.TypePTR, false)
+}
+
+// ResultLookupAddr returns the names addr maps to in the lookup started with [StackAsync.StartLookupAddr].
+// The bool is false while the lookup is in progress. The returned names are valid until the next call.
+func (s *StackAsync) ResultLookupAddr(addr netip.Addr) ([]dns.Name, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.revName.SetReverseAddr(addr)
+	if err != nil {
+		return nil, true, err
+	}
+	q := s.dnsr.findName(s.revName, dns.TypePTR)
+	if q == nil {
+		return nil, true, errDNSNoLookup
+	}
+	s.pollQuery(q, s.nanotime())
+	if q.state == dnsQueryPending {
+		return nil, false, errDNSNotDone
+	} else if q.timedOut {
+		return nil, true, errDNSTimeout
+	}
+	q.read = true
+	_, err = s.dnsr.response(q).ResponseCopyTo(&s.lookup)
+	if err != nil {
+		return nil, true, s.extendedError(q, err)
+	}
+	// Classless in-addr.arpa delegation (RFC 2317) answers with a CNAME to the PTR record.
+	owner, _ := s.lookup.CanonicalName(s.revName)
+	n := 0
+	for i := range s.lookup.Answers {
+		ans := &s.lookup.Answers[i]
+		if n == len(s.ptrNames) {
+			break
+		} else if !dns.NamesEqualFold(ans.Header().Name, owner) {
+			continue
+		}
+		if ans.DecodePTR(&s.ptrNames[n]) == nil {
+			n++
+		}
+	}
+	if n == 0 {
+		err = s.extendedError(q, errDNSNoPTR)
+	}
+	return s.ptrNames[:n], true, err
+}
+
+// FlushDNSCache removes all cached lookup results. See [StackConfig.DNSCacheEntries].
+func (s *StackAsync) FlushDNSCache() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dnsCache.Flush()
+}
+
 func (s *StackAsync) StartDHCPv4Request(request [4]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -686,7 +942,7 @@ func (s *StackAsync) StartDHCPv4Request(request [4]byte) error {
 func (s *StackAsync) StartNTP(addr netip.Addr) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.ntp.Reset(s.sysprec, time.Now)
+	s.ntp.Reset(s.sysprec, s.wallTime)
 
 	*(*[4]byte)(s.addrBuf[:4]) = addr.As4()
 	s.ntpUDP.SetStackNode(&s.ntp, s.addrBuf[:4], ntp.ServerPort)
@@ -789,7 +1045,7 @@ func (s *StackAsync) ReadStatistics(stats *Statistics) {
 
 // AssimilateDHCPResults sets the stack's following parameters:
 //   - IPv4 address.
-//   - DNS server.
+//   - DNS servers.
 //   - Subnet (for ARP resolution of local addresses).
 func (stack *StackAsync) AssimilateDHCPResults(results *DHCPResults) error {
 	stack.mu.Lock()
@@ -804,10 +1060,10 @@ func (stack *StackAsync) AssimilateDHCPResults(results *DHCPResults) error {
 		}
 	}
 	if len(results.DNSServers) > 0 {
-		if !results.DNSServers[0].IsValid() || !results.DNSServers[0].Is4() {
-			return lneto.ErrInvalidAddr
+		err := stack.dnsr.setServers(results.DNSServers)
+		if err != nil {
+			return err
 		}
-		stack.dnssv = results.DNSServers[0]
 	}
 	return nil
 }
@@ -174,7 +174,7 @@ func (s StackBlocking) DoLookupIPType(host string, timeout time.Duration, qtype
 	deadline := s.deadlineTO(timeout)
 	var backoffs uint
 	for range maxIter {
-		addrs, completed, err := s.async.ResultLookupIP(host)
+		addrs, completed, err := s.async.ResultLookupIPType(host, qtype)
 		if completed {
 			return addrs, err
 		} else if err = s.checkDeadline(deadline); err != nil {
@@ -186,6 +186,29 @@ func (s StackBlocking) DoLookupIPType(host string, timeout time.Duration, qtype
 	return nil, errDeadlineExceed
 }
 
+// DoLookupAddr performs a reverse lookup of addr, blocking until a response arrives or the timeout elapses.
+// The returned names are valid until the next lookup of addr. See [StackAsync.StartLookupAddr].
+func (s StackBlocking) DoLookupAddr(addr netip.Addr, timeout time.Duration) (names []dns.Name, err error) {
+	err = s.async.StartLookupAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := s.deadlineTO(timeout)
+	var backoffs uint
+	for range maxIter {
+		names, completed, err := s.async.ResultLookupAddr(addr)
+		if completed {
+			return names, err
+		} else if err = s.checkDeadline(deadline); err != nil {
+			return nil, err
+		}
+		s.backoff(backoffs)
+		backoffs++
+	}
+	return nil, errDeadlineExceed
+}
+
 var errTCPFailedToConnect = errors.New("tcp failed to connect")
 
 func (s StackBlocking) DoDialTCP(conn *tcp.Conn, localPort uint16, addrp netip.AddrPort, timeout time.Duration) (err error) {
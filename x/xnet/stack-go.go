@@ -6,10 +6,12 @@ import (
 	"math"
 	"net"
 	"net/netip"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/dns"
 	"github.com/soypat/lneto/tcp"
 	"github.com/soypat/lneto/udp"
 )
@@ -21,12 +23,24 @@ const (
 
 	defaultTCPDialTimeout = 2 * time.Second
 	defaultTCPDialRetries = 1
+	defaultLookupTimeout  = 2 * time.Second
 )
 
 type StackGoConfig struct {
 	ListenerPoolConfig TCPPoolConfig
 	TCPDialTimeout     time.Duration
 	TCPDialRetries     int
+	// LookupTimeout is the time waited for a DNS response in [StackGo.LookupNetIP] and [StackGo.DialContext]. Defaults to 2s.
+	LookupTimeout time.Duration
+	// Resolver, if set, resolves names in [StackGo.LookupNetIP] and [StackGo.DialContext] in place
+	// of the stack's DNS client, such as the DNS-over-TLS resolver of package x/dot. A resolver
+	// dialing through a StackGo must address its server by IP to not recurse into itself.
+	Resolver Resolver
+}
+
+// Resolver looks up IP addresses of hosts. Implemented by [StackGo] and [net.Resolver].
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
 }
 
 func (s *StackAsync) StackGo(stackProtoBackoff lneto.BackoffStrategy, cfg StackGoConfig) StackGo {
@@ -43,12 +57,17 @@ func (s StackBlocking) StackGo(cfg StackGoConfig) StackGo {
 	if cfg.TCPDialTimeout <= 0 {
 		cfg.TCPDialTimeout = defaultTCPDialTimeout
 	}
+	if cfg.LookupTimeout <= 0 {
+		cfg.LookupTimeout = defaultLookupTimeout
+	}
 
 	sg := StackGo{
 		blk:            s,
 		plcfg:          cfg.ListenerPoolConfig,
 		tcpDialTimeout: cfg.TCPDialTimeout,
 		tcpDialRetries: cfg.TCPDialRetries,
+		lookupTimeout:  cfg.LookupTimeout,
+		resolver:       cfg.Resolver,
 	}
 	return sg
 }
@@ -58,6 +77,123 @@ type StackGo struct {
 	plcfg          TCPPoolConfig
 	tcpDialTimeout time.Duration
 	tcpDialRetries int
+	lookupTimeout  time.Duration
+	resolver       Resolver
+}
+
+// LookupNetIP looks up host and returns its IP addresses, like [net.Resolver.LookupNetIP].
+// network is "ip" or "ip4" for IPv4 addresses and "ip6" for IPv6 addresses. If host is an IP address it is returned as is.
+// Lookups are served from the stack's DNS cache when possible, see [StackConfig.DNSCacheEntries],
+// or by [StackGoConfig.Resolver] if set.
+func (s StackGo) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	} else if s.resolver != nil {
+		return s.resolver.LookupNetIP(ctx, network, host)
+	}
+	qtype := dns.TypeA
+	switch network {
+	case "ip", "ip4":
+	case "ip6":
+		qtype = dns.TypeAAAA
+	default:
+		return nil, lneto.ErrUnsupported
+	}
+	timeout := s.lookupTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	addrs, err := s.blk.DoLookupIPType(host, timeout, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return append([]netip.Addr(nil), addrs...), nil // Copy out of the stack's buffer.
+}
+
+// LookupAddr performs a reverse lookup of addr and returns the names mapping to it, like [net.Resolver.LookupAddr].
+// Names are returned fully qualified, with a trailing dot.
+func (s StackGo) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := s.lookupTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	names, err := s.blk.DoLookupAddr(ip, timeout)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(names))
+	for i := range names {
+		hosts[i] = names[i].String()
+	}
+	return hosts, nil
+}
+
+// DialContext connects to address on the named network, like [net.Dialer.DialContext].
+// Supported networks are "tcp", "tcp4", "tcp6", "udp", "udp4" and "udp6". The host in address
+// may be a name, resolved with [StackGo.LookupNetIP], or an IP address. For "tcp" and "udp"
+// IPv6 addresses are looked up when the host has no IPv4 address and IPv6 is enabled.
+// Addresses are tried in order until one succeeds; the error of the first attempt is returned otherwise.
+func (s StackGo) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	sotype := sockSTREAM
+	ipnet := "ip4"
+	dualStack := false
+	switch network {
+	case "tcp":
+		dualStack = true
+	case "tcp4":
+	case "tcp6":
+		ipnet = "ip6"
+	case "udp":
+		sotype, dualStack = sockDGRAM, true
+	case "udp4":
+		sotype = sockDGRAM
+	case "udp6":
+		sotype, ipnet = sockDGRAM, "ip6"
+	default:
+		return nil, lneto.ErrUnsupported
+	}
+	addrs, err := s.LookupNetIP(ctx, ipnet, host)
+	if dualStack && len(addrs) == 0 && s.blk.async.IsIPv6Enabled() {
+		// Host may only have IPv6 addresses. Keep the IPv4 lookup error if both fail.
+		if addrs6, err6 := s.LookupNetIP(ctx, "ip6", host); err6 == nil {
+			addrs, err = addrs6, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, errDNSNoAns
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		raddr := netip.AddrPortFrom(addr, uint16(port))
+		family, laddr := syscall.AF_INET, netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		if addr.Is6() {
+			family, laddr = syscall.AF_INET6, netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		}
+		c, err := s.SocketNetip(ctx, network, family, sotype, laddr, raddr)
+		if err == nil {
+			return c.(net.Conn), nil
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break // Do not try remaining addresses after cancellation.
+		}
+	}
+	return nil, firstErr
 }
 
 func (s StackGo) Socket(ctx context.Context, network string, family, sotype int, laddr, raddr net.Addr) (c any, err error) {
@@ -208,7 +344,7 @@ func (s StackGo) SocketNetip(ctx context.Context, network string, family, sotype
 				} else {
 					// Unexpected state, abort and terminate connection.
 					conn.Abort()
-					return errTCPFailedToConnect, nil
+					return nil, errTCPFailedToConnect
 				}
 			}
 		} else {
@@ -62,7 +62,7 @@ func (s StackRetrying) DoNTP(ntpHost netip.Addr, timeout time.Duration, retries
 	return -1, errRetriesExceeded
 }
 func (s StackRetrying) DoLookupIP(host string, timeout time.Duration, retries int) (addrs []netip.Addr, err error) {
-	if !s.block.async.dnssv.IsValid() {
+	if len(s.block.async.dnsr.servers) == 0 {
 		return nil, errNoDNSServer
 	}
 	expectEnd := time.Now().Add(timeout * time.Duration(retries))
@@ -26,6 +26,7 @@ type Stack6 interface {
 	Register6(node lneto.StackNode) error
 	DialUDP6(conn *udp.Conn, localPort uint16, raddr [16]byte, rport uint16) error
 	DialTCP6(conn *tcp.Conn, localPort uint16, raddr [16]byte, rport uint16, iss tcp.Value) error
+	RegisterUDPPort6(port *internet.StackUDPPort, raddr [16]byte) error
 	RegisterListenerTCP6(listener *tcp.Listener) error
 	RegisterListenerUDP6(pktconn *udp.PacketConn) error
 	IngressIPv6(ipframe []byte) error
@@ -40,12 +41,19 @@ type stack6 struct {
 	vld      lneto.Validator
 	icmp6buf []byte
 	icmp6    icmpv6.Client
-	// ndpPending tracks in-flight NDP MAC resolves for outbound connections.
-	// macBuf is shared with the registered node so macResolve patches it in place.
-	ndpPending []struct {
-		addr   [16]byte
-		macBuf []byte
-	}
+	// subnet6 is the on-link prefix, see [StackConfig.Subnet6].
+	subnet6 netip.Prefix
+	// ndpPending tracks NDP MAC resolves for outbound connections, one entry per neighbor address.
+	ndpPending []ndpEntry
+}
+
+// ndpEntry is the NDP resolution state of a neighbor. macBuf is shared with the registered
+// nodes so macResolve patches it in place. Resolved entries are kept so later connections
+// to the same neighbor reuse macBuf.
+type ndpEntry struct {
+	addr    [16]byte
+	macBuf  []byte
+	pending bool
 }
 
 func (s *stack6) Register6(node lneto.StackNode) error { return s.ip6.Register6(node) }
@@ -67,16 +75,26 @@ func (s *stack6) Reset6(cfg *StackConfig) error {
 	}
 	s.ip6.SetAddr6(cfg.StaticAddress6)
 	s.ip6.SetAcceptMulticast6(true) // IPv6 needs multicast to work.
+	s.subnet6 = cfg.Subnet6
+	s.dropNDPPending()
 
-	s.tcps6.ResetTCP(cfg.MaxActiveTCPPorts)
-	if cfg.MaxActiveTCPPorts > 0 {
+	tcpConns := cfg.MaxActiveTCPPorts
+	if cfg.DNSTCPBufferSize > 0 {
+		tcpConns++ // DNS over TCP.
+	}
+	s.tcps6.ResetTCP(tcpConns)
+	if tcpConns > 0 {
 		err = s.ip6.Register6(&s.tcps6)
 		if err != nil {
 			return err
 		}
 	}
-	s.udps6.ResetUDP(cfg.MaxActiveUDPPorts)
-	if cfg.MaxActiveUDPPorts > 0 {
+	udpConns := uint16(cfg.dnsQueries()) + cfg.MaxActiveUDPPorts // DNS queries + user-registered.
+	s.udps6.ResetUDP(udpConns)
+	unbound := cfg.unboundPortConfig()
+	s.udps6.ConfigureUnbound(unbound)
+	s.tcps6.ConfigureUnbound(unbound)
+	if udpConns > 0 {
 		err = s.ip6.Register6(&s.udps6)
 		if err != nil {
 			return err
@@ -99,7 +117,7 @@ func (s *stack6) Reset6(cfg *StackConfig) error {
 			return err
 		}
 		s.icmp6.SetNDPResolveCallback(s.macResolve)
-		ndpSlots := int(cfg.MaxActiveTCPPorts) + int(cfg.MaxActiveUDPPorts)
+		ndpSlots := int(tcpConns) + int(udpConns)
 		internal.SliceReuse(&s.ndpPending, ndpSlots)
 		s.ndpPending = s.ndpPending[:cap(s.ndpPending)] // all slots available for scan
 	}
@@ -181,6 +199,16 @@ func (s *stack6) DialUDP6(conn *udp.Conn, localPort uint16, raddr [16]byte, rpor
 	return nil
 }
 
+// RegisterUDPPort6 registers port, whose node and remote address raddr are already set, on the
+// IPv6 UDP ports stack. Like DialUDP6, datagrams are held until NDP resolves the MAC of raddr.
+func (s *stack6) RegisterUDPPort6(port *internet.StackUDPPort, raddr [16]byte) error {
+	mac, err := s.ndpDynamicResolve(raddr)
+	if err != nil {
+		return err
+	}
+	return s.udps6.RegisterMACFiltered(port, mac)
+}
+
 // macResolve is the NDP resolve callback. It patches the shared macBuf of any
 // pending outbound connection to addr so StackPortsMACFiltered begins forwarding.
 func (s *stack6) macResolve(mac [6]byte, addr [16]byte) {
@@ -189,8 +217,7 @@ func (s *stack6) macResolve(mac [6]byte, addr [16]byte) {
 		if e.addr == addr && e.macBuf != nil {
 			// macbuf is externally owned and expects it to be written to on resolve.
 			copy(e.macBuf, mac[:])
-			e.macBuf = nil // free slot for future NDP resolution.
-			e.addr = [16]byte{}
+			e.pending = false
 		}
 	}
 }
@@ -198,41 +225,68 @@ func (s *stack6) macResolve(mac [6]byte, addr [16]byte) {
 // ndpDynamicResolve mirrors hwDynamicResolve for IPv6. It returns a
 // heap-allocated MAC slice shared with the ndpPending table so that macResolve
 // can patch the destination MAC in place once NDP resolves, exactly as the ARP
-// subnetTable does for IPv4. Returns nil (no MAC filtering) when NDP is not
-// configured.
+// subnetTable does for IPv4. Connections to the same neighbor share the slice.
+// Returns nil (no MAC filtering) when NDP is not configured or raddr is off-link,
+// in which case frames are sent to the gateway hardware address.
 func (s *stack6) ndpDynamicResolve(raddr [16]byte) ([]byte, error) {
-	if !s.ip6.IsRegistered6(lneto.IPProtoIPv6ICMP) {
-		return nil, nil // NDP unavailable; routing layer handles MAC.
+	if !s.ip6.IsRegistered6(lneto.IPProtoIPv6ICMP) || !s.onLink6(raddr) {
+		return nil, nil // Routing layer handles MAC.
 	}
 	mac, err := s.icmp6.NDPCacheLookup(raddr)
-	macBuf := make([]byte, 6)
-	if err == nil {
-		copy(macBuf, mac[:])
-		return macBuf, nil
+	resolved := err == nil
+	e := s.ndpSlot(raddr)
+	if e == nil {
+		return nil, lneto.ErrExhausted
 	}
+	if resolved {
+		copy(e.macBuf, mac[:])
+		e.pending = false
+		return e.macBuf, nil
+	}
+	// Replace any incomplete cache entry so retries resend the solicitation without filling the cache.
+	s.icmp6.NDPCacheRemove(raddr)
 	if err = s.icmp6.NDPStartQuery(raddr, true); err != nil {
 		return nil, err
 	}
-	// Find a freed slot or grow the pending slice.
+	e.pending = true
+	return e.macBuf, nil
+}
+
+// ndpSlot returns the ndpPending entry for addr. If there is none a free or resolved
+// entry is taken over with a new MAC buffer. Returns nil if all entries are pending resolution.
+func (s *stack6) ndpSlot(addr [16]byte) *ndpEntry {
 	idx := -1
 	for i := range s.ndpPending {
-		if s.ndpPending[i].macBuf == nil {
+		e := &s.ndpPending[i]
+		if e.macBuf != nil && e.addr == addr {
+			return e
+		} else if idx < 0 && !e.pending {
 			idx = i
-			break
 		}
 	}
 	if idx < 0 {
-		return nil, lneto.ErrExhausted
+		return nil
 	}
 	e := &s.ndpPending[idx]
-	e.addr = raddr
-	e.macBuf = macBuf
-	return macBuf, nil
+	e.addr = addr
+	e.macBuf = make([]byte, 6) // Buffer of evicted entry stays with the nodes using it.
+	e.pending = false
+	return e
 }
 
-func (s *stack6) dropNDPPending() {
-	for i := range s.ndpPending {
-		s.ndpPending[i].macBuf = nil
-		s.ndpPending[i].addr = [16]byte{}
+// onLink6 reports whether addr is reachable without going through a router, see [StackConfig.Subnet6].
+func (s *stack6) onLink6(addr [16]byte) bool {
+	a := netip.AddrFrom16(addr)
+	if a.IsLinkLocalUnicast() {
+		return true
+	}
+	subnet := s.subnet6
+	if !subnet.IsValid() {
+		subnet, _ = netip.AddrFrom16(s.ip6.Addr6()).Prefix(64)
 	}
+	return subnet.Contains(a)
+}
+
+func (s *stack6) dropNDPPending() {
+	clear(s.ndpPending)
 }
@@ -1,10 +1,12 @@
 package xnet
 
 import (
+	"context"
 	"errors"
 	"net/netip"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/soypat/lneto"
 	"github.com/soypat/lneto/dns"
@@ -94,6 +96,849 @@ func TestDNS_QueryReceivesAnswer(t *testing.T) {
 	}
 }
 
+func TestDNS_CachedLookup(t *testing.T) {
+	const MTU = ethernet.MaxMTU
+	client := new(StackAsync)
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	clientAddr := netip.AddrFrom4([4]byte{10, 0, 0, 100})
+	clientMAC := [6]byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	dnsServerMAC := [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	err := client.Reset(StackConfig{
+		Hostname:        "DNSClient",
+		RandSeed:        1234,
+		StaticAddress4:  clientAddr.As4(),
+		DNSServer:       dnsServerAddr,
+		HardwareAddress: clientMAC,
+		MTU:             uint16(MTU),
+		DNSCacheEntries: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGatewayHardwareAddr(dnsServerMAC)
+	wantAddr := netip.MustParseAddr("93.184.216.34")
+	const hostname = "example.com"
+	var buf [ethernet.MaxFrameLength]byte
+
+	// First lookup goes to the network.
+	err = client.StartLookupIP(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	txid, clientPort, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := buildDNSResponsePacket(t, txid, clientPort, hostname, wantAddr, dnsServerAddr, dnsServerMAC, clientAddr, clientMAC, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.IngressEthernet(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, done, err := client.ResultLookupIP(hostname)
+	if err != nil || !done || !slices.Contains(addrs, wantAddr) {
+		t.Fatalf("first lookup: addrs=%v done=%v err=%v", addrs, done, err)
+	}
+
+	// Second lookup is served from the cache without a query.
+	err = client.StartLookupIP(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, done, err = client.ResultLookupIP(hostname)
+	if err != nil || !done || !slices.Equal(addrs, []netip.Addr{wantAddr}) {
+		t.Fatalf("cached lookup: addrs=%v done=%v err=%v", addrs, done, err)
+	}
+	n, err = client.EgressEthernet(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Error("query sent for cached lookup")
+	}
+
+	// Flushed cache goes to the network again.
+	client.FlushDNSCache()
+	err = client.StartLookupIP(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, done, _ = client.ResultLookupIP(hostname)
+	if done {
+		t.Error("lookup done after cache flush")
+	}
+}
+
+func TestDNS_ParallelLookups(t *testing.T) {
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: netip.AddrFrom4([4]byte{8, 8, 8, 8})})
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	hosts := []string{"a.example.com", "b.example.com"}
+	wantAddrs := []netip.Addr{netip.MustParseAddr("10.1.1.1"), netip.MustParseAddr("10.2.2.2")}
+	for _, host := range hosts {
+		err := client.StartLookupIP(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.StartLookupIP("c.example.com"); err == nil {
+		t.Error("expected error with all queries in flight")
+	}
+	var txids, ports [2]uint16
+	var buf [ethernet.MaxFrameLength]byte
+	for i := range hosts {
+		n, err := client.EgressEthernet(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("expected DNS query packet", err)
+		}
+		txids[i], ports[i], err = extractDNSTxIDAndPort(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ports[0] == ports[1] {
+		t.Fatal("parallel queries share local port")
+	}
+	for i := range ports {
+		if ports[i] < 1024 || ports[i]-1024 == txids[i]>>1 {
+			t.Errorf("query port %d not independent of txid %d", ports[i], txids[i])
+		}
+	}
+	// Answer in reverse order.
+	for i := len(hosts) - 1; i >= 0; i-- {
+		pkt, err := buildDNSResponsePacket(t, txids[i], ports[i], hosts[i], wantAddrs[i], dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.IngressEthernet(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, host := range hosts {
+		addrs, done, err := client.ResultLookupIPType(host, dns.TypeA)
+		if err != nil || !done || !slices.Equal(addrs, wantAddrs[i:i+1]) {
+			t.Errorf("%s: addrs=%v done=%v err=%v", host, addrs, done, err)
+		}
+	}
+}
+
+func TestDNS_ServerFailover(t *testing.T) {
+	deadServer := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	liveServer := netip.AddrFrom4([4]byte{1, 1, 1, 1})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSRetryTimeout: time.Millisecond})
+	err := client.SetDNSServers([]netip.Addr{deadServer, liveServer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	// expectQuery checks the next egress packet is a DNS query to server.
+	expectQuery := func(server netip.Addr) (txid, port uint16) {
+		t.Helper()
+		n, err := client.EgressEthernet(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("expected DNS query packet", err)
+		}
+		ifrm, _ := ipv4.NewFrame(buf[14:n])
+		if dst := netip.AddrFrom4(*ifrm.DestinationAddr()); dst != server {
+			t.Fatalf("query sent to %s, want %s", dst, server)
+		}
+		txid, port, err = extractDNSTxIDAndPort(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return txid, port
+	}
+
+	const host = "example.com"
+	wantAddr := netip.MustParseAddr("93.184.216.34")
+	err = client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid1, port1 := expectQuery(deadServer)
+	time.Sleep(2 * time.Millisecond)
+	_, done, _ := client.ResultLookupIP(host)
+	if done {
+		t.Fatal("lookup done without response")
+	}
+	txid2, port2 := expectQuery(liveServer)
+	if txid1 == txid2 || port1 == port2 {
+		t.Error("retransmission reused transaction ID or port")
+	}
+	pkt, err := buildDNSResponsePacket(t, txid2, port2, host, wantAddr, liveServer, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.IngressEthernet(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, done, err := client.ResultLookupIP(host)
+	if err != nil || !done || !slices.Equal(addrs, []netip.Addr{wantAddr}) {
+		t.Fatalf("addrs=%v done=%v err=%v", addrs, done, err)
+	}
+
+	// Dead server is demoted: next lookup goes to the live server first.
+	err = client.StartLookupIP("other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectQuery(liveServer)
+
+	// With no server responding the lookup eventually times out.
+	for range 3 {
+		time.Sleep(5 * time.Millisecond)
+		_, done, err = client.ResultLookupIP("other.com")
+		client.EgressEthernet(buf[:])
+	}
+	if !done || err == nil {
+		t.Errorf("expected timeout, got done=%v err=%v", done, err)
+	}
+}
+
+func TestDNS_TruncatedRetriesOverTCP(t *testing.T) {
+	const MTU = ethernet.MaxMTU
+	const host = "big.example.com"
+	wantAddrs := []netip.Addr{netip.MustParseAddr("10.9.9.1"), netip.MustParseAddr("10.9.9.2")}
+	client, server, _, svconn := newTCPStacks(t, 1234, MTU)
+	svAddr := netip.AddrFrom4(server.Addr4())
+	err := client.Reset(StackConfig{
+		Hostname:         "DNSClient",
+		RandSeed:         1234,
+		StaticAddress4:   client.Addr4(),
+		HardwareAddress:  client.HardwareAddr(),
+		MTU:              MTU,
+		DNSServer:        svAddr,
+		DNSTCPBufferSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGatewayHardwareAddr(server.HardwareAddr())
+	err = server.ListenTCP4(svconn, dns.ServerPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	pump := func() {
+		for range 8 {
+			if n, _ := client.EgressEthernet(buf[:]); n > 0 {
+				server.IngressEthernet(buf[:n])
+			}
+			if n, _ := server.EgressEthernet(buf[:]); n > 0 {
+				client.IngressEthernet(buf[:n])
+			}
+		}
+	}
+
+	err = client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := client.EgressEthernet(buf[:])
+	txid, port, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncated UDP response with TC bit set.
+	flags := dns.HeaderFlags(1<<15 | 1<<9 | 1<<8 | 1<<7)
+	pkt, err := buildDNSResponsePacketFlags(t, txid, port, host, wantAddrs[0], flags, svAddr, server.HardwareAddr(), netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.IngressEthernet(pkt)
+	_, done, _ := client.ResultLookupIP(host)
+	if done {
+		t.Fatal("truncated response not retried over TCP")
+	}
+	pump()                      // Handshake and query.
+	client.ResultLookupIP(host) // Writes query once connected.
+	pump()
+	if svconn.BufferedInput() < 2 {
+		t.Fatal("server received no TCP query")
+	}
+	var qbuf [512]byte
+	qn, _ := svconn.Read(qbuf[:])
+	var query dns.Message
+	query.LimitResourceDecoding(1, 0, 0, 1)
+	if _, _, err = query.Decode(qbuf[2:qn]); err != nil || len(query.Questions) != 1 {
+		t.Fatalf("bad TCP query: %v", err)
+	}
+	qfrm, _ := dns.NewFrame(qbuf[2:qn])
+	resp := dns.Message{Questions: query.Questions}
+	for _, addr := range wantAddrs {
+		resp.Answers = append(resp.Answers, dns.NewResource(query.Questions[0].Name, dns.TypeA, dns.ClassINET, 60, addr.AsSlice()))
+	}
+	wire, err := resp.AppendTo(make([]byte, 2, 512), qfrm.TxID(), dns.HeaderFlags(1<<15|1<<8|1<<7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire[0], wire[1] = byte((len(wire)-2)>>8), byte(len(wire)-2)
+	svconn.Write(wire)
+	pump()
+	addrs, done, err := client.ResultLookupIP(host)
+	if err != nil || !done || !slices.Equal(addrs, wantAddrs) {
+		t.Fatalf("addrs=%v done=%v err=%v", addrs, done, err)
+	}
+}
+
+func TestDNS_ForceTCPRequiresBuffer(t *testing.T) {
+	client, _ := newDNSTestStack(t, StackConfig{DNSServer: netip.AddrFrom4([4]byte{8, 8, 8, 8})})
+	if err := client.StartLookupIPTypeTCP("example.com", dns.TypeA); err == nil {
+		t.Error("expected error with DNS over TCP disabled")
+	}
+}
+
+func TestDNS_ReverseLookup(t *testing.T) {
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: dnsServerAddr})
+	peer := netip.MustParseAddr("192.0.2.7")
+	err := client.StartLookupAddr(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	txid, port, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, done, _ := client.ResultLookupAddr(peer)
+	if done {
+		t.Fatal("lookup done without response")
+	}
+	// Respond with a classless delegation CNAME (RFC 2317) to the PTR record.
+	revName := dns.MustNewName("7.2.0.192.in-addr.arpa")
+	delegated := dns.MustNewName("7.0-25.2.0.192.in-addr.arpa")
+	var ptr dns.Resource
+	ptr.SetPTR(delegated, dns.ClassINET, 300, dns.MustNewName("host.example.com"))
+	msg := dns.Message{
+		Questions: []dns.Question{{Name: revName, Type: dns.TypePTR, Class: dns.ClassINET}},
+		Answers: []dns.Resource{
+			dns.NewResource(revName, dns.TypeCNAME, dns.ClassINET, 300, mustNameWire(t, delegated)),
+			ptr,
+		},
+	}
+	pkt, err := buildDNSMessagePacket(t, txid, port, &msg, dns.HeaderFlags(1<<15|1<<8|1<<7), dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.IngressEthernet(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, done, err := client.ResultLookupAddr(peer)
+	if err != nil || !done || len(names) != 1 || !names[0].EqualString("host.example.com") {
+		t.Fatalf("names=%v done=%v err=%v", names, done, err)
+	}
+	if _, _, err = client.ResultLookupAddr(netip.MustParseAddr("192.0.2.8")); err == nil {
+		t.Error("expected error for address without lookup")
+	}
+}
+
+func TestDNS_IPv6Transport(t *testing.T) {
+	const host = "example.com"
+	cfgClient, cfgServer := stack6PairConfigs(4321, 1, 4)
+	cfgClient.Hostname = "DNSClient6"
+	cfgClient.IPv6Stack = DefaultStack6()
+	client := new(StackAsync)
+	err := client.Reset(cfgClient) // No IPv4 address: IPv6-only network.
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.EnableICMP(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := DefaultStack6()
+	err = server.Reset6(&cfgServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.EnableICMP6(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := netip.AddrFrom16(cfgServer.StaticAddress6)
+	err = client.SetDNSServers([]netip.Addr{netip.AddrFrom4([4]byte{8, 8, 8, 8}), serverAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.StartLookupIPType(host, dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	efrm, _ := ethernet.NewFrame(buf[:])
+	// toClient delivers the IPv6 packet of length n written by the server at buf[14:] to the client.
+	toClient := func(n int) {
+		t.Helper()
+		*efrm.DestinationHardwareAddr() = cfgClient.HardwareAddress
+		*efrm.SourceHardwareAddr() = cfgServer.HardwareAddress
+		efrm.SetEtherType(ethernet.TypeIPv6)
+		if err := client.IngressEthernet(buf[:14+n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The server is on-link: its MAC is resolved with NDP before the query is sent.
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 || buf[14+6] != byte(lneto.IPProtoIPv6ICMP) {
+		t.Fatal("expected neighbor solicitation for DNS server", err)
+	}
+	err = server.IngressIPv6(buf[14:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = server.EgressIPv6(buf[14:])
+	if err != nil || n == 0 {
+		t.Fatal("expected neighbor advertisement", err)
+	}
+	toClient(n)
+	n, err = client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	if efrm.EtherTypeOrSize() != ethernet.TypeIPv6 {
+		t.Fatalf("query sent over %s, want IPv6", efrm.EtherTypeOrSize())
+	} else if *efrm.DestinationHardwareAddr() != cfgServer.HardwareAddress {
+		t.Fatalf("query sent to MAC %x, want NDP resolved %x", *efrm.DestinationHardwareAddr(), cfgServer.HardwareAddress)
+	}
+	const udpOff = 14 + ipv6HeaderSize
+	ufrm, _ := udp.NewFrame(buf[udpOff:n])
+	qfrm, err := dns.NewFrame(buf[udpOff+8 : n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Answer from the server stack.
+	wantAddr := netip.MustParseAddr("2001:db8::cafe")
+	name := dns.MustNewName(host)
+	resp := dns.Message{
+		Questions: []dns.Question{{Name: name, Type: dns.TypeAAAA, Class: dns.ClassINET}},
+		Answers:   []dns.Resource{dns.NewResource(name, dns.TypeAAAA, dns.ClassINET, 300, wantAddr.AsSlice())},
+	}
+	payload, err := resp.AppendTo(nil, qfrm.TxID(), dns.HeaderFlags(1<<15|1<<8|1<<7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newUDPConn6(t)
+	err = server.DialUDP6(conn, dns.ServerPort, cfgClient.StaticAddress6, ufrm.SourcePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		n, err = server.EgressIPv6(buf[14:])
+		if err != nil || n == 0 {
+			t.Fatal("expected DNS response packet", err)
+		}
+		toClient(n)
+		if buf[14+6] != byte(lneto.IPProtoIPv6ICMP) {
+			break
+		}
+		// Server resolving the client's MAC.
+		if n, _ = client.EgressEthernet(buf[:]); n > 0 {
+			server.IngressIPv6(buf[14:n])
+		}
+	}
+	addrs, done, err := client.ResultLookupIPType(host, dns.TypeAAAA)
+	if err != nil || !done || !slices.Equal(addrs, []netip.Addr{wantAddr}) {
+		t.Fatalf("addrs=%v done=%v err=%v", addrs, done, err)
+	}
+}
+
+func TestDNS_IPv6Unresponsive(t *testing.T) {
+	routerMAC := [6]byte{0x02, 0, 0, 0, 0, 0xfe}
+	for _, tc := range []struct {
+		name     string
+		server   netip.Addr
+		wantProt lneto.IPProto
+	}{
+		{name: "offlink", server: netip.MustParseAddr("2001:4860:4860::8888"), wantProt: lneto.IPProtoUDP},
+		{name: "onlink", server: netip.MustParseAddr("2001:db8::99"), wantProt: lneto.IPProtoIPv6ICMP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfgClient, _ := stack6PairConfigs(4321, 1, 4)
+			cfgClient.Hostname = "DNSClient6"
+			cfgClient.IPv6Stack = DefaultStack6()
+			cfgClient.DNSRetryTimeout = time.Millisecond
+			cfgClient.DNSRetries = 5
+			client := new(StackAsync)
+			err := client.Reset(cfgClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.EnableICMP(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SetGatewayHardwareAddr(routerMAC)
+			err = client.SetDNSServers([]netip.Addr{tc.server})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf [ethernet.MaxFrameLength]byte
+			efrm, _ := ethernet.NewFrame(buf[:])
+			// Off-link queries go straight to the router. On-link servers are solicited
+			// again on every retransmission without exhausting the stack.
+			err = client.StartLookupIPType("example.com", dns.TypeAAAA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range int(cfgClient.DNSRetries) + 1 {
+				n, err := client.EgressEthernet(buf[:])
+				deadline := time.Now().Add(time.Second)
+				for n == 0 && err == nil && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+					_, _, err = client.ResultLookupIPType("example.com", dns.TypeAAAA)
+					if err == errDNSNotDone {
+						n, err = client.EgressEthernet(buf[:])
+					}
+				}
+				if err != nil || n == 0 {
+					t.Fatalf("attempt %d: expected packet: %v", i, err)
+				} else if got := lneto.IPProto(buf[14+6]); got != tc.wantProt {
+					t.Fatalf("attempt %d: want %s, got %s", i, tc.wantProt, got)
+				} else if tc.wantProt == lneto.IPProtoUDP && *efrm.DestinationHardwareAddr() != routerMAC {
+					t.Fatalf("attempt %d: off-link query sent to MAC %x, want router %x", i, *efrm.DestinationHardwareAddr(), routerMAC)
+				}
+			}
+		})
+	}
+}
+
+func TestDNS_NoReachableServer(t *testing.T) {
+	client, _ := newDNSTestStack(t, StackConfig{})
+	err := client.SetDNSServers([]netip.Addr{netip.MustParseAddr("2001:4860:4860::8888")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.StartLookupIP("example.com"); err == nil {
+		t.Error("expected error with IPv6 server and IPv6 disabled")
+	}
+}
+
+type resolverFunc func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+func (f resolverFunc) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return f(ctx, network, host)
+}
+
+func TestDNS_StackGoResolver(t *testing.T) {
+	client, _ := newDNSTestStack(t, StackConfig{})
+	want := netip.MustParseAddr("192.0.2.1")
+	sg := client.StackBlocking(backoffYield).StackGo(StackGoConfig{
+		Resolver: resolverFunc(func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			if network != "ip4" || host != "example.com" {
+				t.Errorf("unexpected lookup %s %s", network, host)
+			}
+			return []netip.Addr{want}, nil
+		}),
+	})
+	addrs, err := sg.LookupNetIP(context.Background(), "ip4", "example.com")
+	if err != nil || len(addrs) != 1 || addrs[0] != want {
+		t.Errorf("addrs=%v err=%v", addrs, err)
+	}
+	var buf [ethernet.MaxMTU]byte
+	if n, _ := client.EgressEthernet(buf[:]); n != 0 {
+		t.Error("stack sent packet with resolver set")
+	}
+}
+
+func TestDNS_StackGoDialAddrs(t *testing.T) {
+	addr4 := netip.MustParseAddr("192.0.2.1")
+	addr6 := netip.MustParseAddr("2001:db8::2")
+	dial := func(t *testing.T, cfg StackConfig, lookup resolverFunc) string {
+		t.Helper()
+		cfg.MaxActiveUDPPorts = 2
+		client, _ := newDNSTestStack(t, cfg)
+		sg := client.StackBlocking(backoffYield).StackGo(StackGoConfig{
+			ListenerPoolConfig: TCPPoolConfig{
+				QueueSize:  2,
+				TxBufSize:  512,
+				RxBufSize:  512,
+				NewBackoff: func() lneto.BackoffStrategy { return backoffYield },
+			},
+			Resolver: lookup,
+		})
+		conn, err := sg.DialContext(context.Background(), "udp", "example.com:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.RemoteAddr().String()
+	}
+	t.Run("skipfailed", func(t *testing.T) {
+		// IPv6 is disabled so the first address fails to dial.
+		got := dial(t, StackConfig{}, func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			return []netip.Addr{addr6, addr4}, nil
+		})
+		if got != "192.0.2.1:53" {
+			t.Errorf("want second address dialed, got %s", got)
+		}
+	})
+	t.Run("ipv6only", func(t *testing.T) {
+		cfg := StackConfig{IPv6Stack: DefaultStack6(), StaticAddress6: netip.MustParseAddr("2001:db8::1").As16()}
+		got := dial(t, cfg, func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			if network == "ip6" {
+				return []netip.Addr{addr6}, nil
+			}
+			return nil, errDNSNoAns
+		})
+		if got != "[2001:db8::2]:53" {
+			t.Errorf("want IPv6 address dialed, got %s", got)
+		}
+	})
+}
+
+func TestDNS_Cookies(t *testing.T) {
+	const host = "example.com"
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: dnsServerAddr})
+	var buf [ethernet.MaxFrameLength]byte
+	// nextQuery returns the transaction ID, port and cookie option of the next query sent.
+	nextQuery := func() (txid, port uint16, clientCookie [dns.SizeClientCookie]byte, srvCookie []byte) {
+		t.Helper()
+		n, err := client.EgressEthernet(buf[:])
+		if err != nil || n == 0 {
+			t.Fatal("expected DNS query packet", err)
+		}
+		txid, port, err = extractDNSTxIDAndPort(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var query dns.Message
+		query.LimitResourceDecoding(1, 0, 0, 1)
+		if _, _, err = query.Decode(buf[14+20+8 : n]); err != nil || query.OPT() == nil {
+			t.Fatal("query without OPT record", err)
+		}
+		data, ok := query.OPT().EDNSOption(dns.EDNSOptionCookie)
+		if !ok {
+			t.Fatal("query without cookie")
+		}
+		clientCookie, srvCookie, err = dns.DecodeEDNSCookie(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return txid, port, clientCookie, append([]byte(nil), srvCookie...)
+	}
+	// respond answers the query for host. A zero cookie omits the cookie option.
+	respond := func(host string, txid, port uint16, cookie [dns.SizeClientCookie]byte, srvCookie []byte) {
+		t.Helper()
+		name := dns.MustNewName(host)
+		var opts []byte
+		if cookie != [dns.SizeClientCookie]byte{} {
+			opts, _ = dns.AppendEDNSCookie(nil, cookie, srvCookie)
+		}
+		var opt dns.Resource
+		opt.SetEDNS0(1232, 0, 0, opts)
+		msg := dns.Message{
+			Questions:   []dns.Question{{Name: name, Type: dns.TypeA, Class: dns.ClassINET}},
+			Answers:     []dns.Resource{dns.NewResource(name, dns.TypeA, dns.ClassINET, 300, []byte{93, 184, 216, 34})},
+			Additionals: []dns.Resource{opt},
+		}
+		pkt, err := buildDNSMessagePacket(t, txid, port, &msg, dns.HeaderFlags(1<<15|1<<8|1<<7), dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = client.IngressEthernet(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, port, cookie, srvCookie := nextQuery()
+	if len(srvCookie) != 0 {
+		t.Fatal("server cookie sent on first contact")
+	}
+	// Off-path attacker guessed transaction ID and port but not the client cookie.
+	respond(host, txid, port, [dns.SizeClientCookie]byte{0xba, 0xd}, nil)
+	if _, done, _ := client.ResultLookupIP(host); done {
+		t.Fatal("spoofed response accepted")
+	}
+	txid, port, cookie2, _ := nextQuery()
+	if cookie2 != cookie {
+		t.Error("client cookie changed between queries to same server")
+	}
+	serverCookie := []byte("0123456789abcdef")
+	respond(host, txid, port, cookie, serverCookie)
+	addrs, done, err := client.ResultLookupIP(host)
+	if err != nil || !done || len(addrs) != 1 {
+		t.Fatalf("addrs=%v done=%v err=%v", addrs, done, err)
+	}
+	// Server cookie is echoed in following queries.
+	err = client.StartLookupIP("other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, port, _, srvCookie = nextQuery()
+	if string(srvCookie) != string(serverCookie) {
+		t.Errorf("got server cookie %q, want %q", srvCookie, serverCookie)
+	}
+	// Server implementing cookies must include them: responses omitting them are spoofed (RFC 7873 §5.3).
+	respond("other.com", txid, port, [dns.SizeClientCookie]byte{}, nil)
+	if _, done, _ := client.ResultLookupIP("other.com"); done {
+		t.Fatal("response without cookie accepted from server that sent one")
+	}
+	txid, port, _, _ = nextQuery()
+	respond("other.com", txid, port, cookie, serverCookie)
+	if _, done, err := client.ResultLookupIP("other.com"); err != nil || !done {
+		t.Fatalf("done=%v err=%v", done, err)
+	}
+}
+
+func TestDNS_ServersChangedInFlight(t *testing.T) {
+	const host = "example.com"
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: dnsServerAddr})
+	err := client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	txid, port, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Server removed while query is in flight: its response is not accepted.
+	if err = client.SetDNSServers(nil); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := buildDNSResponsePacket(t, txid, port, host, netip.MustParseAddr("10.1.1.1"), dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.IngressEthernet(pkt)
+	addrs, done, err := client.ResultLookupIP(host)
+	if err == nil || len(addrs) != 0 {
+		t.Errorf("response of removed server accepted: addrs=%v done=%v err=%v", addrs, done, err)
+	}
+}
+
+func TestDNS_ExtendedError(t *testing.T) {
+	const host = "ads.example.com"
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: dnsServerAddr})
+	err := client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	txid, port, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opt dns.Resource
+	opt.SetEDNS0(1232, 0, 0, dns.AppendEDNSExtendedError(nil, dns.ExtendedErrorBlocked, "ad blocker"))
+	msg := dns.Message{
+		Questions:   []dns.Question{{Name: dns.MustNewName(host), Type: dns.TypeA, Class: dns.ClassINET}},
+		Additionals: []dns.Resource{opt},
+	}
+	flags := dns.HeaderFlags(1<<15|1<<8|1<<7) | dns.HeaderFlags(dns.RCodeNameError)
+	pkt, err := buildDNSMessagePacket(t, txid, port, &msg, flags, dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.IngressEthernet(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, done, err := client.ResultLookupIP(host)
+	var ede *dns.ExtendedError
+	if !done || !errors.As(err, &ede) || ede.Code != dns.ExtendedErrorBlocked || !errors.Is(err, dns.RCodeNameError) {
+		t.Fatalf("done=%v err=%v, want blocked NXDOMAIN", done, err)
+	}
+}
+
+func TestDNS_ExtendedErrorNoData(t *testing.T) {
+	const host = "filtered.example.com"
+	dnsServerAddr := netip.AddrFrom4([4]byte{8, 8, 8, 8})
+	client, dnsServerMAC := newDNSTestStack(t, StackConfig{DNSServer: dnsServerAddr})
+	err := client.StartLookupIP(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [ethernet.MaxFrameLength]byte
+	n, err := client.EgressEthernet(buf[:])
+	if err != nil || n == 0 {
+		t.Fatal("expected DNS query packet", err)
+	}
+	txid, port, err := extractDNSTxIDAndPort(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opt dns.Resource
+	opt.SetEDNS0(1232, 0, 0, dns.AppendEDNSExtendedError(nil, dns.ExtendedErrorFiltered, "policy"))
+	msg := dns.Message{
+		Questions:   []dns.Question{{Name: dns.MustNewName(host), Type: dns.TypeA, Class: dns.ClassINET}},
+		Additionals: []dns.Resource{opt},
+	}
+	flags := dns.HeaderFlags(1<<15 | 1<<8 | 1<<7) // NOERROR without answers (NODATA).
+	pkt, err := buildDNSMessagePacket(t, txid, port, &msg, flags, dnsServerAddr, dnsServerMAC, netip.AddrFrom4(client.Addr4()), client.HardwareAddr(), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.IngressEthernet(pkt); err != nil {
+		t.Fatal(err)
+	}
+	_, done, err := client.ResultLookupIP(host)
+	var ede *dns.ExtendedError
+	if !done || !errors.As(err, &ede) || ede.Code != dns.ExtendedErrorFiltered || ede.Text != "policy" || !errors.Is(err, errDNSNoAns) {
+		t.Fatalf("done=%v err=%v, want filtered NODATA", done, err)
+	}
+	allocs := testing.AllocsPerRun(10, func() { client.ResultLookupIP(host) })
+	if allocs != 0 {
+		t.Errorf("failed lookup result allocated %v times", allocs)
+	}
+}
+
+func mustNameWire(t *testing.T, name dns.Name) []byte {
+	t.Helper()
+	b, err := name.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newDNSTestStack(t *testing.T, cfg StackConfig) (*StackAsync, [6]byte) {
+	t.Helper()
+	dnsServerMAC := [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	cfg.Hostname = "DNSClient"
+	cfg.RandSeed = 4321
+	cfg.StaticAddress4 = [4]byte{10, 0, 0, 100}
+	cfg.HardwareAddress = [6]byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	cfg.MTU = ethernet.MaxMTU
+	client := new(StackAsync)
+	err := client.Reset(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGatewayHardwareAddr(dnsServerMAC)
+	return client, dnsServerMAC
+}
+
 // extractDNSTxIDAndPort extracts the DNS transaction ID and source port from an Ethernet+IP+UDP+DNS packet.
 func extractDNSTxIDAndPort(pkt []byte) (txid uint16, srcPort uint16, err error) {
 	const ethHdrLen = 14
@@ -137,6 +982,15 @@ func extractDNSTxIDAndPort(pkt []byte) (txid uint16, srcPort uint16, err error)
 func buildDNSResponsePacket(t *testing.T, txid uint16, dstPort uint16, hostname string, addr netip.Addr,
 	srcIP netip.Addr, srcMAC [6]byte, dstIP netip.Addr, dstMAC [6]byte, buf []byte) ([]byte, error) {
 	t.Helper()
+	// Response flags: QR=1 (response), RD=1 (recursion desired), RA=1 (recursion available).
+	responseFlags := dns.HeaderFlags(1<<15 | 1<<8 | 1<<7)
+	return buildDNSResponsePacketFlags(t, txid, dstPort, hostname, addr, responseFlags, srcIP, srcMAC, dstIP, dstMAC, buf)
+}
+
+// buildDNSResponsePacketFlags is like buildDNSResponsePacket with the DNS header flags set by the caller.
+func buildDNSResponsePacketFlags(t *testing.T, txid uint16, dstPort uint16, hostname string, addr netip.Addr, responseFlags dns.HeaderFlags,
+	srcIP netip.Addr, srcMAC [6]byte, dstIP netip.Addr, dstMAC [6]byte, buf []byte) ([]byte, error) {
+	t.Helper()
 
 	name, err := dns.NewName(hostname)
 	if err != nil {
@@ -156,10 +1010,13 @@ func buildDNSResponsePacket(t *testing.T, txid uint16, dstPort uint16, hostname
 			dns.NewResource(name, dns.TypeA, dns.ClassINET, 300, addr.AsSlice()),
 		},
 	}
+	return buildDNSMessagePacket(t, txid, dstPort, &msg, responseFlags, srcIP, srcMAC, dstIP, dstMAC, buf)
+}
 
-	// Response flags: QR=1 (response), RD=1 (recursion desired), RA=1 (recursion available).
-	responseFlags := dns.HeaderFlags(1<<15 | 1<<8 | 1<<7)
-
+// buildDNSMessagePacket builds a complete Ethernet+IP+UDP packet carrying msg.
+func buildDNSMessagePacket(t *testing.T, txid uint16, dstPort uint16, msg *dns.Message, responseFlags dns.HeaderFlags,
+	srcIP netip.Addr, srcMAC [6]byte, dstIP netip.Addr, dstMAC [6]byte, buf []byte) ([]byte, error) {
+	t.Helper()
 	var dnsBuf [512]byte
 	dnsPayload, err := msg.AppendTo(dnsBuf[:0], txid, responseFlags)
 	if err != nil {